@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Options of the connections to the servers and of the moves of the slots
+type Options struct {
+	//Credentials sent with AUTH to every server, and given to MIGRATE
+	User     string
+	Password string
+
+	//Timeout of every read and write, also given to MIGRATE
+	Timeout time.Duration
+	//Number of keys moved by every MIGRATE
+	Pipeline int
+}
+
+// A connection to a server, the commands are sent one at a time
+type Client struct {
+	addr    string
+	conn    net.Conn
+	rd      *response.Reader
+	timeout time.Duration
+}
+
+// An error replied by the server
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// Connects to the server at addr and authenticates when a password is given
+func Dial(addr string, opts Options) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{addr: addr, conn: conn, rd: response.NewReader(conn), timeout: opts.Timeout}
+	if opts.Password != "" {
+		args := []string{"AUTH", opts.Password}
+		if opts.User != "" {
+			args = []string{"AUTH", opts.User, opts.Password}
+		}
+		if _, err := c.Do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Sends the command and returns its reply decoded by response.DecodeReply, an error reply is returned as a ReplyError
+func (c *Client) Do(args ...string) (interface{}, error) {
+	tokens := make([][]byte, len(args))
+	for i, arg := range args {
+		tokens[i] = response.Encode(arg, false)
+	}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(response.EncodeArray(tokens)); err != nil {
+		return nil, err
+	}
+	reply, err := c.rd.ReadReply()
+	if err != nil {
+		return nil, err
+	}
+	if msg, ok := reply.(response.ErrorReply); ok {
+		return nil, ReplyError(msg)
+	}
+	return reply, nil
+}
+
+// Sends the command and fails unless the server replies with a string
+func (c *Client) DoString(args ...string) (string, error) {
+	reply, err := c.Do(args...)
+	if err != nil {
+		return "", err
+	}
+	switch s := reply.(type) {
+	case string:
+		return s, nil
+	case response.SimpleString:
+		return string(s), nil
+	}
+	return "", fmt.Errorf("%s replied %v to %s", c.addr, reply, args[0])
+}
@@ -0,0 +1,311 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+The cluster commands of inmem-cli move hash slots between the masters of a cluster of inmem servers:
+	- reshard moves a number of slots from some masters, or from all the others, to a master
+	- rebalance moves slots so that every master serves about the same number of slots
+A slot is moved key by key, like redis-cli does:
+	1. the master the slot is moved to is told to import it with CLUSTER SETSLOT <slot> IMPORTING
+	2. the master serving it is told to migrate it with CLUSTER SETSLOT <slot> MIGRATING
+	3. its keys are moved by batches with CLUSTER GETKEYSINSLOT and MIGRATE, the clients are meanwhile sent
+	   -ASK to the master importing the slot for the keys already moved
+	4. every master is told the master now serving the slot with CLUSTER SETSLOT <slot> NODE
+The state of the cluster is read from CLUSTER NODES of the server given, the masters are then connected to.
+*/
+
+// A master of the cluster
+type ClusterNode struct {
+	ID    string
+	Addr  string
+	Slots []int
+
+	client *Client
+}
+
+type Cluster struct {
+	Masters []*ClusterNode
+	opts    Options
+	out     io.Writer
+}
+
+// Connects to the masters of the cluster the server at addr is a node of, the progress is written to out
+func LoadCluster(addr string, opts Options, out io.Writer) (*Cluster, error) {
+	if opts.Pipeline <= 0 {
+		opts.Pipeline = 10
+	}
+	entry, err := Dial(addr, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.Close()
+	nodes, err := entry.DoString("CLUSTER", "NODES")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{opts: opts, out: out}
+	for _, line := range strings.Split(strings.TrimSpace(nodes), "\n") {
+		n, ok, err := parseNodeLine(line)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if n.client, err = Dial(n.Addr, opts); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("connecting to %s: %v", n.Addr, err)
+		}
+		c.Masters = append(c.Masters, n)
+	}
+	return c, nil
+}
+
+/**
+Parses a line of CLUSTER NODES, returns false for the nodes that are not masters or are failing:
+	<id> <ip:port@cport> <flags> <master> <ping sent> <pong received> <config epoch> <link state> <slot>...
+A slot being migrated or imported is an error, the cluster must be fixed first.
+*/
+func parseNodeLine(line string) (*ClusterNode, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 {
+		return nil, false, fmt.Errorf("invalid CLUSTER NODES line: %s", line)
+	}
+	flags := "," + fields[2] + ","
+	if !strings.Contains(flags, ",master,") || strings.Contains(flags, ",fail") || strings.Contains(flags, ",handshake,") || strings.Contains(flags, ",noaddr,") {
+		return nil, false, nil
+	}
+	addr := fields[1]
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		addr = addr[:i]
+	}
+	n := &ClusterNode{ID: fields[0], Addr: addr}
+	for _, field := range fields[8:] {
+		if strings.HasPrefix(field, "[") {
+			return nil, false, fmt.Errorf("slot %s of node %s is open, fix it with CLUSTER SETSLOT first", strings.Trim(field, "[]"), n.ID)
+		}
+		start, end := field, field
+		if i := strings.IndexByte(field, '-'); i >= 0 {
+			start, end = field[:i], field[i+1:]
+		}
+		first, err := strconv.Atoi(start)
+		last, err2 := strconv.Atoi(end)
+		if err != nil || err2 != nil || first > last {
+			return nil, false, fmt.Errorf("invalid slots %s of node %s", field, n.ID)
+		}
+		for slot := first; slot <= last; slot++ {
+			n.Slots = append(n.Slots, slot)
+		}
+	}
+	return n, true, nil
+}
+
+func (c *Cluster) Close() {
+	for _, n := range c.Masters {
+		n.client.Close()
+	}
+}
+
+// Returns the master whose id starts with prefix
+func (c *Cluster) Node(prefix string) (*ClusterNode, error) {
+	var found *ClusterNode
+	for _, n := range c.Masters {
+		if strings.HasPrefix(n.ID, prefix) {
+			if found != nil {
+				return nil, fmt.Errorf("several masters have an id starting with %s", prefix)
+			}
+			found = n
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no master has an id starting with %s", prefix)
+	}
+	return found, nil
+}
+
+// Moves the slot from the master serving it to the master to, key by key
+func (c *Cluster) MoveSlot(slot int, from, to *ClusterNode) error {
+	s := strconv.Itoa(slot)
+	if _, err := to.client.Do("CLUSTER", "SETSLOT", s, "IMPORTING", from.ID); err != nil {
+		return fmt.Errorf("importing slot %d on %s: %v", slot, to.Addr, err)
+	}
+	if _, err := from.client.Do("CLUSTER", "SETSLOT", s, "MIGRATING", to.ID); err != nil {
+		return fmt.Errorf("migrating slot %d on %s: %v", slot, from.Addr, err)
+	}
+	host, port, err := net.SplitHostPort(to.Addr)
+	if err != nil {
+		return err
+	}
+	for {
+		reply, err := from.client.Do("CLUSTER", "GETKEYSINSLOT", s, strconv.Itoa(c.opts.Pipeline))
+		if err != nil {
+			return fmt.Errorf("getting the keys of slot %d from %s: %v", slot, from.Addr, err)
+		}
+		keys, _ := reply.([]interface{})
+		if len(keys) == 0 {
+			break
+		}
+		args := []string{"MIGRATE", host, port, "", "0", strconv.Itoa(int(c.opts.Timeout.Milliseconds()))}
+		if c.opts.Password != "" && c.opts.User != "" {
+			args = append(args, "AUTH2", c.opts.User, c.opts.Password)
+		} else if c.opts.Password != "" {
+			args = append(args, "AUTH", c.opts.Password)
+		}
+		args = append(args, "KEYS")
+		for _, key := range keys {
+			args = append(args, fmt.Sprint(key))
+		}
+		if _, err := from.client.Do(args...); err != nil {
+			return fmt.Errorf("migrating the keys of slot %d from %s to %s: %v", slot, from.Addr, to.Addr, err)
+		}
+	}
+	//INFO: The master importing the slot is told first, it takes the slot with a new config epoch
+	for _, n := range []*ClusterNode{to, from} {
+		if _, err := n.client.Do("CLUSTER", "SETSLOT", s, "NODE", to.ID); err != nil {
+			return fmt.Errorf("assigning slot %d on %s: %v", slot, n.Addr, err)
+		}
+	}
+	//INFO: The other masters would learn it from the bus anyway
+	for _, n := range c.Masters {
+		if n != to && n != from {
+			n.client.Do("CLUSTER", "SETSLOT", s, "NODE", to.ID)
+		}
+	}
+	from.Slots = removeSlot(from.Slots, slot)
+	to.Slots = append(to.Slots, slot)
+	sort.Ints(to.Slots)
+	return nil
+}
+
+func removeSlot(slots []int, slot int) []int {
+	for i, s := range slots {
+		if s == slot {
+			return append(slots[:i:i], slots[i+1:]...)
+		}
+	}
+	return slots
+}
+
+// Moves numSlots slots to the master to, taken from the sources in proportion of the slots they serve
+func (c *Cluster) Reshard(sources []*ClusterNode, to *ClusterNode, numSlots int) error {
+	if len(sources) == 0 {
+		for _, n := range c.Masters {
+			if n != to {
+				sources = append(sources, n)
+			}
+		}
+	}
+	total := 0
+	for _, n := range sources {
+		if n == to {
+			return errors.New("the master receiving the slots can not be a source")
+		}
+		total += len(n.Slots)
+	}
+	if numSlots <= 0 || numSlots > total {
+		return fmt.Errorf("the number of slots must be between 1 and %d", total)
+	}
+	//INFO: Rounded up, the last sources give fewer slots
+	left := numSlots
+	for _, from := range sources {
+		count := (numSlots*len(from.Slots) + total - 1) / total
+		if count > left {
+			count = left
+		}
+		if err := c.moveSlots(from, to, count); err != nil {
+			return err
+		}
+		left -= count
+	}
+	return nil
+}
+
+// Moves the first count slots of the master from to the master to
+func (c *Cluster) moveSlots(from, to *ClusterNode, count int) error {
+	if count == 0 {
+		return nil
+	}
+	fmt.Fprintf(c.out, "Moving %d slots from %s to %s\n", count, from.Addr, to.Addr)
+	slots := append([]int{}, from.Slots[:count]...)
+	for _, slot := range slots {
+		if err := c.MoveSlot(slot, from, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Moves slots between the masters until every master serves about the same number of slots. Nothing moves while
+every master is within threshold percent of the number of slots it should serve. The masters serving no slot
+only get slots when useEmpty is set.
+*/
+func (c *Cluster) Rebalance(threshold float64, useEmpty bool) error {
+	type balance struct {
+		node    *ClusterNode
+		balance int
+	}
+	var nodes []*balance
+	for _, n := range c.Masters {
+		if len(n.Slots) > 0 || useEmpty {
+			nodes = append(nodes, &balance{node: n})
+		}
+	}
+	if len(nodes) < 2 {
+		fmt.Fprintln(c.out, "No rebalancing needed")
+		return nil
+	}
+	served := 0
+	for _, b := range nodes {
+		served += len(b.node.Slots)
+	}
+	expected := served / len(nodes)
+	needed, total := false, 0
+	for _, b := range nodes {
+		b.balance = len(b.node.Slots) - expected
+		total += b.balance
+		if diff := float64(expected-len(b.node.Slots)) / float64(expected) * 100; diff > threshold || diff < -threshold {
+			needed = true
+		}
+	}
+	if !needed {
+		fmt.Fprintln(c.out, "No rebalancing needed")
+		return nil
+	}
+	//INFO: Rounded down the expected slots leave some, they go to the masters receiving slots
+	for i := 0; total > 0; i = (i + 1) % len(nodes) {
+		if nodes[i].balance <= 0 {
+			nodes[i].balance--
+			total--
+		}
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].balance < nodes[j].balance })
+	for dst, src := 0, len(nodes)-1; dst < src; {
+		count := -nodes[dst].balance
+		if nodes[src].balance < count {
+			count = nodes[src].balance
+		}
+		if err := c.moveSlots(nodes[src].node, nodes[dst].node, count); err != nil {
+			return err
+		}
+		nodes[dst].balance += count
+		nodes[src].balance -= count
+		if nodes[dst].balance == 0 {
+			dst++
+		}
+		if nodes[src].balance == 0 {
+			src--
+		}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package cli
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The cluster commands are tested against fake nodes: they answer the commands the cluster commands send, from a
+model of the slots and keys of every node, and log the commands that move slots.
+*/
+
+type fakeCluster struct {
+	mu    sync.Mutex
+	nodes []*fakeNode
+	//The CLUSTER SETSLOT and MIGRATE commands received, prefixed by the id of the node
+	log []string
+}
+
+type fakeNode struct {
+	id        string
+	addr      string
+	slots     map[int]bool
+	keys      map[string]int
+	migrating map[int]string
+	importing map[int]string
+}
+
+// Starts the nodes, the slots and the keys of each are given as a map of key to slot
+func newFakeCluster(t *testing.T, slots [][]int, keys []map[string]int) *fakeCluster {
+	fc := &fakeCluster{}
+	for i := range slots {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		n := &fakeNode{
+			id:        strings.Repeat(string(rune('a'+i)), 40),
+			addr:      listener.Addr().String(),
+			slots:     map[int]bool{},
+			keys:      keys[i],
+			migrating: map[int]string{},
+			importing: map[int]string{},
+		}
+		for _, slot := range slots[i] {
+			n.slots[slot] = true
+		}
+		fc.nodes = append(fc.nodes, n)
+		go fc.serve(n, listener)
+	}
+	return fc
+}
+
+func (fc *fakeCluster) serve(n *fakeNode, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			rd := response.NewReader(conn)
+			for {
+				args, _, err := rd.ReadCommand()
+				if err != nil {
+					return
+				}
+				fc.mu.Lock()
+				reply := fc.reply(n, args)
+				fc.mu.Unlock()
+				conn.Write(reply)
+			}
+		}()
+	}
+}
+
+func (fc *fakeCluster) reply(n *fakeNode, args []string) []byte {
+	ok := response.Encode("OK", true)
+	cmd := strings.ToUpper(strings.Join(args[:2], " "))
+	switch {
+	case cmd == "CLUSTER NODES":
+		var b strings.Builder
+		for _, node := range fc.nodes {
+			flags := "master"
+			if node == n {
+				flags = "myself,master"
+			}
+			fmt.Fprintf(&b, "%s %s@0 %s - 0 0 0 connected", node.id, node.addr, flags)
+			for _, slot := range node.sortedSlots() {
+				fmt.Fprintf(&b, " %d", slot)
+			}
+			b.WriteString("\n")
+		}
+		return response.Encode(b.String(), false)
+	case cmd == "CLUSTER SETSLOT":
+		fc.log = append(fc.log, n.id[:1]+" "+strings.Join(args[1:], " "))
+		slot, _ := strconv.Atoi(args[2])
+		switch strings.ToUpper(args[3]) {
+		case "IMPORTING":
+			n.importing[slot] = args[4]
+		case "MIGRATING":
+			n.migrating[slot] = args[4]
+		case "NODE":
+			if n.slots[slot] && args[4] != n.id && n.keysIn(slot) != nil {
+				return response.EncodeError(fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			}
+			delete(n.importing, slot)
+			delete(n.migrating, slot)
+			n.slots[slot] = args[4] == n.id
+		}
+		return ok
+	case cmd == "CLUSTER GETKEYSINSLOT":
+		slot, _ := strconv.Atoi(args[2])
+		count, _ := strconv.Atoi(args[3])
+		var replies [][]byte
+		for _, key := range n.keysIn(slot) {
+			if len(replies) < count {
+				replies = append(replies, response.Encode(key, false))
+			}
+		}
+		return response.EncodeArray(replies)
+	case strings.ToUpper(args[0]) == "MIGRATE":
+		fc.log = append(fc.log, n.id[:1]+" "+strings.Join(args, " "))
+		var target *fakeNode
+		for _, node := range fc.nodes {
+			if node.addr == net.JoinHostPort(args[1], args[2]) {
+				target = node
+			}
+		}
+		keys := args[len(args)-1:]
+		for i, arg := range args {
+			if arg == "KEYS" {
+				keys = args[i+1:]
+			}
+		}
+		for _, key := range keys {
+			slot := n.keys[key]
+			if target == nil || target.importing[slot] != n.id || n.migrating[slot] != target.id {
+				return response.EncodeError(fmt.Errorf("ERR slot %d of %s is not being migrated", slot, key))
+			}
+			delete(n.keys, key)
+			target.keys[key] = slot
+		}
+		return ok
+	}
+	return ok
+}
+
+func (n *fakeNode) sortedSlots() []int {
+	var slots []int
+	for slot, served := range n.slots {
+		if served {
+			slots = append(slots, slot)
+		}
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+func (n *fakeNode) keysIn(slot int) []string {
+	var keys []string
+	for key, s := range n.keys {
+		if s == slot {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func loadFakeCluster(t *testing.T, fc *fakeCluster) *Cluster {
+	c, err := LoadCluster(fc.nodes[0].addr, Options{Timeout: 5 * time.Second, Pipeline: 2}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+func TestMoveSlot(t *testing.T) {
+	fc := newFakeCluster(t, [][]int{{0, 1}, {2}, {}}, []map[string]int{{"k1": 0, "k2": 0, "k3": 0, "k4": 1}, {}, {}})
+	c := loadFakeCluster(t, fc)
+	if len(c.Masters) != 3 || !reflect.DeepEqual(c.Masters[0].Slots, []int{0, 1}) || len(c.Masters[2].Slots) != 0 {
+		t.Fatalf("loaded %+v", c.Masters)
+	}
+	from, err := c.Node("aaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := c.Node("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.MoveSlot(0, from, to); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := fc.nodes[0].id, fc.nodes[1].id
+	expected := []string{
+		"b SETSLOT 0 IMPORTING " + a,
+		"a SETSLOT 0 MIGRATING " + b,
+		"a MIGRATE 127.0.0.1 " + strings.Split(fc.nodes[1].addr, ":")[1] + "  0 5000 KEYS k1 k2",
+		"a MIGRATE 127.0.0.1 " + strings.Split(fc.nodes[1].addr, ":")[1] + "  0 5000 KEYS k3",
+		"b SETSLOT 0 NODE " + b,
+		"a SETSLOT 0 NODE " + b,
+		"c SETSLOT 0 NODE " + b,
+	}
+	if !reflect.DeepEqual(fc.log, expected) {
+		t.Errorf("the nodes received:\n%s\nexpected:\n%s", strings.Join(fc.log, "\n"), strings.Join(expected, "\n"))
+	}
+	if !reflect.DeepEqual(fc.nodes[1].keys, map[string]int{"k1": 0, "k2": 0, "k3": 0}) || !reflect.DeepEqual(fc.nodes[0].keys, map[string]int{"k4": 1}) {
+		t.Errorf("the keys are %v and %v", fc.nodes[0].keys, fc.nodes[1].keys)
+	}
+	if !reflect.DeepEqual(from.Slots, []int{1}) || !reflect.DeepEqual(to.Slots, []int{0, 2}) {
+		t.Errorf("the slots are %v and %v", from.Slots, to.Slots)
+	}
+	if _, err := c.Node("d"); err == nil {
+		t.Error("found a node that does not exist")
+	}
+}
+
+func TestReshard(t *testing.T) {
+	fc := newFakeCluster(t, [][]int{{0, 1, 2, 3, 4, 5}, {6, 7, 8}, {}}, []map[string]int{{"k0": 0, "k5": 5}, {"k6": 6}, {}})
+	c := loadFakeCluster(t, fc)
+	if err := c.Reshard(nil, c.Masters[2], 3); err != nil {
+		t.Fatal(err)
+	}
+	//The slots are taken from the sources in proportion of the slots they serve
+	for i, slots := range [][]int{{2, 3, 4, 5}, {7, 8}, {0, 1, 6}} {
+		if served := fc.nodes[i].sortedSlots(); !reflect.DeepEqual(served, slots) {
+			t.Errorf("node %d serves %v, expected %v", i, served, slots)
+		}
+	}
+	if !reflect.DeepEqual(fc.nodes[2].keys, map[string]int{"k0": 0, "k6": 6}) {
+		t.Errorf("the keys moved are %v", fc.nodes[2].keys)
+	}
+	if err := c.Reshard([]*ClusterNode{c.Masters[0]}, c.Masters[2], 5); err == nil {
+		t.Error("resharded more slots than the sources serve")
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	fc := newFakeCluster(t, [][]int{{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, {10, 11}, {}}, []map[string]int{{"k0": 0, "k9": 9}, {"k10": 10}, {}})
+	c := loadFakeCluster(t, fc)
+	if err := c.Rebalance(2, false); err != nil {
+		t.Fatal(err)
+	}
+	if served := fc.nodes[2].sortedSlots(); len(served) != 0 {
+		t.Errorf("an empty master got slots %v without --cluster-use-empty-masters", served)
+	}
+	for i, count := range []int{6, 6} {
+		if served := fc.nodes[i].sortedSlots(); len(served) != count {
+			t.Errorf("node %d serves %v", i, served)
+		}
+	}
+
+	c = loadFakeCluster(t, fc)
+	if err := c.Rebalance(2, true); err != nil {
+		t.Fatal(err)
+	}
+	served := map[int]bool{}
+	for i, n := range fc.nodes {
+		slots := n.sortedSlots()
+		if len(slots) != 4 {
+			t.Errorf("node %d serves %v", i, slots)
+		}
+		for _, slot := range slots {
+			served[slot] = true
+		}
+		for key, slot := range n.keys {
+			if !n.slots[slot] {
+				t.Errorf("node %d has %s of slot %d", i, key, slot)
+			}
+		}
+	}
+	if len(served) != 12 {
+		t.Errorf("the slots served are %v", served)
+	}
+
+	//Every master is within the threshold
+	fc.log = nil
+	c = loadFakeCluster(t, fc)
+	if err := c.Rebalance(2, true); err != nil || len(fc.log) != 0 {
+		t.Errorf("rebalanced a balanced cluster: %v %q", err, fc.log)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/cli"
+)
+
+/**
+inmem-cli drives the clusters of inmem servers, like redis-cli --cluster:
+	inmem-cli --cluster reshard <host:port> --cluster-to <id> --cluster-slots <n> [--cluster-from <id,...>]
+	inmem-cli --cluster rebalance <host:port> [--cluster-threshold <percent>] [--cluster-use-empty-masters]
+The server given is any node of the cluster, the ids of the masters can be abbreviated.
+*/
+
+var (
+	clusterCommand  string
+	fromIDs         string
+	toID            string
+	numSlots        int
+	threshold       float64
+	useEmptyMasters bool
+	opts            cli.Options
+	timeoutMillis   int
+)
+
+func setupFlags() {
+	flag.StringVar(&clusterCommand, "cluster", "", "cluster command to run on the cluster of the node given: reshard or rebalance")
+	flag.StringVar(&fromIDs, "cluster-from", "", "ids of the masters reshard takes the slots from, separated by commas, all the other masters when empty")
+	flag.StringVar(&toID, "cluster-to", "", "id of the master reshard moves the slots to")
+	flag.IntVar(&numSlots, "cluster-slots", 0, "number of slots reshard moves")
+	flag.Float64Var(&threshold, "cluster-threshold", 2, "percentage of slots a master can serve above or below the average before rebalance moves slots")
+	flag.BoolVar(&useEmptyMasters, "cluster-use-empty-masters", false, "let rebalance move slots to the masters serving no slot")
+	flag.IntVar(&opts.Pipeline, "cluster-pipeline", 10, "number of keys moved by every MIGRATE")
+	flag.IntVar(&timeoutMillis, "cluster-timeout", 60000, "milliseconds every command, and every read and write of MIGRATE, can take")
+	flag.StringVar(&opts.User, "user", "", "user to authenticate as")
+	flag.StringVar(&opts.Password, "a", "", "password to authenticate with")
+}
+
+func main() {
+	setupFlags()
+	flag.Parse()
+	args := flag.Args()
+	if clusterCommand == "" || len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: inmem-cli --cluster reshard|rebalance <host:port> [options]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	//INFO: Like with redis-cli the options can follow the address of the node
+	addr := args[0]
+	flag.CommandLine.Parse(args[1:])
+	opts.Timeout = time.Duration(timeoutMillis) * time.Millisecond
+
+	cluster, err := cli.LoadCluster(addr, opts, os.Stdout)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cluster.Close()
+	switch clusterCommand {
+	case "reshard":
+		err = reshard(cluster)
+	case "rebalance":
+		err = cluster.Rebalance(threshold, useEmptyMasters)
+	default:
+		err = fmt.Errorf("unknown cluster command %s", clusterCommand)
+	}
+	if err != nil {
+		cluster.Close()
+		log.Fatal(err)
+	}
+}
+
+func reshard(cluster *cli.Cluster) error {
+	if toID == "" {
+		return fmt.Errorf("--cluster-to is required")
+	}
+	to, err := cluster.Node(toID)
+	if err != nil {
+		return err
+	}
+	var sources []*cli.ClusterNode
+	if fromIDs != "" {
+		for _, id := range strings.Split(fromIDs, ",") {
+			from, err := cluster.Node(strings.TrimSpace(id))
+			if err != nil {
+				return err
+			}
+			sources = append(sources, from)
+		}
+	}
+	return cluster.Reshard(sources, to, numSlots)
+}
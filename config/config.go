@@ -2,3 +2,141 @@ package config
 
 var Host string
 var Port int
+
+// Milliseconds a script can run before other clients are told the server is busy
+var LuaTimeLimit int
+
+// Milliseconds a watched query waits after a modification of its keys before it runs again
+var WatchQueryDebounce int
+
+// Maximum number of queries a client can watch at once
+var WatchQueryMaxPerClient int
+
+// Classes of keyspace events published through pub/sub, empty disables them
+var NotifyKeyspaceEvents string
+
+// Maximum number of keys remembered for client side caching, 0 for no limit
+var TrackingTableMaxKeys int
+
+// Password clients must authenticate with, empty when no authentication is required
+var RequirePass string
+
+// File the ACL users are loaded from and saved to by ACL LOAD / ACL SAVE
+var ACLFile string
+
+// Maximum number of entries of the ACL log
+var ACLLogMaxLen int
+
+// TLS port, 0 disables TLS
+var TLSPort int
+
+// Certificate and private key of the server, in PEM format
+var TLSCertFile string
+var TLSKeyFile string
+
+// Certificates of the authorities that sign the client certificates, in PEM format
+var TLSCACertFile string
+
+// Tells if clients must present a certificate: yes, optional or no
+var TLSAuthClients string
+
+// Path of the unix socket to listen on, empty to only listen on TCP
+var UnixSocket string
+
+// Permissions of the unix socket file as an octal mode, eg: 700
+var UnixSocketPerm string
+
+// Refuse clients from other machines while the default user needs no password
+var ProtectedMode bool
+
+// Address of the HTTP listener serving Prometheus metrics on /metrics, empty to disable it
+var MetricsAddr string
+
+// Microseconds a command must run for to be logged in the slow log, 0 logs every command and a negative value none
+var SlowlogLogSlowerThan int
+
+// Maximum number of entries of the slow log
+var SlowlogMaxLen int
+
+// Milliseconds an event must take to be sampled by the latency monitor, 0 disables it
+var LatencyMonitorThreshold int
+
+// Master to replicate at startup as "host port", empty to start as a master
+var ReplicaOf string
+
+// Replicas refuse the write commands of their clients
+var ReplicaReadOnly bool
+
+// User and password a replica authenticates with to its master, no AUTH is sent when the password is empty
+var MasterUser string
+var MasterAuth string
+
+// Seconds without data from the other end after which a replication link is considered lost
+var ReplTimeout int
+
+// Number of bytes of the replication stream kept for the replicas that reconnect
+var ReplBacklogSize int
+
+// Replicas connect to their master with TLS, the master address must then be its TLS port
+var TLSReplication bool
+
+// Writes are appended to the append only file AppendFilename and replayed at startup
+var AppendOnly bool
+var AppendFilename string
+
+// When the append only file is fsynced: always, everysec or no
+var AppendFsync string
+
+// Masters refuse writes with fewer than MinReplicasToWrite replicas that acknowledged the stream within
+// MinReplicasMaxLag seconds, 0 disables the check
+var MinReplicasToWrite int
+var MinReplicasMaxLag int
+
+// Id of the node in raft mode, 0 disables raft mode
+var RaftID uint64
+
+// Nodes of the initial raft cluster and the address of their raft bus as "id=host:port,...",
+// empty for a node that joins an existing cluster
+var RaftPeers string
+
+// Address the raft bus listens on, the address of RaftID in RaftPeers when empty
+var RaftAddr string
+
+// Entries applied before the raft log is compacted into a snapshot of the dataset
+var RaftSnapshotEntries int
+
+// The nodes connect to the raft bus, or the cluster bus, of each other with TLS
+var TLSCluster bool
+
+// Cluster mode: the keys are sharded in hash slots over the nodes of a cluster
+var ClusterEnabled bool
+
+// Port of the cluster bus, 0 for the port of the clients + 10000
+var ClusterPort int
+
+// Milliseconds a node of the cluster must be unreachable for to be considered failing
+var ClusterNodeTimeout int
+
+// IP address announced to the other nodes of the cluster, empty to use the address they reach the node at
+var ClusterAnnounceIP string
+
+// Sentinel mode: the server monitors a master and its replicas and promotes a replica when the master fails,
+// it serves no dataset
+var Sentinel bool
+
+// Master monitored in sentinel mode as "name host port quorum", quorum being the number of sentinels that must
+// agree the master is down
+var SentinelMonitor string
+
+// Milliseconds an instance must be unreachable for to be considered down by a sentinel
+var SentinelDownAfter int
+
+// Milliseconds a failover can take before it is aborted, a failover of the same master is not retried before twice
+// this time
+var SentinelFailoverTimeout int
+
+// IP address announced to the other sentinels, empty to use the address the monitored instances are reached from
+var SentinelAnnounceIP string
+
+// Version of the server reported to clients
+const Version = "0.1.0"
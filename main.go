@@ -18,10 +18,57 @@ func main() {
 }
 
 func setupFlags() {
-	//Says the host
-	flag.StringVar(&config.Host, "host", "0.0.0.0", "host for inmem server")
+	//Says the host, several addresses can be separated by spaces or commas
+	flag.StringVar(&config.Host, "host", "0.0.0.0", "addresses for inmem server to listen on, separated by spaces or commas, eg: \"127.0.0.1 ::1\"")
 
 	// INFO: default Port for REDIS server is 6379
-	flag.IntVar(&config.Port, "port", 7379, "port for inmem server")
+	flag.IntVar(&config.Port, "port", 7379, "port for inmem server, 0 disables TCP (a unixsocket is then required)")
+
+	flag.IntVar(&config.LuaTimeLimit, "lua-time-limit", 5000, "milliseconds a script can run before the server replies BUSY to other clients")
+	flag.IntVar(&config.WatchQueryDebounce, "watchquery-debounce", 50, "milliseconds to wait after a key is modified before running the queries reading it again")
+	flag.IntVar(&config.WatchQueryMaxPerClient, "watchquery-max-per-client", 16, "maximum number of queries a client can watch with WATCHQUERY")
+	flag.StringVar(&config.NotifyKeyspaceEvents, "notify-keyspace-events", "", "classes of keyspace events published through pub/sub, eg: KEA")
+	flag.IntVar(&config.TrackingTableMaxKeys, "tracking-table-max-keys", 1000000, "maximum number of keys remembered for client side caching, 0 for no limit")
+	flag.StringVar(&config.RequirePass, "requirepass", "", "password clients must authenticate with using AUTH or HELLO")
+	flag.StringVar(&config.ACLFile, "aclfile", "", "file the ACL users are loaded from at startup and by ACL LOAD, and saved to by ACL SAVE")
+	flag.IntVar(&config.ACLLogMaxLen, "acllog-max-len", 128, "maximum number of entries of the ACL log")
+	flag.IntVar(&config.TLSPort, "tls-port", 0, "port for TLS connections, 0 disables TLS")
+	flag.StringVar(&config.TLSCertFile, "tls-cert-file", "", "server certificate in PEM format, reloaded when it changes")
+	flag.StringVar(&config.TLSKeyFile, "tls-key-file", "", "server private key in PEM format, reloaded when it changes")
+	flag.StringVar(&config.TLSCACertFile, "tls-ca-cert-file", "", "CA certificates used to verify client certificates and the certificates of the servers replicated from, reloaded when they change")
+	flag.StringVar(&config.TLSAuthClients, "tls-auth-clients", "yes", "require client certificates: yes, optional or no")
+	flag.StringVar(&config.UnixSocket, "unixsocket", "", "path of a unix socket to listen on in addition to TCP")
+	flag.StringVar(&config.UnixSocketPerm, "unixsocketperm", "", "permissions of the unix socket file as an octal mode, eg: 700")
+	flag.BoolVar(&config.ProtectedMode, "protected-mode", true, "only serve loopback and unix socket clients while the default user needs no password")
+	flag.StringVar(&config.MetricsAddr, "metrics-addr", "", "address of the HTTP listener serving Prometheus metrics on /metrics, eg: 127.0.0.1:9121")
+	flag.IntVar(&config.SlowlogLogSlowerThan, "slowlog-log-slower-than", 10000, "microseconds a command must run for to be logged in the slow log, 0 logs every command and a negative value none")
+	flag.IntVar(&config.SlowlogMaxLen, "slowlog-max-len", 128, "maximum number of entries of the slow log")
+	flag.IntVar(&config.LatencyMonitorThreshold, "latency-monitor-threshold", 0, "milliseconds an event must take to be sampled by the latency monitor, 0 disables it")
+	flag.StringVar(&config.ReplicaOf, "replicaof", "", "master to replicate at startup, eg: \"10.0.0.1 7379\"")
+	flag.BoolVar(&config.ReplicaReadOnly, "replica-read-only", true, "replicas refuse the write commands of their clients")
+	flag.StringVar(&config.MasterUser, "masteruser", "", "ACL user a replica authenticates with to its master, the default user when empty")
+	flag.StringVar(&config.MasterAuth, "masterauth", "", "password a replica authenticates with to its master")
+	flag.IntVar(&config.ReplTimeout, "repl-timeout", 60, "seconds without data from the other end after which a replication link is considered lost")
+	flag.IntVar(&config.ReplBacklogSize, "repl-backlog-size", 1024*1024, "bytes of the replication stream kept so that replicas reconnecting can continue where they stopped")
+	flag.BoolVar(&config.TLSReplication, "tls-replication", false, "replicas connect to the TLS port of their master, using tls-cert-file, tls-key-file and tls-ca-cert-file")
+	flag.BoolVar(&config.AppendOnly, "appendonly", false, "append the writes to the append only file and replay it at startup")
+	flag.StringVar(&config.AppendFilename, "appendfilename", "appendonly.aof", "path of the append only file")
+	flag.StringVar(&config.AppendFsync, "appendfsync", "everysec", "when the append only file is fsynced: always, everysec or no")
+	flag.IntVar(&config.MinReplicasToWrite, "min-replicas-to-write", 0, "masters refuse writes with fewer replicas that acknowledged within min-replicas-max-lag, 0 disables it")
+	flag.IntVar(&config.MinReplicasMaxLag, "min-replicas-max-lag", 10, "seconds within which a replica must have acknowledged the stream to count for min-replicas-to-write")
+	flag.Uint64Var(&config.RaftID, "raft-id", 0, "id of the node in raft mode, where writes are committed to a majority of the nodes before they are applied, 0 disables raft mode")
+	flag.StringVar(&config.RaftPeers, "raft-peers", "", "nodes of the initial raft cluster and the address of their raft bus, eg: 1=10.0.0.1:17379,2=10.0.0.2:17379,3=10.0.0.3:17379, empty to join an existing cluster")
+	flag.StringVar(&config.RaftAddr, "raft-addr", "", "address the raft bus listens on, the address of raft-id in raft-peers when empty")
+	flag.IntVar(&config.RaftSnapshotEntries, "raft-snapshot-entries", 10000, "entries applied before the raft log is compacted into a snapshot of the dataset")
+	flag.BoolVar(&config.TLSCluster, "tls-cluster", false, "nodes connect to the raft bus, or the cluster bus, of each other with TLS, using tls-cert-file, tls-key-file and tls-ca-cert-file")
+	flag.BoolVar(&config.ClusterEnabled, "cluster-enabled", false, "shard the keys in hash slots over the nodes of a cluster")
+	flag.IntVar(&config.ClusterPort, "cluster-port", 0, "port of the cluster bus, 0 for port + 10000")
+	flag.IntVar(&config.ClusterNodeTimeout, "cluster-node-timeout", 15000, "milliseconds a node of the cluster must be unreachable for to be considered failing")
+	flag.StringVar(&config.ClusterAnnounceIP, "cluster-announce-ip", "", "IP address announced to the other nodes of the cluster, empty to use the address they reach the node at")
+	flag.BoolVar(&config.Sentinel, "sentinel", false, "run as a sentinel monitoring sentinel-monitor and promoting one of its replicas when it fails, port is then the port of the sentinel")
+	flag.StringVar(&config.SentinelMonitor, "sentinel-monitor", "", "master monitored in sentinel mode as \"name host port quorum\", eg: \"mymaster 10.0.0.1 7379 2\"")
+	flag.IntVar(&config.SentinelDownAfter, "sentinel-down-after-milliseconds", 30000, "milliseconds an instance must be unreachable for to be considered down by a sentinel")
+	flag.IntVar(&config.SentinelFailoverTimeout, "sentinel-failover-timeout", 180000, "milliseconds a failover can take before it is aborted, it is not retried before twice this time")
+	flag.StringVar(&config.SentinelAnnounceIP, "sentinel-announce-ip", "", "IP address announced to the other sentinels, empty to use the address the monitored instances are reached from")
 	flag.Parse()
 }
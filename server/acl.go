@@ -0,0 +1,387 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/acl"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Access control, the users and their rules live in server/acl:
+	- ACL SETUSER username [rule ...] / GETUSER username / DELUSER username [username ...]
+	- ACL LIST / USERS / WHOAMI / CAT [category]
+	- ACL DRYRUN username command [arg ...] tells if the user could run the command
+	- ACL LOG [count | RESET] shows the commands, keys and channels that were denied and the failed logins
+	- ACL SAVE / LOAD write and read the users of the aclfile
+Before a command runs the user of the client must be allowed to run it, to access its keys (read access
+for read only commands, read and write access for the others) and its pub/sub channels.
+*/
+
+var (
+	//The users, guarded by execMu.
+	//INFO: They are also checked while a script holds execMu (see busyScriptReply), so they are
+	//changed holding usersMu as well and can be read holding either of them.
+	users   *acl.ACL
+	usersMu sync.RWMutex
+
+	//Denied commands and failed logins, the newest first, guarded by aclLogMu
+	aclLog       []*aclLogEntry
+	lastACLLogID int64
+	aclLogMu     sync.Mutex
+
+	errNoACLFile = errors.New("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+)
+
+// Similar denials within this time are counted in the same log entry
+const aclLogGroupingTime = 60 * time.Second
+
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// Creates the users from the configuration, called once at startup
+func initACL() error {
+	commands := acl.CommandSet{}
+	for name, spec := range commandTable {
+		commands[name] = spec.categories
+	}
+	usersMu.Lock()
+	users = acl.New(commands)
+	if config.RequirePass != "" {
+		if err := users.SetUser(acl.DefaultUser, []string{"resetpass", ">" + config.RequirePass}); err != nil {
+			usersMu.Unlock()
+			return err
+		}
+	}
+	usersMu.Unlock()
+
+	if config.ACLFile != "" {
+		return loadACLFile()
+	}
+	return nil
+}
+
+func loadACLFile() error {
+	f, err := os.Open(config.ACLFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	return users.Load(f, config.ACLFile)
+}
+
+func saveACLFile() error {
+	tmp := config.ACLFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err = users.Save(f); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, config.ACLFile)
+}
+
+// Checks that the user of the client can run the command, must be called holding execMu.
+// The context (toplevel, multi or lua) only tells where the denial happened in the ACL log.
+func (c *Client) checkPermissions(cmd *Command, context string) error {
+	usersMu.RLock()
+	reason, object := checkUserPermissions(users.User(c.user), cmd)
+	usersMu.RUnlock()
+	if reason == "" {
+		return nil
+	}
+
+	addACLLogEntry(c, reason, context, object, c.user)
+	switch reason {
+	case "command":
+		return fmt.Errorf("NOPERM User %s has no permissions to run the '%s' command", c.user, object)
+	case "key":
+		return errors.New("NOPERM No permissions to access a key")
+	default:
+		return errors.New("NOPERM No permissions to access a channel")
+	}
+}
+
+// Returns why the user can not run the command (command, key or channel) and the denied object,
+// an empty reason when it can
+func checkUserPermissions(u *acl.User, cmd *Command) (string, string) {
+	spec, ok := commandTable[cmd.name()]
+	if !ok || spec.flags&CMD_FLAG_NOAUTH != 0 {
+		return "", ""
+	}
+	if u == nil || !u.CanRun(cmd.name()) {
+		return "command", cmd.name()
+	}
+	if cmd.checkArity() != nil {
+		return "", ""
+	}
+
+	access := acl.KeyRead | acl.KeyWrite
+	if spec.flags&CMD_FLAG_READONLY != 0 {
+		access = acl.KeyRead
+	}
+	for _, key := range cmd.keys() {
+		if !u.CanAccessKey(key, access) {
+			return "key", key
+		}
+	}
+
+	var channels []string
+	isPattern := false
+	switch cmd.name() {
+	case COMMAND_PUBLISH:
+		channels = cmd.Args[:1]
+	case COMMAND_SUBSCRIBE:
+		channels = cmd.Args
+	case COMMAND_PSUBSCRIBE:
+		channels, isPattern = cmd.Args, true
+	}
+	for _, channel := range channels {
+		if !u.CanAccessChannel(channel, isPattern) {
+			return "channel", channel
+		}
+	}
+	return "", ""
+}
+
+func addACLLogEntry(c *Client, reason string, context string, object string, username string) {
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	now := time.Now()
+	for _, e := range aclLog {
+		if now.Sub(e.updated) > aclLogGroupingTime {
+			break
+		}
+		if e.reason == reason && e.context == context && e.object == object && e.username == username {
+			e.count++
+			e.updated = now
+			return
+		}
+	}
+
+	lastACLLogID++
+	entry := &aclLogEntry{
+		id:         lastACLLogID,
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: fmt.Sprintf("id=%d addr=%s user=%s", c.id, c.conn.RemoteAddr(), c.user),
+		created:    now,
+		updated:    now,
+	}
+	aclLog = append([]*aclLogEntry{entry}, aclLog...)
+	if len(aclLog) > config.ACLLogMaxLen {
+		aclLog = aclLog[:config.ACLLogMaxLen]
+	}
+}
+
+// Disconnects the clients authenticated as users that do not exist anymore
+func disconnectDeletedUsers() {
+	for _, c := range clients {
+		if users.User(c.user) == nil {
+			c.quitting = true
+			if c != currentClient {
+				c.closeAfterReply()
+			}
+		}
+	}
+}
+
+func (c *Client) acl(args []string) []byte {
+	sub := strings.ToLower(args[0])
+	args = args[1:]
+	switch {
+	case sub == "setuser" && len(args) >= 1:
+		usersMu.Lock()
+		err := users.SetUser(args[0], args[1:])
+		usersMu.Unlock()
+		if err != nil {
+			return response.EncodeError(errors.New("ERR " + err.Error()))
+		}
+		return response.Encode("OK", true)
+	case sub == "getuser" && len(args) == 1:
+		return c.aclGetUser(args[0])
+	case sub == "deluser" && len(args) >= 1:
+		usersMu.Lock()
+		deleted, err := users.DelUser(args)
+		usersMu.Unlock()
+		if err != nil {
+			return response.EncodeError(errors.New("ERR " + err.Error()))
+		}
+		disconnectDeletedUsers()
+		return response.Encode(deleted, false)
+	case sub == "list" && len(args) == 0:
+		var lines [][]byte
+		for _, name := range users.Users() {
+			lines = append(lines, response.Encode("user "+name+" "+users.User(name).Describe(), false))
+		}
+		return response.EncodeArray(lines)
+	case sub == "users" && len(args) == 0:
+		var names [][]byte
+		for _, name := range users.Users() {
+			names = append(names, response.Encode(name, false))
+		}
+		return response.EncodeArray(names)
+	case sub == "whoami" && len(args) == 0:
+		return response.Encode(c.user, false)
+	case sub == "cat" && len(args) <= 1:
+		return aclCat(args)
+	case sub == "dryrun" && len(args) >= 2:
+		return aclDryRun(args)
+	case sub == "log" && len(args) <= 1:
+		return c.aclLog(args)
+	case sub == "save" && len(args) == 0:
+		if config.ACLFile == "" {
+			return response.EncodeError(errNoACLFile)
+		}
+		if err := saveACLFile(); err != nil {
+			return response.EncodeError(fmt.Errorf("ERR There was an error trying to save the ACLs. Please check the server logs for more information: %s", err))
+		}
+		return response.Encode("OK", true)
+	case sub == "load" && len(args) == 0:
+		if config.ACLFile == "" {
+			return response.EncodeError(errNoACLFile)
+		}
+		if err := loadACLFile(); err != nil {
+			return response.EncodeError(errors.New("ERR " + err.Error()))
+		}
+		disconnectDeletedUsers()
+		return response.Encode("OK", true)
+	}
+
+	switch sub {
+	case "setuser", "getuser", "deluser", "list", "users", "whoami", "cat", "dryrun", "log", "save", "load":
+		return response.EncodeError(fmt.Errorf("ERR wrong number of arguments for 'acl|%s' command", sub))
+	}
+	return response.EncodeError(fmt.Errorf("ERR unknown subcommand '%s'. Try ACL HELP.", sub))
+}
+
+func (c *Client) aclGetUser(name string) []byte {
+	u := users.User(name)
+	if u == nil {
+		return response.Encode(nil, false)
+	}
+	encodeStrings := func(values []string) []byte {
+		items := make([][]byte, 0, len(values))
+		for _, v := range values {
+			items = append(items, response.Encode(v, false))
+		}
+		return response.EncodeArray(items)
+	}
+	return c.encodeMap([][]byte{
+		response.Encode("flags", false), encodeStrings(u.Flags()),
+		response.Encode("passwords", false), encodeStrings(u.Passwords()),
+		response.Encode("commands", false), response.Encode(u.CommandRules(), false),
+		response.Encode("keys", false), response.Encode(u.KeyRules(), false),
+		response.Encode("channels", false), response.Encode(u.ChannelRules(), false),
+		response.Encode("selectors", false), response.EncodeArray(nil),
+	})
+}
+
+func aclCat(args []string) []byte {
+	names := acl.Categories
+	if len(args) == 1 {
+		var err error
+		if names, err = users.CategoryCommands(strings.ToLower(args[0])); err != nil {
+			return response.EncodeError(errors.New("ERR " + err.Error()))
+		}
+	}
+	replies := make([][]byte, 0, len(names))
+	for _, name := range names {
+		replies = append(replies, response.Encode(name, false))
+	}
+	return response.EncodeArray(replies)
+}
+
+func aclDryRun(args []string) []byte {
+	u := users.User(args[0])
+	if u == nil {
+		return response.EncodeError(fmt.Errorf("ERR User '%s' not found", args[0]))
+	}
+	cmd := &Command{Cmd: args[1], Args: args[2:]}
+	if _, ok := commandTable[cmd.name()]; !ok {
+		return response.EncodeError(fmt.Errorf("ERR Command '%s' not found", cmd.name()))
+	}
+	if err := cmd.checkArity(); err != nil {
+		return response.EncodeError(err)
+	}
+
+	switch reason, object := checkUserPermissions(u, cmd); reason {
+	case "":
+		return response.Encode("OK", true)
+	case "command":
+		return response.Encode(fmt.Sprintf("User %s has no permissions to run the '%s' command", args[0], object), false)
+	case "key":
+		return response.Encode(fmt.Sprintf("User %s has no permissions to access the '%s' key", args[0], object), false)
+	default:
+		return response.Encode(fmt.Sprintf("User %s has no permissions to access the '%s' channel", args[0], object), false)
+	}
+}
+
+func (c *Client) aclLog(args []string) []byte {
+	aclLogMu.Lock()
+	defer aclLogMu.Unlock()
+
+	count := len(aclLog)
+	if len(args) == 1 {
+		if strings.EqualFold(args[0], "reset") {
+			aclLog = nil
+			return response.Encode("OK", true)
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return response.EncodeError(errors.New("ERR value is out of range, must be positive"))
+		}
+		if n < count {
+			count = n
+		}
+	}
+
+	now := time.Now()
+	entries := make([][]byte, 0, count)
+	for _, e := range aclLog[:count] {
+		age := strconv.FormatFloat(now.Sub(e.created).Seconds(), 'f', 3, 64)
+		entries = append(entries, c.encodeMap([][]byte{
+			response.Encode("count", false), response.Encode(e.count, false),
+			response.Encode("reason", false), response.Encode(e.reason, false),
+			response.Encode("context", false), response.Encode(e.context, false),
+			response.Encode("object", false), response.Encode(e.object, false),
+			response.Encode("username", false), response.Encode(e.username, false),
+			response.Encode("age-seconds", false), response.Encode(age, false),
+			response.Encode("client-info", false), response.Encode(e.clientInfo, false),
+			response.Encode("entry-id", false), response.Encode(e.id, false),
+			response.Encode("timestamp-created", false), response.Encode(e.created.UnixMilli(), false),
+			response.Encode("timestamp-last-updated", false), response.Encode(e.updated.UnixMilli(), false),
+		}))
+	}
+	return response.EncodeArray(entries)
+}
@@ -0,0 +1,537 @@
+package acl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/inmemdb/inmem/server/glob"
+)
+
+/**
+Access control lists: the users of the server and what each of them is allowed to do.
+A user is described by a list of rules, the same ones redis ACL SETUSER accepts:
+	- on / off enable or disable the user
+	- >password / <password add or remove a password, #sha256 / !sha256 do the same with its hash
+	- nopass lets the user authenticate with any password, resetpass forgets all the passwords
+	- +command / -command allow or deny a command, +@category / -@category all the commands of a category
+	- allcommands / nocommands are aliases for +@all / -@all
+	- ~pattern allows reading and writing keys matching the glob pattern, %R~pattern only reading,
+	  %W~pattern only writing, allkeys is an alias for ~* and resetkeys forgets all the patterns
+	- &pattern allows pub/sub channels matching the pattern, allchannels is an alias for &*
+	  and resetchannels forgets all the patterns
+	- reset brings the user back to its initial state: resetpass resetkeys resetchannels off -@all
+*/
+
+// The categories a command can belong to
+var Categories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string", "bitmap", "hyperloglog",
+	"geo", "stream", "pubsub", "admin", "fast", "slow", "blocking", "dangerous", "connection",
+	"transaction", "scripting",
+}
+
+const DefaultUser = "default"
+
+// The commands known to the server with the categories each of them belongs to
+type CommandSet map[string][]string
+
+// Key access requested by a command
+const (
+	KeyRead = 1 << iota
+	KeyWrite
+)
+
+type keyPattern struct {
+	pattern string
+	flags   int
+}
+
+func (p keyPattern) String() string {
+	switch p.flags {
+	case KeyRead:
+		return "%R~" + p.pattern
+	case KeyWrite:
+		return "%W~" + p.pattern
+	}
+	return "~" + p.pattern
+}
+
+type User struct {
+	Name string
+
+	enabled   bool
+	noPass    bool
+	passwords []string
+
+	//The commands the user can run, and the rules that built the set
+	commands     map[string]bool
+	commandRules []string
+
+	keys     []keyPattern
+	channels []string
+}
+
+type ACL struct {
+	commands CommandSet
+	users    map[string]*User
+}
+
+// Creates the list of users with only the default user, which can run everything without a password
+func New(commands CommandSet) *ACL {
+	a := &ACL{commands: commands, users: map[string]*User{}}
+	a.users[DefaultUser] = a.defaultUser()
+	return a
+}
+
+func (a *ACL) newUser(name string) *User {
+	return &User{Name: name, commands: map[string]bool{}, commandRules: []string{"-@all"}}
+}
+
+func (a *ACL) defaultUser() *User {
+	u := a.newUser(DefaultUser)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		a.applyRule(u, rule)
+	}
+	return u
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]keyPattern(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	c.commands = make(map[string]bool, len(u.commands))
+	for name, allowed := range u.commands {
+		c.commands[name] = allowed
+	}
+	return &c
+}
+
+// Returns the user, nil if it does not exist
+func (a *ACL) User(name string) *User {
+	return a.users[name]
+}
+
+// Sorted names of all the users
+func (a *ACL) Users() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Creates or modifies the user, the rules are applied all or none
+func (a *ACL) SetUser(name string, rules []string) error {
+	u, ok := a.users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = a.newUser(name)
+	}
+	for _, rule := range rules {
+		if err := a.applyRule(u, rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err)
+		}
+	}
+	a.users[name] = u
+	return nil
+}
+
+// Deletes the users, returns how many existed. The default user can not be deleted.
+func (a *ACL) DelUser(names []string) (int, error) {
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, errors.New("The 'default' user cannot be removed")
+		}
+	}
+	deleted := 0
+	for _, name := range names {
+		if _, ok := a.users[name]; ok {
+			delete(a.users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// Tells if the user exists, is enabled and the password is one of its passwords
+func (a *ACL) Authenticate(name string, password string) bool {
+	u, ok := a.users[name]
+	if !ok || !u.enabled {
+		return false
+	}
+	if u.noPass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// The commands of the category, sorted
+func (a *ACL) CategoryCommands(category string) ([]string, error) {
+	if !validCategory(category) {
+		return nil, fmt.Errorf("Unknown category '%s'", category)
+	}
+	var names []string
+	for name, categories := range a.commands {
+		if contains(categories, category) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func validCategory(category string) bool {
+	return category == "all" || contains(Categories, category)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *ACL) applyRule(u *User, rule string) error {
+	if rule == "" {
+		return errors.New("Syntax error")
+	}
+	lower := strings.ToLower(rule)
+	switch lower {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.noPass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.noPass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		return a.applyRule(u, "~*")
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		return a.applyRule(u, "&*")
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		return a.applyRule(u, "+@all")
+	case "nocommands":
+		return a.applyRule(u, "-@all")
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"} {
+			a.applyRule(u, r)
+		}
+		return nil
+	}
+
+	switch {
+	case rule[0] == '>':
+		a.addPassword(u, hashPassword(rule[1:]))
+	case rule[0] == '<':
+		return u.removePassword(hashPassword(rule[1:]))
+	case rule[0] == '#' || rule[0] == '!':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != 2*sha256.Size {
+			return errors.New("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		if rule[0] == '!' {
+			return u.removePassword(hash)
+		}
+		a.addPassword(u, hash)
+	case rule[0] == '~':
+		return u.addKeyPattern(rule[1:], KeyRead|KeyWrite)
+	case strings.HasPrefix(lower, "%"):
+		i := strings.IndexByte(rule, '~')
+		if i < 0 {
+			return errors.New("Syntax error")
+		}
+		flags := 0
+		for _, c := range strings.ToUpper(rule[1:i]) {
+			switch c {
+			case 'R':
+				flags |= KeyRead
+			case 'W':
+				flags |= KeyWrite
+			default:
+				return errors.New("Syntax error")
+			}
+		}
+		if flags == 0 {
+			return errors.New("Syntax error")
+		}
+		return u.addKeyPattern(rule[i+1:], flags)
+	case rule[0] == '&':
+		if u.hasAllChannels() {
+			return nil
+		}
+		if rule == "&*" {
+			u.channels = nil
+		}
+		if !contains(u.channels, rule[1:]) {
+			u.channels = append(u.channels, rule[1:])
+		}
+	case rule[0] == '+' || rule[0] == '-':
+		return a.applyCommandRule(u, lower)
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
+
+func (a *ACL) addPassword(u *User, hash string) {
+	u.noPass = false
+	if !contains(u.passwords, hash) {
+		u.passwords = append(u.passwords, hash)
+	}
+}
+
+func (u *User) removePassword(hash string) error {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no such password")
+}
+
+func (u *User) addKeyPattern(pattern string, flags int) error {
+	if u.hasAllKeys(flags) {
+		return nil
+	}
+	if pattern == "*" && flags == KeyRead|KeyWrite {
+		u.keys = nil
+	}
+	for i, p := range u.keys {
+		if p.pattern == pattern {
+			u.keys[i].flags |= flags
+			return nil
+		}
+	}
+	u.keys = append(u.keys, keyPattern{pattern, flags})
+	return nil
+}
+
+func (u *User) hasAllKeys(flags int) bool {
+	for _, p := range u.keys {
+		if p.pattern == "*" && p.flags&flags == flags {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) hasAllChannels() bool {
+	return contains(u.channels, "*")
+}
+
+func (a *ACL) applyCommandRule(u *User, rule string) error {
+	allow := rule[0] == '+'
+	name := rule[1:]
+
+	var names []string
+	if strings.HasPrefix(name, "@") {
+		category := name[1:]
+		if !validCategory(category) {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		for command, categories := range a.commands {
+			if category == "all" || contains(categories, category) {
+				names = append(names, command)
+			}
+		}
+		if category == "all" {
+			//+@all and -@all override every rule before them
+			u.commandRules = nil
+		}
+	} else {
+		if _, ok := a.commands[name]; !ok {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		names = []string{name}
+	}
+
+	for _, command := range names {
+		if allow {
+			u.commands[command] = true
+		} else {
+			delete(u.commands, command)
+		}
+	}
+	u.commandRules = append(u.commandRules, rule)
+	return nil
+}
+
+func (u *User) Enabled() bool {
+	return u.enabled
+}
+
+func (u *User) NoPass() bool {
+	return u.noPass
+}
+
+func (u *User) CanRun(command string) bool {
+	return u.commands[command]
+}
+
+// Tells if the user can access the key with the requested KeyRead / KeyWrite flags
+func (u *User) CanAccessKey(key string, flags int) bool {
+	granted := 0
+	for _, p := range u.keys {
+		if glob.Match(p.pattern, key) {
+			granted |= p.flags
+			if granted&flags == flags {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Tells if the user can publish or subscribe to the channel. A pattern subscription is
+// only allowed when the pattern is literally one of the channel patterns of the user.
+func (u *User) CanAccessChannel(channel string, isPattern bool) bool {
+	for _, p := range u.channels {
+		if p == "*" {
+			return true
+		}
+		if isPattern {
+			if p == channel {
+				return true
+			}
+		} else if glob.Match(p, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// The flags of the user as listed by ACL GETUSER
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.noPass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+// SHA-256 hashes of the passwords
+func (u *User) Passwords() []string {
+	return append([]string(nil), u.passwords...)
+}
+
+func (u *User) CommandRules() string {
+	return strings.Join(u.commandRules, " ")
+}
+
+func (u *User) KeyRules() string {
+	rules := make([]string, 0, len(u.keys))
+	for _, p := range u.keys {
+		rules = append(rules, p.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *User) ChannelRules() string {
+	rules := make([]string, 0, len(u.channels))
+	for _, p := range u.channels {
+		rules = append(rules, "&"+p)
+	}
+	return strings.Join(rules, " ")
+}
+
+// The rules recreating the user, as listed by ACL LIST and saved to the ACL file
+func (u *User) Describe() string {
+	parts := u.Flags()
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if keys := u.KeyRules(); keys != "" {
+		parts = append(parts, keys)
+	}
+	if !u.hasAllChannels() {
+		parts = append(parts, "resetchannels")
+	}
+	if channels := u.ChannelRules(); channels != "" {
+		parts = append(parts, channels)
+	}
+	parts = append(parts, u.CommandRules())
+	return strings.Join(parts, " ")
+}
+
+// Writes the users in the ACL file format, one "user <name> <rules>" line per user
+func (a *ACL) Save(w io.Writer) error {
+	for _, name := range a.Users() {
+		if _, err := fmt.Fprintf(w, "user %s %s\n", name, a.users[name].Describe()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the users with the ones read from an ACL file, nothing changes if the file has an error.
+// The default user is kept as it is when the file does not define it.
+func (a *ACL) Load(r io.Reader, source string) error {
+	loaded := &ACL{commands: a.commands, users: map[string]*User{}}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d should start with user keyword", source, line)
+		}
+		if _, ok := loaded.users[fields[1]]; ok {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", source, line, fields[1])
+		}
+		if err := loaded.SetUser(fields[1], fields[2:]); err != nil {
+			return fmt.Errorf("%s:%d: %s", source, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if _, ok := loaded.users[DefaultUser]; !ok {
+		loaded.users[DefaultUser] = a.users[DefaultUser]
+	}
+	a.users = loaded.users
+	return nil
+}
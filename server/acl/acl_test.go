@@ -0,0 +1,121 @@
+package acl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+var commands = CommandSet{
+	"get":       {"read", "string", "fast"},
+	"set":       {"write", "string", "slow"},
+	"publish":   {"pubsub", "fast"},
+	"subscribe": {"pubsub", "slow"},
+	"flushall":  {"keyspace", "write", "slow", "dangerous"},
+}
+
+func TestDefaultUser(t *testing.T) {
+	a := New(commands)
+	u := a.User(DefaultUser)
+	if !a.Authenticate(DefaultUser, "anything") || !u.CanRun("flushall") || !u.CanAccessKey("k", KeyRead|KeyWrite) {
+		t.Fail()
+	}
+	if got := u.Describe(); got != "on nopass ~* &* +@all" {
+		t.Errorf("unexpected description %q", got)
+	}
+}
+
+func TestSetUser(t *testing.T) {
+	a := New(commands)
+	if err := a.SetUser("alice", []string{"on", ">secret", "+@read", "+publish", "~cache:*", "%W~log:*", "&news.*"}); err != nil {
+		t.Fatal(err)
+	}
+	u := a.User("alice")
+
+	cases := []struct {
+		name string
+		ok   bool
+	}{
+		{"auth with the password", a.Authenticate("alice", "secret")},
+		{"auth with a wrong password", !a.Authenticate("alice", "nope")},
+		{"run a read command", u.CanRun("get")},
+		{"run an added command", u.CanRun("publish")},
+		{"run a write command", !u.CanRun("set")},
+		{"read a matching key", u.CanAccessKey("cache:1", KeyRead)},
+		{"read a key of another pattern", !u.CanAccessKey("user:1", KeyRead)},
+		{"write a write only key", u.CanAccessKey("log:1", KeyWrite)},
+		{"read a write only key", !u.CanAccessKey("log:1", KeyRead)},
+		{"publish to a matching channel", u.CanAccessChannel("news.sport", false)},
+		{"subscribe to another pattern", !u.CanAccessChannel("news.*.x", true)},
+		{"subscribe to the same pattern", u.CanAccessChannel("news.*", true)},
+	}
+	for _, tc := range cases {
+		if !tc.ok {
+			t.Errorf("failed to %s", tc.name)
+		}
+	}
+
+	if err := a.SetUser("alice", []string{"off", "+nosuchcommand"}); err == nil {
+		t.Error("expected an error for an unknown command")
+	}
+	if !a.User("alice").Enabled() {
+		t.Error("a failed SETUSER must not apply any rule")
+	}
+
+	if err := a.SetUser("alice", []string{"reset"}); err != nil || a.Authenticate("alice", "secret") || a.User("alice").CanRun("get") {
+		t.Error("reset must bring the user back to its initial state")
+	}
+}
+
+func TestCommandRules(t *testing.T) {
+	a := New(commands)
+	a.SetUser("bob", []string{"+@all", "-@dangerous", "-set"})
+	u := a.User("bob")
+	if !u.CanRun("get") || u.CanRun("set") || u.CanRun("flushall") {
+		t.Fail()
+	}
+	if got := u.CommandRules(); got != "+@all -@dangerous -set" {
+		t.Errorf("unexpected rules %q", got)
+	}
+	a.SetUser("bob", []string{"nocommands", "+get"})
+	if got := a.User("bob").CommandRules(); got != "-@all +get" {
+		t.Errorf("unexpected rules %q", got)
+	}
+}
+
+func TestDelUser(t *testing.T) {
+	a := New(commands)
+	a.SetUser("alice", nil)
+	if _, err := a.DelUser([]string{"alice", DefaultUser}); err == nil {
+		t.Error("the default user must not be deleted")
+	}
+	if n, err := a.DelUser([]string{"alice", "nobody"}); err != nil || n != 1 {
+		t.Errorf("expected one deleted user, got %d %v", n, err)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	a := New(commands)
+	a.SetUser("alice", []string{"on", ">secret", "~*", "+get"})
+
+	var buf bytes.Buffer
+	if err := a.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	b := New(commands)
+	if err := b.Load(&buf, "users.acl"); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Authenticate("alice", "secret") || !b.User("alice").CanRun("get") || b.User("alice").CanRun("set") {
+		t.Error("the loaded user differs from the saved one")
+	}
+
+	err := b.Load(strings.NewReader("user carol on\nuser dave +nosuchcommand\n"), "users.acl")
+	if err == nil || !strings.HasPrefix(err.Error(), "users.acl:2:") {
+		t.Errorf("expected an error on line 2, got %v", err)
+	}
+	if b.User("carol") != nil || b.User("alice") == nil {
+		t.Error("a file with errors must not change the users")
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestACLPermissions(t *testing.T) {
+	setupTestServer(t)
+	admin := connect(t)
+	bob := connect(t)
+
+	admin.expect(replyOK, "ACL", "SETUSER", "bob", "on", ">pw", "+@all", "-@scripting", "~cache:*", "&news")
+	bob.expect(replyOK, "AUTH", "bob", "pw")
+	bob.expect("bob", "ACL", "WHOAMI")
+
+	bob.expect(int64(1), "SIM.ADD", "cache:1", "x")
+	bob.expectError("NOPERM No permissions to access a key", "SIM.ADD", "user:1", "x")
+	bob.expectError("NOPERM User bob has no permissions to run the 'eval' command", "EVAL", "return 1", "0")
+	bob.expectError("NOPERM No permissions to access a channel", "PUBLISH", "weather", "sunny")
+	bob.expect(int64(0), "PUBLISH", "news", "hello")
+
+	admin.expect("User bob has no permissions to access the 'user:1' key", "ACL", "DRYRUN", "bob", "SIM.ADD", "user:1", "x")
+	admin.expect(replyOK, "ACL", "DRYRUN", "bob", "SIM.ADD", "cache:1", "x")
+	entry := admin.do("ACL", "LOG", "1").([]interface{})[0].([]interface{})
+	if entry[3] != "channel" || entry[7] != "weather" || entry[9] != "bob" {
+		t.Errorf("unexpected ACL log entry %#v", entry)
+	}
+
+	//Deleting the user disconnects its clients
+	admin.expect(int64(1), "ACL", "DELUSER", "bob")
+	bob.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	if _, err := bob.conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("the client of a deleted user was not disconnected: %v", err)
+	}
+}
+
+// AUTH and HELLO are not subject to the ACL rules, otherwise restricting the default user
+// would keep every client from logging in as another user
+func TestAuthWithRestrictedDefaultUser(t *testing.T) {
+	setupTestServer(t)
+	admin := connect(t)
+	admin.expect(replyOK, "ACL", "SETUSER", "alice", "on", ">secret", "+@all", "~*", "&*")
+	admin.expect(replyOK, "AUTH", "alice", "secret")
+	admin.expect(replyOK, "ACL", "SETUSER", "default", "-@all")
+
+	c := connect(t)
+	c.expectError("NOPERM", "PING")
+	c.expect(replyOK, "AUTH", "alice", "secret")
+	c.expect("alice", "ACL", "WHOAMI")
+
+	c = connect(t)
+	if _, ok := c.do("HELLO", "2", "AUTH", "alice", "secret").([]interface{}); !ok {
+		t.Error("HELLO AUTH failed while the default user can not run any command")
+	}
+	c.expect("alice", "ACL", "WHOAMI")
+
+	admin.expect(replyOK, "ACL", "SETUSER", "default", "off")
+	c = connect(t)
+	c.expectError("NOAUTH", "PING")
+	c.expectError("WRONGPASS", "AUTH", "default", "")
+	c.expect(replyOK, "AUTH", "alice", "secret")
+	c.expect(replyOK, "QUIT")
+}
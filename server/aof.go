@@ -0,0 +1,311 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The append only file logs the writes so that the dataset survives a restart, it is enabled by appendonly:
+	- the commands that modified the dataset are appended to appendfilename as they are propagated to the
+	  replicas (see replication.go), the writes of transactions and scripts are wrapped in MULTI / EXEC
+	- appendfsync always fsyncs the file before the replies of the commands are sent, everysec fsyncs it every
+	  second in the background and no leaves it to the operating system. The fsyncs are sampled by the latency
+	  monitor as the aof-fsync event.
+	- at startup the file is replayed. A last command that was only partly written, because the server stopped
+	  while writing it, is dropped and the file is truncated.
+	- a replica that fully syncs with its master replaces the file by the snapshot it received, sent as
+	  `$<length>\r\n<snapshot>` like by PSYNC (see snapshot.go), the writes that follow are appended to it
+	- once a write to the file failed the write commands are refused with a MISCONF error until a write succeeds
+The replication offset up to which the writes are fsynced is tracked for WAITAOF, with appendfsync no the
+writes count once they are written.
+The state of the file is guarded by execMu.
+*/
+
+const (
+	APPENDFSYNC_ALWAYS   = "always"
+	APPENDFSYNC_EVERYSEC = "everysec"
+	APPENDFSYNC_NO       = "no"
+)
+
+var (
+	//The append only file, nil when it is disabled
+	aofFile *os.File
+	//The writes not written to the file yet
+	aofBuf []byte
+	//Replication offsets up to which the writes are written to the file and fsynced, -1 when the file is disabled
+	aofWrittenOffset int64 = -1
+	aofFsyncedOffset int64 = -1
+	//The error of the last write to the file, nil when it succeeded
+	aofLastWriteErr error
+)
+
+// Checks the appendfsync setting
+func checkAppendFsync() error {
+	switch config.AppendFsync {
+	case APPENDFSYNC_ALWAYS, APPENDFSYNC_EVERYSEC, APPENDFSYNC_NO:
+		return nil
+	}
+	return fmt.Errorf("invalid appendfsync '%s', must be always, everysec or no", config.AppendFsync)
+}
+
+// Replays the append only file and opens it to append the writes, does nothing when appendonly is disabled
+func startAppendOnlyFile() error {
+	if !config.AppendOnly {
+		return nil
+	}
+	if err := checkAppendFsync(); err != nil {
+		return err
+	}
+	if err := loadAppendOnlyFile(config.AppendFilename); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(config.AppendFilename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	execMu.Lock()
+	aofFile = file
+	aofWrittenOffset, aofFsyncedOffset = masterReplOffset, masterReplOffset
+	execMu.Unlock()
+	go appendOnlyFileCron(file)
+	return nil
+}
+
+// Runs the commands of the file, a missing file is an empty dataset
+func loadAppendOnlyFile(name string) error {
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	//INFO: valid is the size of the commands applied, a transaction only counts once its EXEC is read
+	var valid, read int64
+	var queue []*Command
+	inMulti, commands := false, 0
+	rd := response.NewReader(file)
+	//INFO: The file of a replica starts with the snapshot it received from its master
+	first := make([]byte, 1)
+	if n, _ := file.ReadAt(first, 0); n == 1 && first[0] == '$' {
+		payload, err := rd.ReadPayload()
+		if err != nil {
+			return fmt.Errorf("bad snapshot reading the append only file %s: %v", name, err)
+		}
+		keys, err := parseSnapshot(payload)
+		if err != nil {
+			return fmt.Errorf("bad snapshot reading the append only file %s: %v", name, err)
+		}
+		execMu.Lock()
+		loadDataset(keys)
+		execMu.Unlock()
+		read = int64(len(fmt.Sprintf("$%d\r\n", len(payload))) + len(payload))
+		valid = read
+	}
+	for {
+		tokens, raw, err := rd.ReadCommand()
+		//INFO: A file that ends in the middle of a command ends like one that ends after a command,
+		//it is told by its size
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("bad file format reading the append only file %s: %v", name, err)
+		}
+		read += int64(len(raw))
+
+		cmd := &Command{Cmd: tokens[0], Args: tokens[1:]}
+		switch {
+		case cmd.name() == COMMAND_MULTI:
+			inMulti, queue = true, nil
+		case cmd.name() == COMMAND_EXEC:
+			execMu.Lock()
+			for _, queued := range queue {
+				loadAppendOnlyFileCommand(queued)
+			}
+			execMu.Unlock()
+			inMulti, queue, valid = false, nil, read
+		case inMulti:
+			queue = append(queue, cmd)
+		default:
+			execMu.Lock()
+			loadAppendOnlyFileCommand(cmd)
+			execMu.Unlock()
+			valid = read
+		}
+		commands++
+	}
+
+	if info, err := file.Stat(); err == nil && info.Size() > valid {
+		log.Printf("!!! Warning: short read while loading the AOF file %s, truncating it to %d bytes !!!", name, valid)
+		if err := os.Truncate(name, valid); err != nil {
+			return err
+		}
+	}
+	log.Printf("DB loaded from append only file %s: %d commands", name, commands)
+	return nil
+}
+
+// Runs a command of the file, must be called holding execMu
+func loadAppendOnlyFileCommand(cmd *Command) {
+	//INFO: The writes of the file are not written to it again, like the writes of the master on a replica
+	applyingMasterStream = true
+	defer func() { applyingMasterStream = false }()
+	if reply := evalCommand(cmd); len(reply) > 0 && reply[0] == '-' {
+		log.Printf("Error loading a command of the AOF: %v %s", cmd.redacted(), reply)
+	}
+}
+
+// Appends writes to the buffer of the file, must be called holding execMu
+func feedAppendOnlyFile(data []byte) {
+	if aofFile != nil {
+		aofBuf = append(aofBuf, data...)
+	}
+}
+
+// Writes the buffer to the file, and fsyncs it with appendfsync always, must be called holding execMu
+func flushAppendOnlyFile() {
+	if aofFile == nil || len(aofBuf) == 0 {
+		return
+	}
+	n, err := aofFile.Write(aofBuf)
+	aofBuf = aofBuf[n:]
+	if err != nil {
+		if aofLastWriteErr == nil {
+			log.Println("Error writing to the AOF file:", err)
+		}
+		aofLastWriteErr = err
+		return
+	}
+	if aofLastWriteErr != nil {
+		log.Println("AOF write error looks solved, writes are accepted again.")
+		aofLastWriteErr = nil
+	}
+	aofBuf = nil
+	aofWrittenOffset = masterReplOffset
+
+	switch config.AppendFsync {
+	case APPENDFSYNC_ALWAYS:
+		start := time.Now()
+		if err := aofFile.Sync(); err != nil {
+			log.Println("Can't persist AOF for fsync error when the AOF fsync policy is 'always':", err)
+			aofLastWriteErr = err
+			return
+		}
+		latencyAddSampleIfNeeded(LATENCY_EVENT_AOF_FSYNC, time.Since(start))
+		aofFsyncedOffset = aofWrittenOffset
+		wakeWaitingClients()
+	case APPENDFSYNC_NO:
+		aofFsyncedOffset = aofWrittenOffset
+		wakeWaitingClients()
+	}
+}
+
+// Retries failed writes and, with appendfsync everysec, fsyncs the file every second outside of execMu
+func appendOnlyFileCron(file *os.File) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		execMu.Lock()
+		if aofFile != file {
+			execMu.Unlock()
+			return
+		}
+		flushAppendOnlyFile()
+		offset := aofWrittenOffset
+		fsync := config.AppendFsync == APPENDFSYNC_EVERYSEC && offset > aofFsyncedOffset
+		execMu.Unlock()
+		if !fsync {
+			continue
+		}
+
+		start := time.Now()
+		err := file.Sync()
+		execMu.Lock()
+		latencyAddSampleIfNeeded(LATENCY_EVENT_AOF_FSYNC, time.Since(start))
+		if err != nil {
+			log.Println("Error fsyncing the AOF file:", err)
+		} else if offset > aofFsyncedOffset {
+			aofFsyncedOffset = offset
+			wakeWaitingClients()
+		}
+		execMu.Unlock()
+	}
+}
+
+// Replaces the file by a snapshot of the dataset, must be called holding execMu
+func rewriteAppendOnlyFile() error {
+	if aofFile == nil {
+		return nil
+	}
+	name := aofFile.Name()
+	snapshot := createSnapshot()
+	tmp, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append([]byte(fmt.Sprintf("$%d\r\n", len(snapshot))), snapshot...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), name)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	aofFile.Close()
+	aofFile, aofBuf, aofLastWriteErr = file, nil, nil
+	aofWrittenOffset, aofFsyncedOffset = masterReplOffset, masterReplOffset
+	go appendOnlyFileCron(file)
+	log.Println("Append only file rewritten with the dataset at offset", masterReplOffset)
+	return nil
+}
+
+// Replication offset up to which the writes are fsynced, -1 when the file is disabled, must be called holding execMu
+func appendOnlyFileOffset() int64 {
+	//INFO: The stream also holds PINGs and REPLCONF GETACKs that are not written to the file,
+	//once every write is fsynced the file is up to date with the whole stream
+	if aofFile != nil && len(aofBuf) == 0 && aofFsyncedOffset == aofWrittenOffset {
+		return masterReplOffset
+	}
+	return aofFsyncedOffset
+}
+
+// Stops appending to the file, must be called holding execMu
+func stopAppendOnlyFile() {
+	if aofFile != nil {
+		aofFile.Close()
+	}
+	aofFile, aofBuf, aofLastWriteErr = nil, nil, nil
+	aofWrittenOffset, aofFsyncedOffset = -1, -1
+}
+
+// Refuses the write commands while the file can not be written, must be called holding execMu
+func checkAppendOnlyFileWritable(cmd *Command) error {
+	if aofLastWriteErr == nil || applyingMasterStream || commandTable[cmd.name()].flags&CMD_FLAG_WRITE == 0 {
+		return nil
+	}
+	return errors.New("MISCONF Errors writing to the AOF file: " + strings.TrimSpace(aofLastWriteErr.Error()))
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Enables the append only file in a temporary directory
+func startTestAppendOnlyFile(t *testing.T, fsync string) string {
+	t.Helper()
+	config.AppendOnly = true
+	config.AppendFilename = filepath.Join(t.TempDir(), "appendonly.aof")
+	config.AppendFsync = fsync
+	if err := startAppendOnlyFile(); err != nil {
+		t.Fatal(err)
+	}
+	return config.AppendFilename
+}
+
+// Stops the file and empties the dataset, like a server that restarts
+func restartTestAppendOnlyFile(t *testing.T) {
+	t.Helper()
+	execMu.Lock()
+	stopAppendOnlyFile()
+	keyspace = map[string]interface{}{}
+	execMu.Unlock()
+	if err := startAppendOnlyFile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasKeys(keys ...string) bool {
+	execMu.Lock()
+	defer execMu.Unlock()
+	for _, key := range keys {
+		if _, ok := keyspace[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAppendOnlyFile(t *testing.T) {
+	setupTestServer(t)
+	name := startTestAppendOnlyFile(t, APPENDFSYNC_ALWAYS)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect(int64(0), "SIM.ADD", "a", "x")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "1")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "2")
+	c.expect(array(int64(1), int64(1)), "EXEC")
+	c.expect(array(int64(1), int64(0)), "WAITAOF", "1", "0", "0")
+
+	//Only the writes that modified the dataset are appended, the writes of transactions at once
+	expected := ""
+	for _, cmd := range []*Command{
+		{Cmd: "SIM.ADD", Args: []string{"a", "x"}},
+		{Cmd: "MULTI"},
+		{Cmd: "SIM.ADD", Args: []string{"b", "1"}},
+		{Cmd: "SIM.ADD", Args: []string{"b", "2"}},
+		{Cmd: "EXEC"},
+	} {
+		expected += string(cmd.encode())
+	}
+	if data, err := os.ReadFile(name); err != nil || string(data) != expected {
+		t.Fatalf("the file holds %q, %v, expected %q", data, err, expected)
+	}
+	info := c.do("INFO", "persistence").(string)
+	for _, field := range []string{"aof_enabled:1", "aof_last_write_status:ok"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO persistence misses %s:\n%s", field, info)
+		}
+	}
+
+	//A transaction without its EXEC and a command partly written are dropped when the file is replayed
+	tail := string((&Command{Cmd: "MULTI"}).encode()) + string((&Command{Cmd: "SIM.ADD", Args: []string{"c", "x"}}).encode()) + "*3\r\n$7\r\nSIM.ADD\r\n$1\r\nd"
+	if err := os.WriteFile(name, []byte(expected+tail), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restartTestAppendOnlyFile(t)
+	if !hasKeys("a", "b") || hasKeys("c") || hasKeys("d") {
+		t.Errorf("unexpected dataset after the replay")
+	}
+	if data, err := os.ReadFile(name); err != nil || string(data) != expected {
+		t.Errorf("the file was truncated to %q, %v, expected %q", data, err, expected)
+	}
+	c.expect("1", "SIM.JACCARD", "a", "a")
+}
+
+func TestAppendOnlyFileEverysec(t *testing.T) {
+	setupTestServer(t)
+	startTestAppendOnlyFile(t, APPENDFSYNC_EVERYSEC)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+
+	//The write is fsynced in the background within a second
+	c.send("WAITAOF", "1", "0", "0")
+	if !c.silent(10 * time.Millisecond) {
+		t.Error("WAITAOF replied before the file was fsynced")
+	}
+	c.expectNext(array(int64(1), int64(0)))
+}
+
+func TestAppendOnlyFileWriteError(t *testing.T) {
+	setupTestServer(t)
+	name := startTestAppendOnlyFile(t, APPENDFSYNC_NO)
+	c := connect(t)
+
+	//The file can not be written once it is only opened for reading
+	file, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execMu.Lock()
+	aofFile.Close()
+	aofFile = file
+	execMu.Unlock()
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expectError("MISCONF Errors writing to the AOF file", "SIM.ADD", "a", "y")
+	c.expect("1", "SIM.JACCARD", "a", "a")
+	if info := c.do("INFO", "persistence").(string); !strings.Contains(info, "aof_last_write_status:err") {
+		t.Errorf("INFO persistence misses aof_last_write_status:err:\n%s", info)
+	}
+}
+
+func TestReplicaAppendOnlyFile(t *testing.T) {
+	setupTestServer(t)
+	name := startTestAppendOnlyFile(t, APPENDFSYNC_ALWAYS)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "old", "x")
+	c.expect(replyOK, "REPLICAOF", host, port)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := newTestStream(t, conn)
+	serveTestHandshake(master, "?", "-1")
+	//The file is replaced by the snapshot, the replica acknowledges it as fsynced
+	serveTestFullResync(master, strings.Repeat("a", 40), 100, "k")
+
+	//The writes of the master are appended and acknowledged once fsynced
+	write := string((&Command{Cmd: "SIM.ADD", Args: []string{"k2", "x"}}).encode())
+	getack := string((&Command{Cmd: "REPLCONF", Args: []string{"GETACK", "*"}}).encode())
+	master.reply(write + getack)
+	offset := int64(100 + len(write) + len(getack))
+	master.expectAck(offset, offset)
+
+	stopTestReplication()
+	restartTestAppendOnlyFile(t)
+	if !hasKeys("k", "k2") || hasKeys("old") {
+		t.Errorf("unexpected dataset after the replay of %s", name)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/inmemdb/inmem/config"
 	iomux "github.com/inmemdb/inmem/server/iomux"
@@ -18,17 +22,63 @@ type Poller interface {
 	//Wait() ([]net.Conn, error)
 	WaitForCurrentConn(conn net.Conn) ([]net.Conn, error)
 	Remove(conn net.Conn) error
+	//Names the readiness API of the operating system the poller is built on, eg: kqueue
+	API() string
 }
 
 type AsyncServer struct {
 	poller      Poller
-	listener    net.Listener
+	listeners   []net.Listener
 	threadCount int
+
+	//Listeners of the TLS port, empty when TLS is disabled
+	tlsListeners []net.Listener
+
+	//Listener of the unix socket, nil when it is disabled
+	unixListener net.Listener
+
+	//Listener of the Prometheus metrics endpoint, nil when it is disabled
+	metricsListener net.Listener
 }
 
 func NewAsyncServer() *AsyncServer {
+	if err := setNotifyKeyspaceEvents(config.NotifyKeyspaceEvents); err != nil {
+		panic(err)
+	}
+	if err := initACL(); err != nil {
+		panic(err)
+	}
+	warnUnprotectedBind()
+	go sampleInstantaneousMetrics()
+	go replicationCron()
+	if err := startAppendOnlyFile(); err != nil {
+		panic(err)
+	}
+	if err := startConfiguredReplication(); err != nil {
+		panic(err)
+	}
+	if err := startRaft(); err != nil {
+		panic(err)
+	}
+	if err := startConfiguredCluster(); err != nil {
+		panic(err)
+	}
+	if err := startConfiguredSentinel(); err != nil {
+		panic(err)
+	}
+
 	//1. Create a Server Socket and fetch the FD for the server
-	serverSocketFd, listener := createServerSocket()
+	//INFO: With port 0 there is no TCP listener, the unix socket is used instead
+	serverSocketFd, listeners := createServerSocket()
+	unixSocketFd, unixListener := createUnixSocket()
+	if len(listeners) == 0 {
+		if unixListener == nil {
+			panic("port 0 disables TCP, a unixsocket is required to accept connections")
+		}
+		serverSocketFd = unixSocketFd
+	} else if unixListener != nil {
+		defer syscall.Close(unixSocketFd)
+	}
 	defer syscall.Close(serverSocketFd)
 
 	//2. Create an EPOLL instance
@@ -36,22 +86,44 @@ func NewAsyncServer() *AsyncServer {
 	if err != nil {
 		log.Println("Error Creating an Epoller instance, Err: ", err)
 	}
+	multiplexingAPI = epoller.API()
 
 	return &AsyncServer{
-		epoller, listener, 0,
+		epoller, listeners, 0, createTLSListeners(), unixListener, createMetricsListener(),
 	}
 
 }
 func (as *AsyncServer) RunInMemDBASyncServer() {
-	log.Println("Running Async TCP server on", config.Host, config.Port)
 	//Configuration to limit the number of concurrent Clients at a time
 	//maxClients := 20000
 
+	//INFO: TLS and unix socket connections are accepted on their own listener
+	//but are handled and polled like the others
+	if as.metricsListener != nil {
+		go serveMetrics(as.metricsListener)
+	}
+	for _, listener := range as.tlsListeners {
+		log.Println("Running Async TLS server on", listener.Addr())
+		go as.acceptConnections(listener)
+	}
+	if as.unixListener != nil {
+		log.Println("Running Async server on unix socket", config.UnixSocket)
+		go as.acceptConnections(as.unixListener)
+	}
+	for _, listener := range as.listeners {
+		log.Println("Running Async TCP server on", listener.Addr())
+		go as.acceptConnections(listener)
+	}
+	select {}
+}
+
+func (as *AsyncServer) acceptConnections(listener net.Listener) {
 	for {
 		//A. Start Accepting for conections
-		conn, err := as.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			log.Println("Error in establishing Client Connection, Err: ", err)
+			continue
 		}
 
 		//B. use a goroutene to process all connections as and when data is available to process.
@@ -92,82 +164,245 @@ func (as *AsyncServer) pollForConn(c net.Conn) {
 // }
 
 func (as *AsyncServer) handleAsyncConnection(clientConn net.Conn) error {
+	execMu.Lock()
+	denied := protectedModeDenied(clientConn)
+	if denied {
+		statProtectedModeRejectedConn++
+	}
+	execMu.Unlock()
+	if denied {
+		log.Println("Protected mode refused the client", clientConn.RemoteAddr())
+		clientConn.Write(response.EncodeError(errProtectedMode))
+		as.poller.Remove(clientConn)
+		return nil
+	}
+
+	client := newClient(clientConn)
+	rd := response.NewReader(inputCounter{clientConn})
+
 	//Process on the connection that is established, continuously loop over the connection to keep reading
 	//whatever is sent by the client over the TCP connection.
 	for {
-		req, err := readAsyncClientCommand(clientConn)
+		req, err := readAsyncClientCommand(rd)
 		if err != nil {
 			as.poller.Remove(clientConn)
+			client.free()
 			log.Println("Read Connection Error: ", err)
 			break
 		}
-		log.Println("Req Sent is: ", req)
-		if err = respondAsyncClient(req, clientConn); err != nil {
-			log.Println("error responding to client: ", err)
-		}
+		//INFO: The handling of the command is timed, waiting for the command is not
+		start := time.Now()
+		processCommand(client, req)
+		observeCommandHandling(time.Since(start))
 	}
 	return nil
 }
 
-func readAsyncClientCommand(c net.Conn) (*Command, error) {
-	//INFO: Max reads is 512 bytes on a single read call ,
-	//for larger inputs we keep calling readCommand until
-	//we recieve EOF from client
-	var buf []byte = make([]byte, 512)
+// Checks that the client can run the command and runs it, or queues it inside a transaction
+func processCommand(client *Client, req *Command) {
+	log.Println("Req Sent is: ", req.redacted())
 
-	//INFO: This is a blocking call and blocks until the client
-	//sends some bytes to the server over the TCP connection.
-	_, err := c.Read(buf)
+	err := client.checkAuth(req)
 	if err != nil {
-		return nil, err
+		client.reject(req, err)
+		return
+	}
+
+	//A script running for too long holds execMu, the command is answered without waiting for it
+	if reply, busy := busyScriptReply(client, req); busy {
+		client.write(reply)
+		return
+	}
+
+	if req.name() == COMMAND_QUIT {
+		client.write(response.Encode("OK", true))
+		client.closeAfterReply()
+		return
+	}
+
+	waitStart := time.Now()
+	if !lockExecMu(client, req) {
+		return
+	}
+	//INFO: Commands run one at a time, waiting for the commands of other clients stalls this one
+	latencyAddSampleIfNeeded(LATENCY_EVENT_EVENT_LOOP, time.Since(waitStart))
+	//INFO: Checked under execMu, the refresh timer of a watched query can stop it at any time
+	err = client.checkSubscriberMode(req)
+	if err == nil && client.inMulti {
+		err = client.checkPermissions(req, "multi")
+		//INFO: The keys of the commands are checked as they are queued, then together by EXEC
+		if err == nil && !isTransactionCommand(req) {
+			err = checkClusterQueued(client, req)
+		}
+		if err != nil {
+			client.multiError = true
+		}
+	} else if err == nil {
+		err = client.checkPermissions(req, "toplevel")
+	}
+	if err == nil {
+		feedMonitors(client.monitorAddr(), req)
+	}
+	execMu.Unlock()
+	if err != nil {
+		client.reject(req, err)
+		return
 	}
 
-	//INFO: The requests or commands are submitted to The server as array of strings encoded in RESP,
+	//INFO: Inside a transaction commands are only queued,
+	//they are evaluated together when the client sends EXEC.
+	if client.inMulti && !isTransactionCommand(req) {
+		client.write(client.queueCommand(req))
+		return
+	}
+	if req.name() == COMMAND_WAIT || req.name() == COMMAND_WAITAOF {
+		client.wait(req)
+		return
+	}
+	//INFO: In raft mode the writes are applied from the raft log and the reads wait for the leader to confirm it leads
+	if raftNode != nil && client.raftCommand(req) {
+		return
+	}
+
+	respondAsyncClient(client, req)
+}
+
+// Counts the bytes read from the clients
+type inputCounter struct {
+	conn net.Conn
+}
+
+func (r inputCounter) Read(p []byte) (int, error) {
+	n, err := r.conn.Read(p)
+	atomic.AddUint64(&statNetInputBytes, uint64(n))
+	return n, err
+}
+
+func readAsyncClientCommand(rd *response.Reader) (*Command, error) {
+	//INFO: This is a blocking call and blocks until the client sent a whole command over the TCP connection.
+	//The reader keeps what the client sent after it, the next commands of a pipeline are read from it.
+	//The requests or commands are submitted to The server as array of strings encoded in RESP,
 	//So the command is decoded into simple array
-	cmdTokens, err := response.DecodeInputCommand(buf)
+	cmdTokens, _, err := rd.ReadCommand()
 	if err != nil {
 		return nil, err
 	}
 
-	//INFO: we specifically mentioned the end of the buffer slice ,
-	//otherwise if the buffer is not full it can have garbage
 	return &Command{
 		Cmd:  cmdTokens[0],
 		Args: cmdTokens[1:],
 	}, nil
 }
 
-func respondAsyncClient(req *Command, c net.Conn) error {
-	data, err := req.EvalCommand()
-	if err != nil {
-		c.Write(response.EncodeError(err))
+// Evaluates the command and queues the reply, the reply is queued holding execMu
+// so that it is never sent after a message published by a command that ran later.
+func respondAsyncClient(client *Client, req *Command) {
+	if !lockExecMu(client, req) {
+		return
 	}
-	_, err = c.Write(data)
-	if err != nil {
-		c.Write(response.EncodeError(err))
+	defer execMu.Unlock()
+
+	currentClient = client
+	defer func() {
+		currentClient = nil
+		//CLIENT CACHING only applies to the command following it
+		if !(req.name() == COMMAND_CLIENT && len(req.Args) > 0 && strings.EqualFold(req.Args[0], "caching")) {
+			client.tracking.caching = false
+		}
+		//ASKING applies to the command following it, or to the transaction it starts
+		if req.name() != COMMAND_ASKING && !client.inMulti {
+			client.asking = false
+		}
+	}()
+
+	//INFO: evalCommand records its own statistics, the commands of the connection are recorded here
+	start := time.Now()
+	var reply []byte
+	switch {
+	case isTransactionCommand(req):
+		reply = client.evalTransactionCommand(req)
+		recordCall(req, time.Since(start), reply)
+	case client.isConnectionCommand(req):
+		reply = client.evalConnectionCommand(req)
+		recordCall(req, time.Since(start), reply)
+	default:
+		reply = evalCommand(req)
+	}
+	slowlogPushEntryIfNeeded(client, req, time.Since(start))
+	//INFO: WAIT and WAITAOF wait for the stream up to the last command of the client
+	client.woff = masterReplOffset
+	//INFO: Some commands of replicas have no reply
+	if reply != nil {
+		client.write(reply)
+	}
+	if client.quitting {
+		client.closeAfterReply()
 	}
-	return nil
 }
 
-func createServerSocket() (int, net.Listener) {
+func createServerSocket() (int, []net.Listener) {
 	//serverSocketFd, err := syscall.Socket(syscall.AF_INET, syscall.O_NONBLOCK|syscall.SOCK_STREAM, 0)
 	//if err != nil {
 	//	log.Println("Failed to create server socket ", err)
 	//	panic(err)
 	//}
 
-	listener, err := net.Listen("tcp", config.Host+":"+strconv.Itoa(config.Port))
-	if err != nil {
-		panic(err)
+	if config.Port == 0 {
+		return 0, nil
 	}
+	//INFO: Every bind address has its own listener, the poller is created with the first one
+	listeners := listenTCP(config.Port)
 	// Get the underlying file descriptor
-	file, err := listener.(*net.TCPListener).File()
+	file, err := listeners[0].(*net.TCPListener).File()
 	if err != nil {
 		fmt.Println("Error getting file descriptor:", err)
 		return 0, nil
 	}
 
 	// Get the integer file descriptor
-	serverSocketFd := int(file.Fd())
-	return serverSocketFd, listener
+	//INFO: The descriptor of an os.File is closed when it is garbage collected, a duplicate is returned
+	//so that closing it can not close a client socket that reused the number in the meantime
+	defer file.Close()
+	serverSocketFd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		fmt.Println("Error getting file descriptor:", err)
+		return 0, nil
+	}
+	return serverSocketFd, listeners
+}
+
+// Creates the unix socket listener with the unixsocketperm permissions, nil when no unixsocket is set
+func createUnixSocket() (int, net.Listener) {
+	if config.UnixSocket == "" {
+		return 0, nil
+	}
+
+	//A socket file left behind by a previous run would make the listen fail
+	os.Remove(config.UnixSocket)
+	listener, err := net.Listen("unix", config.UnixSocket)
+	if err != nil {
+		panic(err)
+	}
+	if config.UnixSocketPerm != "" {
+		perm, err := strconv.ParseUint(config.UnixSocketPerm, 8, 32)
+		if err != nil {
+			panic("invalid unixsocketperm, it must be an octal mode like 700: " + config.UnixSocketPerm)
+		}
+		if err = os.Chmod(config.UnixSocket, os.FileMode(perm)); err != nil {
+			panic(err)
+		}
+	}
+
+	file, err := listener.(*net.UnixListener).File()
+	if err != nil {
+		panic(err)
+	}
+	//INFO: The descriptor of an os.File is closed when it is garbage collected, a duplicate is returned
+	//so that closing it can not close a client socket that reused the number in the meantime
+	defer file.Close()
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		panic(err)
+	}
+	return fd, listener
 }
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+func TestUnixSocket(t *testing.T) {
+	setupTestServer(t)
+	config.UnixSocket = filepath.Join(t.TempDir(), "inmem.sock")
+	config.UnixSocketPerm = "700"
+
+	//A socket file left behind by a previous run is replaced
+	if err := os.WriteFile(config.UnixSocket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, listener := createUnixSocket()
+	defer listener.Close()
+	syscall.Close(fd)
+
+	info, err := os.Stat(config.UnixSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0700 {
+		t.Errorf("unexpected mode %v", info.Mode())
+	}
+
+	conn, err := net.Dial("unix", config.UnixSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConns = append(testConns, conn)
+	serverConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveTestConn(serverConn)
+
+	//Unix socket clients are local, protected mode serves them
+	c := &testClient{t, conn}
+	c.expect(replyPONG, "PING")
+}
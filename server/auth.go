@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/inmemdb/inmem/server/acl"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Authentication:
+	- While the default user has a password (set with requirepass or ACL SETUSER) or is disabled,
+	  a connection must authenticate before running any command but AUTH, HELLO and QUIT,
+	  the other commands fail with NOAUTH
+	- AUTH password authenticates as the default user, AUTH username password as any ACL user
+	- HELLO protover AUTH username password authenticates and switches protocol at once
+AUTH, HELLO and QUIT are not subject to the ACL rules of the user, so a client can still log in as another
+user when the default user is disabled or can not run any command.
+*/
+
+var (
+	errNoAuth    = errors.New("NOAUTH Authentication required.")
+	errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+)
+
+// Tells if a new connection has to authenticate first, must be called holding execMu
+func authRequired() bool {
+	u := users.User(acl.DefaultUser)
+	return !u.Enabled() || !u.NoPass()
+}
+
+// Authenticates the client as the user, must be called holding execMu
+func (c *Client) authenticate(username string, password string) error {
+	if !users.Authenticate(username, password) {
+		addACLLogEntry(c, "auth", "toplevel", "AUTH", username)
+		return errWrongPass
+	}
+	c.authenticated = true
+	c.user = username
+	return nil
+}
+
+func (c *Client) auth(args []string) []byte {
+	if len(args) > 2 {
+		return response.EncodeError(errors.New("ERR syntax error"))
+	}
+	username, password := acl.DefaultUser, args[0]
+	if len(args) == 2 {
+		username, password = args[0], args[1]
+	} else if !authRequired() {
+		return response.EncodeError(errors.New("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"))
+	}
+
+	if err := c.authenticate(username, password); err != nil {
+		return response.EncodeError(err)
+	}
+	return response.Encode("OK", true)
+}
+
+// Only the commands flagged CMD_FLAG_NOAUTH (AUTH, HELLO and QUIT) can be run before authenticating
+func (c *Client) checkAuth(cmd *Command) error {
+	if c.authenticated || commandTable[cmd.name()].flags&CMD_FLAG_NOAUTH != 0 {
+		return nil
+	}
+	return errNoAuth
+}
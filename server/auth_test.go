@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+func TestRequirePass(t *testing.T) {
+	setupTestServer(t)
+	config.RequirePass = "secret"
+	execMu.Lock()
+	err := initACL()
+	execMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := connect(t)
+
+	c.expectError("NOAUTH", "PING")
+	c.expectError("NOAUTH", "SIM.ADD", "a", "x")
+	c.expectError("WRONGPASS", "AUTH", "nope")
+	c.expectError("WRONGPASS", "AUTH", "alice", "secret")
+	c.expect(replyOK, "AUTH", "secret")
+	c.expect(replyPONG, "PING")
+
+	c = connect(t)
+	c.expect(replyOK, "AUTH", "default", "secret")
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+
+	c = connect(t)
+	c.expectError("NOAUTH HELLO must be called with the client already authenticated", "HELLO", "2")
+	if _, ok := c.do("HELLO", "2", "AUTH", "default", "secret").([]interface{}); !ok {
+		t.Error("HELLO AUTH did not authenticate")
+	}
+	c.expect(replyPONG, "PING")
+
+	connect(t).expect(replyOK, "QUIT")
+}
+
+func TestAuthWithoutPassword(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(replyPONG, "PING")
+	c.expectError("ERR AUTH <password> called without any password configured", "AUTH", "secret")
+	c.expect(replyOK, "AUTH", "default", "anything")
+	c.expectError("ERR syntax error", "AUTH", "a", "b", "c")
+}
+
+// The sync server can not authenticate clients, it refuses to run with a password
+func TestSyncServerWithPassword(t *testing.T) {
+	setupTestServer(t)
+	if err := checkSyncServerConfig(); err != nil {
+		t.Errorf("the sync server refused to run without a password: %v", err)
+	}
+	config.RequirePass = "secret"
+	if checkSyncServerConfig() != errSyncAuth {
+		t.Error("the sync server accepted requirepass")
+	}
+	config.RequirePass, config.ACLFile = "", "users.acl"
+	if checkSyncServerConfig() != errSyncAuth {
+		t.Error("the sync server accepted an aclfile")
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+/**
+The replication backlog keeps the end of the replication stream in a circular buffer of repl-backlog-size bytes.
+A replica that reconnects sends PSYNC with the offset of the next byte it needs, offsets are counted from 1
+like in redis. When the backlog still holds that byte the master only sends the rest of the stream (+CONTINUE)
+instead of a snapshot of the whole dataset (+FULLRESYNC).
+*/
+
+type replicationBacklog struct {
+	buf []byte
+	//Position in buf of the next byte written
+	idx int
+	//Number of bytes of the stream held
+	histlen int
+	//Offset of the first byte held
+	offset int64
+}
+
+// Creates a backlog whose first byte will be at offset
+func newReplicationBacklog(size int, offset int64) *replicationBacklog {
+	if size < 1 {
+		size = 1
+	}
+	return &replicationBacklog{buf: make([]byte, size), offset: offset}
+}
+
+func (b *replicationBacklog) feed(data []byte) {
+	//INFO: Only the end of data fits when it is larger than the backlog
+	if skipped := len(data) - len(b.buf); skipped > 0 {
+		b.offset += int64(b.histlen + skipped)
+		b.histlen = 0
+		data = data[skipped:]
+	}
+	for len(data) > 0 {
+		n := copy(b.buf[b.idx:], data)
+		data = data[n:]
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen += n
+	}
+	if overflow := b.histlen - len(b.buf); overflow > 0 {
+		b.offset += int64(overflow)
+		b.histlen = len(b.buf)
+	}
+}
+
+// Tells if the stream can be continued from offset, the offset right after the last byte held included
+func (b *replicationBacklog) contains(offset int64) bool {
+	return offset >= b.offset && offset <= b.offset+int64(b.histlen)
+}
+
+// Returns a copy of the stream from offset, which must be contained in the backlog
+func (b *replicationBacklog) from(offset int64) []byte {
+	n := int(b.offset + int64(b.histlen) - offset)
+	start := (b.idx - n + len(b.buf)) % len(b.buf)
+	data := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		return append(data, b.buf[start:start+n]...)
+	}
+	data = append(data, b.buf[start:]...)
+	return append(data, b.buf[:n-(len(b.buf)-start)]...)
+}
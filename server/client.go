@@ -0,0 +1,166 @@
+package server
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/inmemdb/inmem/server/acl"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Maximum number of replies and pushes waiting to be written to a client,
+// a client that does not read fast enough is disconnected once it is reached.
+const clientOutputQueueLen = 1024
+
+var (
+	//Id of the last connected client, ids are never reused
+	lastClientID uint64
+
+	//The connected clients by id, guarded by execMu
+	clients = map[uint64]*Client{}
+
+	//The client whose command is running, guarded by execMu.
+	//It is nil while nothing runs on behalf of a client, eg: when a watched query is refreshed.
+	currentClient *Client
+)
+
+// Client holds the state of a single client connection to the AsyncServer
+type Client struct {
+	id   uint64
+	conn net.Conn
+
+	//RESP protocol version negotiated with HELLO
+	resp int
+
+	//Set once the client authenticated with AUTH or HELLO, or right away when no password is required
+	authenticated bool
+	//The ACL user the client is authenticated as
+	user string
+
+	//Name set with CLIENT SETNAME or HELLO SETNAME
+	name string
+
+	//Set when the connection is closed once the reply of the running command is sent
+	quitting bool
+
+	//INFO: Everything sent to the client goes through the output queue and is written by writeLoop.
+	//Pub/sub messages are pushed by the clients publishing them, the queue keeps them in order
+	//with the replies of the client and keeps a slow client from blocking the publisher.
+	out  chan []byte
+	done chan struct{}
+
+	//INFO: Transaction state
+	//Commands sent after MULTI are queued in multiQueue until EXEC or DISCARD.
+	inMulti    bool
+	multiQueue []*Command
+
+	//Set when a command could not be queued, EXEC then discards the transaction
+	multiError bool
+
+	//Set when one of the keys WATCHed by the client is modified,
+	//EXEC then replies with a null array instead of running the transaction
+	dirtyCAS    bool
+	watchedKeys map[string]struct{}
+
+	//Pub/sub channels and patterns the client is subscribed to
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	//Queries watched with WATCHQUERY by id
+	queries     map[int64]*watchedQuery
+	lastQueryID int64
+
+	//Client side caching state set by CLIENT TRACKING
+	tracking tracking
+
+	//Set by ASKING, the next command is served in a slot the node imports. Inside a transaction it lasts until EXEC.
+	asking bool
+
+	//Replication state when the client is a replica
+	replica replicaState
+	//Replication offset after the last command of the client, waited for by WAIT and WAITAOF
+	woff int64
+}
+
+func newClient(conn net.Conn) *Client {
+	c := &Client{
+		id:          atomic.AddUint64(&lastClientID, 1),
+		conn:        conn,
+		resp:        2,
+		user:        acl.DefaultUser,
+		out:         make(chan []byte, clientOutputQueueLen),
+		done:        make(chan struct{}),
+		watchedKeys: make(map[string]struct{}),
+		channels:    make(map[string]struct{}),
+		patterns:    make(map[string]struct{}),
+		queries:     make(map[int64]*watchedQuery),
+	}
+	go c.writeLoop()
+
+	execMu.Lock()
+	clients[c.id] = c
+	statNumConnections++
+	c.authenticated = !authRequired()
+	execMu.Unlock()
+	return c
+}
+
+// Queues data to be sent to the client
+func (c *Client) write(data []byte) {
+	select {
+	case c.out <- data:
+	default:
+		//INFO: Closing the connection makes the read loop of the client fail, which frees the client
+		log.Println("Closing client that reached the output buffer limit:", c.conn.RemoteAddr())
+		c.conn.Close()
+	}
+}
+
+// Replies with the error to a command refused before running
+func (c *Client) reject(cmd *Command, err error) {
+	execMu.Lock()
+	recordRejectedCall(cmd)
+	execMu.Unlock()
+	c.write(response.EncodeError(err))
+}
+
+// Closes the connection once everything queued before has been written
+func (c *Client) closeAfterReply() {
+	c.write(nil)
+}
+
+func (c *Client) writeLoop() {
+	for {
+		select {
+		case data := <-c.out:
+			if data == nil {
+				c.conn.Close()
+				return
+			}
+			n, err := c.conn.Write(data)
+			atomic.AddUint64(&statNetOutputBytes, uint64(n))
+			if err != nil {
+				log.Println("error responding to client: ", err)
+				c.conn.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Releases all server wide state held for the client once the connection is gone
+func (c *Client) free() {
+	execMu.Lock()
+	defer execMu.Unlock()
+	c.unwatchAllKeys()
+	c.unsubscribeAll()
+	c.unwatchAllQueries()
+	c.disableTracking()
+	delete(monitors, c)
+	delete(replicas, c)
+	delete(clients, c.id)
+	close(c.done)
+}
@@ -0,0 +1,1002 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Cluster mode, enabled by cluster-enabled, shards the keys over the nodes of a cluster like redis cluster does:
+	- the keyspace is split in 16384 hash slots, the slot of a key is the CRC16 of the key modulo 16384. When
+	  the key has a non empty part between its first { and the next } only that part is hashed, so that keys
+	  sharing this hash tag are in the same slot.
+	- every slot is served by a master. A command whose keys are in a slot of another node is refused with
+	  -MOVED <slot> <ip:port> of the node serving it, the keys of a command must all be in the same slot or it
+	  is refused with -CROSSSLOT, and the commands with keys are refused with -CLUSTERDOWN while a slot is not
+	  served. The redirections are checked before Command.EvalCommand runs the command of a client. The
+	  commands queued in a transaction are checked when queued, then together by EXEC.
+	- the nodes know each other through the cluster bus (see cluster_bus.go). CLUSTER MEET <ip> <port>
+	  introduces a node, the nodes then gossip about the nodes they know so that every node knows every other.
+	- CLUSTER ADDSLOTS and ADDSLOTSRANGE assign slots to the node, DELSLOTS and DELSLOTSRANGE unassign them,
+	  the slots of a node are announced to the others on the bus. When two nodes claim a slot the node with
+	  the greater config epoch gets it, two masters with the same config epoch make the one with the smaller
+	  id take a new epoch.
+	- a slot is moved to another node key by key with CLUSTER SETSLOT and MIGRATE, see clusterSetSlot and
+	  clusterRedirect
+	- CLUSTER REPLICATE makes the node a replica of a master, a failing master is replaced by one of its
+	  replicas and CLUSTER FAILOVER makes a replica take over its master, see cluster_failover.go
+	- the state of the cluster is kept in memory, a node that restarts joins the cluster as a new node
+CLUSTER MYID, NODES, REPLICAS, SLOTS, SHARDS, INFO, KEYSLOT, COUNTKEYSINSLOT, GETKEYSINSLOT and
+COUNT-FAILURE-REPORTS report the state of the cluster. The state of the cluster is guarded by execMu.
+*/
+
+const CLUSTER_SLOTS = 16384
+
+// Flags of the nodes, as reported by CLUSTER NODES
+const (
+	CLUSTER_NODE_MYSELF = 1 << iota
+	CLUSTER_NODE_MASTER
+	CLUSTER_NODE_REPLICA
+	CLUSTER_NODE_PFAIL
+	CLUSTER_NODE_FAIL
+	CLUSTER_NODE_HANDSHAKE
+	CLUSTER_NODE_NOADDR
+	//The node is sent a MEET instead of a PING, it does not know this node yet
+	CLUSTER_NODE_MEET
+)
+
+var clusterNodeFlagNames = []struct {
+	flag int
+	name string
+}{
+	{CLUSTER_NODE_MYSELF, "myself"},
+	{CLUSTER_NODE_MASTER, "master"},
+	{CLUSTER_NODE_REPLICA, "slave"},
+	{CLUSTER_NODE_PFAIL, "fail?"},
+	{CLUSTER_NODE_FAIL, "fail"},
+	{CLUSTER_NODE_HANDSHAKE, "handshake"},
+	{CLUSTER_NODE_NOADDR, "noaddr"},
+}
+
+// How often the cluster cron runs
+const clusterCronPeriod = 100 * time.Millisecond
+
+type clusterNode struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	flags   int
+	//The master of a replica
+	master      *clusterNode
+	slots       [CLUSTER_SLOTS / 8]byte
+	numSlots    int
+	configEpoch uint64
+
+	//When the node was created, a handshake that does not complete in time is dropped
+	ctime time.Time
+	//When the last PING was sent, pingSent is reset by the PONG answering it
+	lastPing     time.Time
+	pingSent     time.Time
+	pongReceived time.Time
+	link         *clusterLink
+
+	//The replication offset the node announced
+	replOffset int64
+	//When the node was flagged as failing, and when the masters that reported it as failing did
+	failTime    time.Time
+	failReports map[*clusterNode]time.Time
+	//When this node last voted for a replica of this master
+	votedTime time.Time
+}
+
+type clusterState struct {
+	myself       *clusterNode
+	currentEpoch uint64
+	nodes        map[string]*clusterNode
+	slots        [CLUSTER_SLOTS]*clusterNode
+	//The node a slot of this node is migrated to, and the node a slot is imported from
+	migrating [CLUSTER_SLOTS]*clusterNode
+	importing [CLUSTER_SLOTS]*clusterNode
+	//The keys of every slot
+	slotKeys [CLUSTER_SLOTS]map[string]struct{}
+
+	listener net.Listener
+	//The connections accepted on the bus, closed with the cluster
+	inbound map[net.Conn]struct{}
+	stop    chan struct{}
+
+	statsSent     uint64
+	statsReceived uint64
+
+	//The election of this replica: when it starts, the epoch it was started in and the votes received
+	failoverAuthTime  time.Time
+	failoverAuthEpoch uint64
+	failoverAuthCount int
+	failoverAuthSent  bool
+	failoverAuthRank  int
+	//The last epoch this master voted in
+	lastVoteEpoch uint64
+
+	//The end of the manual failover running, zero when none runs. The master pauses its writes for the replica
+	//taking over, the replica waits until it processed the stream up to the offset of the paused master.
+	mfEnd          time.Time
+	mfReplica      *clusterNode
+	mfMasterOffset int64
+	mfCanStart     bool
+}
+
+var (
+	//The state of the cluster, nil when cluster mode is disabled. Guarded by execMu.
+	cluster *clusterState
+
+	errClusterDisabled = errors.New("ERR This instance has cluster support disabled")
+	errCrossSlot       = errors.New("CROSSSLOT Keys in request don't hash to the same slot")
+	errClusterDown     = errors.New("CLUSTERDOWN The cluster is down")
+	errSlotUnbound     = errors.New("CLUSTERDOWN Hash slot not served")
+	errInvalidSlot     = errors.New("ERR Invalid or out of range slot")
+	errTryAgain        = errors.New("TRYAGAIN Multiple keys request during rehashing of slot")
+	errSetSlotSyntax   = errors.New("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+)
+
+// CRC16 of the XMODEM variant, the one of redis cluster
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc ^= uint16(data[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// The slot of the key, only its hash tag is hashed when it has one
+func keyHashSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) & (CLUSTER_SLOTS - 1))
+}
+
+func newClusterNode(id string, flags int) *clusterNode {
+	return &clusterNode{id: id, flags: flags, ctime: time.Now()}
+}
+
+func (n *clusterNode) hasSlot(slot int) bool {
+	return n.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (n *clusterNode) addr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.port))
+}
+
+func (n *clusterNode) busAddr() string {
+	return net.JoinHostPort(n.ip, strconv.Itoa(n.busPort))
+}
+
+func (n *clusterNode) isMaster() bool {
+	return n.flags&CLUSTER_NODE_MASTER != 0
+}
+
+func (n *clusterNode) flagNames() string {
+	var names []string
+	for _, f := range clusterNodeFlagNames {
+		if n.flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+// Assigns the slot to the node, must be called holding execMu
+func clusterAddSlot(n *clusterNode, slot int) {
+	if owner := cluster.slots[slot]; owner != nil {
+		clusterDelSlot(slot)
+	}
+	cluster.slots[slot] = n
+	n.slots[slot/8] |= 1 << (slot % 8)
+	n.numSlots++
+}
+
+// Unassigns the slot, must be called holding execMu
+func clusterDelSlot(slot int) {
+	n := cluster.slots[slot]
+	if n == nil {
+		return
+	}
+	cluster.slots[slot] = nil
+	n.slots[slot/8] &^= 1 << (slot % 8)
+	n.numSlots--
+}
+
+// Unassigns all the slots of the node, must be called holding execMu
+func clusterDelNodeSlots(n *clusterNode) {
+	for slot := 0; slot < CLUSTER_SLOTS && n.numSlots > 0; slot++ {
+		if cluster.slots[slot] == n {
+			clusterDelSlot(slot)
+		}
+	}
+}
+
+// Forgets the node, must be called holding execMu
+func clusterDelNode(n *clusterNode) {
+	if n.link != nil {
+		n.link.close()
+		n.link = nil
+	}
+	clusterDelNodeSlots(n)
+	for _, other := range cluster.nodes {
+		if other.master == n {
+			other.master = nil
+		}
+		delete(other.failReports, n)
+	}
+	if cluster.mfReplica == n {
+		clusterResetManualFailover()
+	}
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if cluster.migrating[slot] == n {
+			cluster.migrating[slot] = nil
+		}
+		if cluster.importing[slot] == n {
+			cluster.importing[slot] = nil
+		}
+	}
+	delete(cluster.nodes, n.id)
+}
+
+// The cluster is ok when every slot is served by a node that is not failing
+func clusterStateOK() bool {
+	for _, n := range cluster.slots {
+		if n == nil || n.flags&CLUSTER_NODE_FAIL != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Keeps the keys of every slot, must be called holding execMu when a key is created
+func clusterAddKey(key string) {
+	slot := keyHashSlot(key)
+	if cluster.slotKeys[slot] == nil {
+		cluster.slotKeys[slot] = map[string]struct{}{}
+	}
+	cluster.slotKeys[slot][key] = struct{}{}
+}
+
+// Must be called holding execMu when a key is deleted
+func clusterDelKey(key string) {
+	delete(cluster.slotKeys[keyHashSlot(key)], key)
+}
+
+// Deletes the keys of a slot this node no longer serves, the deletes are propagated. Must be called holding execMu.
+func clusterDelKeysInSlot(slot int) {
+	beginPropagation()
+	defer endPropagation()
+	for key := range cluster.slotKeys[slot] {
+		deleteKey(key)
+		signalModifiedKey(key)
+		notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		propagate(&Command{Cmd: "DEL", Args: []string{key}})
+	}
+}
+
+// Indexes the keys of the keyspace by slot, must be called holding execMu when the keyspace is replaced
+func clusterIndexKeys() {
+	cluster.slotKeys = [CLUSTER_SLOTS]map[string]struct{}{}
+	for key := range keyspace {
+		clusterAddKey(key)
+	}
+}
+
+// The port of the cluster bus
+func clusterBusPort() int {
+	if config.ClusterPort != 0 {
+		return config.ClusterPort
+	}
+	return config.Port + 10000
+}
+
+// Starts cluster mode when cluster-enabled is set
+func startConfiguredCluster() error {
+	if !config.ClusterEnabled {
+		return nil
+	}
+	if config.RaftID != 0 {
+		return errors.New("cluster-enabled can not be used in raft mode")
+	}
+	listener, err := listenBus(net.JoinHostPort("", strconv.Itoa(clusterBusPort())))
+	if err != nil {
+		return err
+	}
+	startCluster(listener)
+	return nil
+}
+
+// Starts the cluster as a new node serving no slot, the other nodes connect to the listener
+func startCluster(listener net.Listener) {
+	execMu.Lock()
+	defer execMu.Unlock()
+	myself := newClusterNode(randomHex(40), CLUSTER_NODE_MYSELF|CLUSTER_NODE_MASTER)
+	myself.ip = config.ClusterAnnounceIP
+	myself.port = config.Port
+	myself.busPort = listener.Addr().(*net.TCPAddr).Port
+	cluster = &clusterState{
+		myself:   myself,
+		nodes:    map[string]*clusterNode{myself.id: myself},
+		listener: listener,
+		inbound:  map[net.Conn]struct{}{},
+		stop:     make(chan struct{}),
+
+		mfMasterOffset: -1,
+	}
+	clusterIndexKeys()
+	log.Printf("Cluster node %s, the cluster bus listens on port %d", myself.id, myself.busPort)
+	go acceptClusterConns(cluster, listener)
+	go clusterCron(cluster.stop)
+}
+
+// Stops cluster mode, the links and the listener of the bus are closed
+func stopCluster() {
+	execMu.Lock()
+	defer execMu.Unlock()
+	if cluster == nil {
+		return
+	}
+	close(cluster.stop)
+	cluster.listener.Close()
+	for conn := range cluster.inbound {
+		conn.Close()
+	}
+	for _, n := range cluster.nodes {
+		if n.link != nil {
+			n.link.close()
+		}
+	}
+	cluster = nil
+}
+
+func clusterCron(stop <-chan struct{}) {
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		execMu.Lock()
+		if cluster != nil {
+			now := time.Now()
+			clusterCronOnce(now)
+			clusterHandleManualFailover(now)
+			clusterHandleReplicaFailover(now)
+		}
+		execMu.Unlock()
+	}
+}
+
+func clusterNodeTimeout() time.Duration {
+	return time.Duration(config.ClusterNodeTimeout) * time.Millisecond
+}
+
+// Every node is pinged every second, or twice per node timeout when it is shorter
+func clusterPingPeriod() time.Duration {
+	if period := clusterNodeTimeout() / 2; period < time.Second {
+		return period
+	}
+	return time.Second
+}
+
+/**
+Connects to the nodes without a link, drops the handshakes that did not complete within the node timeout and
+pings the nodes every ping period. A link whose PING is not answered within half the node timeout is closed, so
+that the node is connected again. A node that does not answer within the node timeout is flagged PFAIL, it
+possibly fails. Must be called holding execMu.
+*/
+func clusterCronOnce(now time.Time) {
+	timeout := clusterNodeTimeout()
+	for _, n := range cluster.nodes {
+		if n == cluster.myself || n.flags&CLUSTER_NODE_NOADDR != 0 {
+			continue
+		}
+		if n.flags&CLUSTER_NODE_HANDSHAKE != 0 && now.Sub(n.ctime) > timeout {
+			log.Printf("Cluster handshake with %s timed out", n.busAddr())
+			clusterDelNode(n)
+			continue
+		}
+		if n.flags&CLUSTER_NODE_HANDSHAKE == 0 && !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout && n.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0 {
+			log.Printf("*** NODE %s possibly failing", n.id)
+			n.flags |= CLUSTER_NODE_PFAIL
+			clusterMarkFailingIfNeeded(n, now)
+		}
+		if n.link == nil {
+			//INFO: The node must answer within the node timeout from now, even when it can not be connected
+			if n.pingSent.IsZero() {
+				n.pingSent = now
+			}
+			n.link = newClusterLink(n)
+			continue
+		}
+		if !n.link.connected {
+			continue
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout/2 && now.Sub(n.link.ctime) > timeout/2 {
+			n.link.close()
+			n.link = nil
+			continue
+		}
+		if n.pingSent.IsZero() && now.Sub(n.lastPing) >= clusterPingPeriod() {
+			clusterSendPing(n, CLUSTER_MSG_PING)
+		}
+	}
+}
+
+// Introduces the node at the address, it is sent a MEET once connected. Must be called holding execMu.
+func clusterStartHandshake(ip string, port int, busPort int) {
+	for _, n := range cluster.nodes {
+		if n.flags&CLUSTER_NODE_HANDSHAKE != 0 && n.ip == ip && n.port == port && n.busPort == busPort {
+			return
+		}
+	}
+	n := newClusterNode(randomHex(40), CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_MEET)
+	n.ip, n.port, n.busPort = ip, port, busPort
+	cluster.nodes[n.id] = n
+}
+
+/**
+Returns the error redirecting the client when the keys of the commands are not served by this node, asking is
+set when the client sent ASKING. While a slot is migrated:
+	- the node migrating it serves the keys it still has, the client is sent -ASK to the node importing the
+	  slot for the keys already moved
+	- the node importing it serves the commands following ASKING, the other commands are sent -MOVED to the
+	  node still serving the slot
+A command with keys both moved and not moved yet is refused with -TRYAGAIN. Must be called holding execMu.
+*/
+func clusterRedirect(cmds []*Command, asking bool) error {
+	slot := -1
+	var keys []string
+	for _, cmd := range cmds {
+		for _, key := range cmd.keys() {
+			if s := keyHashSlot(key); slot == -1 {
+				slot = s
+			} else if s != slot {
+				return errCrossSlot
+			}
+			keys = append(keys, key)
+		}
+		if commandTable[cmd.name()].flags&CMD_FLAG_ASKING != 0 {
+			asking = true
+		}
+	}
+	if slot == -1 {
+		return nil
+	}
+	if !clusterStateOK() {
+		return errClusterDown
+	}
+	n := cluster.slots[slot]
+	if n == nil {
+		return errSlotUnbound
+	}
+	migrating := n == cluster.myself && cluster.migrating[slot] != nil
+	importing := cluster.importing[slot] != nil
+	missing := 0
+	if migrating || importing {
+		for _, key := range keys {
+			if _, ok := keyspace[key]; !ok {
+				missing++
+			}
+		}
+	}
+	switch {
+	case migrating && missing > 0:
+		if missing < len(keys) {
+			return errTryAgain
+		}
+		return fmt.Errorf("ASK %d %s", slot, cluster.migrating[slot].addr())
+	case importing && asking:
+		if len(keys) > 1 && missing > 0 {
+			return errTryAgain
+		}
+		return nil
+	case n != cluster.myself:
+		return fmt.Errorf("MOVED %d %s", slot, n.addr())
+	}
+	return nil
+}
+
+// Redirects the commands of clients whose keys are not served by this node, must be called holding execMu
+func checkClusterRedirect(cmds ...*Command) error {
+	if cluster == nil || currentClient == nil || applyingMasterStream {
+		return nil
+	}
+	return clusterRedirect(cmds, currentClient.asking)
+}
+
+// Redirects a command the client queues in a transaction, must be called holding execMu
+func checkClusterQueued(c *Client, cmd *Command) error {
+	//INFO: The arity is checked first, the keys of a command with too few arguments are unknown
+	if cluster == nil || cmd.checkArity() != nil {
+		return nil
+	}
+	return clusterRedirect([]*Command{cmd}, c.asking)
+}
+
+// Parses a slot argument
+func parseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= CLUSTER_SLOTS {
+		return 0, errInvalidSlot
+	}
+	return slot, nil
+}
+
+// Parses the slots of ADDSLOTS and DELSLOTS, or the ranges of ADDSLOTSRANGE and DELSLOTSRANGE
+func parseSlots(sub string, args []string) ([]int, error) {
+	ranges := strings.HasSuffix(sub, "range")
+	if ranges && len(args)%2 != 0 {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", sub)
+	}
+	var slots []int
+	seen := map[int]bool{}
+	for i := 0; i < len(args); i++ {
+		start, err := parseSlot(args[i])
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if ranges {
+			i++
+			if end, err = parseSlot(args[i]); err != nil {
+				return nil, err
+			}
+			if start > end {
+				return nil, fmt.Errorf("ERR start slot number %d is greater than end slot number %d", start, end)
+			}
+		}
+		for slot := start; slot <= end; slot++ {
+			if seen[slot] {
+				return nil, fmt.Errorf("ERR Slot %d specified multiple times", slot)
+			}
+			seen[slot] = true
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// The arity of the subcommands of CLUSTER, counting CLUSTER and the subcommand
+var clusterSubcommandArity = map[string]int{
+	"myid": 2, "meet": -4, "addslots": -3, "addslotsrange": -4, "delslots": -3, "delslotsrange": -4,
+	"nodes": 2, "slots": 2, "shards": 2, "info": 2, "keyslot": 3, "countkeysinslot": 3, "getkeysinslot": 4,
+	"setslot": -4, "replicate": 3, "replicas": 3, "slaves": 3, "failover": -2, "count-failure-reports": 3,
+}
+
+func (cmd *Command) evalCLUSTER() ([]byte, error) {
+	if cluster == nil {
+		return nil, errClusterDisabled
+	}
+	sub := strings.ToLower(cmd.Args[0])
+	arity, ok := clusterSubcommandArity[sub]
+	if !ok {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", cmd.Args[0])
+	}
+	tokens := len(cmd.Args) + 1
+	if (arity > 0 && tokens != arity) || (arity < 0 && tokens < -arity) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'cluster|%s' command", sub)
+	}
+	args := cmd.Args[1:]
+
+	switch sub {
+	case "myid":
+		return response.Encode(cluster.myself.id, false), nil
+	case "meet":
+		return clusterMeet(args)
+	case "setslot":
+		return clusterSetSlot(args)
+	case "replicate":
+		return clusterReplicate(args[0])
+	case "failover":
+		return clusterFailover(args)
+	case "addslots", "addslotsrange":
+		slots, err := parseSlots(sub, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			if cluster.slots[slot] != nil {
+				return nil, fmt.Errorf("ERR Slot %d is already busy", slot)
+			}
+		}
+		for _, slot := range slots {
+			clusterAddSlot(cluster.myself, slot)
+		}
+		return response.Encode("OK", true), nil
+	case "delslots", "delslotsrange":
+		slots, err := parseSlots(sub, args)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			if cluster.slots[slot] == nil {
+				return nil, fmt.Errorf("ERR Slot %d is already unassigned", slot)
+			}
+		}
+		for _, slot := range slots {
+			clusterDelSlot(slot)
+		}
+		return response.Encode("OK", true), nil
+	case "nodes":
+		return response.Encode(clusterNodesDescription(), false), nil
+	case "replicas", "slaves":
+		n := cluster.nodes[args[0]]
+		if n == nil || n.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+			return nil, fmt.Errorf("ERR Unknown node %s", args[0])
+		}
+		if !n.isMaster() {
+			return nil, errors.New("ERR The specified node is not a master")
+		}
+		replicas := n.replicas()
+		replies := make([][]byte, len(replicas))
+		for i, replica := range replicas {
+			replies[i] = response.Encode(clusterNodeDescription(replica), false)
+		}
+		return response.EncodeArray(replies), nil
+	case "count-failure-reports":
+		n := cluster.nodes[args[0]]
+		if n == nil {
+			return nil, fmt.Errorf("ERR Unknown node %s", args[0])
+		}
+		return response.Encode(clusterFailureReports(n, time.Now()), false), nil
+	case "slots":
+		return clusterSlotsReply(), nil
+	case "shards":
+		return clusterShardsReply(), nil
+	case "info":
+		return response.Encode(strings.Join(clusterInfoLines(), "\r\n")+"\r\n", false), nil
+	case "keyslot":
+		return response.Encode(keyHashSlot(args[0]), false), nil
+	case "countkeysinslot":
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return response.Encode(len(cluster.slotKeys[slot]), false), nil
+	default:
+		slot, err := parseSlot(args[0])
+		if err != nil {
+			return nil, err
+		}
+		count, err := strconv.Atoi(args[1])
+		if err != nil || count < 0 {
+			return nil, errors.New("ERR Invalid number of keys")
+		}
+		keys := make([]string, 0, len(cluster.slotKeys[slot]))
+		for key := range cluster.slotKeys[slot] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > count {
+			keys = keys[:count]
+		}
+		replies := make([][]byte, len(keys))
+		for i, key := range keys {
+			replies[i] = response.Encode(key, false)
+		}
+		return response.EncodeArray(replies), nil
+	}
+}
+
+// CLUSTER MEET <ip> <port> [<bus port>]
+func clusterMeet(args []string) ([]byte, error) {
+	if len(args) > 3 {
+		return nil, errors.New("ERR wrong number of arguments for 'cluster|meet' command")
+	}
+	ip := net.ParseIP(args[0])
+	port, err := strconv.Atoi(args[1])
+	busPort := port + 10000
+	if err == nil && len(args) == 3 {
+		busPort, err = strconv.Atoi(args[2])
+	}
+	if ip == nil || err != nil || port <= 0 || port > 65535 || busPort <= 0 || busPort > 65535 {
+		return nil, fmt.Errorf("ERR Invalid node address specified: %s:%s", args[0], args[1])
+	}
+	clusterStartHandshake(ip.String(), port, busPort)
+	return response.Encode("OK", true), nil
+}
+
+/**
+CLUSTER SETSLOT <slot> IMPORTING <node id> | MIGRATING <node id> | NODE <node id> | STABLE
+A slot is moved by making the node it is moved to import it and the node serving it migrate it, then the keys are
+moved with MIGRATE and both nodes are told the node now serving the slot with SETSLOT NODE. The node importing the
+slot takes a new config epoch so that the other nodes take the slot from the node that served it.
+*/
+func clusterSetSlot(args []string) ([]byte, error) {
+	slot, err := parseSlot(args[0])
+	if err != nil {
+		return nil, err
+	}
+	action := strings.ToLower(args[1])
+	if action == "stable" {
+		if len(args) != 2 {
+			return nil, errSetSlotSyntax
+		}
+		cluster.migrating[slot], cluster.importing[slot] = nil, nil
+		return response.Encode("OK", true), nil
+	}
+	if len(args) != 3 || (action != "migrating" && action != "importing" && action != "node") {
+		return nil, errSetSlotSyntax
+	}
+	n := cluster.nodes[args[2]]
+	if n == nil || n.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+		return nil, fmt.Errorf("ERR I don't know about node %s", args[2])
+	}
+	if !n.isMaster() {
+		return nil, errors.New("ERR Target node is not a master")
+	}
+	myself := cluster.myself
+	switch action {
+	case "migrating":
+		if cluster.slots[slot] != myself {
+			return nil, fmt.Errorf("ERR I'm not the owner of hash slot %d", slot)
+		}
+		if n == myself {
+			return nil, errors.New("ERR Can't migrate a hash slot to myself")
+		}
+		cluster.migrating[slot] = n
+	case "importing":
+		if cluster.slots[slot] == myself {
+			return nil, fmt.Errorf("ERR I'm already the owner of hash slot %d", slot)
+		}
+		cluster.importing[slot] = n
+	default:
+		if cluster.slots[slot] == myself && n != myself && len(cluster.slotKeys[slot]) > 0 {
+			return nil, fmt.Errorf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot)
+		}
+		if n != myself {
+			cluster.migrating[slot] = nil
+		}
+		clusterAddSlot(n, slot)
+		if n == myself && cluster.importing[slot] != nil {
+			cluster.importing[slot] = nil
+			cluster.currentEpoch++
+			myself.configEpoch = cluster.currentEpoch
+			log.Printf("Cluster slot %d imported, this node takes config epoch %d", slot, myself.configEpoch)
+			clusterBroadcastPong()
+		}
+	}
+	return response.Encode("OK", true), nil
+}
+
+// The slots of the node as ranges of contiguous slots, start and end of each
+func (n *clusterNode) slotRanges() [][2]int {
+	var ranges [][2]int
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if !n.hasSlot(slot) {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last][1] == slot-1 {
+			ranges[last][1] = slot
+		} else {
+			ranges = append(ranges, [2]int{slot, slot})
+		}
+	}
+	return ranges
+}
+
+// The nodes sorted by id, the handshakes are left out
+func sortedClusterNodes() []*clusterNode {
+	nodes := make([]*clusterNode, 0, len(cluster.nodes))
+	for _, n := range cluster.nodes {
+		if n.flags&CLUSTER_NODE_HANDSHAKE == 0 {
+			nodes = append(nodes, n)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].id < nodes[j].id })
+	return nodes
+}
+
+// The replicas of the master, sorted by id
+func (n *clusterNode) replicas() []*clusterNode {
+	var replicas []*clusterNode
+	for _, other := range sortedClusterNodes() {
+		if other.master == n {
+			replicas = append(replicas, other)
+		}
+	}
+	return replicas
+}
+
+func unixMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+/**
+CLUSTER NODES, a line per node:
+	<id> <ip:port@cport> <flags> <master id or -> <ping sent> <pong received> <config epoch> <link state> <slot>...
+The line of this node ends with the slots it migrates, as [<slot>->-<node id>], and imports, as [<slot>-<-<node id>].
+*/
+func clusterNodesDescription() string {
+	var b strings.Builder
+	for _, n := range sortedClusterNodes() {
+		b.WriteString(clusterNodeDescription(n))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// The line of CLUSTER NODES describing the node, without its newline
+func clusterNodeDescription(n *clusterNode) string {
+	var b strings.Builder
+	master := "-"
+	if n.master != nil {
+		master = n.master.id
+	}
+	linkState := "disconnected"
+	if n == cluster.myself || (n.link != nil && n.link.connected) {
+		linkState = "connected"
+	}
+	fmt.Fprintf(&b, "%s %s@%d %s %s %d %d %d %s", n.id, n.addr(), n.busPort, n.flagNames(), master,
+		unixMillis(n.pingSent), unixMillis(n.pongReceived), n.configEpoch, linkState)
+	for _, r := range n.slotRanges() {
+		if r[0] == r[1] {
+			fmt.Fprintf(&b, " %d", r[0])
+		} else {
+			fmt.Fprintf(&b, " %d-%d", r[0], r[1])
+		}
+	}
+	if n == cluster.myself {
+		for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+			if cluster.migrating[slot] != nil {
+				fmt.Fprintf(&b, " [%d->-%s]", slot, cluster.migrating[slot].id)
+			}
+			if cluster.importing[slot] != nil {
+				fmt.Fprintf(&b, " [%d-<-%s]", slot, cluster.importing[slot].id)
+			}
+		}
+	}
+	return b.String()
+}
+
+func clusterNodeAddrReply(n *clusterNode) []byte {
+	return response.EncodeArray([][]byte{response.Encode(n.ip, false), response.Encode(n.port, false), response.Encode(n.id, false)})
+}
+
+// The replicas that can serve reads, the failing ones are left out
+func (n *clusterNode) healthyReplicas() []*clusterNode {
+	var replicas []*clusterNode
+	for _, replica := range n.replicas() {
+		if replica.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) == 0 {
+			replicas = append(replicas, replica)
+		}
+	}
+	return replicas
+}
+
+// CLUSTER SLOTS, per range of slots served by a node: start, end, the master and the replicas as [ip, port, id]
+func clusterSlotsReply() []byte {
+	var replies [][]byte
+	for start := 0; start < CLUSTER_SLOTS; {
+		n, end := cluster.slots[start], start
+		for end+1 < CLUSTER_SLOTS && cluster.slots[end+1] == n {
+			end++
+		}
+		if n != nil {
+			elems := [][]byte{response.Encode(start, false), response.Encode(end, false), clusterNodeAddrReply(n)}
+			for _, replica := range n.healthyReplicas() {
+				elems = append(elems, clusterNodeAddrReply(replica))
+			}
+			replies = append(replies, response.EncodeArray(elems))
+		}
+		start = end + 1
+	}
+	return response.EncodeArray(replies)
+}
+
+// CLUSTER SHARDS, per master: its slots and the master and its replicas
+func clusterShardsReply() []byte {
+	encodeMap := response.EncodeArray
+	if currentClient != nil {
+		encodeMap = currentClient.encodeMap
+	}
+	var shards [][]byte
+	for _, master := range sortedClusterNodes() {
+		if !master.isMaster() {
+			continue
+		}
+		var slots [][]byte
+		for _, r := range master.slotRanges() {
+			slots = append(slots, response.Encode(r[0], false), response.Encode(r[1], false))
+		}
+		var nodes [][]byte
+		for _, n := range append([]*clusterNode{master}, master.replicas()...) {
+			role, health := "master", "online"
+			if n != master {
+				role = "replica"
+			}
+			if n.flags&(CLUSTER_NODE_FAIL|CLUSTER_NODE_PFAIL) != 0 {
+				health = "fail"
+			}
+			nodes = append(nodes, encodeMap([][]byte{
+				response.Encode("id", false), response.Encode(n.id, false),
+				response.Encode("port", false), response.Encode(n.port, false),
+				response.Encode("ip", false), response.Encode(n.ip, false),
+				response.Encode("endpoint", false), response.Encode(n.ip, false),
+				response.Encode("role", false), response.Encode(role, false),
+				response.Encode("health", false), response.Encode(health, false),
+			}))
+		}
+		shards = append(shards, encodeMap([][]byte{
+			response.Encode("slots", false), response.EncodeArray(slots),
+			response.Encode("nodes", false), response.EncodeArray(nodes),
+		}))
+	}
+	return response.EncodeArray(shards)
+}
+
+func clusterInfoLines() []string {
+	state := "fail"
+	if clusterStateOK() {
+		state = "ok"
+	}
+	assigned, ok, pfail, fail, size := 0, 0, 0, 0, 0
+	for _, n := range cluster.slots {
+		switch {
+		case n == nil:
+			continue
+		case n.flags&CLUSTER_NODE_FAIL != 0:
+			fail++
+		case n.flags&CLUSTER_NODE_PFAIL != 0:
+			pfail++
+		default:
+			ok++
+		}
+		assigned++
+	}
+	known := 0
+	for _, n := range cluster.nodes {
+		if n.flags&CLUSTER_NODE_HANDSHAKE == 0 {
+			known++
+		}
+		if n.isMaster() && n.numSlots > 0 {
+			size++
+		}
+	}
+	return []string{
+		"cluster_enabled:1",
+		"cluster_state:" + state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", ok),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", known),
+		fmt.Sprintf("cluster_size:%d", size),
+		fmt.Sprintf("cluster_current_epoch:%d", cluster.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", cluster.myself.configEpoch),
+		fmt.Sprintf("cluster_stats_messages_sent:%d", cluster.statsSent),
+		fmt.Sprintf("cluster_stats_messages_received:%d", cluster.statsReceived),
+	}
+}
@@ -0,0 +1,613 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The cluster bus connects the nodes of the cluster, on the port of the node + 10000 unless cluster-port is set.
+Every node connects to every other node it knows, it sends its messages on this link and the replies are sent
+back on the same connection. The messages are RESP commands, the name of the command is the type of message,
+it starts with a header describing the sender:
+	<sender id> <current epoch> <config epoch> <ip> <port> <bus port> <flags> <master id> <slots> <repl offset> <message flags>
+The ip is empty unless cluster-announce-ip is set, the receiver then uses the address of the connection. The
+master id is empty for masters, the slots are the bitmap of the slots served by the sender and the replication
+offset is the one of its dataset.
+	- PING is sent to every node every second, the node replies with a PONG. MEET is a PING to a node that
+	  does not know the sender yet, the node adds the sender to the cluster. The header of these messages is
+	  followed by the gossip about the failing nodes and up to 3 other nodes known by the sender, 5 arguments
+	  per node:
+		<id> <ip> <port> <bus port> <flags>
+	  The nodes the receiver does not know yet are sent a MEET, a master gossiping about a failing node is a
+	  failure report. A PONG is also sent alone to tell the other nodes a change right away, it is not answered.
+	- FAIL <node id> tells the nodes that a node is failing, see cluster_failover.go for the failover messages
+	  FAILOVER_AUTH_REQUEST, FAILOVER_AUTH_ACK and MFSTART
+The messages are processed holding execMu.
+*/
+
+// Types of the messages of the cluster bus
+const (
+	CLUSTER_MSG_PING = "CLUSTER.PING"
+	CLUSTER_MSG_PONG = "CLUSTER.PONG"
+	CLUSTER_MSG_MEET = "CLUSTER.MEET"
+	CLUSTER_MSG_FAIL = "CLUSTER.FAIL"
+
+	CLUSTER_MSG_FAILOVER_AUTH_REQUEST = "CLUSTER.FAILOVER_AUTH_REQUEST"
+	CLUSTER_MSG_FAILOVER_AUTH_ACK     = "CLUSTER.FAILOVER_AUTH_ACK"
+	CLUSTER_MSG_MFSTART               = "CLUSTER.MFSTART"
+)
+
+// Flags of the messages
+const (
+	//The sender is a master that paused its writes for a manual failover
+	CLUSTER_MSG_FLAG_PAUSED = 1 << iota
+	//The failover is manual, the vote is given even though the master is not failing
+	CLUSTER_MSG_FLAG_FORCEACK
+)
+
+const (
+	//The number of arguments of the header, with the type of message
+	clusterHeaderLen = 12
+	//The number of nodes gossiped about in a PING
+	clusterGossipNodes  = 3
+	clusterLinkQueueLen = 64
+)
+
+var errClusterMessage = errors.New("invalid cluster bus message")
+
+// An outgoing connection of the cluster bus to a node
+type clusterLink struct {
+	node  *clusterNode
+	queue chan []byte
+	stop  chan struct{}
+	//The connection, guarded by execMu
+	conn      net.Conn
+	connected bool
+	closed    bool
+	ctime     time.Time
+}
+
+type clusterGossip struct {
+	id      string
+	ip      string
+	port    int
+	busPort int
+	flags   int
+}
+
+type clusterMessage struct {
+	typ          string
+	sender       string
+	currentEpoch uint64
+	configEpoch  uint64
+	ip           string
+	port         int
+	busPort      int
+	flags        int
+	master       string
+	slots        string
+	replOffset   int64
+	mflags       int
+	//The arguments following the header
+	data []string
+}
+
+// Connects to the node, must be called holding execMu
+func newClusterLink(n *clusterNode) *clusterLink {
+	l := &clusterLink{node: n, queue: make(chan []byte, clusterLinkQueueLen), stop: make(chan struct{}), ctime: time.Now()}
+	go l.run(n.busAddr())
+	return l
+}
+
+// Closes the link, must be called holding execMu
+func (l *clusterLink) close() {
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// Closes the link when the connection is lost, the cron connects to the node again. Must be called holding execMu.
+func (l *clusterLink) fail() {
+	l.close()
+	if l.node.link == l {
+		l.node.link = nil
+	}
+}
+
+// Queues the message, the message is dropped when the node does not read fast enough
+func (l *clusterLink) send(data []byte) {
+	select {
+	case l.queue <- data:
+	default:
+	}
+}
+
+// Connects to the node, then writes the messages queued for it
+func (l *clusterLink) run(addr string) {
+	conn, err := dialBus(addr, clusterNodeTimeout())
+	execMu.Lock()
+	if err != nil || l.closed {
+		if err == nil {
+			conn.Close()
+		}
+		l.fail()
+		execMu.Unlock()
+		return
+	}
+	l.conn, l.connected, l.ctime = conn, true, time.Now()
+	typ := CLUSTER_MSG_PING
+	if l.node.flags&CLUSTER_NODE_MEET != 0 {
+		typ = CLUSTER_MSG_MEET
+	}
+	clusterSendPing(l.node, typ)
+	execMu.Unlock()
+
+	go l.read(conn)
+	for {
+		select {
+		case <-l.stop:
+			return
+		case data := <-l.queue:
+			conn.SetWriteDeadline(time.Now().Add(clusterNodeTimeout()))
+			if _, err := conn.Write(data); err != nil {
+				execMu.Lock()
+				l.fail()
+				execMu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// Processes the replies of the node
+func (l *clusterLink) read(conn net.Conn) {
+	rd := response.NewReader(conn)
+	for {
+		args, _, err := rd.ReadCommand()
+		execMu.Lock()
+		if err == nil && !l.closed {
+			_, err = clusterProcessMessage(args, l, conn)
+		}
+		if err != nil {
+			if err != io.EOF && !l.closed {
+				log.Println("Error reading from the cluster bus:", conn.RemoteAddr(), err)
+			}
+			l.fail()
+		}
+		closed := l.closed
+		execMu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
+
+func acceptClusterConns(state *clusterState, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		execMu.Lock()
+		if cluster != state {
+			execMu.Unlock()
+			conn.Close()
+			return
+		}
+		state.inbound[conn] = struct{}{}
+		execMu.Unlock()
+		go serveClusterConn(state, conn)
+	}
+}
+
+// Processes the messages sent by a node and replies to them, until the node closes the connection
+func serveClusterConn(state *clusterState, conn net.Conn) {
+	defer func() {
+		execMu.Lock()
+		delete(state.inbound, conn)
+		execMu.Unlock()
+		conn.Close()
+	}()
+	rd := response.NewReader(conn)
+	for {
+		args, _, err := rd.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading from the cluster bus:", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		execMu.Lock()
+		var reply []byte
+		if cluster == state {
+			reply, err = clusterProcessMessage(args, nil, conn)
+		} else {
+			err = io.EOF
+		}
+		execMu.Unlock()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error processing a message of the cluster bus:", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if reply != nil {
+			conn.SetWriteDeadline(time.Now().Add(clusterNodeTimeout()))
+			if _, err := conn.Write(reply); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func parseClusterMessage(args []string) (*clusterMessage, error) {
+	if len(args) < clusterHeaderLen {
+		return nil, errClusterMessage
+	}
+	m := &clusterMessage{typ: strings.ToUpper(args[0]), sender: args[1], ip: args[4], master: args[8], slots: args[9], data: args[clusterHeaderLen:]}
+	var err error
+	if m.currentEpoch, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+		return nil, errClusterMessage
+	}
+	if m.configEpoch, err = strconv.ParseUint(args[3], 10, 64); err != nil {
+		return nil, errClusterMessage
+	}
+	for i, dst := range []*int{&m.port, &m.busPort, &m.flags} {
+		if *dst, err = strconv.Atoi(args[5+i]); err != nil {
+			return nil, errClusterMessage
+		}
+	}
+	if m.replOffset, err = strconv.ParseInt(args[10], 10, 64); err != nil {
+		return nil, errClusterMessage
+	}
+	if m.mflags, err = strconv.Atoi(args[11]); err != nil {
+		return nil, errClusterMessage
+	}
+	if len(m.sender) != 40 || len(m.slots) != CLUSTER_SLOTS/8 {
+		return nil, errClusterMessage
+	}
+	return m, nil
+}
+
+func (m *clusterMessage) hasSlot(slot int) bool {
+	return m.slots[slot/8]&(1<<(slot%8)) != 0
+}
+
+func (m *clusterMessage) gossip() ([]clusterGossip, error) {
+	if len(m.data)%5 != 0 {
+		return nil, errClusterMessage
+	}
+	entries := make([]clusterGossip, 0, len(m.data)/5)
+	for i := 0; i < len(m.data); i += 5 {
+		g := clusterGossip{id: m.data[i], ip: m.data[i+1]}
+		var err error
+		for j, dst := range []*int{&g.port, &g.busPort, &g.flags} {
+			if *dst, err = strconv.Atoi(m.data[i+2+j]); err != nil {
+				return nil, errClusterMessage
+			}
+		}
+		entries = append(entries, g)
+	}
+	return entries, nil
+}
+
+// The message describing this node, followed by the arguments. Must be called holding execMu.
+func clusterBuildMessage(typ string, args ...string) []byte {
+	return clusterBuildMessageFlags(typ, 0, args...)
+}
+
+// The message with the flags, a master pausing its writes for a manual failover adds the PAUSED flag
+func clusterBuildMessageFlags(typ string, mflags int, args ...string) []byte {
+	myself := cluster.myself
+	master := ""
+	if myself.master != nil {
+		master = myself.master.id
+	}
+	if myself.isMaster() && !cluster.mfEnd.IsZero() {
+		mflags |= CLUSTER_MSG_FLAG_PAUSED
+	}
+	header := []string{
+		myself.id,
+		strconv.FormatUint(cluster.currentEpoch, 10),
+		strconv.FormatUint(myself.configEpoch, 10),
+		config.ClusterAnnounceIP,
+		strconv.Itoa(myself.port),
+		strconv.Itoa(myself.busPort),
+		strconv.Itoa(myself.flags &^ CLUSTER_NODE_MYSELF),
+		master,
+		string(myself.slots[:]),
+		strconv.FormatInt(masterReplOffset, 10),
+		strconv.Itoa(mflags),
+	}
+	cluster.statsSent++
+	return (&Command{Cmd: typ, Args: append(header, args...)}).encode()
+}
+
+/**
+The gossip sent to the node, about nodes it is not and whose address is known. The failing nodes are always
+gossiped about so that the failure reports reach the masters quickly. Must be called holding execMu.
+*/
+func clusterGossipArgs(to *clusterNode) []string {
+	var args []string
+	count := 0
+	//INFO: The order of the map is random, the nodes gossiped about change with every message
+	for _, n := range cluster.nodes {
+		if n == cluster.myself || n == to || n.flags&(CLUSTER_NODE_HANDSHAKE|CLUSTER_NODE_NOADDR) != 0 || n.ip == "" {
+			continue
+		}
+		if n.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0 {
+			if count == clusterGossipNodes {
+				continue
+			}
+			count++
+		}
+		args = append(args, n.id, n.ip, strconv.Itoa(n.port), strconv.Itoa(n.busPort), strconv.Itoa(n.flags))
+	}
+	return args
+}
+
+// Sends the message to the node when it is connected, must be called holding execMu
+func clusterSendMessage(n *clusterNode, data []byte) {
+	if n.link != nil && n.link.connected {
+		n.link.send(data)
+	}
+}
+
+// Sends the message to every node, must be called holding execMu
+func clusterBroadcastMessage(data []byte) {
+	for _, n := range cluster.nodes {
+		if n != cluster.myself && n.flags&CLUSTER_NODE_HANDSHAKE == 0 {
+			clusterSendMessage(n, data)
+		}
+	}
+}
+
+// Sends a PING, a MEET or a PONG to the node when it is connected, must be called holding execMu
+func clusterSendPing(n *clusterNode, typ string) {
+	if n.link == nil || !n.link.connected {
+		return
+	}
+	n.link.send(clusterBuildMessage(typ, clusterGossipArgs(n)...))
+	if typ == CLUSTER_MSG_PONG {
+		return
+	}
+	now := time.Now()
+	n.lastPing = now
+	if n.pingSent.IsZero() {
+		n.pingSent = now
+	}
+}
+
+func hostOf(addr net.Addr) string {
+	host, _, _ := net.SplitHostPort(addr.String())
+	return host
+}
+
+/**
+Processes a message received on the link to a node, or on a connection accepted from a node when link is nil.
+Returns the reply to send back on the connection. Must be called holding execMu.
+*/
+func clusterProcessMessage(args []string, link *clusterLink, conn net.Conn) ([]byte, error) {
+	m, err := parseClusterMessage(args)
+	if err != nil {
+		return nil, err
+	}
+	ping := m.typ == CLUSTER_MSG_PING || m.typ == CLUSTER_MSG_PONG || m.typ == CLUSTER_MSG_MEET
+	switch m.typ {
+	case CLUSTER_MSG_PING, CLUSTER_MSG_PONG, CLUSTER_MSG_MEET, CLUSTER_MSG_FAILOVER_AUTH_REQUEST, CLUSTER_MSG_FAILOVER_AUTH_ACK, CLUSTER_MSG_MFSTART:
+	case CLUSTER_MSG_FAIL:
+		if len(m.data) != 1 {
+			return nil, errClusterMessage
+		}
+	default:
+		return nil, fmt.Errorf("unknown cluster bus message '%s'", args[0])
+	}
+	cluster.statsReceived++
+	myself := cluster.myself
+	if myself.ip == "" {
+		//INFO: The address of this node is the one the other nodes connect to
+		myself.ip = hostOf(conn.LocalAddr())
+	}
+	if m.currentEpoch > cluster.currentEpoch {
+		cluster.currentEpoch = m.currentEpoch
+	}
+	ip := m.ip
+	if ip == "" {
+		ip = hostOf(conn.RemoteAddr())
+	}
+
+	sender := cluster.nodes[m.sender]
+	if link != nil && link.node.flags&CLUSTER_NODE_HANDSHAKE != 0 {
+		if m.typ != CLUSTER_MSG_PONG {
+			return nil, errClusterMessage
+		}
+		//The node answered the handshake, it takes the id of the node
+		node := link.node
+		if sender != nil {
+			clusterDelNode(node)
+			return nil, nil
+		}
+		delete(cluster.nodes, node.id)
+		node.id = m.sender
+		node.flags &^= CLUSTER_NODE_HANDSHAKE | CLUSTER_NODE_MEET
+		cluster.nodes[node.id] = node
+		sender = node
+		log.Printf("Cluster handshake with %s completed, node %s", node.busAddr(), node.id)
+	}
+	if sender == nil && m.typ == CLUSTER_MSG_MEET {
+		sender = newClusterNode(m.sender, 0)
+		sender.ip, sender.port, sender.busPort = ip, m.port, m.busPort
+		cluster.nodes[sender.id] = sender
+		log.Printf("Cluster node %s at %s met this node", sender.id, sender.busAddr())
+	}
+	//INFO: A node this node does not know is answered, but what it tells is ignored until it is met
+	if sender == nil || sender == myself {
+		if !ping {
+			return nil, nil
+		}
+		return clusterReply(m, link, sender), nil
+	}
+
+	now := time.Now()
+	sender.replOffset = m.replOffset
+	if link != nil && m.typ == CLUSTER_MSG_PONG {
+		sender.pongReceived = now
+		sender.pingSent = time.Time{}
+		clusterClearFailureIfNeeded(sender, now)
+	}
+	if sender == myself.master && m.mflags&CLUSTER_MSG_FLAG_PAUSED != 0 {
+		clusterManualFailoverPaused(m.replOffset)
+	}
+	switch m.typ {
+	case CLUSTER_MSG_FAIL:
+		if failing := cluster.nodes[m.data[0]]; failing != nil && failing != myself && failing.flags&CLUSTER_NODE_FAIL == 0 {
+			log.Printf("FAIL message received from %s about %s", sender.id, failing.id)
+			failing.flags = failing.flags&^CLUSTER_NODE_PFAIL | CLUSTER_NODE_FAIL
+			failing.failTime = now
+		}
+		return nil, nil
+	case CLUSTER_MSG_FAILOVER_AUTH_REQUEST:
+		return clusterSendFailoverAuthIfNeeded(sender, m), nil
+	case CLUSTER_MSG_FAILOVER_AUTH_ACK:
+		//INFO: Only the votes of the masters serving slots count, and only for the election running
+		if sender.isMaster() && sender.numSlots > 0 && m.currentEpoch >= cluster.failoverAuthEpoch {
+			cluster.failoverAuthCount++
+		}
+		return nil, nil
+	case CLUSTER_MSG_MFSTART:
+		return clusterManualFailoverStart(sender), nil
+	}
+
+	if link == nil && (sender.ip != ip || sender.port != m.port || sender.busPort != m.busPort) {
+		//The node changed its address, it is connected again
+		sender.ip, sender.port, sender.busPort = ip, m.port, m.busPort
+		if sender.link != nil {
+			sender.link.fail()
+		}
+	}
+	clusterUpdateRole(sender, m)
+	if sender.isMaster() {
+		clusterUpdateSlots(sender, m)
+	}
+	sender.configEpoch = m.configEpoch
+	gossip, err := m.gossip()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gossip {
+		n := cluster.nodes[g.id]
+		if n == nil {
+			if g.flags&CLUSTER_NODE_NOADDR == 0 && g.ip != "" && len(g.id) == 40 {
+				clusterStartHandshake(g.ip, g.port, g.busPort)
+			}
+			continue
+		}
+		if n == myself || !sender.isMaster() {
+			continue
+		}
+		if g.flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) != 0 {
+			clusterAddFailureReport(n, sender, now)
+			clusterMarkFailingIfNeeded(n, now)
+		} else {
+			delete(n.failReports, sender)
+		}
+	}
+	return clusterReply(m, link, sender), nil
+}
+
+// The PONG answering a PING or a MEET received on a connection accepted from a node, must be called holding execMu
+func clusterReply(m *clusterMessage, link *clusterLink, to *clusterNode) []byte {
+	if link != nil || m.typ == CLUSTER_MSG_PONG {
+		return nil
+	}
+	return clusterBuildMessage(CLUSTER_MSG_PONG, clusterGossipArgs(to)...)
+}
+
+// Sends a PONG to every node, to tell them a change right away. Must be called holding execMu.
+func clusterBroadcastPong() {
+	for _, n := range cluster.nodes {
+		if n != cluster.myself && n.flags&CLUSTER_NODE_HANDSHAKE == 0 {
+			clusterSendPing(n, CLUSTER_MSG_PONG)
+		}
+	}
+}
+
+// Updates the role of the node, a master that becomes a replica no longer serves slots. Must be called holding execMu.
+func clusterUpdateRole(n *clusterNode, m *clusterMessage) {
+	if m.master == "" {
+		n.flags = n.flags&^CLUSTER_NODE_REPLICA | CLUSTER_NODE_MASTER
+		n.master = nil
+		return
+	}
+	if n.isMaster() {
+		clusterDelNodeSlots(n)
+	}
+	n.flags = n.flags&^CLUSTER_NODE_MASTER | CLUSTER_NODE_REPLICA
+	n.master = cluster.nodes[m.master]
+}
+
+/**
+Assigns to the master the slots it claims, when they are not served or served by a node with a smaller config
+epoch, but the slots this node imports. The keys this node has in the slots it loses are deleted. When the master
+of this node, or this node when it is a master, loses its last slot to the node, the node was failed over: this
+node becomes its replica and keeps its keys until it syncs. Two masters with the same config epoch make the one
+with the smaller id take a new epoch. Must be called holding execMu.
+*/
+func clusterUpdateSlots(n *clusterNode, m *clusterMessage) {
+	myself := cluster.myself
+	current := myself
+	if !myself.isMaster() {
+		current = myself.master
+	}
+	var dirty []int
+	lost := false
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		owner := cluster.slots[slot]
+		if !m.hasSlot(slot) || owner == n || cluster.importing[slot] != nil {
+			continue
+		}
+		if owner != nil && owner.configEpoch >= m.configEpoch {
+			continue
+		}
+		if owner != nil && owner == current {
+			lost = true
+		}
+		if owner == myself {
+			log.Printf("Cluster slot %d is now served by %s", slot, n.id)
+			cluster.migrating[slot] = nil
+			if len(cluster.slotKeys[slot]) > 0 {
+				dirty = append(dirty, slot)
+			}
+		}
+		clusterAddSlot(n, slot)
+	}
+	if lost && current.numSlots == 0 {
+		log.Printf("Cluster master %s lost its last slot to %s, this node replicates it", current.id, n.id)
+		clusterSetMyMaster(n)
+	} else {
+		for _, slot := range dirty {
+			clusterDelKeysInSlot(slot)
+		}
+	}
+
+	if myself.isMaster() && m.configEpoch == myself.configEpoch && n.id > myself.id {
+		cluster.currentEpoch++
+		myself.configEpoch = cluster.currentEpoch
+		log.Printf("Cluster config epoch collision with %s, this node takes config epoch %d", n.id, myself.configEpoch)
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+A master of the cluster that fails is replaced by one of its replicas, like redis cluster does:
+	- a node that does not answer the PINGs of this node within cluster-node-timeout is flagged PFAIL, it
+	  possibly fails. The nodes gossip about the nodes they flag, a master gossiping about a failing node is a
+	  failure report. A node flagged PFAIL by a majority of the masters serving slots is flagged FAIL and
+	  every node is told with a FAIL message. The FAIL flag of a replica or of a master serving no slot is
+	  cleared once it answers again, the one of a master serving slots only after twice the node timeout, its
+	  replicas may have replaced it meanwhile.
+	- the replicas of a master flagged FAIL start an election: the replica waits 500ms, a random delay up to
+	  500ms and a second per replica of the same master with a greater replication offset, so that the replica
+	  with the most data is elected first. It then takes a new current epoch and asks every node for its vote
+	  with FAILOVER_AUTH_REQUEST.
+	- a master serving slots votes with FAILOVER_AUTH_ACK once per epoch, for a replica whose master is
+	  flagged FAIL and not for another replica of the same master within twice the node timeout
+	- the replica with the votes of a majority of the masters serving slots takes the slots of its master with
+	  the epoch of the election as config epoch, so that the other nodes give it the slots. The other replicas
+	  of the master, and the master when it comes back, then replicate the new master (see clusterUpdateSlots),
+	  its clients are redirected to the new master.
+CLUSTER FAILOVER makes a replica take over its master while it works: the replica tells its master with MFSTART,
+the master pauses its writes and sends its replication offset with the PAUSED flag. The replica waits until it
+processed the replication stream up to this offset, then starts an election right away with the FORCEACK flag,
+the masters vote even though the master does not fail. FAILOVER FORCE starts the election without the master,
+FAILOVER TAKEOVER takes the slots without an election. A manual failover that does not end within 5 seconds is
+aborted.
+*/
+
+// How long a manual failover can take
+const clusterManualFailoverTimeout = 5 * time.Second
+
+var errManualFailoverPaused = errors.New("TRYAGAIN Writes are paused by a manual failover")
+
+// The number of masters serving slots that must agree to flag a node FAIL or to elect a replica
+func clusterQuorum() int {
+	size := 0
+	for _, n := range cluster.nodes {
+		if n.isMaster() && n.numSlots > 0 {
+			size++
+		}
+	}
+	return size/2 + 1
+}
+
+// Makes this node a replica of the master, must be called holding execMu
+func clusterSetMyMaster(n *clusterNode) {
+	myself := cluster.myself
+	if myself.isMaster() {
+		clusterDelNodeSlots(myself)
+		cluster.migrating, cluster.importing = [CLUSTER_SLOTS]*clusterNode{}, [CLUSTER_SLOTS]*clusterNode{}
+		myself.flags = myself.flags&^CLUSTER_NODE_MASTER | CLUSTER_NODE_REPLICA
+	}
+	myself.master = n
+	clusterResetManualFailover()
+	startReplication(n.ip, n.port)
+}
+
+// Keeps the report of the master that the node fails, must be called holding execMu
+func clusterAddFailureReport(n *clusterNode, reporter *clusterNode, now time.Time) {
+	if n.failReports == nil {
+		n.failReports = map[*clusterNode]time.Time{}
+	}
+	n.failReports[reporter] = now
+}
+
+// The number of masters that reported that the node fails within twice the node timeout, must be called holding execMu
+func clusterFailureReports(n *clusterNode, now time.Time) int {
+	for reporter, reported := range n.failReports {
+		if now.Sub(reported) > 2*clusterNodeTimeout() {
+			delete(n.failReports, reporter)
+		}
+	}
+	return len(n.failReports)
+}
+
+// Flags FAIL a node flagged PFAIL by a majority of the masters, and tells the other nodes. Must be called holding execMu.
+func clusterMarkFailingIfNeeded(n *clusterNode, now time.Time) {
+	if n.flags&CLUSTER_NODE_PFAIL == 0 || n.flags&CLUSTER_NODE_FAIL != 0 {
+		return
+	}
+	failures := clusterFailureReports(n, now)
+	if cluster.myself.isMaster() {
+		failures++
+	}
+	if failures < clusterQuorum() {
+		return
+	}
+	log.Printf("Marking node %s as failing (quorum reached).", n.id)
+	n.flags = n.flags&^CLUSTER_NODE_PFAIL | CLUSTER_NODE_FAIL
+	n.failTime = now
+	clusterBroadcastMessage(clusterBuildMessage(CLUSTER_MSG_FAIL, n.id))
+}
+
+// Clears the failure flags of a node that answered, must be called holding execMu
+func clusterClearFailureIfNeeded(n *clusterNode, now time.Time) {
+	if n.flags&CLUSTER_NODE_PFAIL != 0 {
+		n.flags &^= CLUSTER_NODE_PFAIL
+		return
+	}
+	if n.flags&CLUSTER_NODE_FAIL == 0 {
+		return
+	}
+	if !n.isMaster() || n.numSlots == 0 || now.Sub(n.failTime) > 2*clusterNodeTimeout() {
+		log.Printf("Clear FAIL state for node %s: it is reachable again.", n.id)
+		n.flags &^= CLUSTER_NODE_FAIL
+	}
+}
+
+// The number of replicas of the same master with a greater replication offset, must be called holding execMu
+func clusterReplicaRank() int {
+	rank := 0
+	for _, replica := range cluster.myself.master.replicas() {
+		if replica != cluster.myself && replica.replOffset > masterReplOffset {
+			rank++
+		}
+	}
+	return rank
+}
+
+/**
+Runs the election of this replica when its master fails, or when a manual failover can start. An election that
+does not get the votes within twice the node timeout, or 2 seconds, is started again after as long. Must be
+called holding execMu.
+*/
+func clusterHandleReplicaFailover(now time.Time) {
+	myself := cluster.myself
+	master := myself.master
+	manual := !cluster.mfEnd.IsZero() && cluster.mfCanStart
+	if myself.isMaster() || master == nil || master.numSlots == 0 || (master.flags&CLUSTER_NODE_FAIL == 0 && !manual) {
+		return
+	}
+	authTimeout := 2 * clusterNodeTimeout()
+	if authTimeout < 2*time.Second {
+		authTimeout = 2 * time.Second
+	}
+
+	if cluster.failoverAuthTime.IsZero() || now.Sub(cluster.failoverAuthTime) > 2*authTimeout {
+		cluster.failoverAuthCount, cluster.failoverAuthSent = 0, false
+		cluster.failoverAuthRank = clusterReplicaRank()
+		delay := 500*time.Millisecond + time.Duration(rand.Int63n(int64(500*time.Millisecond))) + time.Duration(cluster.failoverAuthRank)*time.Second
+		if manual {
+			delay, cluster.failoverAuthRank = 0, 0
+		}
+		cluster.failoverAuthTime = now.Add(delay)
+		log.Printf("Start of election delayed for %v (rank #%d, offset %d).", delay, cluster.failoverAuthRank, masterReplOffset)
+		//INFO: The other replicas of the master learn the offset of this one, to compute their rank
+		for _, replica := range master.replicas() {
+			if replica != myself {
+				clusterSendPing(replica, CLUSTER_MSG_PONG)
+			}
+		}
+		return
+	}
+	if !cluster.failoverAuthSent && !manual {
+		if rank := clusterReplicaRank(); rank > cluster.failoverAuthRank {
+			added := time.Duration(rank-cluster.failoverAuthRank) * time.Second
+			cluster.failoverAuthTime = cluster.failoverAuthTime.Add(added)
+			cluster.failoverAuthRank = rank
+			log.Printf("Replica rank updated to #%d, added %v of delay.", rank, added)
+		}
+	}
+	if now.Before(cluster.failoverAuthTime) || now.Sub(cluster.failoverAuthTime) > authTimeout {
+		return
+	}
+	if !cluster.failoverAuthSent {
+		cluster.currentEpoch++
+		cluster.failoverAuthEpoch = cluster.currentEpoch
+		cluster.failoverAuthSent = true
+		log.Printf("Starting a failover election for epoch %d.", cluster.currentEpoch)
+		mflags := 0
+		if manual {
+			mflags = CLUSTER_MSG_FLAG_FORCEACK
+		}
+		clusterBroadcastMessage(clusterBuildMessageFlags(CLUSTER_MSG_FAILOVER_AUTH_REQUEST, mflags))
+		return
+	}
+	if cluster.failoverAuthCount < clusterQuorum() {
+		return
+	}
+	log.Println("Failover election won, this node becomes a master.")
+	if myself.configEpoch < cluster.failoverAuthEpoch {
+		myself.configEpoch = cluster.failoverAuthEpoch
+	}
+	clusterFailoverReplaceYourMaster()
+}
+
+// Makes this replica a master serving the slots of its master, must be called holding execMu
+func clusterFailoverReplaceYourMaster() {
+	myself, old := cluster.myself, cluster.myself.master
+	myself.flags = myself.flags&^CLUSTER_NODE_REPLICA | CLUSTER_NODE_MASTER
+	myself.master = nil
+	for slot := 0; slot < CLUSTER_SLOTS; slot++ {
+		if cluster.slots[slot] == old {
+			clusterAddSlot(myself, slot)
+		}
+	}
+	stopReplication()
+	cluster.failoverAuthTime, cluster.failoverAuthSent, cluster.failoverAuthCount = time.Time{}, false, 0
+	clusterResetManualFailover()
+	log.Printf("Cluster failover of %s done, this node serves its slots with config epoch %d", old.id, myself.configEpoch)
+	clusterBroadcastPong()
+}
+
+/**
+Returns the vote for the replica asking for it, nil when this node does not vote for it: this node must be a
+master serving slots that did not vote in the current epoch, the master of the replica must be flagged FAIL
+unless the failover is manual and this node must not have voted for a replica of that master within twice the
+node timeout. Must be called holding execMu.
+*/
+func clusterSendFailoverAuthIfNeeded(n *clusterNode, m *clusterMessage) []byte {
+	myself, master := cluster.myself, n.master
+	if !myself.isMaster() || myself.numSlots == 0 {
+		return nil
+	}
+	now := time.Now()
+	var denied string
+	switch {
+	case m.currentEpoch < cluster.currentEpoch:
+		denied = "its epoch is older than the current epoch"
+	case cluster.lastVoteEpoch == cluster.currentEpoch:
+		denied = "this master already voted in the current epoch"
+	case n.isMaster() || master == nil:
+		denied = "it is not a replica of a known master"
+	case master.flags&CLUSTER_NODE_FAIL == 0 && m.mflags&CLUSTER_MSG_FLAG_FORCEACK == 0:
+		denied = "its master is not failing"
+	case now.Sub(master.votedTime) < 2*clusterNodeTimeout():
+		denied = "this master voted for a replica of the same master recently"
+	}
+	if denied != "" {
+		log.Printf("Failover auth denied to %s for epoch %d: %s", n.id, m.currentEpoch, denied)
+		return nil
+	}
+	cluster.lastVoteEpoch = cluster.currentEpoch
+	master.votedTime = now
+	log.Printf("Failover auth granted to %s for epoch %d", n.id, cluster.currentEpoch)
+	return clusterBuildMessage(CLUSTER_MSG_FAILOVER_AUTH_ACK)
+}
+
+// The master pauses its writes for its replica asking for a manual failover, the reply tells its offset
+func clusterManualFailoverStart(n *clusterNode) []byte {
+	if !cluster.myself.isMaster() || n.master != cluster.myself {
+		return nil
+	}
+	clusterResetManualFailover()
+	cluster.mfEnd = time.Now().Add(clusterManualFailoverTimeout)
+	cluster.mfReplica = n
+	log.Printf("Manual failover requested by replica %s.", n.id)
+	return clusterBuildMessage(CLUSTER_MSG_PONG, clusterGossipArgs(n)...)
+}
+
+// The replica learns the offset of its master that paused its writes, must be called holding execMu
+func clusterManualFailoverPaused(offset int64) {
+	if cluster.mfEnd.IsZero() || cluster.mfMasterOffset >= 0 {
+		return
+	}
+	cluster.mfMasterOffset = offset
+	log.Printf("Received replication offset for paused master manual failover: %d", offset)
+}
+
+// Aborts the manual failover that timed out, or lets the replica start its election. Must be called holding execMu.
+func clusterHandleManualFailover(now time.Time) {
+	if cluster.mfEnd.IsZero() {
+		return
+	}
+	if now.After(cluster.mfEnd) {
+		log.Println("Manual failover timed out.")
+		clusterResetManualFailover()
+		return
+	}
+	//INFO: The offset of the replica may go past the one of the master, the master PINGs its replicas in the stream
+	if !cluster.myself.isMaster() && !cluster.mfCanStart && cluster.mfMasterOffset >= 0 && masterReplOffset >= cluster.mfMasterOffset {
+		cluster.mfCanStart = true
+		log.Println("All master replication stream processed, manual failover can start.")
+	}
+}
+
+// Ends the manual failover, the master writes again. Must be called holding execMu.
+func clusterResetManualFailover() {
+	cluster.mfEnd, cluster.mfReplica, cluster.mfMasterOffset, cluster.mfCanStart = time.Time{}, nil, -1, false
+}
+
+// Refuses the writes of clients while a replica of this master takes over, must be called holding execMu
+func checkClusterWritesPaused(cmd *Command) error {
+	if cluster == nil || cluster.mfEnd.IsZero() || !cluster.myself.isMaster() || currentClient == nil || applyingMasterStream {
+		return nil
+	}
+	if commandTable[cmd.name()].flags&CMD_FLAG_WRITE != 0 {
+		return errManualFailoverPaused
+	}
+	return nil
+}
+
+// CLUSTER REPLICATE <node id>, a master must serve no slot and have no key to become a replica
+func clusterReplicate(id string) ([]byte, error) {
+	n := cluster.nodes[id]
+	myself := cluster.myself
+	switch {
+	case n == nil || n.flags&CLUSTER_NODE_HANDSHAKE != 0:
+		return nil, errors.New("ERR Unknown node " + id)
+	case n == myself:
+		return nil, errors.New("ERR Can't replicate myself")
+	case !n.isMaster():
+		return nil, errors.New("ERR I can only replicate a master, not a replica.")
+	case myself.isMaster() && (myself.numSlots > 0 || len(keyspace) > 0):
+		return nil, errors.New("ERR To set a master the node must be empty and without assigned slots.")
+	}
+	if myself.master != n {
+		clusterSetMyMaster(n)
+		clusterBroadcastPong()
+	}
+	return response.Encode("OK", true), nil
+}
+
+// CLUSTER FAILOVER [FORCE|TAKEOVER], makes this replica take over its master
+func clusterFailover(args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("ERR syntax error")
+	}
+	option := ""
+	if len(args) == 1 {
+		option = strings.ToLower(args[0])
+		if option != "force" && option != "takeover" {
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+	myself := cluster.myself
+	master := myself.master
+	if myself.isMaster() {
+		return nil, errors.New("ERR You should send CLUSTER FAILOVER to a replica")
+	}
+	if master == nil {
+		return nil, errors.New("ERR I'm a replica but my master is unknown to me")
+	}
+	if option == "" && (master.flags&CLUSTER_NODE_FAIL != 0 || master.link == nil || !master.link.connected) {
+		return nil, errors.New("ERR Master is down or failed, please use CLUSTER FAILOVER FORCE")
+	}
+	clusterResetManualFailover()
+	cluster.mfEnd = time.Now().Add(clusterManualFailoverTimeout)
+	cluster.failoverAuthTime = time.Time{}
+	switch option {
+	case "takeover":
+		//INFO: Without an election the replica takes a new epoch of its own, like a node solving an epoch collision
+		log.Println("Taking over the master (user request).")
+		cluster.currentEpoch++
+		myself.configEpoch = cluster.currentEpoch
+		clusterFailoverReplaceYourMaster()
+	case "force":
+		log.Println("Forced failover user request accepted.")
+		cluster.mfCanStart = true
+	default:
+		log.Println("Manual failover user request accepted.")
+		clusterSendMessage(master, clusterBuildMessage(CLUSTER_MSG_MFSTART))
+	}
+	return response.Encode("OK", true), nil
+}
@@ -0,0 +1,370 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Accepts the links of the server to the node and answers the PINGs and MEETs with a PONG, and the
+FAILOVER_AUTH_REQUESTs with a vote when vote is set. The messages received are sent to the channel. The node
+must not be changed once it serves.
+*/
+func (n *testClusterNode) serve(vote bool) <-chan *clusterMessage {
+	messages := make(chan *clusterMessage, 1024)
+	go func() {
+		for {
+			conn, err := n.bus.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := response.NewReader(conn)
+				for {
+					args, _, err := rd.ReadCommand()
+					if err != nil {
+						return
+					}
+					m, err := parseClusterMessage(args)
+					if err != nil {
+						return
+					}
+					switch {
+					case m.typ == CLUSTER_MSG_PING || m.typ == CLUSTER_MSG_MEET:
+						conn.Write(n.message(CLUSTER_MSG_PONG))
+					case m.typ == CLUSTER_MSG_FAILOVER_AUTH_REQUEST && vote:
+						conn.Write(n.messageEpoch(CLUSTER_MSG_FAILOVER_AUTH_ACK, m.currentEpoch, 0))
+					}
+					select {
+					case messages <- m:
+					default:
+					}
+				}
+			}()
+		}
+	}()
+	return messages
+}
+
+// Makes the node meet the server, returns the connection of the node to the bus of the server
+func (n *testClusterNode) meet() *testBusConn {
+	conn := n.dial()
+	if pong := conn.exchange(n.message(CLUSTER_MSG_MEET)); pong.typ != CLUSTER_MSG_PONG {
+		n.t.Fatalf("the server answered the MEET with %+v", pong)
+	}
+	return conn
+}
+
+// The gossip about the node, flagged as failing
+func (n *testClusterNode) failingGossip() []string {
+	return []string{n.id, "127.0.0.1", strconv.Itoa(n.port), strconv.Itoa(n.busPort()), strconv.Itoa(n.flags() | CLUSTER_NODE_PFAIL)}
+}
+
+// Waits for a message of the type the server sent to a node
+func expectBusMessage(t *testing.T, messages <-chan *clusterMessage, typ string) *clusterMessage {
+	t.Helper()
+	timeout := time.After(testReplyTimeout)
+	for {
+		select {
+		case m := <-messages:
+			if m.typ == typ {
+				return m
+			}
+		case <-timeout:
+			t.Fatalf("the server did not send %s", typ)
+		}
+	}
+}
+
+// Waits until done returns true, it is called holding execMu
+func waitCluster(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		execMu.Lock()
+		ok := done()
+		execMu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func hasClusterFlags(id string, flags int) bool {
+	n := cluster.nodes[id]
+	return n != nil && n.flags&flags == flags
+}
+
+func TestClusterFailureDetection(t *testing.T) {
+	setupTestServer(t)
+	config.ClusterNodeTimeout = 200
+	startTestCluster(t)
+	c := connect(t)
+	c.expect(replyOK, "CLUSTER", "ADDSLOTSRANGE", "0", "8191")
+	//a does not answer, b does
+	a := newTestClusterNode(t, 'a', 30002)
+	a.configEpoch = 1
+	a.addSlots(8192, 12287)
+	a.meet()
+	b := newTestClusterNode(t, 'b', 30003)
+	b.configEpoch = 2
+	b.addSlots(12288, CLUSTER_SLOTS-1)
+	bconn := b.meet()
+	messages := b.serve(false)
+
+	waitCluster(t, "a flagged PFAIL", func() bool { return hasClusterFlags(a.id, CLUSTER_NODE_PFAIL) })
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, a.id+" 127.0.0.1:30002@"+strconv.Itoa(a.busPort())+" master,fail? ") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+
+	//With the report of b, a majority of the masters flags a as failing
+	bconn.exchange(b.message(CLUSTER_MSG_PING, a.failingGossip()...))
+	c.expect(int64(1), "CLUSTER", "COUNT-FAILURE-REPORTS", a.id)
+	c.expect(int64(0), "CLUSTER", "COUNT-FAILURE-REPORTS", b.id)
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " master,fail ") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	if fail := expectBusMessage(t, messages, CLUSTER_MSG_FAIL); len(fail.data) != 1 || fail.data[0] != a.id {
+		t.Errorf("the server sent %+v", fail)
+	}
+	if info := c.do("CLUSTER", "INFO").(string); !strings.Contains(info, "cluster_state:fail\r\n") || !strings.Contains(info, "cluster_slots_fail:4096\r\n") {
+		t.Errorf("CLUSTER INFO: %s", info)
+	}
+	c.expectError("CLUSTERDOWN The cluster is down", "SIM.ADD", "bar", "x")
+
+	//A replica flagged FAIL by the FAIL message of a master is cleared once it answers
+	r := newTestClusterNode(t, 'r', 30004)
+	r.master = b.id
+	r.meet()
+	bconn.conn.Write(b.message(CLUSTER_MSG_FAIL, r.id))
+	waitCluster(t, "r flagged FAIL", func() bool { return hasClusterFlags(r.id, CLUSTER_NODE_FAIL) })
+	r.serve(false)
+	waitCluster(t, "r answering", func() bool {
+		return cluster.nodes[r.id].flags&(CLUSTER_NODE_PFAIL|CLUSTER_NODE_FAIL) == 0
+	})
+	c.expect(array(), "CLUSTER", "REPLICAS", a.id)
+	if replicas := c.do("CLUSTER", "REPLICAS", b.id).([]interface{}); len(replicas) != 1 || !strings.HasPrefix(replicas[0].(string), r.id+" ") {
+		t.Errorf("CLUSTER REPLICAS: %q", replicas)
+	}
+	c.expectError("ERR The specified node is not a master", "CLUSTER", "REPLICAS", r.id)
+}
+
+func TestClusterFailover(t *testing.T) {
+	setupTestServer(t)
+	config.ClusterNodeTimeout = 200
+	myid := startTestCluster(t)
+	c := connect(t)
+	//The server replicates a, that does not answer
+	a := newTestClusterNode(t, 'a', 30002)
+	a.configEpoch = 1
+	a.addSlots(0, 8191)
+	a.meet()
+	b := newTestClusterNode(t, 'b', 30003)
+	b.configEpoch = 2
+	b.addSlots(8192, 12287)
+	bconn := b.meet()
+	votes := b.serve(true)
+	d := newTestClusterNode(t, 'd', 30004)
+	d.configEpoch = 3
+	d.addSlots(12288, CLUSTER_SLOTS-1)
+	dconn := d.meet()
+	d.serve(true)
+	c.expect(replyOK, "CLUSTER", "REPLICATE", a.id)
+
+	//The masters report a as failing, the server is a replica and needs both reports
+	waitCluster(t, "a flagged PFAIL", func() bool { return hasClusterFlags(a.id, CLUSTER_NODE_PFAIL) })
+	bconn.exchange(b.message(CLUSTER_MSG_PING, a.failingGossip()...))
+	if hasClusterFlags(a.id, CLUSTER_NODE_FAIL) {
+		t.Error("a was flagged FAIL without a majority")
+	}
+	dconn.exchange(d.message(CLUSTER_MSG_PING, a.failingGossip()...))
+	if !hasClusterFlags(a.id, CLUSTER_NODE_FAIL) {
+		t.Error("a was not flagged FAIL by a majority")
+	}
+
+	//The server is elected with the votes of b and d, it serves the slots of a
+	if request := expectBusMessage(t, votes, CLUSTER_MSG_FAILOVER_AUTH_REQUEST); request.currentEpoch != 4 || request.master != a.id || request.mflags != 0 {
+		t.Errorf("the server sent %+v", request)
+	}
+	waitCluster(t, "the failover", func() bool { return cluster.myself.isMaster() })
+	nodes := c.do("CLUSTER", "NODES").(string)
+	if !strings.Contains(nodes, myid+" 127.0.0.1:30001@") || !strings.Contains(nodes, " myself,master - 0 0 4 connected 0-8191\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	if role := c.do("ROLE").([]interface{}); role[0] != "master" {
+		t.Errorf("ROLE: %q", role)
+	}
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+	for {
+		if pong := expectBusMessage(t, votes, CLUSTER_MSG_PONG); pong.configEpoch == 4 && pong.hasSlot(0) {
+			break
+		}
+	}
+}
+
+func TestClusterFailoverVote(t *testing.T) {
+	setupTestServer(t)
+	_, a, _, c := setupTestCluster(t)
+	r := newTestClusterNode(t, 'r', 30003)
+	r.master = a.id
+	rconn := r.meet()
+
+	//The vote is denied while a does not fail, unless the failover is manual
+	rconn.conn.Write(r.messageEpoch(CLUSTER_MSG_FAILOVER_AUTH_REQUEST, 2, 0))
+	if pong := rconn.exchange(r.message(CLUSTER_MSG_PING)); pong.typ != CLUSTER_MSG_PONG {
+		t.Errorf("the server answered with %+v", pong)
+	}
+	if ack := rconn.exchange(r.messageEpoch(CLUSTER_MSG_FAILOVER_AUTH_REQUEST, 2, CLUSTER_MSG_FLAG_FORCEACK)); ack.typ != CLUSTER_MSG_FAILOVER_AUTH_ACK || ack.currentEpoch != 2 {
+		t.Errorf("the server answered with %+v", ack)
+	}
+	//A single vote per epoch
+	rconn.conn.Write(r.messageEpoch(CLUSTER_MSG_FAILOVER_AUTH_REQUEST, 2, CLUSTER_MSG_FLAG_FORCEACK))
+	if pong := rconn.exchange(r.message(CLUSTER_MSG_PING)); pong.typ != CLUSTER_MSG_PONG {
+		t.Errorf("the server answered with %+v", pong)
+	}
+
+	//No vote for another replica of the same master within twice the node timeout
+	rconn.conn.Write(r.message(CLUSTER_MSG_FAIL, a.id))
+	s := newTestClusterNode(t, 's', 30004)
+	s.master = a.id
+	sconn := s.meet()
+	if !strings.Contains(c.do("CLUSTER", "NODES").(string), a.id+" 127.0.0.1:30002@"+strconv.Itoa(a.busPort())+" master,fail ") {
+		t.Errorf("a was not flagged FAIL")
+	}
+	sconn.conn.Write(s.messageEpoch(CLUSTER_MSG_FAILOVER_AUTH_REQUEST, 3, 0))
+	if pong := sconn.exchange(s.message(CLUSTER_MSG_PING)); pong.typ != CLUSTER_MSG_PONG {
+		t.Errorf("the server answered with %+v", pong)
+	}
+}
+
+func TestClusterManualFailoverOfMaster(t *testing.T) {
+	setupTestServer(t)
+	myid, _, _, c := setupTestCluster(t)
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+	r := newTestClusterNode(t, 'r', 30003)
+	r.master = myid
+	rconn := r.meet()
+	if replicas := c.do("CLUSTER", "REPLICAS", myid).([]interface{}); len(replicas) != 1 || !strings.Contains(replicas[0].(string), " slave "+myid+" ") {
+		t.Errorf("CLUSTER REPLICAS: %q", replicas)
+	}
+
+	//The master pauses its writes and tells its offset
+	offset := c.do("ROLE").([]interface{})[1].(int64)
+	if pong := rconn.exchange(r.message(CLUSTER_MSG_MFSTART)); pong.typ != CLUSTER_MSG_PONG || pong.mflags&CLUSTER_MSG_FLAG_PAUSED == 0 || pong.replOffset != offset {
+		t.Errorf("the server answered MFSTART with %+v", pong)
+	}
+	c.expectError("TRYAGAIN Writes are paused by a manual failover", "SIM.ADD", "bar", "y")
+	if dump := c.do("DUMP", "bar"); dump == nil {
+		t.Error("the reads are paused")
+	}
+
+	//The replica took over, the server replicates it and redirects its clients to it
+	r.master = ""
+	r.configEpoch = 2
+	r.addSlots(0, 8191)
+	rconn.exchange(r.message(CLUSTER_MSG_PING))
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " myself,slave "+r.id+" ") || !strings.Contains(nodes, " 2 connected 0-8191\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	if role := c.do("ROLE").([]interface{}); role[0] != "slave" || role[2] != int64(30003) {
+		t.Errorf("ROLE: %q", role)
+	}
+	c.expectError("MOVED 5061 127.0.0.1:30003", "SIM.ADD", "bar", "y")
+	c.expectError("MOVED 5061 127.0.0.1:30003", "DUMP", "bar")
+	//The keys are kept until the server syncs with its new master
+	c.expect(int64(1), "CLUSTER", "COUNTKEYSINSLOT", "5061")
+}
+
+func TestClusterManualFailover(t *testing.T) {
+	setupTestServer(t)
+	myid := startTestCluster(t)
+	c := connect(t)
+	a := newTestClusterNode(t, 'a', 30002)
+	a.configEpoch = 1
+	a.addSlots(0, 8191)
+	a.meet()
+	link, _ := a.accept()
+	b := newTestClusterNode(t, 'b', 30003)
+	b.configEpoch = 2
+	b.addSlots(8192, 12287)
+	b.meet()
+	votes := b.serve(true)
+	d := newTestClusterNode(t, 'd', 30004)
+	d.configEpoch = 3
+	d.addSlots(12288, CLUSTER_SLOTS-1)
+	d.meet()
+	d.serve(true)
+
+	c.expectError("ERR You should send CLUSTER FAILOVER to a replica", "CLUSTER", "FAILOVER")
+	c.expectError("ERR Unknown node", "CLUSTER", "REPLICATE", strings.Repeat("f", 40))
+	c.expectError("ERR Can't replicate myself", "CLUSTER", "REPLICATE", myid)
+	c.expectError("ERR REPLICAOF not allowed in cluster mode.", "REPLICAOF", "127.0.0.1", "30002")
+	c.expect(replyOK, "CLUSTER", "REPLICATE", a.id)
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " myself,slave "+a.id+" ") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	if role := c.do("ROLE").([]interface{}); role[0] != "slave" || role[2] != int64(30002) {
+		t.Errorf("ROLE: %q", role)
+	}
+	c.expectError("ERR syntax error", "CLUSTER", "FAILOVER", "NOW")
+
+	//The server asks a to pause, then is elected once it processed the stream of a
+	c.expect(replyOK, "CLUSTER", "FAILOVER")
+	for m := link.read(); m.typ != CLUSTER_MSG_MFSTART; m = link.read() {
+	}
+	link.conn.Write(a.messageEpoch(CLUSTER_MSG_PONG, 3, CLUSTER_MSG_FLAG_PAUSED))
+	if request := expectBusMessage(t, votes, CLUSTER_MSG_FAILOVER_AUTH_REQUEST); request.currentEpoch != 4 || request.mflags&CLUSTER_MSG_FLAG_FORCEACK == 0 {
+		t.Errorf("the server sent %+v", request)
+	}
+	waitCluster(t, "the failover", func() bool { return cluster.myself.isMaster() })
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " myself,master - 0 0 4 connected 0-8191\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+}
+
+func TestClusterReplicaTakeover(t *testing.T) {
+	setupTestServer(t)
+	startTestCluster(t)
+	c := connect(t)
+	a := newTestClusterNode(t, 'a', 30002)
+	a.configEpoch = 1
+	a.addSlots(0, CLUSTER_SLOTS-1)
+	a.meet()
+	c.expect(replyOK, "CLUSTER", "REPLICATE", a.id)
+	c.expectError("ERR Master is down or failed, please use CLUSTER FAILOVER FORCE", "CLUSTER", "FAILOVER")
+
+	//Another replica of a took over, the server replicates it
+	r := newTestClusterNode(t, 'r', 30003)
+	r.configEpoch = 2
+	r.addSlots(0, CLUSTER_SLOTS-1)
+	r.meet()
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " myself,slave "+r.id+" ") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+	if role := c.do("ROLE").([]interface{}); role[0] != "slave" || role[2] != int64(30003) {
+		t.Errorf("ROLE: %q", role)
+	}
+	c.expectError("MOVED 5061 127.0.0.1:30003", "SIM.ADD", "bar", "x")
+
+	//TAKEOVER takes the slots without an election
+	c.expect(replyOK, "CLUSTER", "FAILOVER", "TAKEOVER")
+	if info := c.do("CLUSTER", "INFO").(string); !strings.Contains(info, "cluster_state:ok\r\n") || !strings.Contains(info, "cluster_my_epoch:3\r\n") {
+		t.Errorf("CLUSTER INFO: %s", info)
+	}
+	if role := c.do("ROLE").([]interface{}); role[0] != "master" {
+		t.Errorf("ROLE: %q", role)
+	}
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// A node of the cluster played by the test, it talks to the server on the cluster bus
+type testClusterNode struct {
+	t           *testing.T
+	id          string
+	port        int
+	bus         net.Listener
+	configEpoch uint64
+	slots       [CLUSTER_SLOTS / 8]byte
+	//The master of a replica
+	master string
+}
+
+func newTestClusterNode(t *testing.T, name byte, port int) *testClusterNode {
+	bus, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bus.Close() })
+	return &testClusterNode{t: t, id: strings.Repeat(string(name), 40), port: port, bus: bus}
+}
+
+func (n *testClusterNode) busPort() int {
+	return n.bus.Addr().(*net.TCPAddr).Port
+}
+
+func (n *testClusterNode) addSlots(start, end int) {
+	for slot := start; slot <= end; slot++ {
+		n.slots[slot/8] |= 1 << (slot % 8)
+	}
+}
+
+func (n *testClusterNode) flags() int {
+	if n.master != "" {
+		return CLUSTER_NODE_REPLICA
+	}
+	return CLUSTER_NODE_MASTER
+}
+
+// The message of the node, the arguments follow the header
+func (n *testClusterNode) message(typ string, args ...string) []byte {
+	return n.messageEpoch(typ, n.configEpoch, 0, args...)
+}
+
+// The message of the node in the current epoch, with the message flags
+func (n *testClusterNode) messageEpoch(typ string, currentEpoch uint64, mflags int, args ...string) []byte {
+	header := []string{
+		n.id, strconv.FormatUint(currentEpoch, 10), strconv.FormatUint(n.configEpoch, 10), "", strconv.Itoa(n.port), strconv.Itoa(n.busPort()),
+		strconv.Itoa(n.flags()), n.master, string(n.slots[:]), "0", strconv.Itoa(mflags),
+	}
+	return (&Command{Cmd: typ, Args: append(header, args...)}).encode()
+}
+
+// The gossip about the node
+func (n *testClusterNode) gossip() []string {
+	return []string{n.id, "127.0.0.1", strconv.Itoa(n.port), strconv.Itoa(n.busPort()), strconv.Itoa(n.flags())}
+}
+
+type testBusConn struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *response.Reader
+}
+
+// Connects the node to the cluster bus of the server
+func (n *testClusterNode) dial() *testBusConn {
+	execMu.Lock()
+	addr := cluster.listener.Addr().String()
+	execMu.Unlock()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	n.t.Cleanup(func() { conn.Close() })
+	return &testBusConn{n.t, conn, response.NewReader(conn)}
+}
+
+// Accepts the link of the server to the node and reads the first message sent on it
+func (n *testClusterNode) accept() (*testBusConn, *clusterMessage) {
+	n.bus.(*net.TCPListener).SetDeadline(time.Now().Add(testReplyTimeout))
+	conn, err := n.bus.Accept()
+	if err != nil {
+		n.t.Fatalf("the server did not connect to the bus of the node: %v", err)
+	}
+	n.t.Cleanup(func() { conn.Close() })
+	bc := &testBusConn{n.t, conn, response.NewReader(conn)}
+	return bc, bc.read()
+}
+
+func (bc *testBusConn) read() *clusterMessage {
+	bc.t.Helper()
+	bc.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	args, _, err := bc.rd.ReadCommand()
+	if err != nil {
+		bc.t.Fatalf("reading a message of the cluster bus: %v", err)
+	}
+	m, err := parseClusterMessage(args)
+	if err != nil {
+		bc.t.Fatalf("parsing %q: %v", args[0], err)
+	}
+	return m
+}
+
+// Sends the message and reads the reply
+func (bc *testBusConn) exchange(data []byte) *clusterMessage {
+	bc.t.Helper()
+	if _, err := bc.conn.Write(data); err != nil {
+		bc.t.Fatal(err)
+	}
+	return bc.read()
+}
+
+// Starts the server as a node of a cluster serving no slot, returns its id
+func startTestCluster(t *testing.T) string {
+	config.Port = 30001
+	config.ClusterEnabled = true
+	bus, err := listenBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	startCluster(bus)
+	execMu.Lock()
+	defer execMu.Unlock()
+	return cluster.myself.id
+}
+
+// Starts the cluster and makes a node serving the slots 8192 to 16383 meet the server, which serves the slots 0 to 8191
+func setupTestCluster(t *testing.T) (string, *testClusterNode, *testBusConn, *testClient) {
+	myid := startTestCluster(t)
+	a := newTestClusterNode(t, 'a', 30002)
+	a.configEpoch = 1
+	a.addSlots(8192, CLUSTER_SLOTS-1)
+	conn := a.dial()
+	pong := conn.exchange(a.message(CLUSTER_MSG_MEET))
+	if pong.typ != CLUSTER_MSG_PONG || pong.sender != myid || pong.port != 30001 || pong.flags&CLUSTER_NODE_MASTER == 0 || pong.master != "" {
+		t.Fatalf("the server answered the MEET with %+v", pong)
+	}
+	c := connect(t)
+	c.expect(replyOK, "CLUSTER", "ADDSLOTSRANGE", "0", "8191")
+	return myid, a, conn, c
+}
+
+func TestKeyHashSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31C3 {
+		t.Errorf("crc16: %#x", crc)
+	}
+	for _, tc := range []struct {
+		key, hashed string
+	}{
+		{"foo", "foo"},
+		{"{user1000}.following", "user1000"},
+		{"{user1000}.followers", "user1000"},
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"foo{{bar}}zap", "{bar"},
+		{"foo{bar}{zap}", "bar"},
+		{"{}", "{}"},
+	} {
+		if slot := keyHashSlot(tc.key); slot != int(crc16(tc.hashed))%CLUSTER_SLOTS {
+			t.Errorf("slot of %q: %d, expected the slot of %q", tc.key, slot, tc.hashed)
+		}
+	}
+	if slot := keyHashSlot("foo"); slot != 12182 {
+		t.Errorf("slot of foo: %d", slot)
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	setupTestServer(t)
+	_, _, _, c := setupTestCluster(t)
+	c.expect(replyPONG, "PING")
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+	c.expect(int64(1), "SIM.ADD", "{bar}1", "x")
+	c.expectError("MOVED 12182 127.0.0.1:30002", "SIM.ADD", "foo", "x")
+	c.expectError("MOVED 12182 127.0.0.1:30002", "SIM.ADD", "{foo}bar", "x")
+	c.expectError("CROSSSLOT", "SIM.JACCARD", "bar", "b")
+	c.expectError("MOVED 12182", "EVAL", "return 1", "1", "foo")
+	c.expect(int64(1), "EVAL", "return 1", "0", "foo")
+
+	//The commands of a transaction are checked as they are queued, then together
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "bar", "y")
+	c.expectError("MOVED 12182", "SIM.ADD", "foo", "x")
+	c.expectError("EXECABORT", "EXEC")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "bar", "y")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "y")
+	c.expectError("CROSSSLOT", "EXEC")
+	c.expect(int64(0), "CLUSTER", "COUNTKEYSINSLOT", strconv.Itoa(keyHashSlot("b")))
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "bar", "y")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "{bar}2", "y")
+	c.expect(array(int64(1), int64(1)), "EXEC")
+}
+
+func TestClusterCommands(t *testing.T) {
+	setupTestServer(t)
+	myid, a, _, c := setupTestCluster(t)
+	c.expect(myid, "CLUSTER", "MYID")
+	c.expect(int64(12182), "CLUSTER", "KEYSLOT", "foo")
+	c.expect(int64(keyHashSlot("user1000")), "CLUSTER", "KEYSLOT", "{user1000}.following")
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+	c.expect(int64(1), "SIM.ADD", "{bar}1", "x")
+	c.expect(int64(2), "CLUSTER", "COUNTKEYSINSLOT", "5061")
+	c.expect(array("bar", "{bar}1"), "CLUSTER", "GETKEYSINSLOT", "5061", "10")
+	c.expect(array("bar"), "CLUSTER", "GETKEYSINSLOT", "5061", "1")
+
+	c.expect(array(
+		array(int64(0), int64(8191), array("127.0.0.1", int64(30001), myid)),
+		array(int64(8192), int64(16383), array("127.0.0.1", int64(30002), a.id)),
+	), "CLUSTER", "SLOTS")
+	if shards := c.do("CLUSTER", "SHARDS").([]interface{}); len(shards) != 2 {
+		t.Errorf("CLUSTER SHARDS: %#v", shards)
+	}
+	info := c.do("CLUSTER", "INFO").(string)
+	for _, line := range []string{"cluster_enabled:1", "cluster_state:ok", "cluster_slots_assigned:16384", "cluster_known_nodes:2", "cluster_size:2"} {
+		if !strings.Contains(info, line+"\r\n") {
+			t.Errorf("CLUSTER INFO has no %s: %s", line, info)
+		}
+	}
+	if info := c.do("INFO", "cluster").(string); !strings.Contains(info, "cluster_enabled:1") {
+		t.Errorf("INFO cluster: %s", info)
+	}
+	nodes := c.do("CLUSTER", "NODES").(string)
+	for _, line := range []string{
+		myid + " 127.0.0.1:30001@",
+		" myself,master - 0 0 0 connected 0-8191\n",
+		a.id + " 127.0.0.1:30002@" + strconv.Itoa(a.busPort()) + " master - ",
+		" 8192-16383\n",
+	} {
+		if !strings.Contains(nodes, line) {
+			t.Errorf("CLUSTER NODES has no %q: %s", line, nodes)
+		}
+	}
+
+	c.expectError("ERR Slot 0 is already busy", "CLUSTER", "ADDSLOTS", "0")
+	c.expectError("ERR Invalid or out of range slot", "CLUSTER", "ADDSLOTS", "16384")
+	c.expectError("ERR Slot 1 specified multiple times", "CLUSTER", "DELSLOTS", "1", "1")
+	c.expectError("ERR start slot number 2 is greater than end slot number 1", "CLUSTER", "DELSLOTSRANGE", "2", "1")
+	c.expectError("ERR wrong number of arguments for 'cluster|addslotsrange' command", "CLUSTER", "ADDSLOTSRANGE", "1", "2", "3")
+	c.expectError("ERR Invalid node address specified", "CLUSTER", "MEET", "nowhere", "30003")
+	c.expectError("ERR unknown subcommand 'FOO'", "CLUSTER", "FOO")
+	c.expectError("ERR wrong number of arguments for 'cluster|keyslot' command", "CLUSTER", "KEYSLOT")
+
+	c.expect(replyOK, "CLUSTER", "DELSLOTS", "0")
+	c.expectError("ERR Slot 0 is already unassigned", "CLUSTER", "DELSLOTS", "0")
+	c.expectError("CLUSTERDOWN The cluster is down", "SIM.ADD", "bar", "x")
+}
+
+func TestClusterBus(t *testing.T) {
+	setupTestServer(t)
+	myid, a, _, c := setupTestCluster(t)
+
+	//The server connects to the node that met it and pings it
+	link, ping := a.accept()
+	if ping.typ != CLUSTER_MSG_PING || ping.sender != myid || !ping.hasSlot(0) || ping.hasSlot(8192) {
+		t.Fatalf("the server sent %+v", ping)
+	}
+
+	//The server meets the node the PONG gossips about
+	b := newTestClusterNode(t, 'b', 30003)
+	if _, err := link.conn.Write(a.message(CLUSTER_MSG_PONG, b.gossip()...)); err != nil {
+		t.Fatal(err)
+	}
+	if _, meet := b.accept(); meet.typ != CLUSTER_MSG_MEET || meet.sender != myid {
+		t.Fatalf("the server sent %+v", meet)
+	}
+	nodes := c.do("CLUSTER", "NODES").(string)
+	if !strings.Contains(nodes, " 1 connected 8192-16383\n") || strings.Contains(nodes, b.id) {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+
+	//CLUSTER MEET starts a handshake too
+	d := newTestClusterNode(t, 'd', 30004)
+	c.expect(replyOK, "CLUSTER", "MEET", "127.0.0.1", "30004", strconv.Itoa(d.busPort()))
+	if _, meet := d.accept(); meet.typ != CLUSTER_MSG_MEET {
+		t.Fatalf("the server sent %+v", meet)
+	}
+}
+
+func TestClusterSlotTakeover(t *testing.T) {
+	setupTestServer(t)
+	myid, a, conn, c := setupTestCluster(t)
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+
+	//A node claiming slots with a greater config epoch takes them
+	a.configEpoch = 2
+	a.addSlots(0, 6000)
+	pong := conn.exchange(a.message(CLUSTER_MSG_PING))
+	if pong.sender != myid || pong.hasSlot(0) || !pong.hasSlot(6001) || pong.currentEpoch != 2 {
+		t.Errorf("the server answered the PING with %+v", pong)
+	}
+	c.expectError("MOVED 5061 127.0.0.1:30002", "SIM.ADD", "bar", "x")
+	//The keys of the slots lost are deleted
+	c.expect(int64(0), "CLUSTER", "COUNTKEYSINSLOT", "5061")
+
+	//Two masters with the same config epoch end with different ones
+	f := newTestClusterNode(t, 'f', 30005)
+	f.configEpoch = 0
+	f.dial().exchange(f.message(CLUSTER_MSG_MEET))
+	if info := c.do("CLUSTER", "INFO").(string); !strings.Contains(info, "cluster_my_epoch:3\r\n") {
+		t.Errorf("CLUSTER INFO: %s", info)
+	}
+}
+
+func TestClusterMigrateSlot(t *testing.T) {
+	setupTestServer(t)
+	_, a, _, c := setupTestCluster(t)
+	c.expect(int64(1), "SIM.ADD", "bar", "x")
+	c.expectError("ERR I'm not the owner of hash slot 12182", "CLUSTER", "SETSLOT", "12182", "MIGRATING", a.id)
+	c.expectError("ERR I don't know about node", "CLUSTER", "SETSLOT", "5061", "MIGRATING", strings.Repeat("b", 40))
+	c.expectError("ERR Invalid CLUSTER SETSLOT action", "CLUSTER", "SETSLOT", "5061", "MOVING", a.id)
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "5061", "MIGRATING", a.id)
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " [5061->-"+a.id+"]\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+
+	//The keys still here are served, the keys already moved are redirected to the node importing the slot
+	c.expect(int64(1), "SIM.ADD", "bar", "y")
+	c.expectError("ASK 5061 127.0.0.1:30002", "SIM.ADD", "{bar}1", "x")
+	c.expectError("TRYAGAIN", "SIM.JACCARD", "bar", "{bar}1")
+	port, commands := startTestMigrateTarget(t, "+OK\r\n")
+	bar := dumpKey(t, "bar")
+	c.expect(replyOK, "MIGRATE", "127.0.0.1", port, "", "0", "1000", "KEYS", "bar")
+	expectMigrated(t, commands, []string{"RESTORE-ASKING", "bar", "0", bar})
+	c.expectError("ASK 5061 127.0.0.1:30002", "SIM.ADD", "bar", "x")
+	c.expect(int64(0), "CLUSTER", "COUNTKEYSINSLOT", "5061")
+
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "5061", "NODE", a.id)
+	c.expectError("MOVED 5061 127.0.0.1:30002", "SIM.ADD", "bar", "x")
+	if nodes := c.do("CLUSTER", "NODES").(string); strings.Contains(nodes, "[") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+
+	c.expect(int64(1), "SIM.ADD", "b", "x")
+	c.expectError("ERR Can't assign hashslot 3300 to a different node while I still hold keys for this hash slot.", "CLUSTER", "SETSLOT", "3300", "NODE", a.id)
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "3300", "MIGRATING", a.id)
+	c.expectError("ASK", "SIM.ADD", "{b}1", "x")
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "3300", "STABLE")
+	c.expect(int64(1), "SIM.ADD", "{b}1", "x")
+}
+
+func TestClusterImportSlot(t *testing.T) {
+	setupTestServer(t)
+	myid, a, _, c := setupTestCluster(t)
+	c.expectError("ERR I'm already the owner of hash slot 5061", "CLUSTER", "SETSLOT", "5061", "IMPORTING", a.id)
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "12182", "IMPORTING", a.id)
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " [12182-<-"+a.id+"]\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+
+	//Only the commands following ASKING are served
+	c.expectError("MOVED 12182 127.0.0.1:30002", "SIM.ADD", "foo", "x")
+	c.expect(replyOK, "ASKING")
+	c.expect(int64(1), "SIM.ADD", "foo", "x")
+	c.expectError("MOVED 12182 127.0.0.1:30002", "SIM.ADD", "foo", "x")
+	c.expect(replyOK, "RESTORE-ASKING", "{foo}1", "0", dumpKey(t, "foo"))
+	c.expect(replyOK, "ASKING")
+	c.expectError("TRYAGAIN", "SIM.JACCARD", "foo", "{foo}2")
+	c.expect(replyOK, "ASKING")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "foo", "y")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "{foo}1", "y")
+	c.expect(array(int64(1), int64(1)), "EXEC")
+	c.expectError("MOVED", "SIM.ADD", "foo", "z")
+
+	//The node takes the slot with a new config epoch
+	c.expect(replyOK, "CLUSTER", "SETSLOT", "12182", "NODE", myid)
+	c.expect(int64(1), "SIM.ADD", "foo", "z")
+	if info := c.do("CLUSTER", "INFO").(string); !strings.Contains(info, "cluster_current_epoch:2\r\n") || !strings.Contains(info, "cluster_my_epoch:2\r\n") {
+		t.Errorf("CLUSTER INFO: %s", info)
+	}
+	if nodes := c.do("CLUSTER", "NODES").(string); !strings.Contains(nodes, " 0-8191 12182\n") {
+		t.Errorf("CLUSTER NODES: %s", nodes)
+	}
+}
+
+func TestClusterDisabled(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expectError("ERR This instance has cluster support disabled", "CLUSTER", "INFO")
+	c.expectError("ERR This instance has cluster support disabled", "ASKING")
+	if info := c.do("INFO", "cluster").(string); !strings.Contains(info, "cluster_enabled:0") {
+		t.Errorf("INFO cluster: %s", info)
+	}
+}
@@ -2,8 +2,13 @@ package server
 
 import (
 	"errors"
-	"github.com/inmemdb/inmem/server/response"
+	"fmt"
 	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
 )
 
 /**
@@ -14,6 +19,80 @@ Example: PUT Key Value
 const (
 	COMMAND_PING          = "ping"
 	COMMAND_PING_RESPONSE = "PONG"
+
+	COMMAND_MULTI   = "multi"
+	COMMAND_EXEC    = "exec"
+	COMMAND_DISCARD = "discard"
+	COMMAND_WATCH   = "watch"
+	COMMAND_UNWATCH = "unwatch"
+
+	COMMAND_EVAL    = "eval"
+	COMMAND_EVALSHA = "evalsha"
+	COMMAND_EVAL_RO = "eval_ro"
+	COMMAND_SCRIPT  = "script"
+
+	COMMAND_HELLO  = "hello"
+	COMMAND_QUIT   = "quit"
+	COMMAND_CLIENT = "client"
+	COMMAND_AUTH   = "auth"
+	COMMAND_ACL    = "acl"
+
+	COMMAND_SUBSCRIBE    = "subscribe"
+	COMMAND_UNSUBSCRIBE  = "unsubscribe"
+	COMMAND_PSUBSCRIBE   = "psubscribe"
+	COMMAND_PUNSUBSCRIBE = "punsubscribe"
+	COMMAND_PUBLISH      = "publish"
+	COMMAND_PUBSUB       = "pubsub"
+
+	COMMAND_WATCHQUERY   = "watchquery"
+	COMMAND_UNWATCHQUERY = "unwatchquery"
+
+	COMMAND_INFO    = "info"
+	COMMAND_SLOWLOG = "slowlog"
+	COMMAND_LATENCY = "latency"
+	COMMAND_MONITOR = "monitor"
+
+	COMMAND_REPLICAOF = "replicaof"
+	COMMAND_ROLE      = "role"
+	COMMAND_REPLCONF  = "replconf"
+	COMMAND_PSYNC     = "psync"
+	COMMAND_SYNC      = "sync"
+	COMMAND_WAIT      = "wait"
+	COMMAND_WAITAOF   = "waitaof"
+
+	COMMAND_RAFT    = "raft"
+	COMMAND_CLUSTER = "cluster"
+	COMMAND_ASKING  = "asking"
+
+	COMMAND_SENTINEL = "sentinel"
+
+	COMMAND_DEL            = "del"
+	COMMAND_DUMP           = "dump"
+	COMMAND_RESTORE        = "restore"
+	COMMAND_RESTORE_ASKING = "restore-asking"
+	COMMAND_MIGRATE        = "migrate"
+
+	COMMAND_SIM_ADD         = "sim.add"
+	COMMAND_SIM_JACCARD     = "sim.jaccard"
+	COMMAND_SIM_MERGE       = "sim.merge"
+	COMMAND_SIM_INDEX_ADD   = "sim.index.add"
+	COMMAND_SIM_INDEX_QUERY = "sim.index.query"
+)
+
+// Command flags
+const (
+	//The command modifies the dataset
+	CMD_FLAG_WRITE = 1 << iota
+	//The command only reads the dataset
+	CMD_FLAG_READONLY
+	//The command can not be called from scripts
+	CMD_FLAG_NOSCRIPT
+	//The command can be run before authenticating, whatever the ACL rules of the user
+	CMD_FLAG_NOAUTH
+	//The command is served in a slot the node imports, like the commands following ASKING
+	CMD_FLAG_ASKING
+	//The command propagates the writes it does itself, eg: MIGRATE propagates a DEL of the keys it moved
+	CMD_FLAG_NOPROPAGATE
 )
 
 type Command struct {
@@ -24,11 +103,262 @@ type Command struct {
 	Args []string
 }
 
+// Describes a command known to the server
+type commandSpec struct {
+	//INFO: Arity follows the redis convention, it counts the command name as well.
+	//A positive arity is the exact number of tokens, a negative arity is the minimum.
+	arity int
+	flags int
+
+	//INFO: Key positions also follow the redis convention, they are indexes of the tokens.
+	//A negative lastKey counts from the end, firstKey 0 means the command takes no keys.
+	firstKey int
+	lastKey  int
+	step     int
+
+	//The ACL categories of the command, without the @
+	categories []string
+}
+
+var commandTable = map[string]commandSpec{
+	COMMAND_PING:    {arity: -1, categories: []string{"fast", "connection"}},
+	COMMAND_MULTI:   {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"fast", "transaction"}},
+	COMMAND_EXEC:    {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "transaction"}},
+	COMMAND_DISCARD: {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"fast", "transaction"}},
+	COMMAND_WATCH:   {arity: -2, flags: CMD_FLAG_NOSCRIPT, firstKey: 1, lastKey: -1, step: 1, categories: []string{"fast", "transaction"}},
+	COMMAND_UNWATCH: {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"fast", "transaction"}},
+	COMMAND_EVAL:    {arity: -3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "scripting"}},
+	COMMAND_EVALSHA: {arity: -3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "scripting"}},
+	COMMAND_EVAL_RO: {arity: -3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "scripting"}},
+	COMMAND_SCRIPT:  {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "scripting"}},
+
+	COMMAND_HELLO:  {arity: -1, flags: CMD_FLAG_NOSCRIPT | CMD_FLAG_NOAUTH, categories: []string{"fast", "connection"}},
+	COMMAND_QUIT:   {arity: -1, flags: CMD_FLAG_NOSCRIPT | CMD_FLAG_NOAUTH, categories: []string{"fast", "connection"}},
+	COMMAND_CLIENT: {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "connection"}},
+	COMMAND_AUTH:   {arity: -2, flags: CMD_FLAG_NOSCRIPT | CMD_FLAG_NOAUTH, categories: []string{"fast", "connection"}},
+	COMMAND_ACL:    {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+
+	COMMAND_SUBSCRIBE:    {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "pubsub"}},
+	COMMAND_UNSUBSCRIBE:  {arity: -1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "pubsub"}},
+	COMMAND_PSUBSCRIBE:   {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "pubsub"}},
+	COMMAND_PUNSUBSCRIBE: {arity: -1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "pubsub"}},
+	COMMAND_PUBLISH:      {arity: 3, categories: []string{"fast", "pubsub"}},
+	COMMAND_PUBSUB:       {arity: -2, categories: []string{"slow", "pubsub"}},
+
+	COMMAND_WATCHQUERY:   {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "read", "pubsub"}},
+	COMMAND_UNWATCHQUERY: {arity: -1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "pubsub"}},
+
+	COMMAND_INFO:    {arity: -1, categories: []string{"slow", "dangerous"}},
+	COMMAND_SLOWLOG: {arity: -2, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_LATENCY: {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_MONITOR: {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+
+	COMMAND_REPLICAOF: {arity: 3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_ROLE:      {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"fast", "admin", "dangerous"}},
+	COMMAND_REPLCONF:  {arity: -1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_PSYNC:     {arity: -3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_SYNC:      {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_WAIT:      {arity: 3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "connection"}},
+	COMMAND_WAITAOF:   {arity: 4, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "connection"}},
+
+	COMMAND_RAFT:    {arity: -3, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+	COMMAND_CLUSTER: {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow"}},
+	COMMAND_ASKING:  {arity: 1, flags: CMD_FLAG_NOSCRIPT, categories: []string{"fast", "connection"}},
+
+	COMMAND_SENTINEL: {arity: -2, flags: CMD_FLAG_NOSCRIPT, categories: []string{"slow", "admin", "dangerous"}},
+
+	COMMAND_DEL:            {arity: -2, flags: CMD_FLAG_WRITE, firstKey: 1, lastKey: -1, step: 1, categories: []string{"keyspace", "write", "slow"}},
+	COMMAND_DUMP:           {arity: 2, flags: CMD_FLAG_READONLY, firstKey: 1, lastKey: 1, step: 1, categories: []string{"keyspace", "read", "slow"}},
+	COMMAND_RESTORE:        {arity: -4, flags: CMD_FLAG_WRITE, firstKey: 1, lastKey: 1, step: 1, categories: []string{"keyspace", "write", "slow", "dangerous"}},
+	COMMAND_RESTORE_ASKING: {arity: -4, flags: CMD_FLAG_WRITE | CMD_FLAG_ASKING, firstKey: 1, lastKey: 1, step: 1, categories: []string{"keyspace", "write", "slow", "dangerous"}},
+	COMMAND_MIGRATE:        {arity: -6, flags: CMD_FLAG_WRITE | CMD_FLAG_NOSCRIPT | CMD_FLAG_NOPROPAGATE, categories: []string{"keyspace", "write", "slow", "dangerous"}},
+
+	COMMAND_SIM_ADD:         {arity: -3, flags: CMD_FLAG_WRITE, firstKey: 1, lastKey: 1, step: 1, categories: []string{"slow", "write", "set"}},
+	COMMAND_SIM_JACCARD:     {arity: 3, flags: CMD_FLAG_READONLY, firstKey: 1, lastKey: 2, step: 1, categories: []string{"slow", "read", "set"}},
+	COMMAND_SIM_MERGE:       {arity: -3, flags: CMD_FLAG_WRITE, firstKey: 1, lastKey: -1, step: 1, categories: []string{"slow", "write", "set"}},
+	COMMAND_SIM_INDEX_ADD:   {arity: -3, flags: CMD_FLAG_WRITE, firstKey: 1, lastKey: -1, step: 1, categories: []string{"slow", "write", "set"}},
+	COMMAND_SIM_INDEX_QUERY: {arity: 4, flags: CMD_FLAG_READONLY, firstKey: 1, lastKey: 2, step: 1, categories: []string{"slow", "read", "set"}},
+}
+
+// Returns a copy of the command with the secrets it carries hidden, to be logged
+func (cmd *Command) redacted() *Command {
+	var secret func(i int) bool
+	switch cmd.name() {
+	case COMMAND_AUTH:
+		secret = func(i int) bool { return true }
+	case COMMAND_HELLO:
+		//HELLO protover AUTH username password
+		secret = func(i int) bool { return i >= 2 && strings.EqualFold(cmd.Args[i-2], "auth") }
+	case COMMAND_ACL:
+		//ACL SETUSER username rule..., the >password, <password, #hash and !hash rules carry secrets
+		if len(cmd.Args) == 0 || !strings.EqualFold(cmd.Args[0], "setuser") {
+			return cmd
+		}
+		secret = func(i int) bool { return i >= 2 && cmd.Args[i] != "" && strings.IndexByte("><#!", cmd.Args[i][0]) >= 0 }
+	default:
+		return cmd
+	}
+
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		if secret(i) {
+			arg = "(redacted)"
+		}
+		args[i] = arg
+	}
+	return &Command{Cmd: cmd.Cmd, Args: args}
+}
+
+// Tells if the command is in the @fast category, commands missing from the command table run as PING which is fast
+func isFastCommand(cmd *Command) bool {
+	spec, ok := commandTable[cmd.name()]
+	if !ok {
+		return true
+	}
+	for _, category := range spec.categories {
+		if category == "fast" {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands are case insensitive, the name is always looked up in lower case
+func (cmd *Command) name() string {
+	return strings.ToLower(cmd.Cmd)
+}
+
+// Validates the number of arguments against the command table,
+// commands that are not in the table are not validated.
+func (cmd *Command) checkArity() error {
+	spec, ok := commandTable[cmd.name()]
+	if !ok {
+		return nil
+	}
+	tokens := len(cmd.Args) + 1
+	if (spec.arity > 0 && tokens != spec.arity) || (spec.arity < 0 && tokens < -spec.arity) {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.name())
+	}
+	return nil
+}
+
+// Returns the keys the command reads or writes, derived from the key positions in the command table.
+// The arity must have been checked before.
+func (cmd *Command) keys() []string {
+	switch cmd.name() {
+	case COMMAND_EVAL, COMMAND_EVALSHA, COMMAND_EVAL_RO:
+		//The number of keys of a script is given by its numkeys argument
+		numkeys, err := strconv.Atoi(cmd.Args[1])
+		if err != nil || numkeys < 0 || numkeys > len(cmd.Args)-2 {
+			return nil
+		}
+		return cmd.Args[2 : 2+numkeys]
+	case COMMAND_MIGRATE:
+		return migrateKeys(cmd.Args)
+	}
+
+	spec, ok := commandTable[cmd.name()]
+	if !ok || spec.firstKey == 0 {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last = len(cmd.Args) + 1 + last
+	}
+	var keys []string
+	for i := spec.firstKey; i <= last && i <= len(cmd.Args); i += spec.step {
+		keys = append(keys, cmd.Args[i-1])
+	}
+	return keys
+}
+
 func (cmd *Command) EvalCommand() ([]byte, error) {
 	log.Println("comamnd:", cmd.Cmd)
-	switch cmd.Cmd {
+	if err := checkSentinelCommand(cmd); err != nil {
+		return nil, err
+	}
+	if err := cmd.checkArity(); err != nil {
+		return nil, err
+	}
+	//INFO: The client is redirected to the node serving the keys before anything runs
+	if err := checkClusterRedirect(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkClusterWritesPaused(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkReplicaReadOnly(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkMinReplicas(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkAppendOnlyFileWritable(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkRaftApply(cmd); err != nil {
+		return nil, err
+	}
+
+	//INFO: The commands that modified the dataset are propagated to the replicas once they ran
+	dirty := statDirty
+	beginPropagation()
+	defer endPropagation()
+	data, err := cmd.dispatch()
+	if commandTable[cmd.name()].flags&(CMD_FLAG_WRITE|CMD_FLAG_NOPROPAGATE) == CMD_FLAG_WRITE && statDirty != dirty {
+		propagate(cmd)
+	}
+	return data, err
+}
+
+func (cmd *Command) dispatch() ([]byte, error) {
+	switch cmd.name() {
 	case COMMAND_PING:
 		return cmd.evalPING()
+	case COMMAND_EVAL, COMMAND_EVAL_RO, COMMAND_EVALSHA:
+		return cmd.evalEVAL()
+	case COMMAND_SCRIPT:
+		return cmd.evalSCRIPT()
+	case COMMAND_PUBLISH:
+		return cmd.evalPUBLISH()
+	case COMMAND_PUBSUB:
+		return cmd.evalPUBSUB()
+	case COMMAND_INFO:
+		return cmd.evalINFO()
+	case COMMAND_SLOWLOG:
+		return cmd.evalSLOWLOG()
+	case COMMAND_LATENCY:
+		return cmd.evalLATENCY()
+	case COMMAND_REPLICAOF:
+		return cmd.evalREPLICAOF()
+	case COMMAND_ROLE:
+		return cmd.evalROLE()
+	case COMMAND_WAIT, COMMAND_WAITAOF:
+		return cmd.evalWAIT()
+	case COMMAND_RAFT:
+		return cmd.evalRAFT()
+	case COMMAND_CLUSTER:
+		return cmd.evalCLUSTER()
+	case COMMAND_SENTINEL:
+		return cmd.evalSENTINEL()
+	case COMMAND_DEL:
+		return cmd.evalDEL()
+	case COMMAND_DUMP:
+		return cmd.evalDUMP()
+	case COMMAND_RESTORE, COMMAND_RESTORE_ASKING:
+		return cmd.evalRESTORE()
+	case COMMAND_MIGRATE:
+		return cmd.evalMIGRATE()
+	case COMMAND_SIM_ADD:
+		return cmd.evalSIMADD()
+	case COMMAND_SIM_JACCARD:
+		return cmd.evalSIMJACCARD()
+	case COMMAND_SIM_MERGE:
+		return cmd.evalSIMMERGE()
+	case COMMAND_SIM_INDEX_ADD:
+		return cmd.evalSIMINDEXADD()
+	case COMMAND_SIM_INDEX_QUERY:
+		return cmd.evalSIMINDEXQUERY()
 	default:
 		return cmd.evalPING()
 	}
@@ -49,3 +379,20 @@ func (cmd *Command) evalPING() ([]byte, error) {
 
 	return b, nil
 }
+
+// Evaluates the command and encodes the error as the reply if the command fails
+func evalCommand(cmd *Command) []byte {
+	start := time.Now()
+	data, err := cmd.EvalCommand()
+	if err != nil {
+		data = response.EncodeError(err)
+	}
+	recordCall(cmd, time.Since(start), data)
+	if err != nil {
+		return data
+	}
+	if commandTable[cmd.name()].flags&CMD_FLAG_READONLY != 0 {
+		trackKeysRead(cmd)
+	}
+	return data
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Connection commands change the state of the connection of the client sending them, so unlike the
+commands run by Command.EvalCommand they are evaluated with the Client:
+	- HELLO [protover [AUTH username password] [SETNAME clientname]] switches the connection to RESP2
+	  or RESP3, authenticates it, names it and describes the server
+	- AUTH [username] password authenticates the connection (see auth.go)
+	- ACL manages the users and tells the connection which one it uses (see acl.go)
+	- QUIT closes the connection once the replies sent before are written
+	- SUBSCRIBE, UNSUBSCRIBE, PSUBSCRIBE and PUNSUBSCRIBE (see pubsub.go)
+	- WATCHQUERY and UNWATCHQUERY (see watchquery.go)
+	- CLIENT ID returns the id of the connection, CLIENT TRACKING / CACHING / GETREDIR (see tracking.go)
+	- CLIENT SETNAME / GETNAME name the connection, the name is shown in the slow log
+	- MONITOR streams the commands of every client to the connection (see monitor.go)
+	- REPLCONF, PSYNC and SYNC turn the connection into a replica (see replication.go)
+*/
+
+// Tells if the command is evaluated by evalConnectionCommand
+func (c *Client) isConnectionCommand(cmd *Command) bool {
+	switch cmd.name() {
+	case COMMAND_HELLO, COMMAND_AUTH, COMMAND_SUBSCRIBE, COMMAND_UNSUBSCRIBE, COMMAND_PSUBSCRIBE, COMMAND_PUNSUBSCRIBE,
+		COMMAND_WATCHQUERY, COMMAND_UNWATCHQUERY, COMMAND_CLIENT, COMMAND_ACL, COMMAND_MONITOR,
+		COMMAND_REPLCONF, COMMAND_PSYNC, COMMAND_SYNC, COMMAND_ASKING:
+		return true
+	case COMMAND_PING:
+		//In RESP2 PING has its own reply in subscriber mode
+		return c.resp == 2 && c.inSubscriberMode()
+	}
+	return false
+}
+
+// Evaluates the connection commands, must be called holding execMu
+func (c *Client) evalConnectionCommand(cmd *Command) []byte {
+	if err := cmd.checkArity(); err != nil {
+		return response.EncodeError(err)
+	}
+
+	switch cmd.name() {
+	case COMMAND_HELLO:
+		return c.hello(cmd.Args)
+	case COMMAND_AUTH:
+		return c.auth(cmd.Args)
+	case COMMAND_SUBSCRIBE:
+		return c.subscribe(cmd.Args, false)
+	case COMMAND_PSUBSCRIBE:
+		return c.subscribe(cmd.Args, true)
+	case COMMAND_UNSUBSCRIBE:
+		return c.unsubscribe(cmd.Args, false)
+	case COMMAND_PUNSUBSCRIBE:
+		return c.unsubscribe(cmd.Args, true)
+	case COMMAND_WATCHQUERY:
+		return c.watchQuery(cmd.Args)
+	case COMMAND_UNWATCHQUERY:
+		return c.unwatchQuery(cmd.Args)
+	case COMMAND_CLIENT:
+		return c.client(cmd.Args)
+	case COMMAND_ACL:
+		return c.acl(cmd.Args)
+	case COMMAND_MONITOR:
+		return c.monitor()
+	case COMMAND_REPLCONF:
+		return c.replconf(cmd.Args)
+	case COMMAND_PSYNC, COMMAND_SYNC:
+		return c.psync(cmd)
+	case COMMAND_ASKING:
+		if cluster == nil {
+			return response.EncodeError(errClusterDisabled)
+		}
+		c.asking = true
+		return response.Encode("OK", true)
+	default:
+		if len(cmd.Args) > 1 {
+			return response.EncodeError(errors.New("ERR wrong number of arguments for 'ping' command"))
+		}
+		message := ""
+		if len(cmd.Args) == 1 {
+			message = cmd.Args[0]
+		}
+		return response.EncodeArray([][]byte{response.Encode("pong", false), response.Encode(message, false)})
+	}
+}
+
+func (c *Client) hello(args []string) []byte {
+	proto := c.resp
+	if len(args) > 0 {
+		var err error
+		proto, err = strconv.Atoi(args[0])
+		if err != nil {
+			return response.EncodeError(errors.New("ERR Protocol version is not an integer or out of range"))
+		}
+		if proto != 2 && proto != 3 {
+			return response.EncodeError(errors.New("NOPROTO unsupported protocol version"))
+		}
+	}
+
+	authenticated := c.authenticated
+	var name *string
+	for i := 1; i < len(args); i++ {
+		if strings.EqualFold(args[i], "auth") && i+2 < len(args) {
+			if err := c.authenticate(args[i+1], args[i+2]); err != nil {
+				return response.EncodeError(err)
+			}
+			authenticated = true
+			i += 2
+			continue
+		}
+		if strings.EqualFold(args[i], "setname") && i+1 < len(args) {
+			if err := checkClientName(args[i+1]); err != nil {
+				return response.EncodeError(err)
+			}
+			name = &args[i+1]
+			i++
+			continue
+		}
+		return response.EncodeError(fmt.Errorf("ERR Syntax error in HELLO option '%s'", args[i]))
+	}
+	if !authenticated {
+		return response.EncodeError(errors.New("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"))
+	}
+	c.authenticated = true
+	c.resp = proto
+	if name != nil {
+		c.name = *name
+	}
+
+	fields := [][]byte{
+		response.Encode("server", false), response.Encode("inmem", false),
+		response.Encode("version", false), response.Encode(config.Version, false),
+		response.Encode("proto", false), response.Encode(c.resp, false),
+		response.Encode("id", false), response.Encode(int64(c.id), false),
+		response.Encode("mode", false), response.Encode(serverMode(), false),
+		response.Encode("role", false), response.Encode(serverRole(), false),
+		response.Encode("modules", false), response.EncodeArray(nil),
+	}
+	return c.encodeMap(fields)
+}
+
+// Encodes the alternating keys and values as a map in RESP3 and as a flat array in RESP2
+func (c *Client) encodeMap(fields [][]byte) []byte {
+	if c.resp == 3 {
+		return response.EncodeMap(fields)
+	}
+	return response.EncodeArray(fields)
+}
+
+func (c *Client) client(args []string) []byte {
+	sub := strings.ToLower(args[0])
+	switch {
+	case sub == "id" && len(args) == 1:
+		return response.Encode(int64(c.id), false)
+	case sub == "tracking" && len(args) >= 2:
+		return c.clientTracking(args[1:])
+	case sub == "caching" && len(args) == 2:
+		return c.clientCaching(args[1:])
+	case sub == "getredir" && len(args) == 1:
+		return c.clientGetRedir()
+	case sub == "setname" && len(args) == 2:
+		if err := checkClientName(args[1]); err != nil {
+			return response.EncodeError(err)
+		}
+		c.name = args[1]
+		return response.Encode("OK", true)
+	case sub == "getname" && len(args) == 1:
+		if c.name == "" {
+			return response.Encode(nil, false)
+		}
+		return response.Encode(c.name, false)
+	case sub == "id" || sub == "tracking" || sub == "caching" || sub == "getredir" || sub == "setname" || sub == "getname":
+		return response.EncodeError(fmt.Errorf("ERR wrong number of arguments for 'client|%s' command", sub))
+	}
+	return response.EncodeError(fmt.Errorf("ERR unknown subcommand '%s'. Try CLIENT HELP.", args[0]))
+}
+
+// Client names are shown in a space separated list like the slow log, they can not contain spaces
+func checkClientName(name string) error {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+		}
+	}
+	return nil
+}
+
+// A client is in subscriber mode while it has subscriptions or watched queries
+func (c *Client) inSubscriberMode() bool {
+	return c.subscriptionCount() > 0 || len(c.queries) > 0
+}
+
+// In RESP2 a subscribed connection can only receive messages, so it is limited to the commands
+// managing its subscriptions. A RESP3 connection gets the messages as push frames and can run anything.
+func (c *Client) checkSubscriberMode(cmd *Command) error {
+	if c.resp != 2 || !c.inSubscriberMode() {
+		return nil
+	}
+	switch cmd.name() {
+	case COMMAND_SUBSCRIBE, COMMAND_UNSUBSCRIBE, COMMAND_PSUBSCRIBE, COMMAND_PUNSUBSCRIBE,
+		COMMAND_WATCHQUERY, COMMAND_UNWATCHQUERY, COMMAND_PING, COMMAND_QUIT:
+		return nil
+	}
+	return fmt.Errorf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / (UN)WATCHQUERY / PING / QUIT are allowed in this context", cmd.name())
+}
@@ -0,0 +1,53 @@
+package server
+
+import "errors"
+
+var (
+	//INFO: The keyspace maps every key to its value, like every other
+	//server wide state it is only used while holding execMu.
+	keyspace = map[string]interface{}{}
+
+	errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+)
+
+// Stores the value at key, must be called holding execMu
+func setKey(key string, value interface{}) {
+	if _, ok := keyspace[key]; !ok {
+		notifyKeyspaceEvent(NOTIFY_NEW, "new", key)
+		if cluster != nil {
+			clusterAddKey(key)
+		}
+	}
+	keyspace[key] = value
+}
+
+// Deletes the key, must be called holding execMu. Returns false when the key does not exist.
+func deleteKey(key string) bool {
+	if _, ok := keyspace[key]; !ok {
+		return false
+	}
+	delete(keyspace, key)
+	if cluster != nil {
+		clusterDelKey(key)
+	}
+	return true
+}
+
+// Must be called, holding execMu, by every command that modifies a key
+func signalModifiedKey(key string) {
+	statDirty++
+	touchWatchedKey(key)
+	touchWatchedQueries(key)
+	trackingInvalidateKey(key)
+}
+
+// Must be called, holding execMu, by read commands when a key they read does not exist
+func signalKeyMiss(key string) {
+	statKeyspaceMisses++
+	notifyKeyspaceEvent(NOTIFY_KEY_MISS, "keymiss", key)
+}
+
+// Must be called, holding execMu, by read commands when a key they read exists
+func signalKeyHit(key string) {
+	statKeyspaceHits++
+}
@@ -0,0 +1,108 @@
+package glob
+
+/**
+Glob style pattern matching, the same flavour redis uses for PSUBSCRIBE, KEYS and friends:
+	- * matches any sequence of characters, including an empty one
+	- ? matches exactly one character
+	- [abc] matches one of the characters, [^abc] any character but them, [a-z] a range
+	- \x matches the character x literally
+Matching is done on bytes, not on runes.
+*/
+func Match(pattern, s string) bool {
+	//INFO: Only the last star is backtracked to: when the rest of the pattern fails to match, the last
+	//star swallows one more character and the rest is retried from there. An earlier star never has to
+	//be retried, what it could swallow more the last star can swallow as well, so matching takes at most
+	//len(pattern)*len(s) steps whatever the number of stars.
+	p, i := 0, 0
+	starP, starI := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			if p == len(pattern) {
+				return true
+			}
+			starP, starI = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if ok, next := matchOne(pattern, p, s[i]); ok {
+				p = next
+				i++
+				continue
+			}
+		}
+		if starP < 0 {
+			return false
+		}
+		starI++
+		p, i = starP, starI
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches c against the element of the pattern starting at p, which is not a star,
+// returns the position of the next element
+func matchOne(pattern string, p int, c byte) (bool, int) {
+	switch pattern[p] {
+	case '?':
+		return true, p + 1
+	case '[':
+		ok, rest := matchClass(pattern[p+1:], c)
+		return ok, len(pattern) - len(rest)
+	case '\\':
+		if p+1 < len(pattern) {
+			p++
+		}
+	}
+	return pattern[p] == c, p + 1
+}
+
+// Matches c against the character class starting right after '[',
+// returns the rest of the pattern after the closing ']'
+func matchClass(pattern string, c byte) (bool, string) {
+	not := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		not = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			if pattern[1] == c {
+				matched = true
+			}
+			pattern = pattern[2:]
+		case len(pattern) >= 3 && pattern[1] == '-' && pattern[2] != ']':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				matched = true
+			}
+			pattern = pattern[3:]
+		default:
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+
+	//An unterminated class behaves as if it was closed at the end of the pattern
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	if not {
+		matched = !matched
+	}
+	return matched, pattern
+}
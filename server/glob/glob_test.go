@@ -0,0 +1,76 @@
+package glob
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"*", "", true},
+		{"*", "news.sport", true},
+		{"news.*", "news.sport", true},
+		{"news.*", "weather", false},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h*llo", "heeeello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-b]llo", "hbllo", true},
+		{"h[b-a]llo", "hbllo", true},
+		{"h[a-b]llo", "hcllo", false},
+		{"h\\*llo", "h*llo", true},
+		{"h\\*llo", "hello", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "aXbYcZ", false},
+		{"**x", "abcx", true},
+		{"exact", "exact", true},
+		{"exact", "exactly", false},
+		{"[abc", "b", true},
+		{"*?", "", false},
+		{"*?", "a", true},
+		{"a*?c", "abxc", true},
+		{"*[0-9]x", "ab1x", true},
+		{"*[0-9]x", "ab1y", false},
+		{"*.*.end", "a.b.c.end", true},
+		{"*\\*", "ab*", true},
+		{"*\\*", "ab", false},
+		{"a\\", "a\\", true},
+	}
+
+	for _, tc := range cases {
+		if got := Match(tc.pattern, tc.s); got != tc.match {
+			t.Errorf("Match(%q, %q) = %v, expected %v", tc.pattern, tc.s, got, tc.match)
+		}
+	}
+}
+
+// Patterns with many stars that do not match made a backtracking matcher take exponential time
+func TestMatchPathological(t *testing.T) {
+	cases := []struct {
+		pattern string
+		s       string
+	}{
+		{"*a*a*a*a*a*a*b", strings.Repeat("a", 60)},
+		{"*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 60)},
+		{strings.Repeat("*a", 100) + "b", strings.Repeat("a", 1000)},
+		{strings.Repeat("*?", 50) + "[b]", strings.Repeat("a", 1000)},
+	}
+
+	for _, tc := range cases {
+		start := time.Now()
+		if Match(tc.pattern, tc.s) {
+			t.Errorf("Match(%q, %q) = true, expected false", tc.pattern, tc.s)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Match(%q, %d bytes) took %v", tc.pattern, len(tc.s), elapsed)
+		}
+	}
+}
@@ -0,0 +1,478 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/metrics"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+INFO [section ...] reports the state of the server in the text format of redis, one "# Section" header
+followed by field:value lines, so tools reading the INFO of redis can read it:
+	- without sections, or with "default", every section but commandstats is returned
+	- "all" and "everything" return every section
+The statistics are updated when a command runs (recordCall), is rejected before running (recordRejectedCall)
+and when clients connect. There are no RDB snapshots, the persistence section only reports the append only file.
+used_memory_rss and mem_fragmentation_ratio need the resident set size of the process, they are left out
+where it can not be read (it is read from /proc on Linux).
+There is no maxclients limit so rejected_connections stays 0, the clients refused by protected mode are
+counted in protected_mode_rejected_connections.
+*/
+
+const (
+	//The instantaneous metrics are the average of the last samples, taken every period
+	instantaneousSamples      = 16
+	instantaneousSamplePeriod = 100 * time.Millisecond
+)
+
+var (
+	serverStartTime = time.Now()
+	serverRunID     = randomHex(40)
+
+	//Updated with sync/atomic, they are read and written without execMu
+	statNumCommands    uint64
+	statNetInputBytes  uint64
+	statNetOutputBytes uint64
+
+	//Guarded by execMu
+	statNumConnections            int64
+	statProtectedModeRejectedConn int64
+	statKeyspaceHits              int64
+	statKeyspaceMisses            int64
+	statErrorReplies              int64
+	statDirty                     int64
+	statPeakMemory                uint64
+	commandStats                  = map[string]*commandStat{}
+
+	//The readiness API of the poller, set when the AsyncServer is created. The sync server has no poller.
+	multiplexingAPI = "none"
+
+	instantaneousMu                                sync.Mutex
+	instOpsPerSec, instInputBytes, instOutputBytes instantaneousMetric
+)
+
+type commandStat struct {
+	calls         int64
+	usec          int64
+	rejectedCalls int64
+	failedCalls   int64
+	latency       *metrics.Histogram
+
+	//Calls by power of two microseconds for LATENCY HISTOGRAM
+	usecBuckets [64]int64
+}
+
+type instantaneousMetric struct {
+	samples   [instantaneousSamples]float64
+	next      int
+	lastValue uint64
+	lastTime  time.Time
+}
+
+func randomHex(length int) string {
+	b := make([]byte, length/2)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns the statistics of the command, commands missing from the command table run as PING
+func getCommandStat(cmd *Command) *commandStat {
+	name := cmd.name()
+	if _, ok := commandTable[name]; !ok {
+		name = COMMAND_PING
+	}
+	stat, ok := commandStats[name]
+	if !ok {
+		stat = &commandStat{latency: metrics.NewHistogram(metrics.LatencyBuckets)}
+		commandStats[name] = stat
+	}
+	return stat
+}
+
+// Counts a command that ran and its duration, must be called holding execMu
+func recordCall(cmd *Command, duration time.Duration, reply []byte) {
+	atomic.AddUint64(&statNumCommands, 1)
+	stat := getCommandStat(cmd)
+	stat.calls++
+	stat.usec += duration.Microseconds()
+	stat.latency.Observe(duration.Seconds())
+	stat.usecBuckets[latencyHistogramBucket(duration.Microseconds())]++
+	event := LATENCY_EVENT_COMMAND
+	if isFastCommand(cmd) {
+		event = LATENCY_EVENT_FAST_COMMAND
+	}
+	latencyAddSampleIfNeeded(event, duration)
+	if len(reply) > 0 && reply[0] == '-' {
+		stat.failedCalls++
+		statErrorReplies++
+	}
+}
+
+// Counts a command refused before running, eg: by ACL rules, must be called holding execMu
+func recordRejectedCall(cmd *Command) {
+	getCommandStat(cmd).rejectedCalls++
+	statErrorReplies++
+}
+
+func (m *instantaneousMetric) track(value uint64, now time.Time) {
+	if !m.lastTime.IsZero() {
+		m.samples[m.next] = float64(value-m.lastValue) / now.Sub(m.lastTime).Seconds()
+		m.next = (m.next + 1) % instantaneousSamples
+	}
+	m.lastValue = value
+	m.lastTime = now
+}
+
+func (m *instantaneousMetric) value() float64 {
+	sum := 0.0
+	for _, sample := range m.samples {
+		sum += sample
+	}
+	return sum / instantaneousSamples
+}
+
+// Samples the counters behind the instantaneous metrics, runs for the lifetime of the server
+func sampleInstantaneousMetrics() {
+	ticker := time.NewTicker(instantaneousSamplePeriod)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		instantaneousMu.Lock()
+		instOpsPerSec.track(atomic.LoadUint64(&statNumCommands), now)
+		instInputBytes.track(atomic.LoadUint64(&statNetInputBytes), now)
+		instOutputBytes.track(atomic.LoadUint64(&statNetOutputBytes), now)
+		instantaneousMu.Unlock()
+	}
+}
+
+// Formats a number of bytes like redis does, eg: 1.50M
+func bytesToHuman(n uint64) string {
+	units := []string{"K", "M", "G", "T", "P"}
+	if n < 1024 {
+		return strconv.FormatUint(n, 10) + "B"
+	}
+	value := float64(n) / 1024
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64) + units[unit]
+}
+
+// Returns the resident set size of the process, read from /proc on Linux. ok is false elsewhere.
+func residentSetSize() (rss uint64, ok bool) {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, false
+	}
+	//INFO: statm holds sizes in pages: total program size, resident set size, ...
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return 0, false
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return pages * uint64(os.Getpagesize()), true
+}
+
+// Estimated number of bytes used by the keys and their values
+func datasetMemory() uint64 {
+	var usage uint64
+	for key, value := range keyspace {
+		usage += uint64(len(key))
+		if v, ok := value.(interface{ MemoryUsage() int }); ok {
+			usage += uint64(v.MemoryUsage())
+		}
+	}
+	return usage
+}
+
+func infoServer() []string {
+	uptime := time.Since(serverStartTime)
+	executable, _ := os.Executable()
+	return []string{
+		"redis_version:" + config.Version,
+		"redis_git_sha1:00000000",
+		"redis_git_dirty:0",
+		"redis_mode:" + serverMode(),
+		"os:" + runtime.GOOS + " " + runtime.GOARCH,
+		"arch_bits:" + strconv.Itoa(strconv.IntSize),
+		"multiplexing_api:" + multiplexingAPI,
+		"go_version:" + runtime.Version(),
+		"process_id:" + strconv.Itoa(os.Getpid()),
+		"run_id:" + serverRunID,
+		"tcp_port:" + strconv.Itoa(config.Port),
+		"server_time_usec:" + strconv.FormatInt(time.Now().UnixMicro(), 10),
+		"uptime_in_seconds:" + strconv.FormatInt(int64(uptime.Seconds()), 10),
+		"uptime_in_days:" + strconv.FormatInt(int64(uptime.Hours()/24), 10),
+		"hz:10",
+		"executable:" + executable,
+		"config_file:",
+	}
+}
+
+// The mode reported by INFO and HELLO
+func serverMode() string {
+	switch {
+	case sentinel != nil:
+		return "sentinel"
+	case cluster != nil:
+		return "cluster"
+	}
+	return "standalone"
+}
+
+func infoClients() []string {
+	var trackingClients, pubsubClients, watchingClients int
+	for _, c := range clients {
+		if c.tracking.enabled {
+			trackingClients++
+		}
+		if c.subscriptionCount() > 0 {
+			pubsubClients++
+		}
+		if len(c.watchedKeys) > 0 {
+			watchingClients++
+		}
+	}
+	return []string{
+		"connected_clients:" + strconv.Itoa(len(clients)),
+		"blocked_clients:" + strconv.Itoa(len(waitingClients)),
+		"tracking_clients:" + strconv.Itoa(trackingClients),
+		"pubsub_clients:" + strconv.Itoa(pubsubClients),
+		"watching_clients:" + strconv.Itoa(watchingClients),
+		"total_watched_keys:" + strconv.Itoa(len(watchedKeys)),
+		"total_blocking_keys:0",
+	}
+}
+
+func infoMemory() []string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	if ms.Alloc > statPeakMemory {
+		statPeakMemory = ms.Alloc
+	}
+	dataset := datasetMemory()
+	fields := []string{
+		"used_memory:" + strconv.FormatUint(ms.Alloc, 10),
+		"used_memory_human:" + bytesToHuman(ms.Alloc),
+		"used_memory_peak:" + strconv.FormatUint(statPeakMemory, 10),
+		"used_memory_peak_human:" + bytesToHuman(statPeakMemory),
+		"used_memory_dataset:" + strconv.FormatUint(dataset, 10),
+		fmt.Sprintf("used_memory_dataset_perc:%.2f%%", float64(dataset)*100/float64(ms.Alloc)),
+		"mem_allocator:go",
+		"maxmemory:0",
+		"maxmemory_human:0B",
+		"maxmemory_policy:noeviction",
+	}
+	if rss, ok := residentSetSize(); ok {
+		fields = append(fields,
+			"used_memory_rss:"+strconv.FormatUint(rss, 10),
+			"used_memory_rss_human:"+bytesToHuman(rss),
+			fmt.Sprintf("mem_fragmentation_ratio:%.2f", float64(rss)/float64(ms.Alloc)),
+		)
+	}
+	return fields
+}
+
+func infoPersistence() []string {
+	aofEnabled, aofStatus := "0", "ok"
+	if aofFile != nil {
+		aofEnabled = "1"
+	}
+	if aofLastWriteErr != nil {
+		aofStatus = "err"
+	}
+	return []string{
+		"loading:0",
+		"async_loading:0",
+		"rdb_changes_since_last_save:" + strconv.FormatInt(statDirty, 10),
+		"rdb_bgsave_in_progress:0",
+		"rdb_last_save_time:" + strconv.FormatInt(serverStartTime.Unix(), 10),
+		"rdb_last_bgsave_status:ok",
+		"rdb_last_bgsave_time_sec:-1",
+		"rdb_current_bgsave_time_sec:-1",
+		"aof_enabled:" + aofEnabled,
+		"aof_rewrite_in_progress:0",
+		"aof_rewrite_scheduled:0",
+		"aof_last_rewrite_time_sec:-1",
+		"aof_current_rewrite_time_sec:-1",
+		"aof_last_bgrewrite_status:ok",
+		"aof_last_write_status:" + aofStatus,
+	}
+}
+
+func infoStats() []string {
+	instantaneousMu.Lock()
+	opsPerSec := instOpsPerSec.value()
+	inputKbps := instInputBytes.value() / 1024
+	outputKbps := instOutputBytes.value() / 1024
+	instantaneousMu.Unlock()
+
+	return []string{
+		"total_connections_received:" + strconv.FormatInt(statNumConnections, 10),
+		"total_commands_processed:" + strconv.FormatUint(atomic.LoadUint64(&statNumCommands), 10),
+		"instantaneous_ops_per_sec:" + strconv.FormatInt(int64(opsPerSec), 10),
+		"total_net_input_bytes:" + strconv.FormatUint(atomic.LoadUint64(&statNetInputBytes), 10),
+		"total_net_output_bytes:" + strconv.FormatUint(atomic.LoadUint64(&statNetOutputBytes), 10),
+		fmt.Sprintf("instantaneous_input_kbps:%.2f", inputKbps),
+		fmt.Sprintf("instantaneous_output_kbps:%.2f", outputKbps),
+		"rejected_connections:0",
+		"protected_mode_rejected_connections:" + strconv.FormatInt(statProtectedModeRejectedConn, 10),
+		"expired_keys:0",
+		"evicted_keys:0",
+		"keyspace_hits:" + strconv.FormatInt(statKeyspaceHits, 10),
+		"keyspace_misses:" + strconv.FormatInt(statKeyspaceMisses, 10),
+		"pubsub_channels:" + strconv.Itoa(len(pubsubChannels)),
+		"pubsub_patterns:" + strconv.Itoa(len(pubsubPatterns)),
+		"tracking_total_keys:" + strconv.Itoa(len(trackingTable)),
+		"tracking_total_prefixes:" + strconv.Itoa(len(trackingPrefixes)),
+		"total_error_replies:" + strconv.FormatInt(statErrorReplies, 10),
+	}
+}
+
+func infoReplication() []string {
+	lines := []string{"role:master"}
+	if replicaOf != nil {
+		lines = append([]string{"role:slave"}, infoReplicaLink()...)
+	}
+	lines = append(lines, "connected_slaves:"+strconv.Itoa(len(replicas)))
+	for i, c := range sortedReplicas() {
+		ip, port := c.replicaAddr()
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d",
+			i, ip, port, c.replica.ackOffset, int(time.Since(c.replica.ackTime).Seconds())))
+	}
+	if config.MinReplicasToWrite > 0 && config.MinReplicasMaxLag > 0 {
+		lines = append(lines, "min_slaves_good_slaves:"+strconv.Itoa(goodReplicas()))
+	}
+
+	backlogActive, backlogFirstByte, backlogHistlen := 0, int64(0), 0
+	if replBacklog != nil {
+		backlogActive, backlogFirstByte, backlogHistlen = 1, replBacklog.offset, replBacklog.histlen
+	}
+	return append(lines,
+		"master_failover_state:no-failover",
+		"master_replid:"+replicationID,
+		"master_replid2:"+replicationID2,
+		"master_repl_offset:"+strconv.FormatInt(masterReplOffset, 10),
+		"second_repl_offset:"+strconv.FormatInt(secondReplOffset, 10),
+		"repl_backlog_active:"+strconv.Itoa(backlogActive),
+		"repl_backlog_size:"+strconv.Itoa(config.ReplBacklogSize),
+		"repl_backlog_first_byte_offset:"+strconv.FormatInt(backlogFirstByte, 10),
+		"repl_backlog_histlen:"+strconv.Itoa(backlogHistlen),
+	)
+}
+
+func infoCPU() []string {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+	seconds := func(tv syscall.Timeval) string {
+		return strconv.FormatFloat(float64(tv.Sec)+float64(tv.Usec)/1e6, 'f', 6, 64)
+	}
+	return []string{
+		"used_cpu_sys:" + seconds(self.Stime),
+		"used_cpu_user:" + seconds(self.Utime),
+		"used_cpu_sys_children:" + seconds(children.Stime),
+		"used_cpu_user_children:" + seconds(children.Utime),
+	}
+}
+
+func infoCommandStats() []string {
+	names := make([]string, 0, len(commandStats))
+	for name := range commandStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		stat := commandStats[name]
+		perCall := 0.0
+		if stat.calls > 0 {
+			perCall = float64(stat.usec) / float64(stat.calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			name, stat.calls, stat.usec, perCall, stat.rejectedCalls, stat.failedCalls))
+	}
+	return lines
+}
+
+func infoCluster() []string {
+	if cluster == nil {
+		return []string{"cluster_enabled:0"}
+	}
+	return []string{"cluster_enabled:1"}
+}
+
+func infoKeyspace() []string {
+	if len(keyspace) == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("db0:keys=%d,expires=0,avg_ttl=0", len(keyspace))}
+}
+
+// The sections in the order redis reports them
+var infoSections = []struct {
+	name      string
+	title     string
+	inDefault bool
+	lines     func() []string
+}{
+	{"server", "Server", true, infoServer},
+	{"clients", "Clients", true, infoClients},
+	{"memory", "Memory", true, infoMemory},
+	{"persistence", "Persistence", true, infoPersistence},
+	{"stats", "Stats", true, infoStats},
+	{"replication", "Replication", true, infoReplication},
+	{"raft", "Raft", true, infoRaft},
+	{"cpu", "CPU", true, infoCPU},
+	{"commandstats", "Commandstats", false, infoCommandStats},
+	{"cluster", "Cluster", true, infoCluster},
+	{"keyspace", "Keyspace", true, infoKeyspace},
+}
+
+func (cmd *Command) evalINFO() ([]byte, error) {
+	selected := map[string]bool{}
+	all, defaults := false, len(cmd.Args) == 0
+	for _, arg := range cmd.Args {
+		switch section := strings.ToLower(arg); section {
+		case "all", "everything":
+			all = true
+		case "default":
+			defaults = true
+		default:
+			selected[section] = true
+		}
+	}
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !(defaults && section.inDefault) && !selected[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + section.title + "\r\n")
+		for _, line := range section.lines() {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return response.Encode(b.String(), false), nil
+}
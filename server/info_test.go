@@ -0,0 +1,123 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Returns the value of the field in the INFO reply of the section
+func infoField(c *testClient, section string, field string) string {
+	c.t.Helper()
+	for _, line := range strings.Split(c.do("INFO", section).(string), "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	c.t.Errorf("INFO %s has no %s field", section, field)
+	return ""
+}
+
+func TestInfoSections(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	info := c.do("INFO").(string)
+	for _, header := range []string{"# Server\r\n", "# Clients\r\n", "# Memory\r\n", "# Stats\r\n", "# Keyspace\r\n"} {
+		if !strings.Contains(info, header) {
+			t.Errorf("INFO has no %q section", header)
+		}
+	}
+	if strings.Contains(info, "# Commandstats") {
+		t.Error("commandstats is not a default section")
+	}
+
+	info = c.do("INFO", "clients", "CPU").(string)
+	if !strings.HasPrefix(info, "# Clients\r\n") || !strings.Contains(info, "\r\n\r\n# CPU\r\n") || strings.Contains(info, "# Server") {
+		t.Errorf("unexpected INFO clients cpu %q", info)
+	}
+	if info = c.do("INFO", "all").(string); !strings.Contains(info, "# Commandstats") {
+		t.Error("INFO all has no commandstats section")
+	}
+}
+
+func TestInfoStats(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	connect(t).expect(replyOK, "ACL", "SETUSER", "default", "-sim.merge")
+
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect("0", "SIM.JACCARD", "a", "missing")
+	c.expectError("NOPERM", "SIM.MERGE", "b", "a")
+	c.expectError("ERR wrong number of arguments", "SIM.ADD", "a")
+
+	if got := infoField(c, "clients", "connected_clients"); got != "2" {
+		t.Errorf("connected_clients:%s", got)
+	}
+	if got := infoField(c, "stats", "keyspace_hits"); got != "1" {
+		t.Errorf("keyspace_hits:%s", got)
+	}
+	if got := infoField(c, "stats", "keyspace_misses"); got != "1" {
+		t.Errorf("keyspace_misses:%s", got)
+	}
+	if got := infoField(c, "keyspace", "db0"); got != "keys=1,expires=0,avg_ttl=0" {
+		t.Errorf("db0:%s", got)
+	}
+	if got := infoField(c, "commandstats", "cmdstat_sim.add"); !strings.HasPrefix(got, "calls=2,") || !strings.HasSuffix(got, ",rejected_calls=0,failed_calls=1") {
+		t.Errorf("cmdstat_sim.add:%s", got)
+	}
+	if got := infoField(c, "commandstats", "cmdstat_sim.merge"); !strings.HasPrefix(got, "calls=0,") || !strings.HasSuffix(got, ",rejected_calls=1,failed_calls=0") {
+		t.Errorf("cmdstat_sim.merge:%s", got)
+	}
+}
+
+func TestInfoMeasuredFields(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	if got := infoField(c, "server", "multiplexing_api"); got != "test" {
+		t.Errorf("multiplexing_api:%s, expected the API of the poller", got)
+	}
+	//The resident set size is read from the OS, the field is left out when it can not be read
+	if _, ok := residentSetSize(); ok {
+		if rss, err := strconv.ParseUint(infoField(c, "memory", "used_memory_rss"), 10, 64); err != nil || rss == 0 {
+			t.Errorf("used_memory_rss:%d, %v", rss, err)
+		}
+	} else if strings.Contains(c.do("INFO", "memory").(string), "used_memory_rss:") {
+		t.Error("used_memory_rss is reported without a resident set size")
+	}
+
+	//The clients refused by protected mode are not rejected_connections, which are about maxclients
+	before := infoField(c, "stats", "protected_mode_rejected_connections")
+	refused := connectFrom(t, "10.0.0.1")
+	if _, ok := refused.read().(response.ErrorReply); !ok {
+		t.Fatal("the remote client was not refused")
+	}
+	n, _ := strconv.Atoi(before)
+	if got := infoField(c, "stats", "protected_mode_rejected_connections"); got != strconv.Itoa(n+1) {
+		t.Errorf("protected_mode_rejected_connections:%s, was %s", got, before)
+	}
+	if got := infoField(c, "stats", "rejected_connections"); got != "0" {
+		t.Errorf("rejected_connections:%s", got)
+	}
+}
+
+func TestBytesToHuman(t *testing.T) {
+	cases := map[uint64]string{
+		0:             "0B",
+		1023:          "1023B",
+		1024:          "1.00K",
+		1536 * 1024:   "1.50M",
+		3 << 30:       "3.00G",
+		5 << 50:       "5.00P",
+		1 << 62:       "4096.00P",
+		1<<40 + 1<<39: "1.50T",
+	}
+	for n, expected := range cases {
+		if got := bytesToHuman(n); got != expected {
+			t.Errorf("bytesToHuman(%d) = %s, expected %s", n, got, expected)
+		}
+	}
+}
@@ -30,6 +30,11 @@ type Epoll struct {
 	mu sync.RWMutex
 }
 
+// API names the readiness API the poller is built on, shown by INFO
+func (e *Epoll) API() string {
+	return "kqueue"
+}
+
 // NewPoller creates a new poller instance.
 func NewPoller(serverFd int) (*Epoll, error) {
 	// Here we are assuming there will be only 128 events per client connection
@@ -185,11 +190,11 @@ func (e *Epoll) Remove(conn net.Conn) error {
 
 	return nil
 }
-func (e *Epoll) bind(serverSocketFd int, ipBytes [4]byte) {
-	err := syscall.Bind(serverSocketFd, &syscall.SockaddrInet4{
-		Port: config.Port,
-		Addr: ipBytes,
-	})
+func (e *Epoll) bind(serverSocketFd int, host string) {
+	addr, err := convertIPStrtoSockaddr(host, config.Port)
+	if err == nil {
+		err = syscall.Bind(serverSocketFd, addr)
+	}
 	if err != nil {
 		log.Println("Failed to Bind server socket ", err)
 		panic(err)
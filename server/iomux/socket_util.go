@@ -1,11 +1,17 @@
 package iomux
 
 import (
+	"crypto/tls"
+	"errors"
 	"net"
 	"syscall"
 )
 
 func socketFD(conn net.Conn) int {
+	//A TLS connection wraps the TCP connection which holds the socket
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
 	if con, ok := conn.(syscall.Conn); ok {
 		raw, err := con.SyscallConn()
 		if err != nil {
@@ -21,12 +27,24 @@ func socketFD(conn net.Conn) int {
 }
 
 /**
-Converts ipv4 address to an array of bytes
+Converts an ipv4 or ipv6 address and a port to a socket address
 Eg:
-	I/P : 127.0.0.1
-	o/p: [127,0,0,1] as byte array
+	I/P : 127.0.0.1, 7379
+	o/p: SockaddrInet4{Port: 7379, Addr: [127,0,0,1]}
+	I/P : ::1, 7379
+	o/p: SockaddrInet6{Port: 7379, Addr: [0,0,0,0,0,0,0,0,0,0,0,0,0,0,0,1]}
 */
-func convertIPV4StrtoArray(hostIpv4 string) [4]byte {
-	ip4Bytes := net.ParseIP(hostIpv4)
-	return [4]byte{ip4Bytes[0], ip4Bytes[1], ip4Bytes[2], ip4Bytes[3]}
+func convertIPStrtoSockaddr(host string, port int) (syscall.Sockaddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("invalid ip address: " + host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		addr := &syscall.SockaddrInet4{Port: port}
+		copy(addr.Addr[:], ip4)
+		return addr, nil
+	}
+	addr := &syscall.SockaddrInet6{Port: port}
+	copy(addr.Addr[:], ip)
+	return addr, nil
 }
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The latency monitor samples the events that took at least latency-monitor-threshold milliseconds,
+it is disabled when the threshold is 0. The events are:
+	- command: a slow command ran for too long
+	- fast-command: a command of the @fast category, which should always be quick, ran for too long
+	- event-loop: a command waited too long to run because commands run one at a time and the
+	  commands, transactions or scripts of other clients were running
+	- aof-fsync: an fsync of the append only file took too long (see aof.go)
+There is no key expiration, eviction nor snapshot, so the expire-cycle, eviction-cycle and fork events of
+redis are never sampled.
+	- LATENCY LATEST returns the latest and the maximum latency of every event
+	- LATENCY HISTORY event returns the samples of the event, at most one per second is kept
+	- LATENCY RESET [event ...] forgets the samples
+	- LATENCY GRAPH event draws the samples of the event
+	- LATENCY HISTOGRAM [command ...] returns the distribution of the duration of the commands
+	- LATENCY DOCTOR analyses the samples and gives advice
+*/
+
+const (
+	LATENCY_EVENT_COMMAND      = "command"
+	LATENCY_EVENT_FAST_COMMAND = "fast-command"
+	LATENCY_EVENT_EVENT_LOOP   = "event-loop"
+	LATENCY_EVENT_AOF_FSYNC    = "aof-fsync"
+
+	//Number of samples kept per event, the oldest are overwritten
+	latencyTimeSeriesLen = 160
+)
+
+// The samples of each event, guarded by execMu
+var latencyEvents = map[string]*latencyTimeSeries{}
+
+type latencySample struct {
+	time    int64 //unix time in seconds
+	latency int64 //milliseconds
+}
+
+type latencyTimeSeries struct {
+	next    int
+	max     int64
+	samples [latencyTimeSeriesLen]latencySample
+}
+
+// Samples the event when it took at least latency-monitor-threshold, must be called holding execMu
+func latencyAddSampleIfNeeded(event string, duration time.Duration) {
+	ms := duration.Milliseconds()
+	if config.LatencyMonitorThreshold <= 0 || ms < int64(config.LatencyMonitorThreshold) {
+		return
+	}
+
+	ts, ok := latencyEvents[event]
+	if !ok {
+		ts = &latencyTimeSeries{}
+		latencyEvents[event] = ts
+	}
+	if ms > ts.max {
+		ts.max = ms
+	}
+
+	//Samples of the same second are merged, the highest latency is kept
+	now := time.Now().Unix()
+	prev := &ts.samples[(ts.next+latencyTimeSeriesLen-1)%latencyTimeSeriesLen]
+	if prev.time == now {
+		if ms > prev.latency {
+			prev.latency = ms
+		}
+		return
+	}
+	ts.samples[ts.next] = latencySample{now, ms}
+	ts.next = (ts.next + 1) % latencyTimeSeriesLen
+}
+
+// The samples from the oldest to the newest
+func (ts *latencyTimeSeries) history() []latencySample {
+	var samples []latencySample
+	for i := 0; i < latencyTimeSeriesLen; i++ {
+		sample := ts.samples[(ts.next+i)%latencyTimeSeriesLen]
+		if sample.time != 0 {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// Index of the power of two bucket holding the duration in the command histograms,
+// bucket i counts the durations up to 2^i microseconds
+func latencyHistogramBucket(usec int64) int {
+	if usec <= 1 {
+		return 0
+	}
+	return bits.Len64(uint64(usec - 1))
+}
+
+func sortedLatencyEvents() []string {
+	events := make([]string, 0, len(latencyEvents))
+	for event := range latencyEvents {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	return events
+}
+
+func (cmd *Command) evalLATENCY() ([]byte, error) {
+	sub := strings.ToLower(cmd.Args[0])
+	args := cmd.Args[1:]
+	switch {
+	case sub == "latest" && len(args) == 0:
+		var replies [][]byte
+		for _, event := range sortedLatencyEvents() {
+			ts := latencyEvents[event]
+			last := ts.samples[(ts.next+latencyTimeSeriesLen-1)%latencyTimeSeriesLen]
+			replies = append(replies, response.EncodeArray([][]byte{
+				response.Encode(event, false),
+				response.Encode(last.time, false),
+				response.Encode(last.latency, false),
+				response.Encode(ts.max, false),
+			}))
+		}
+		return response.EncodeArray(replies), nil
+	case sub == "history" && len(args) == 1:
+		var replies [][]byte
+		if ts, ok := latencyEvents[args[0]]; ok {
+			for _, sample := range ts.history() {
+				replies = append(replies, response.EncodeArray([][]byte{
+					response.Encode(sample.time, false),
+					response.Encode(sample.latency, false),
+				}))
+			}
+		}
+		return response.EncodeArray(replies), nil
+	case sub == "reset":
+		if len(args) == 0 {
+			count := len(latencyEvents)
+			latencyEvents = map[string]*latencyTimeSeries{}
+			return response.Encode(count, false), nil
+		}
+		count := 0
+		for _, event := range args {
+			if _, ok := latencyEvents[event]; ok {
+				delete(latencyEvents, event)
+				count++
+			}
+		}
+		return response.Encode(count, false), nil
+	case sub == "graph" && len(args) == 1:
+		ts, ok := latencyEvents[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("ERR No samples available for event '%s'", args[0])
+		}
+		return response.Encode(latencyGraph(args[0], ts), false), nil
+	case sub == "histogram":
+		return latencyHistogram(args), nil
+	case sub == "doctor" && len(args) == 0:
+		return response.Encode(latencyDoctor(), false), nil
+	case sub == "latest" || sub == "history" || sub == "graph" || sub == "doctor":
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'latency|%s' command", sub)
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try LATENCY HELP.", cmd.Args[0])
+}
+
+// Draws the samples as columns, from the oldest on the left to the newest on the right, with
+// the age of each sample written vertically below its column
+func latencyGraph(event string, ts *latencyTimeSeries) string {
+	const rows = 4
+	samples := ts.history()
+	low, high := int64(math.MaxInt64), int64(0)
+	for _, sample := range samples {
+		if sample.latency < low {
+			low = sample.latency
+		}
+		if sample.latency > high {
+			high = sample.latency
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - high %d ms, low %d ms (all time high %d ms)\n", event, high, low, ts.max)
+	b.WriteString(strings.Repeat("-", 80) + "\n")
+
+	levels := make([]int, len(samples))
+	for i, sample := range samples {
+		levels[i] = rows
+		if high > low {
+			levels[i] = 1 + int((sample.latency-low)*(rows-1)/(high-low))
+		}
+	}
+	for row := rows; row >= 1; row-- {
+		for i, level := range levels {
+			switch {
+			case level == row && samples[i].latency == high:
+				b.WriteByte('#')
+			case level == row:
+				b.WriteByte('_')
+			case level > row:
+				b.WriteByte('|')
+			default:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+
+	now := time.Now().Unix()
+	labels := make([]string, len(samples))
+	height := 0
+	for i, sample := range samples {
+		labels[i] = formatAge(now - sample.time)
+		if len(labels[i]) > height {
+			height = len(labels[i])
+		}
+	}
+	for row := 0; row < height; row++ {
+		for _, label := range labels {
+			if row < len(label) {
+				b.WriteByte(label[row])
+			} else {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// Formats an age in seconds with its largest unit, eg: 40s, 3m, 2h, 5d
+func formatAge(seconds int64) string {
+	switch {
+	case seconds < 60:
+		return fmt.Sprintf("%ds", seconds)
+	case seconds < 3600:
+		return fmt.Sprintf("%dm", seconds/60)
+	case seconds < 86400:
+		return fmt.Sprintf("%dh", seconds/3600)
+	}
+	return fmt.Sprintf("%dd", seconds/86400)
+}
+
+// Encodes the duration distribution of the commands that ran, all of them when none is given,
+// as the cumulative number of calls that took up to each power of two microseconds
+func latencyHistogram(names []string) []byte {
+	if len(names) == 0 {
+		for name := range commandStats {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	encodeMap := response.EncodeArray
+	if currentClient != nil {
+		encodeMap = currentClient.encodeMap
+	}
+	var fields [][]byte
+	seen := map[string]bool{}
+	for _, name := range names {
+		name = strings.ToLower(name)
+		stat, ok := commandStats[name]
+		if !ok || seen[name] || stat.calls == 0 {
+			continue
+		}
+		seen[name] = true
+
+		var buckets [][]byte
+		var cumulative int64
+		for i, count := range stat.usecBuckets {
+			if count == 0 && cumulative == 0 {
+				continue
+			}
+			cumulative += count
+			buckets = append(buckets, response.Encode(int64(1)<<i, false), response.Encode(cumulative, false))
+			if cumulative == stat.calls {
+				break
+			}
+		}
+		fields = append(fields, response.Encode(name, false), encodeMap([][]byte{
+			response.Encode("calls", false), response.Encode(stat.calls, false),
+			response.Encode("histogram_usec", false), encodeMap(buckets),
+		}))
+	}
+	return encodeMap(fields)
+}
+
+var latencyAdvice = map[string]string{
+	LATENCY_EVENT_COMMAND: "Check your slow log with SLOWLOG GET to find the slow commands. Commands like SIM.INDEX.QUERY on large indexes, " +
+		"EXEC of long transactions and long running scripts block every other client while they run.",
+	LATENCY_EVENT_FAST_COMMAND: "Fast commands should never be slow: the host may be overloaded, the process may have been swapped " +
+		"out or paused by the garbage collector. Check the CPU load and the free memory of the host.",
+	LATENCY_EVENT_EVENT_LOOP: "Commands waited for the commands of other clients to finish, as commands run one at a time a single " +
+		"slow command, transaction or script delays everyone. Find them with SLOWLOG GET and lower lua-time-limit if scripts are involved.",
+	LATENCY_EVENT_AOF_FSYNC: "The disk of the append only file is slow to fsync. With appendfsync always every write waits for it, " +
+		"consider appendfsync everysec, and check that no other process is writing heavily to the same disk.",
+}
+
+// A human readable analysis of the latency samples
+func latencyDoctor() string {
+	if config.LatencyMonitorThreshold <= 0 {
+		return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this inmem instance. " +
+			"You may restart it with the '-latency-monitor-threshold <milliseconds>' option in order to enable it.\n"
+	}
+	if len(latencyEvents) == 0 {
+		return "Dave, no latency spike was observed during the lifetime of this inmem instance, not in the slightest bit. " +
+			"I honestly think you ought to sleep calmly.\n"
+	}
+
+	var b strings.Builder
+	b.WriteString("Dave, I have observed latency spikes in this inmem instance. You don't mind talking about it, do you Dave?\n\n")
+	events := sortedLatencyEvents()
+	for i, event := range events {
+		ts := latencyEvents[event]
+		samples := ts.history()
+
+		var sum int64
+		for _, sample := range samples {
+			sum += sample.latency
+		}
+		avg := float64(sum) / float64(len(samples))
+		deviation := 0.0
+		for _, sample := range samples {
+			deviation += math.Abs(float64(sample.latency) - avg)
+		}
+		deviation /= float64(len(samples))
+		period := 0.0
+		if len(samples) > 1 {
+			period = float64(samples[len(samples)-1].time-samples[0].time) / float64(len(samples)-1)
+		}
+
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, event, len(samples), avg, deviation, period, ts.max)
+	}
+
+	b.WriteString("\nI have a few pieces of advice for you:\n\n")
+	for _, event := range events {
+		if advice, ok := latencyAdvice[event]; ok {
+			b.WriteString("- " + advice + "\n")
+		}
+	}
+	return b.String()
+}
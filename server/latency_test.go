@@ -0,0 +1,150 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+// A script running long enough to be sampled with a threshold of 1ms
+const slowScript = "for i = 1, 2000000 do end return 1"
+
+// Waits until a script started by a client is running
+func waitScriptRunning(t *testing.T) {
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		scriptMu.Lock()
+		running := runningScript != nil
+		scriptMu.Unlock()
+		if running {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the script never started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLatencyEvents(t *testing.T) {
+	setupTestServer(t)
+	config.LatencyMonitorThreshold = 1
+	script := connect(t)
+	other := connect(t)
+
+	script.send("EVAL", slowScript, "0")
+	//The command of the other client waits for the script to finish, which is sampled as event-loop
+	waitScriptRunning(t)
+	other.expect(int64(1), "SIM.ADD", "a", "x")
+	script.expectNext(int64(1))
+
+	latest := other.do("LATENCY", "LATEST").([]interface{})
+	events := map[string][]interface{}{}
+	for _, event := range latest {
+		fields := event.([]interface{})
+		events[fields[0].(string)] = fields
+	}
+	for _, name := range []string{LATENCY_EVENT_COMMAND, LATENCY_EVENT_EVENT_LOOP} {
+		fields, ok := events[name]
+		if !ok {
+			t.Errorf("no %s event in %#v", name, latest)
+			continue
+		}
+		if fields[2].(int64) < 1 || fields[3].(int64) < fields[2].(int64) {
+			t.Errorf("the %s event is %#v", name, fields)
+		}
+	}
+	if _, ok := events[LATENCY_EVENT_FAST_COMMAND]; ok {
+		t.Error("a fast command was sampled")
+	}
+
+	history := other.do("LATENCY", "HISTORY", LATENCY_EVENT_COMMAND).([]interface{})
+	if len(history) != 1 {
+		t.Errorf("LATENCY HISTORY command replied %#v", history)
+	}
+	other.expect(int64(1), "LATENCY", "RESET", LATENCY_EVENT_COMMAND, "nosuchevent")
+	other.expect(array(), "LATENCY", "HISTORY", LATENCY_EVENT_COMMAND)
+	other.expect(int64(1), "LATENCY", "RESET")
+	other.expect(array(), "LATENCY", "LATEST")
+}
+
+func TestLatencyThreshold(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	//The monitor is disabled with a threshold of 0
+	c.expect(int64(1), "EVAL", slowScript, "0")
+	c.expect(array(), "LATENCY", "LATEST")
+	if doctor := c.do("LATENCY", "DOCTOR").(string); !strings.Contains(doctor, "Latency monitoring is disabled") {
+		t.Errorf("LATENCY DOCTOR replied %q", doctor)
+	}
+
+	config.LatencyMonitorThreshold = 1000000
+	c.expect(int64(1), "EVAL", slowScript, "0")
+	c.expect(array(), "LATENCY", "LATEST")
+	if doctor := c.do("LATENCY", "DOCTOR").(string); !strings.Contains(doctor, "no latency spike was observed") {
+		t.Errorf("LATENCY DOCTOR replied %q", doctor)
+	}
+}
+
+func TestLatencySamples(t *testing.T) {
+	setupTestServer(t)
+	config.LatencyMonitorThreshold = 10
+	c := connect(t)
+
+	execMu.Lock()
+	latencyAddSampleIfNeeded(LATENCY_EVENT_FAST_COMMAND, 5*time.Millisecond)
+	latencyAddSampleIfNeeded(LATENCY_EVENT_FAST_COMMAND, 20*time.Millisecond)
+	latencyAddSampleIfNeeded(LATENCY_EVENT_FAST_COMMAND, 15*time.Millisecond)
+	ts := latencyEvents[LATENCY_EVENT_FAST_COMMAND]
+	execMu.Unlock()
+
+	//The samples of the same second are merged, keeping the highest
+	history := c.do("LATENCY", "HISTORY", LATENCY_EVENT_FAST_COMMAND).([]interface{})
+	if len(history) != 1 || history[0].([]interface{})[1] != int64(20) {
+		t.Errorf("LATENCY HISTORY replied %#v", history)
+	}
+
+	//Older samples are kept, the graph has a column per sample
+	execMu.Lock()
+	now := time.Now().Unix()
+	ts.samples[ts.next] = latencySample{now - 120, 40}
+	ts.next = (ts.next + 1) % latencyTimeSeriesLen
+	execMu.Unlock()
+	graph := c.do("LATENCY", "GRAPH", LATENCY_EVENT_FAST_COMMAND).(string)
+	if !strings.HasPrefix(graph, "fast-command - high 40 ms, low 20 ms (all time high 20 ms)\n") {
+		t.Errorf("LATENCY GRAPH replied %q", graph)
+	}
+	c.expectError("ERR No samples available for event 'command'", "LATENCY", "GRAPH", LATENCY_EVENT_COMMAND)
+
+	doctor := c.do("LATENCY", "DOCTOR").(string)
+	if !strings.Contains(doctor, "1. fast-command: 2 latency spikes") || !strings.Contains(doctor, latencyAdvice[LATENCY_EVENT_FAST_COMMAND]) {
+		t.Errorf("LATENCY DOCTOR replied %q", doctor)
+	}
+
+	c.expectError("ERR wrong number of arguments for 'latency|history' command", "LATENCY", "HISTORY")
+	c.expectError("ERR unknown subcommand 'NOPE'", "LATENCY", "NOPE")
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect(int64(1), "SIM.ADD", "b", "x")
+	histogram := c.do("LATENCY", "HISTOGRAM", "SIM.ADD", "nosuchcommand").([]interface{})
+	if len(histogram) != 2 || histogram[0] != "sim.add" {
+		t.Fatalf("LATENCY HISTOGRAM replied %#v", histogram)
+	}
+	fields := histogram[1].([]interface{})
+	if fields[0] != "calls" || fields[1] != int64(2) || fields[2] != "histogram_usec" {
+		t.Fatalf("the histogram of sim.add is %#v", fields)
+	}
+	//The buckets are cumulative, the last one counts every call
+	buckets := fields[3].([]interface{})
+	if len(buckets) < 2 || buckets[len(buckets)-1] != int64(2) {
+		t.Errorf("the buckets of sim.add are %#v", buckets)
+	}
+}
@@ -0,0 +1,169 @@
+package lua
+
+/**
+Scripts are compiled into a tree of statements and expressions which is then walked by the interpreter.
+Local variables are resolved while parsing: every local of a function gets its own slot in the
+frame of the function, and variables of enclosing functions are reached through upvalues.
+*/
+
+// Compiled function, shared by all the closures created from it
+type funcProto struct {
+	name     string
+	chunk    string
+	line     int
+	params   int
+	isVararg bool
+	nslots   int
+	upvals   []upvalDesc
+	body     *block
+}
+
+// Tells a closure where to find a captured variable when it is created
+type upvalDesc struct {
+	//true: local slot of the enclosing function, false: upvalue of the enclosing function
+	fromParent bool
+	index      int
+}
+
+// Proto is a compiled chunk, it can be turned into a function with State.NewFunction
+type Proto struct {
+	main *funcProto
+}
+
+// Activation record of a function call
+type frame struct {
+	//Every slot holds a cell so that closures can capture it
+	slots   []*Value
+	upvals  []*Value
+	varargs []Value
+}
+
+// Statements report how the control flow continues after them
+const (
+	ctrlNone = iota
+	ctrlBreak
+	ctrlReturn
+)
+
+type stmt interface {
+	exec(L *State, fr *frame) (int, []Value)
+}
+
+type expr interface {
+	eval(L *State, fr *frame) Value
+}
+
+// Expressions that can produce several values: function calls and '...'
+type multiExpr interface {
+	expr
+	evalMulti(L *State, fr *frame) []Value
+}
+
+type block struct {
+	stmts []stmt
+	lines []int
+}
+
+type (
+	localStmt struct {
+		slots []int
+		exprs []expr
+	}
+	localFuncStmt struct {
+		slot int
+		fn   *funcExpr
+	}
+	assignStmt struct {
+		targets []expr
+		exprs   []expr
+	}
+	callStmt struct {
+		call multiExpr
+	}
+	doStmt struct {
+		body *block
+	}
+	whileStmt struct {
+		cond expr
+		body *block
+	}
+	repeatStmt struct {
+		body *block
+		cond expr
+	}
+	ifStmt struct {
+		conds    []expr
+		blocks   []*block
+		elseBody *block
+	}
+	numForStmt struct {
+		slot               int
+		start, limit, step expr
+		body               *block
+	}
+	genForStmt struct {
+		slots []int
+		exprs []expr
+		body  *block
+	}
+	returnStmt struct {
+		exprs []expr
+	}
+	breakStmt struct{}
+)
+
+type (
+	constExpr struct {
+		value Value
+	}
+	varargExpr struct{}
+	funcExpr   struct {
+		proto *funcProto
+	}
+	tableField struct {
+		//nil for positional fields
+		key   expr
+		value expr
+	}
+	tableExpr struct {
+		fields []tableField
+	}
+	binExpr struct {
+		op          string
+		left, right expr
+	}
+	andExpr struct {
+		left, right expr
+	}
+	orExpr struct {
+		left, right expr
+	}
+	unExpr struct {
+		op      string
+		operand expr
+	}
+	localExpr struct {
+		slot int
+	}
+	upvalExpr struct {
+		index int
+	}
+	globalExpr struct {
+		name string
+	}
+	indexExpr struct {
+		obj, key expr
+	}
+	callExpr struct {
+		fn   expr
+		args []expr
+	}
+	methodCallExpr struct {
+		obj  expr
+		name string
+		args []expr
+	}
+	parenExpr struct {
+		inner expr
+	}
+)
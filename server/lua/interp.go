@@ -0,0 +1,664 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	//Maximum depth of nested function calls
+	maxCallDepth = 200
+
+	//The hook of the State is called every hookInterval loop iterations or function calls
+	hookInterval = 1000
+)
+
+// MaxStringLen is the length of the longest string a script can build, the proto-max-bulk-len of Redis
+var MaxStringLen = 512 * 1024 * 1024
+
+// Error is a Lua error, Value holds the message or the value passed to error()
+type Error struct {
+	Value Value
+}
+
+func (e *Error) Error() string {
+	if t, ok := e.Value.(*Table); ok {
+		if msg, ok := t.Get("err").(string); ok {
+			return msg
+		}
+	}
+	return ToString(e.Value)
+}
+
+// Raised when the hook aborts the script, pcall can not catch it
+type abortError struct {
+	err error
+}
+
+// State is the execution environment of scripts
+type State struct {
+	Globals *Table
+
+	//INFO: Hook is called periodically while a script runs, a long running script
+	//is stopped by returning an error from it. The error can not be caught by pcall.
+	Hook func() error
+
+	stringLib *Table
+	steps     int
+	depth     int
+	line      int
+	chunk     string
+}
+
+// NewState creates a State with the base, string, table and math libraries.
+// Libraries giving access to the host (io, os, loading code, ...) are not available.
+func NewState() *State {
+	L := &State{Globals: NewTable()}
+	openBase(L)
+	openString(L)
+	openTable(L)
+	openMath(L)
+	return L
+}
+
+// NewFunction creates a function running the compiled chunk
+func (L *State) NewFunction(p *Proto) *Closure {
+	return &Closure{proto: p.main}
+}
+
+func (L *State) SetGlobal(name string, v Value) {
+	L.Globals.Set(name, v)
+}
+
+func (L *State) GetGlobal(name string) Value {
+	return L.Globals.Get(name)
+}
+
+// Call calls fn with the arguments, Lua errors are returned as *Error
+func (L *State) Call(fn Value, args ...Value) (rets []Value, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case *Error:
+				err = e
+			case *abortError:
+				err = e.err
+			default:
+				panic(r)
+			}
+			L.depth = 0
+		}
+	}()
+	return L.call(fn, args), nil
+}
+
+// RaiseError raises an error with the position of the running script as prefix
+func (L *State) RaiseError(format string, args ...interface{}) {
+	panic(&Error{Value: L.where() + fmt.Sprintf(format, args...)})
+}
+
+// Raise raises an error with any value, as error(value, 0) does
+func (L *State) Raise(v Value) {
+	panic(&Error{Value: v})
+}
+
+func (L *State) where() string {
+	if L.chunk == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: ", L.chunk, L.line)
+}
+
+// Raises an error when a string of n bytes is longer than MaxStringLen
+func (L *State) checkStringLen(n int) {
+	if n < 0 || n > MaxStringLen {
+		L.RaiseError("string length overflow")
+	}
+}
+
+// Counts loop iterations and calls, calling the hook every hookInterval steps
+func (L *State) step() {
+	L.steps++
+	if L.steps%hookInterval == 0 && L.Hook != nil {
+		if err := L.Hook(); err != nil {
+			panic(&abortError{err})
+		}
+	}
+}
+
+func (L *State) call(fn Value, args []Value) []Value {
+	L.step()
+	switch f := fn.(type) {
+	case *Closure:
+		return L.callClosure(f, args)
+	case *GoFunction:
+		return f.Fn(L, args)
+	}
+	L.RaiseError("attempt to call a %s value", TypeName(fn))
+	return nil
+}
+
+func (L *State) callClosure(c *Closure, args []Value) []Value {
+	L.depth++
+	defer func() { L.depth-- }()
+	if L.depth > maxCallDepth {
+		L.RaiseError("stack overflow")
+	}
+
+	p := c.proto
+	fr := &frame{slots: make([]*Value, p.nslots), upvals: c.upvals}
+	for i := 0; i < p.params; i++ {
+		var v Value
+		if i < len(args) {
+			v = args[i]
+		}
+		fr.slots[i] = &v
+	}
+	if p.isVararg && len(args) > p.params {
+		fr.varargs = args[p.params:]
+	}
+
+	line, chunk := L.line, L.chunk
+	L.chunk = p.chunk
+	ctrl, rets := p.body.exec(L, fr)
+	L.line, L.chunk = line, chunk
+	if ctrl == ctrlReturn {
+		return rets
+	}
+	return nil
+}
+
+// Reads obj[key] using the __index metamethod
+func (L *State) index(obj Value, key Value) Value {
+	for i := 0; i < 100; i++ {
+		var handler Value
+		switch o := obj.(type) {
+		case *Table:
+			if v := o.Get(key); v != nil || o.meta == nil {
+				return v
+			}
+			handler = o.meta.Get("__index")
+			if handler == nil {
+				return nil
+			}
+		case string:
+			handler = L.stringLib
+		default:
+			L.RaiseError("attempt to index a %s value", TypeName(obj))
+		}
+
+		if _, ok := handler.(*Table); !ok {
+			return first(L.call(handler, []Value{obj, key}))
+		}
+		obj = handler
+	}
+	L.RaiseError("loop in gettable")
+	return nil
+}
+
+// Assigns obj[key] = value using the __newindex metamethod
+func (L *State) setIndex(obj Value, key Value, value Value) {
+	for i := 0; i < 100; i++ {
+		t, ok := obj.(*Table)
+		if !ok {
+			L.RaiseError("attempt to index a %s value", TypeName(obj))
+		}
+		var handler Value
+		if t.meta != nil && t.Get(key) == nil {
+			handler = t.meta.Get("__newindex")
+		}
+		if handler == nil {
+			if msg := checkKey(key); msg != "" {
+				L.RaiseError(msg)
+			}
+			t.Set(key, value)
+			return
+		}
+		if _, ok := handler.(*Table); !ok {
+			L.call(handler, []Value{obj, key, value})
+			return
+		}
+		obj = handler
+	}
+	L.RaiseError("loop in settable")
+}
+
+func first(values []Value) Value {
+	if len(values) == 0 {
+		return nil
+	}
+	return values[0]
+}
+
+// Evaluates a list of expressions, the last one is expanded if it produces several values
+func (L *State) evalList(exprs []expr, fr *frame) []Value {
+	values := make([]Value, 0, len(exprs))
+	for i, e := range exprs {
+		if m, ok := e.(multiExpr); ok && i == len(exprs)-1 {
+			return append(values, m.evalMulti(L, fr)...)
+		}
+		values = append(values, e.eval(L, fr))
+	}
+	return values
+}
+
+// Evaluates a list of expressions adjusted to n values
+func (L *State) evalListN(exprs []expr, fr *frame, n int) []Value {
+	values := L.evalList(exprs, fr)
+	for len(values) < n {
+		values = append(values, nil)
+	}
+	return values[:n]
+}
+
+func (b *block) exec(L *State, fr *frame) (int, []Value) {
+	for i, s := range b.stmts {
+		L.line = b.lines[i]
+		if ctrl, rets := s.exec(L, fr); ctrl != ctrlNone {
+			return ctrl, rets
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (s *localStmt) exec(L *State, fr *frame) (int, []Value) {
+	values := L.evalListN(s.exprs, fr, len(s.slots))
+	for i, slot := range s.slots {
+		v := values[i]
+		fr.slots[slot] = &v
+	}
+	return ctrlNone, nil
+}
+
+func (s *localFuncStmt) exec(L *State, fr *frame) (int, []Value) {
+	//The cell exists before the closure is created so that the function can call itself
+	var v Value
+	fr.slots[s.slot] = &v
+	v = s.fn.eval(L, fr)
+	*fr.slots[s.slot] = v
+	return ctrlNone, nil
+}
+
+func (s *assignStmt) exec(L *State, fr *frame) (int, []Value) {
+	//Tables and keys of the targets are evaluated before the values are assigned
+	objs := make([]Value, len(s.targets))
+	keys := make([]Value, len(s.targets))
+	for i, t := range s.targets {
+		if ix, ok := t.(*indexExpr); ok {
+			objs[i] = ix.obj.eval(L, fr)
+			keys[i] = ix.key.eval(L, fr)
+		}
+	}
+
+	values := L.evalListN(s.exprs, fr, len(s.targets))
+	for i, t := range s.targets {
+		switch target := t.(type) {
+		case *localExpr:
+			*fr.slots[target.slot] = values[i]
+		case *upvalExpr:
+			*fr.upvals[target.index] = values[i]
+		case *globalExpr:
+			L.setIndex(L.Globals, target.name, values[i])
+		case *indexExpr:
+			L.setIndex(objs[i], keys[i], values[i])
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (s *callStmt) exec(L *State, fr *frame) (int, []Value) {
+	s.call.evalMulti(L, fr)
+	return ctrlNone, nil
+}
+
+func (s *doStmt) exec(L *State, fr *frame) (int, []Value) {
+	return s.body.exec(L, fr)
+}
+
+// Runs the body of a loop, tells if the loop is over and with which control flow
+func runLoopBody(L *State, body *block, fr *frame) (bool, int, []Value) {
+	L.step()
+	ctrl, rets := body.exec(L, fr)
+	switch ctrl {
+	case ctrlBreak:
+		return true, ctrlNone, nil
+	case ctrlReturn:
+		return true, ctrlReturn, rets
+	}
+	return false, ctrlNone, nil
+}
+
+func (s *whileStmt) exec(L *State, fr *frame) (int, []Value) {
+	for Truthy(s.cond.eval(L, fr)) {
+		if done, ctrl, rets := runLoopBody(L, s.body, fr); done {
+			return ctrl, rets
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (s *repeatStmt) exec(L *State, fr *frame) (int, []Value) {
+	for {
+		if done, ctrl, rets := runLoopBody(L, s.body, fr); done {
+			return ctrl, rets
+		}
+		if Truthy(s.cond.eval(L, fr)) {
+			return ctrlNone, nil
+		}
+	}
+}
+
+func (s *ifStmt) exec(L *State, fr *frame) (int, []Value) {
+	for i, cond := range s.conds {
+		if Truthy(cond.eval(L, fr)) {
+			return s.blocks[i].exec(L, fr)
+		}
+	}
+	if s.elseBody != nil {
+		return s.elseBody.exec(L, fr)
+	}
+	return ctrlNone, nil
+}
+
+func (s *numForStmt) exec(L *State, fr *frame) (int, []Value) {
+	forNumber := func(e expr, what string) float64 {
+		n, ok := ToNumber(e.eval(L, fr))
+		if !ok {
+			L.RaiseError("'for' %s must be a number", what)
+		}
+		return n
+	}
+	start := forNumber(s.start, "initial value")
+	limit := forNumber(s.limit, "limit")
+	step := 1.0
+	if s.step != nil {
+		step = forNumber(s.step, "step")
+	}
+
+	for i := start; (step > 0 && i <= limit) || (step <= 0 && i >= limit); i += step {
+		//Every iteration gets a fresh variable, closures capture the value of their iteration
+		v := Value(i)
+		fr.slots[s.slot] = &v
+		if done, ctrl, rets := runLoopBody(L, s.body, fr); done {
+			return ctrl, rets
+		}
+	}
+	return ctrlNone, nil
+}
+
+func (s *genForStmt) exec(L *State, fr *frame) (int, []Value) {
+	init := L.evalListN(s.exprs, fr, 3)
+	fn, state, control := init[0], init[1], init[2]
+	for {
+		values := L.call(fn, []Value{state, control})
+		if len(values) == 0 || values[0] == nil {
+			return ctrlNone, nil
+		}
+		control = values[0]
+		for i, slot := range s.slots {
+			var v Value
+			if i < len(values) {
+				v = values[i]
+			}
+			fr.slots[slot] = &v
+		}
+		if done, ctrl, rets := runLoopBody(L, s.body, fr); done {
+			return ctrl, rets
+		}
+	}
+}
+
+func (s *returnStmt) exec(L *State, fr *frame) (int, []Value) {
+	return ctrlReturn, L.evalList(s.exprs, fr)
+}
+
+func (s *breakStmt) exec(L *State, fr *frame) (int, []Value) {
+	return ctrlBreak, nil
+}
+
+func (e *constExpr) eval(L *State, fr *frame) Value {
+	return e.value
+}
+
+func (e *varargExpr) eval(L *State, fr *frame) Value {
+	return first(fr.varargs)
+}
+
+func (e *varargExpr) evalMulti(L *State, fr *frame) []Value {
+	return append([]Value(nil), fr.varargs...)
+}
+
+func (e *funcExpr) eval(L *State, fr *frame) Value {
+	c := &Closure{proto: e.proto, upvals: make([]*Value, len(e.proto.upvals))}
+	for i, u := range e.proto.upvals {
+		if u.fromParent {
+			c.upvals[i] = fr.slots[u.index]
+		} else {
+			c.upvals[i] = fr.upvals[u.index]
+		}
+	}
+	return c
+}
+
+func (e *tableExpr) eval(L *State, fr *frame) Value {
+	t := NewTable()
+	n := 0
+	for i, f := range e.fields {
+		if f.key != nil {
+			key := f.key.eval(L, fr)
+			if msg := checkKey(key); msg != "" {
+				L.RaiseError(msg)
+			}
+			t.Set(key, f.value.eval(L, fr))
+			continue
+		}
+		if m, ok := f.value.(multiExpr); ok && i == len(e.fields)-1 {
+			for _, v := range m.evalMulti(L, fr) {
+				n++
+				t.Set(float64(n), v)
+			}
+			continue
+		}
+		n++
+		t.Set(float64(n), f.value.eval(L, fr))
+	}
+	return t
+}
+
+func (e *andExpr) eval(L *State, fr *frame) Value {
+	if v := e.left.eval(L, fr); !Truthy(v) {
+		return v
+	}
+	return e.right.eval(L, fr)
+}
+
+func (e *orExpr) eval(L *State, fr *frame) Value {
+	if v := e.left.eval(L, fr); Truthy(v) {
+		return v
+	}
+	return e.right.eval(L, fr)
+}
+
+func (e *binExpr) eval(L *State, fr *frame) Value {
+	return L.arith(e.op, e.left.eval(L, fr), e.right.eval(L, fr))
+}
+
+func (L *State) arith(op string, a, b Value) Value {
+	switch op {
+	case "==":
+		return rawEqual(a, b)
+	case "~=":
+		return !rawEqual(a, b)
+	case "<":
+		return L.lessThan(a, b)
+	case "<=":
+		return L.lessEqual(a, b)
+	case ">":
+		return L.lessThan(b, a)
+	case ">=":
+		return L.lessEqual(b, a)
+	case "..":
+		return L.concat(a, b)
+	}
+
+	x, okA := ToNumber(a)
+	y, okB := ToNumber(b)
+	if !okA || !okB {
+		bad := a
+		if okA {
+			bad = b
+		}
+		L.RaiseError("attempt to perform arithmetic on a %s value", TypeName(bad))
+	}
+	switch op {
+	case "+":
+		return x + y
+	case "-":
+		return x - y
+	case "*":
+		return x * y
+	case "/":
+		return x / y
+	case "%":
+		return x - math.Floor(x/y)*y
+	case "^":
+		return math.Pow(x, y)
+	}
+	L.RaiseError("unknown operator '%s'", op)
+	return nil
+}
+
+func rawEqual(a, b Value) bool {
+	return a == b
+}
+
+func (L *State) compareError(a, b Value) {
+	ta, tb := TypeName(a), TypeName(b)
+	if ta == tb {
+		L.RaiseError("attempt to compare two %s values", ta)
+	}
+	L.RaiseError("attempt to compare %s with %s", ta, tb)
+}
+
+func (L *State) lessThan(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x < y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x < y
+		}
+	}
+	L.compareError(a, b)
+	return false
+}
+
+func (L *State) lessEqual(a, b Value) bool {
+	switch x := a.(type) {
+	case float64:
+		if y, ok := b.(float64); ok {
+			return x <= y
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return x <= y
+		}
+	}
+	L.compareError(a, b)
+	return false
+}
+
+func (L *State) concat(a, b Value) Value {
+	str := func(v Value) (string, bool) {
+		switch x := v.(type) {
+		case string:
+			return x, true
+		case float64:
+			return NumberToString(x), true
+		}
+		return "", false
+	}
+	x, okA := str(a)
+	y, okB := str(b)
+	if !okA || !okB {
+		bad := a
+		if okA {
+			bad = b
+		}
+		L.RaiseError("attempt to concatenate a %s value", TypeName(bad))
+	}
+	L.checkStringLen(len(x) + len(y))
+	return x + y
+}
+
+func (e *unExpr) eval(L *State, fr *frame) Value {
+	v := e.operand.eval(L, fr)
+	switch e.op {
+	case "not":
+		return !Truthy(v)
+	case "-":
+		n, ok := ToNumber(v)
+		if !ok {
+			L.RaiseError("attempt to perform arithmetic on a %s value", TypeName(v))
+		}
+		return -n
+	default:
+		switch x := v.(type) {
+		case string:
+			return float64(len(x))
+		case *Table:
+			return float64(x.Len())
+		}
+		L.RaiseError("attempt to get length of a %s value", TypeName(v))
+	}
+	return nil
+}
+
+func (e *localExpr) eval(L *State, fr *frame) Value {
+	return *fr.slots[e.slot]
+}
+
+func (e *upvalExpr) eval(L *State, fr *frame) Value {
+	return *fr.upvals[e.index]
+}
+
+func (e *globalExpr) eval(L *State, fr *frame) Value {
+	return L.index(L.Globals, e.name)
+}
+
+func (e *indexExpr) eval(L *State, fr *frame) Value {
+	return L.index(e.obj.eval(L, fr), e.key.eval(L, fr))
+}
+
+func (e *callExpr) eval(L *State, fr *frame) Value {
+	return first(e.evalMulti(L, fr))
+}
+
+func (e *callExpr) evalMulti(L *State, fr *frame) []Value {
+	fn := e.fn.eval(L, fr)
+	args := L.evalList(e.args, fr)
+	line := L.line
+	rets := L.call(fn, args)
+	L.line = line
+	return rets
+}
+
+func (e *methodCallExpr) eval(L *State, fr *frame) Value {
+	return first(e.evalMulti(L, fr))
+}
+
+func (e *methodCallExpr) evalMulti(L *State, fr *frame) []Value {
+	obj := e.obj.eval(L, fr)
+	fn := L.index(obj, e.name)
+	args := append([]Value{obj}, L.evalList(e.args, fr)...)
+	line := L.line
+	rets := L.call(fn, args)
+	L.line = line
+	return rets
+}
+
+func (e *parenExpr) eval(L *State, fr *frame) Value {
+	return e.inner.eval(L, fr)
+}
@@ -0,0 +1,257 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokName
+	tokNumber
+	tokString
+	tokKeyword
+	//Operators and punctuation
+	tokOp
+)
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+type token struct {
+	typ tokenType
+	//Name, keyword, operator or the value of a string literal
+	s string
+	//Value of a number literal
+	n    float64
+	line int
+}
+
+func (t token) String() string {
+	switch t.typ {
+	case tokEOF:
+		return "<eof>"
+	case tokNumber:
+		return NumberToString(t.n)
+	}
+	return t.s
+}
+
+// Splits the source of a chunk into tokens
+type lexer struct {
+	src   string
+	pos   int
+	line  int
+	chunk string
+}
+
+func (lx *lexer) errorf(line int, format string, args ...interface{}) {
+	panic(&Error{Value: fmt.Sprintf("%s:%d: %s", lx.chunk, line, fmt.Sprintf(format, args...))})
+}
+
+func (lx *lexer) peekByte(offset int) byte {
+	if lx.pos+offset < len(lx.src) {
+		return lx.src[lx.pos+offset]
+	}
+	return 0
+}
+
+func (lx *lexer) next() token {
+	lx.skipSpaceAndComments()
+	if lx.pos >= len(lx.src) {
+		return token{typ: tokEOF, line: lx.line}
+	}
+
+	line := lx.line
+	c := lx.src[lx.pos]
+	switch {
+	case isAlpha(c):
+		start := lx.pos
+		for lx.pos < len(lx.src) && (isAlpha(lx.src[lx.pos]) || isDigit(lx.src[lx.pos])) {
+			lx.pos++
+		}
+		word := lx.src[start:lx.pos]
+		if keywords[word] {
+			return token{typ: tokKeyword, s: word, line: line}
+		}
+		return token{typ: tokName, s: word, line: line}
+	case isDigit(c) || (c == '.' && isDigit(lx.peekByte(1))):
+		return lx.readNumber()
+	case c == '"' || c == '\'':
+		return token{typ: tokString, s: lx.readString(c), line: line}
+	case c == '[' && (lx.peekByte(1) == '[' || lx.peekByte(1) == '='):
+		if level := lx.longBracketLevel(); level >= 0 {
+			return token{typ: tokString, s: lx.readLongString(level), line: line}
+		}
+	}
+
+	for _, op := range []string{"...", "..", "==", "~=", "<=", ">="} {
+		if strings.HasPrefix(lx.src[lx.pos:], op) {
+			lx.pos += len(op)
+			return token{typ: tokOp, s: op, line: line}
+		}
+	}
+	if strings.IndexByte("+-*/%^#<>=(){}[];:,.", c) >= 0 {
+		lx.pos++
+		return token{typ: tokOp, s: string(c), line: line}
+	}
+	lx.errorf(line, "unexpected symbol near '%c'", c)
+	return token{}
+}
+
+func (lx *lexer) skipSpaceAndComments() {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+			lx.pos++
+		case c == '-' && lx.peekByte(1) == '-':
+			lx.pos += 2
+			if lx.peekByte(0) == '[' {
+				if level := lx.longBracketLevel(); level >= 0 {
+					lx.readLongString(level)
+					continue
+				}
+			}
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Returns the level of the long bracket [==[ starting at the current position, or -1
+func (lx *lexer) longBracketLevel() int {
+	level := 0
+	for lx.peekByte(1+level) == '=' {
+		level++
+	}
+	if lx.peekByte(1+level) == '[' {
+		return level
+	}
+	return -1
+}
+
+func (lx *lexer) readLongString(level int) string {
+	line := lx.line
+	lx.pos += level + 2
+	//A newline right after the opening bracket is not part of the string
+	if lx.peekByte(0) == '\r' {
+		lx.pos++
+	}
+	if lx.peekByte(0) == '\n' {
+		lx.line++
+		lx.pos++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(lx.src[lx.pos:], closing)
+	if end < 0 {
+		lx.errorf(line, "unfinished long string near '<eof>'")
+	}
+	s := lx.src[lx.pos : lx.pos+end]
+	lx.line += strings.Count(s, "\n")
+	lx.pos += end + len(closing)
+	return s
+}
+
+func (lx *lexer) readString(quote byte) string {
+	line := lx.line
+	lx.pos++
+	var sb strings.Builder
+	for {
+		if lx.pos >= len(lx.src) || lx.src[lx.pos] == '\n' {
+			lx.errorf(line, "unfinished string")
+		}
+		c := lx.src[lx.pos]
+		lx.pos++
+		if c == quote {
+			return sb.String()
+		}
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		e := lx.peekByte(0)
+		lx.pos++
+		switch e {
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\n':
+			lx.line++
+			sb.WriteByte('\n')
+		case '\\', '"', '\'':
+			sb.WriteByte(e)
+		default:
+			if !isDigit(e) {
+				lx.errorf(line, "invalid escape sequence '\\%c'", e)
+			}
+			//\ddd, up to three decimal digits
+			n := int(e - '0')
+			for i := 0; i < 2 && isDigit(lx.peekByte(0)); i++ {
+				n = n*10 + int(lx.src[lx.pos]-'0')
+				lx.pos++
+			}
+			if n > 255 {
+				lx.errorf(line, "escape sequence too large")
+			}
+			sb.WriteByte(byte(n))
+		}
+	}
+}
+
+func (lx *lexer) readNumber() token {
+	line := lx.line
+	start := lx.pos
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		if (c == '+' || c == '-') && (lx.src[lx.pos-1] == 'e' || lx.src[lx.pos-1] == 'E') &&
+			!strings.ContainsAny(lx.src[start:lx.pos], "xX") {
+			lx.pos++
+			continue
+		}
+		if !isAlpha(c) && !isDigit(c) && c != '.' {
+			break
+		}
+		lx.pos++
+	}
+	text := lx.src[start:lx.pos]
+	n, ok := ParseNumber(text)
+	if !ok {
+		lx.errorf(line, "malformed number near '%s'", text)
+	}
+	return token{typ: tokNumber, n: n, s: text, line: line}
+}
+
+func isAlpha(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
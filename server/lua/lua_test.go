@@ -0,0 +1,144 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// Runs the script and joins the returned values with spaces
+func run(script string) (string, error) {
+	p, err := Compile(script, "user_script")
+	if err != nil {
+		return "", err
+	}
+	L := NewState()
+	rets, err := L.Call(L.NewFunction(p))
+	if err != nil {
+		return "", err
+	}
+	out := make([]string, len(rets))
+	for i, r := range rets {
+		out[i] = ToString(r)
+	}
+	return strings.Join(out, " "), nil
+}
+
+func TestExpressions(t *testing.T) {
+	cases := map[string]string{
+		`return 1 + 2 * 3, 2 ^ 3 ^ 2, -7 % 3, 10 / 4`:                   "7 512 2 2.5",
+		`return "a" .. "b" .. 1, #"abc", "10" + 5`:                      "ab1 3 15",
+		`return 1 < 2, "a" < "b", 1 == 1.0, {} == {}`:                   "true true true false",
+		`return nil or "x", false and 1, not nil`:                       "x false true",
+		`return 0x10, 1e2, .5, 2^53`:                                    "16 100 0.5 9.007199254741e+15",
+		`local a, b, c = (function() return 1, 2 end)() return a, b, c`: "1 2 nil",
+	}
+	for script, expected := range cases {
+		value, err := run(script)
+		if err != nil || value != expected {
+			t.Errorf("%s: got %q, %v", script, value, err)
+		}
+	}
+}
+
+func TestStatements(t *testing.T) {
+	cases := map[string]string{
+		`local s = 0 for i = 1, 10 do s = s + i end return s`:                                              "55",
+		`local s = 0 for i = 10, 1, -3 do s = s + i end return s`:                                          "22",
+		`local i = 0 while true do i = i + 1 if i == 5 then break end end return i`:                        "5",
+		`local i = 0 repeat local j = i i = i + 1 until j >= 3 return i`:                                   "4",
+		`local s = 0 for _, v in ipairs({4, 5, 6}) do s = s + v end return s`:                              "15",
+		`local n = 0 for k, v in pairs({a = 1, b = 2, 3}) do n = n + v end return n`:                       "6",
+		`local function fib(n) if n < 2 then return n end return fib(n-1) + fib(n-2) end return fib(15)`:   "610",
+		`local fs = {} for i = 1, 3 do fs[i] = function() return i end end return fs[1](), fs[3]()`:        "1 3",
+		`local t = {n = 0} function t:add(k) self.n = self.n + k return self end return t:add(2):add(3).n`: "5",
+		`local function f(...) return select("#", ...), ... end return f(1, nil, 3)`:                       "3 1 nil 3",
+	}
+	for script, expected := range cases {
+		value, err := run(script)
+		if err != nil || value != expected {
+			t.Errorf("%s: got %q, %v", script, value, err)
+		}
+	}
+}
+
+func TestLibraries(t *testing.T) {
+	cases := map[string]string{
+		`return string.format("%5.2f|%d|%s|%q|%x", 3.14159, 42, "hi", "a\"b", 255)`:              ` 3.14|42|hi|"a\"b"|ff`,
+		`return string.find("hello world", "o w"), string.match("key:123", "(%a+):(%d+)")`:       "5 key 123",
+		`return string.gsub("hello world", "(%w+)", "<%1>")`:                                     "<hello> <world> 2",
+		`return string.match("  trim  ", "^%s*(.-)%s*$"), string.match("f(a(b)c)", "%b()")`:      "trim (a(b)c)",
+		`local r = {} for w in string.gmatch("one two", "%a+") do r[#r + 1] = w end return r[2]`: "two",
+		`return ("abc"):upper(), string.sub("hello", -3), string.rep("ab", 2)`:                   "ABC llo abab",
+		`local t = {5, 3, 8} table.sort(t) table.insert(t, 1, 0) return table.concat(t, ",")`:    "0,3,5,8",
+		`return tonumber("0x10"), tonumber(" 12 "), tonumber("z", 36), tonumber("1e")`:           "16 12 35 nil",
+		`return math.floor(3.7), math.max(1, 5, 3), math.huge`:                                   "3 5 inf",
+		`return pcall(function() error("boom") end)`:                                             "false user_script:1: boom",
+		`return select(2, pcall(error, {code = 1})).code`:                                        "1",
+		`return type(io), type(os), type(loadstring), type(require)`:                             "nil nil nil nil",
+	}
+	for script, expected := range cases {
+		value, err := run(script)
+		if err != nil || value != expected {
+			t.Errorf("%s: got %q, %v", script, value, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	cases := map[string]string{
+		"return 1 +":                            "user_script:1: unexpected symbol near '<eof>'",
+		"x = ":                                  "user_script:1: unexpected symbol near '<eof>'",
+		"if true then":                          "user_script:1: 'end' expected near '<eof>'",
+		"local x\nreturn x.y":                   "user_script:2: attempt to index a nil value",
+		"return {} < {}":                        "user_script:1: attempt to compare two table values",
+		"return nil .. 'a'":                     "user_script:1: attempt to concatenate a nil value",
+		"local function r() return r() end r()": "user_script:1: stack overflow",
+		"error('custom', 0)":                    "custom",
+	}
+	for script, expected := range cases {
+		_, err := run(script)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: got %v", script, err)
+		}
+	}
+}
+
+func TestHookAbortsScript(t *testing.T) {
+	p, err := Compile("while true do pcall(function() end) end", "user_script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	killed := errors.New("killed")
+	L := NewState()
+	L.Hook = func() error { return killed }
+	if _, err := L.Call(L.NewFunction(p)); err != killed {
+		t.Fail()
+	}
+}
+
+func TestStringLengthLimit(t *testing.T) {
+	defer func(n int) { MaxStringLen = n }(MaxStringLen)
+	MaxStringLen = 10
+
+	cases := map[string]string{
+		"return string.rep('x', 2^40)":                             "user_script:1: string length overflow",
+		"return string.rep('ab', 6)":                               "user_script:1: string length overflow",
+		"return string.rep('x', 6) .. string.rep('y', 5)":          "user_script:1: string length overflow",
+		"return table.concat({'abcd', 'efgh'}, '---')":             "user_script:1: string length overflow",
+		"return (string.gsub('abc', '%w', 'xyzw'))":                "user_script:1: string length overflow",
+		"return string.format('%s%s', 'abcdef', 'ghijk')":          "user_script:1: string length overflow",
+		"local ok, err = pcall(string.rep, 'x', 11) error(err, 0)": "user_script:1: string length overflow",
+	}
+	for script, expected := range cases {
+		_, err := run(script)
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: got %v", script, err)
+		}
+	}
+
+	//Strings of exactly MaxStringLen bytes can be built
+	if value, err := run("return string.rep('ab', 5), 'abcde' .. 'fghij', table.concat({'abcd', 'efgh'}, '-')"); err != nil || value != "ababababab abcdefghij abcd-efgh" {
+		t.Errorf("got %q, %v", value, err)
+	}
+}
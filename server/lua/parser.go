@@ -0,0 +1,627 @@
+package lua
+
+import "fmt"
+
+// Maximum nesting of blocks and expressions, keeps the parser from exhausting the stack
+const maxSyntaxLevels = 200
+
+type localVar struct {
+	name string
+	slot int
+}
+
+// Compilation state of the function being parsed
+type funcState struct {
+	parent     *funcState
+	proto      *funcProto
+	actives    []localVar
+	upvalNames []string
+	loops      int
+}
+
+func (fs *funcState) declareLocal(name string) int {
+	slot := fs.proto.nslots
+	fs.proto.nslots++
+	fs.actives = append(fs.actives, localVar{name, slot})
+	return slot
+}
+
+func (fs *funcState) findLocal(name string) (int, bool) {
+	for i := len(fs.actives) - 1; i >= 0; i-- {
+		if fs.actives[i].name == name {
+			return fs.actives[i].slot, true
+		}
+	}
+	return 0, false
+}
+
+func (fs *funcState) findUpval(name string) (int, bool) {
+	for i, n := range fs.upvalNames {
+		if n == name {
+			return i, true
+		}
+	}
+	if fs.parent == nil {
+		return 0, false
+	}
+
+	var desc upvalDesc
+	if slot, ok := fs.parent.findLocal(name); ok {
+		desc = upvalDesc{fromParent: true, index: slot}
+	} else if idx, ok := fs.parent.findUpval(name); ok {
+		desc = upvalDesc{fromParent: false, index: idx}
+	} else {
+		return 0, false
+	}
+	fs.upvalNames = append(fs.upvalNames, name)
+	fs.proto.upvals = append(fs.proto.upvals, desc)
+	return len(fs.upvalNames) - 1, true
+}
+
+// Resolves a name to a local variable, an upvalue or a global variable
+func (fs *funcState) resolve(name string) expr {
+	if slot, ok := fs.findLocal(name); ok {
+		return &localExpr{slot}
+	}
+	if idx, ok := fs.findUpval(name); ok {
+		return &upvalExpr{idx}
+	}
+	return &globalExpr{name}
+}
+
+type parser struct {
+	lx       *lexer
+	tok      token
+	ahead    token
+	hasAhead bool
+	fs       *funcState
+	levels   int
+}
+
+// Compile parses the source of a chunk, chunkName is used as the prefix of error positions
+func Compile(source string, chunkName string) (proto *Proto, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			proto, err = nil, e
+		}
+	}()
+
+	p := &parser{lx: &lexer{src: source, line: 1, chunk: chunkName}}
+	p.advance()
+	main := &funcProto{name: "main chunk", chunk: chunkName, line: 0, isVararg: true}
+	p.fs = &funcState{proto: main}
+	main.body = p.block()
+	if p.tok.typ != tokEOF {
+		p.errorExpected("<eof>")
+	}
+	return &Proto{main: main}, nil
+}
+
+func (p *parser) advance() {
+	if p.hasAhead {
+		p.tok, p.hasAhead = p.ahead, false
+		return
+	}
+	p.tok = p.lx.next()
+}
+
+func (p *parser) peek() token {
+	if !p.hasAhead {
+		p.ahead, p.hasAhead = p.lx.next(), true
+	}
+	return p.ahead
+}
+
+func (p *parser) errorf(format string, args ...interface{}) {
+	p.lx.errorf(p.tok.line, "%s near '%s'", fmt.Sprintf(format, args...), p.tok)
+}
+
+func (p *parser) errorExpected(what string) {
+	p.errorf("'%s' expected", what)
+}
+
+// Tells if the current token is the keyword or operator s
+func (p *parser) check(s string) bool {
+	return (p.tok.typ == tokKeyword || p.tok.typ == tokOp) && p.tok.s == s
+}
+
+func (p *parser) accept(s string) bool {
+	if p.check(s) {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(s string) {
+	if !p.accept(s) {
+		p.errorExpected(s)
+	}
+}
+
+// Expects the token closing a construct opened by `open` at line `line`
+func (p *parser) expectMatch(what, open string, line int) {
+	if p.accept(what) {
+		return
+	}
+	if line == p.tok.line {
+		p.errorExpected(what)
+	}
+	p.errorf("'%s' expected (to close '%s' at line %d)", what, open, line)
+}
+
+func (p *parser) expectName() string {
+	if p.tok.typ != tokName {
+		p.errorExpected("<name>")
+	}
+	name := p.tok.s
+	p.advance()
+	return name
+}
+
+func (p *parser) enterLevel() {
+	p.levels++
+	if p.levels > maxSyntaxLevels {
+		p.errorf("chunk has too many syntax levels")
+	}
+}
+
+func (p *parser) leaveLevel() {
+	p.levels--
+}
+
+func (p *parser) blockFollows() bool {
+	switch {
+	case p.tok.typ == tokEOF:
+		return true
+	case p.tok.typ == tokKeyword:
+		switch p.tok.s {
+		case "else", "elseif", "end", "until":
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a block in a new scope
+func (p *parser) block() *block {
+	active := len(p.fs.actives)
+	b := p.statements()
+	p.fs.actives = p.fs.actives[:active]
+	return b
+}
+
+func (p *parser) statements() *block {
+	p.enterLevel()
+	defer p.leaveLevel()
+
+	b := &block{}
+	for !p.blockFollows() {
+		if p.accept(";") {
+			continue
+		}
+		line := p.tok.line
+		if p.check("return") {
+			p.advance()
+			b.stmts = append(b.stmts, p.returnStatement())
+			b.lines = append(b.lines, line)
+			break
+		}
+		b.stmts = append(b.stmts, p.statement())
+		b.lines = append(b.lines, line)
+	}
+	return b
+}
+
+func (p *parser) returnStatement() stmt {
+	s := &returnStmt{}
+	if !p.blockFollows() && !p.check(";") {
+		s.exprs = p.exprList()
+	}
+	p.accept(";")
+	if !p.blockFollows() {
+		p.errorExpected("<eof>")
+	}
+	return s
+}
+
+func (p *parser) statement() stmt {
+	line := p.tok.line
+	if p.tok.typ == tokKeyword {
+		switch p.tok.s {
+		case "if":
+			return p.ifStatement(line)
+		case "while":
+			p.advance()
+			cond := p.expr()
+			p.expect("do")
+			body := p.loopBlock()
+			p.expectMatch("end", "while", line)
+			return &whileStmt{cond, body}
+		case "do":
+			p.advance()
+			body := p.block()
+			p.expectMatch("end", "do", line)
+			return &doStmt{body}
+		case "for":
+			return p.forStatement(line)
+		case "repeat":
+			return p.repeatStatement(line)
+		case "function":
+			return p.functionStatement(line)
+		case "local":
+			p.advance()
+			if p.accept("function") {
+				name := p.expectName()
+				slot := p.fs.declareLocal(name)
+				return &localFuncStmt{slot, p.funcBody(name, false, line)}
+			}
+			return p.localStatement()
+		case "break":
+			p.advance()
+			if p.fs.loops == 0 {
+				p.errorf("no loop to break")
+			}
+			return &breakStmt{}
+		}
+	}
+	return p.exprStatement()
+}
+
+func (p *parser) loopBlock() *block {
+	p.fs.loops++
+	defer func() { p.fs.loops-- }()
+	return p.block()
+}
+
+func (p *parser) ifStatement(line int) stmt {
+	s := &ifStmt{}
+	p.advance()
+	s.conds = append(s.conds, p.expr())
+	p.expect("then")
+	s.blocks = append(s.blocks, p.block())
+	for p.check("elseif") {
+		p.advance()
+		s.conds = append(s.conds, p.expr())
+		p.expect("then")
+		s.blocks = append(s.blocks, p.block())
+	}
+	if p.accept("else") {
+		s.elseBody = p.block()
+	}
+	p.expectMatch("end", "if", line)
+	return s
+}
+
+func (p *parser) forStatement(line int) stmt {
+	p.advance()
+	first := p.expectName()
+	active := len(p.fs.actives)
+	defer func() { p.fs.actives = p.fs.actives[:active] }()
+
+	if p.accept("=") {
+		s := &numForStmt{}
+		s.start = p.expr()
+		p.expect(",")
+		s.limit = p.expr()
+		if p.accept(",") {
+			s.step = p.expr()
+		}
+		p.expect("do")
+		s.slot = p.fs.declareLocal(first)
+		s.body = p.loopBlock()
+		p.expectMatch("end", "for", line)
+		return s
+	}
+
+	names := []string{first}
+	for p.accept(",") {
+		names = append(names, p.expectName())
+	}
+	p.expect("in")
+	s := &genForStmt{exprs: p.exprList()}
+	p.expect("do")
+	for _, name := range names {
+		s.slots = append(s.slots, p.fs.declareLocal(name))
+	}
+	s.body = p.loopBlock()
+	p.expectMatch("end", "for", line)
+	return s
+}
+
+func (p *parser) repeatStatement(line int) stmt {
+	p.advance()
+	//The condition can see the locals of the loop body
+	active := len(p.fs.actives)
+	p.fs.loops++
+	body := p.statements()
+	p.fs.loops--
+	p.expectMatch("until", "repeat", line)
+	cond := p.expr()
+	p.fs.actives = p.fs.actives[:active]
+	return &repeatStmt{body, cond}
+}
+
+func (p *parser) functionStatement(line int) stmt {
+	p.advance()
+	name := p.expectName()
+	fullName := name
+	var target expr = p.fs.resolve(name)
+	isMethod := false
+	for p.check(".") || p.check(":") {
+		isMethod = p.check(":")
+		p.advance()
+		key := p.expectName()
+		fullName += "." + key
+		target = &indexExpr{target, &constExpr{key}}
+		if isMethod {
+			break
+		}
+	}
+	return &assignStmt{targets: []expr{target}, exprs: []expr{p.funcBody(fullName, isMethod, line)}}
+}
+
+func (p *parser) localStatement() stmt {
+	names := []string{p.expectName()}
+	for p.accept(",") {
+		names = append(names, p.expectName())
+	}
+	s := &localStmt{}
+	if p.accept("=") {
+		s.exprs = p.exprList()
+	}
+	//The names are only visible after the statement: local x = x
+	for _, name := range names {
+		s.slots = append(s.slots, p.fs.declareLocal(name))
+	}
+	return s
+}
+
+func (p *parser) exprStatement() stmt {
+	e := p.suffixedExpr()
+	if call, ok := e.(multiExpr); ok && !p.check("=") && !p.check(",") {
+		if _, isVararg := e.(*varargExpr); !isVararg {
+			return &callStmt{call}
+		}
+	}
+
+	targets := []expr{e}
+	for p.accept(",") {
+		targets = append(targets, p.suffixedExpr())
+	}
+	for _, t := range targets {
+		switch t.(type) {
+		case *localExpr, *upvalExpr, *globalExpr, *indexExpr:
+		default:
+			p.errorf("syntax error")
+		}
+	}
+	p.expect("=")
+	return &assignStmt{targets: targets, exprs: p.exprList()}
+}
+
+func (p *parser) funcBody(name string, isMethod bool, line int) *funcExpr {
+	proto := &funcProto{name: name, chunk: p.lx.chunk, line: line}
+	fs := &funcState{parent: p.fs, proto: proto}
+	p.fs = fs
+
+	if isMethod {
+		fs.declareLocal("self")
+		proto.params++
+	}
+	p.expect("(")
+	if !p.check(")") {
+		for {
+			if p.accept("...") {
+				proto.isVararg = true
+				break
+			}
+			fs.declareLocal(p.expectName())
+			proto.params++
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	proto.body = p.block()
+	p.expectMatch("end", "function", line)
+
+	p.fs = fs.parent
+	return &funcExpr{proto}
+}
+
+func (p *parser) exprList() []expr {
+	list := []expr{p.expr()}
+	for p.accept(",") {
+		list = append(list, p.expr())
+	}
+	return list
+}
+
+// Left and right priorities of the binary operators, right associative operators
+// have a lower right priority
+var binaryPriority = map[string][2]int{
+	"or":  {1, 1},
+	"and": {2, 2},
+	"<":   {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4},
+	"+":  {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+const unaryPriority = 8
+
+func (p *parser) expr() expr {
+	return p.subExpr(0)
+}
+
+func (p *parser) subExpr(limit int) expr {
+	p.enterLevel()
+	defer p.leaveLevel()
+
+	var e expr
+	if p.check("not") || p.check("-") || p.check("#") {
+		op := p.tok.s
+		p.advance()
+		e = &unExpr{op, p.subExpr(unaryPriority)}
+	} else {
+		e = p.simpleExpr()
+	}
+
+	for p.tok.typ == tokKeyword || p.tok.typ == tokOp {
+		prio, ok := binaryPriority[p.tok.s]
+		if !ok || prio[0] <= limit {
+			break
+		}
+		op := p.tok.s
+		p.advance()
+		right := p.subExpr(prio[1])
+		switch op {
+		case "and":
+			e = &andExpr{e, right}
+		case "or":
+			e = &orExpr{e, right}
+		default:
+			e = &binExpr{op, e, right}
+		}
+	}
+	return e
+}
+
+func (p *parser) simpleExpr() expr {
+	switch p.tok.typ {
+	case tokNumber:
+		n := p.tok.n
+		p.advance()
+		return &constExpr{n}
+	case tokString:
+		s := p.tok.s
+		p.advance()
+		return &constExpr{s}
+	case tokKeyword:
+		switch p.tok.s {
+		case "nil":
+			p.advance()
+			return &constExpr{nil}
+		case "true":
+			p.advance()
+			return &constExpr{true}
+		case "false":
+			p.advance()
+			return &constExpr{false}
+		case "function":
+			line := p.tok.line
+			p.advance()
+			return p.funcBody("anonymous", false, line)
+		}
+	case tokOp:
+		switch p.tok.s {
+		case "...":
+			if !p.fs.proto.isVararg {
+				p.errorf("cannot use '...' outside a vararg function")
+			}
+			p.advance()
+			return &varargExpr{}
+		case "{":
+			return p.tableConstructor()
+		}
+	}
+	return p.suffixedExpr()
+}
+
+func (p *parser) primaryExpr() expr {
+	switch {
+	case p.tok.typ == tokName:
+		name := p.tok.s
+		p.advance()
+		return p.fs.resolve(name)
+	case p.check("("):
+		line := p.tok.line
+		p.advance()
+		e := p.expr()
+		p.expectMatch(")", "(", line)
+		return &parenExpr{e}
+	}
+	p.errorf("unexpected symbol")
+	return nil
+}
+
+func (p *parser) suffixedExpr() expr {
+	e := p.primaryExpr()
+	for {
+		switch {
+		case p.check("."):
+			p.advance()
+			e = &indexExpr{e, &constExpr{p.expectName()}}
+		case p.check("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			e = &indexExpr{e, key}
+		case p.check(":"):
+			p.advance()
+			name := p.expectName()
+			e = &methodCallExpr{e, name, p.callArgs()}
+		case p.check("(") || p.check("{") || p.tok.typ == tokString:
+			e = &callExpr{e, p.callArgs()}
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) callArgs() []expr {
+	switch {
+	case p.tok.typ == tokString:
+		s := p.tok.s
+		p.advance()
+		return []expr{&constExpr{s}}
+	case p.check("{"):
+		return []expr{p.tableConstructor()}
+	case p.check("("):
+		line := p.tok.line
+		p.advance()
+		if p.accept(")") {
+			return nil
+		}
+		args := p.exprList()
+		p.expectMatch(")", "(", line)
+		return args
+	}
+	p.errorf("function arguments expected")
+	return nil
+}
+
+func (p *parser) tableConstructor() expr {
+	line := p.tok.line
+	p.expect("{")
+	t := &tableExpr{}
+	for !p.check("}") {
+		switch {
+		case p.check("["):
+			p.advance()
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			t.fields = append(t.fields, tableField{key, p.expr()})
+		case p.tok.typ == tokName && p.peek().typ == tokOp && p.peek().s == "=":
+			key := p.tok.s
+			p.advance()
+			p.advance()
+			t.fields = append(t.fields, tableField{&constExpr{key}, p.expr()})
+		default:
+			t.fields = append(t.fields, tableField{nil, p.expr()})
+		}
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectMatch("}", "{", line)
+	return t
+}
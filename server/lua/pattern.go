@@ -0,0 +1,609 @@
+package lua
+
+import (
+	"fmt"
+	"strings"
+)
+
+/**
+Lua patterns, as implemented by lstrlib.c in Lua 5.1:
+	- character classes: . %a %c %d %l %p %s %u %w %x %z (upper case negates) and sets [...] / [^...]
+	- quantifiers: * + - ?
+	- anchors ^ (at the start of the pattern) and $ (at the end)
+	- captures (...), position captures (), back references %1-%9
+	- %bxy balanced strings and %f[set] frontiers
+*/
+
+const (
+	maxCaptures    = 32
+	capUnfinished  = -1
+	capPosition    = -2
+	patternSpecial = "^$*+?.([%-"
+)
+
+type capture struct {
+	init   int
+	length int
+}
+
+type matchState struct {
+	L       *State
+	src     string
+	pat     string
+	level   int
+	capture [maxCaptures]capture
+}
+
+func (ms *matchState) srcByte(s int) byte {
+	if s < len(ms.src) {
+		return ms.src[s]
+	}
+	return 0
+}
+
+func (ms *matchState) patByte(p int) byte {
+	if p < len(ms.pat) {
+		return ms.pat[p]
+	}
+	return 0
+}
+
+// Returns the index right after the single character class starting at p
+func (ms *matchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	if c == '%' {
+		if p >= len(ms.pat) {
+			ms.L.RaiseError("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	}
+	if c == '[' {
+		if ms.patByte(p) == '^' {
+			p++
+		}
+		for {
+			if p >= len(ms.pat) {
+				ms.L.RaiseError("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' && p < len(ms.pat) {
+				p++
+			}
+			if p >= len(ms.pat) {
+				ms.L.RaiseError("malformed pattern (missing ']')")
+			}
+			if ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func matchClass(c byte, class byte) bool {
+	var res bool
+	lower := class | 0x20
+	switch lower {
+	case 'a':
+		res = isAlpha(c) && c != '_'
+	case 'c':
+		res = c < 32 || c == 127
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = c >= 'a' && c <= 'z'
+	case 'p':
+		res = (c >= 33 && c <= 47) || (c >= 58 && c <= 64) || (c >= 91 && c <= 96) || (c >= 123 && c <= 126)
+	case 's':
+		res = c == ' ' || (c >= '\t' && c <= '\r')
+	case 'u':
+		res = c >= 'A' && c <= 'Z'
+	case 'w':
+		res = isDigit(c) || (isAlpha(c) && c != '_')
+	case 'x':
+		res = isDigit(c) || (lower >= 'a' && (c|0x20) >= 'a' && (c|0x20) <= 'f')
+	case 'z':
+		res = c == 0
+	default:
+		return class == c
+	}
+	if class >= 'A' && class <= 'Z' {
+		return !res
+	}
+	return res
+}
+
+// Matches c against the set [...] which starts at p and ends at ec (the closing ']')
+func (ms *matchState) matchBracketClass(c byte, p int, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case ms.patByte(p+1) == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+func (ms *matchState) singleMatch(s int, p int, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// Matches the pattern starting at p against the subject starting at s,
+// returns the end of the match or -1
+func (ms *matchState) match(s int, p int) int {
+	for {
+		if p >= len(ms.pat) {
+			return s
+		}
+		switch ms.pat[p] {
+		case '(':
+			if ms.patByte(p+1) == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		case '%':
+			switch next := ms.patByte(p + 1); {
+			case next == 'b':
+				if s = ms.matchBalance(s, p+2); s == -1 {
+					return -1
+				}
+				p += 4
+				continue
+			case next == 'f':
+				p += 2
+				if ms.patByte(p) != '[' {
+					ms.L.RaiseError("missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p)
+				var previous byte
+				if s > 0 {
+					previous = ms.src[s-1]
+				}
+				if ms.matchBracketClass(previous, p, ep-1) || !ms.matchBracketClass(ms.srcByte(s), p, ep-1) {
+					return -1
+				}
+				p = ep
+				continue
+			case isDigit(next):
+				if s = ms.matchCapture(s, next); s == -1 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		}
+
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		switch ms.patByte(ep) {
+		case '?':
+			if m {
+				if res := ms.match(s+1, ep+1); res != -1 {
+					return res
+				}
+			}
+			p = ep + 1
+			continue
+		case '*':
+			return ms.maxExpand(s, p, ep)
+		case '+':
+			if !m {
+				return -1
+			}
+			return ms.maxExpand(s+1, p, ep)
+		case '-':
+			return ms.minExpand(s, p, ep)
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+}
+
+func (ms *matchState) maxExpand(s int, p int, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s int, p int, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s int, p int, what int) int {
+	if ms.level >= maxCaptures {
+		ms.L.RaiseError("too many captures")
+	}
+	ms.capture[ms.level] = capture{init: s, length: what}
+	ms.level++
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.level--
+	}
+	return res
+}
+
+func (ms *matchState) endCapture(s int, p int) int {
+	l := -1
+	for i := ms.level - 1; i >= 0; i-- {
+		if ms.capture[i].length == capUnfinished {
+			l = i
+			break
+		}
+	}
+	if l == -1 {
+		ms.L.RaiseError("invalid pattern capture")
+	}
+	ms.capture[l].length = s - ms.capture[l].init
+	res := ms.match(s, p)
+	if res == -1 {
+		ms.capture[l].length = capUnfinished
+	}
+	return res
+}
+
+func (ms *matchState) matchBalance(s int, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.L.RaiseError("unbalanced pattern")
+	}
+	if ms.srcByte(s) != ms.pat[p] || s >= len(ms.src) {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		if ms.src[s] == e {
+			cont--
+			if cont == 0 {
+				return s + 1
+			}
+		} else if ms.src[s] == b {
+			cont++
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) matchCapture(s int, l byte) int {
+	idx := int(l - '1')
+	if idx < 0 || idx >= ms.level || ms.capture[idx].length == capUnfinished {
+		ms.L.RaiseError("invalid capture index")
+	}
+	c := ms.capture[idx]
+	if len(ms.src)-s >= c.length && ms.src[c.init:c.init+c.length] == ms.src[s:s+c.length] {
+		return s + c.length
+	}
+	return -1
+}
+
+// Returns the capture i of the match s..e, the whole match when the pattern has no captures
+func (ms *matchState) oneCapture(i int, s int, e int) Value {
+	if i >= ms.level {
+		if i != 0 {
+			ms.L.RaiseError("invalid capture index")
+		}
+		return ms.src[s:e]
+	}
+	c := ms.capture[i]
+	switch c.length {
+	case capUnfinished:
+		ms.L.RaiseError("unfinished capture")
+	case capPosition:
+		return float64(c.init + 1)
+	}
+	return ms.src[c.init : c.init+c.length]
+}
+
+func (ms *matchState) captures(s int, e int, wholeIfNone bool) []Value {
+	n := ms.level
+	if n == 0 && wholeIfNone {
+		n = 1
+	}
+	values := make([]Value, n)
+	for i := range values {
+		values[i] = ms.oneCapture(i, s, e)
+	}
+	return values
+}
+
+// string.find and string.match
+func strFind(L *State, args []Value, find bool) []Value {
+	fname := "match"
+	if find {
+		fname = "find"
+	}
+	src := checkString(L, args, 0, fname)
+	pat := checkString(L, args, 1, fname)
+	init := relativePosition(optInt(L, args, 2, fname, 1), len(src)) - 1
+	if init < 0 {
+		init = 0
+	} else if init > len(src) {
+		return []Value{nil}
+	}
+
+	if find && (Truthy(arg(args, 3)) || !strings.ContainsAny(pat, patternSpecial)) {
+		idx := strings.Index(src[init:], pat)
+		if idx < 0 {
+			return []Value{nil}
+		}
+		return []Value{float64(init + idx + 1), float64(init + idx + len(pat))}
+	}
+
+	ms := &matchState{L: L, src: src, pat: pat}
+	p := 0
+	anchor := len(pat) > 0 && pat[0] == '^'
+	if anchor {
+		p = 1
+	}
+	for s := init; s <= len(src); s++ {
+		ms.level = 0
+		if e := ms.match(s, p); e != -1 {
+			if find {
+				return append([]Value{float64(s + 1), float64(e)}, ms.captures(-1, -1, false)...)
+			}
+			return ms.captures(s, e, true)
+		}
+		if anchor {
+			break
+		}
+	}
+	return []Value{nil}
+}
+
+func strGmatch(L *State, args []Value) []Value {
+	src := checkString(L, args, 0, "gmatch")
+	pat := checkString(L, args, 1, "gmatch")
+	pos := 0
+	iter := &GoFunction{Name: "gmatch_iterator", Fn: func(L *State, args []Value) []Value {
+		ms := &matchState{L: L, src: src, pat: pat}
+		for s := pos; s <= len(src); s++ {
+			ms.level = 0
+			if e := ms.match(s, 0); e != -1 {
+				pos = e
+				if e == s {
+					pos++
+				}
+				return ms.captures(s, e, true)
+			}
+		}
+		pos = len(src) + 1
+		return []Value{nil}
+	}}
+	return []Value{iter}
+}
+
+func strGsub(L *State, args []Value) []Value {
+	src := checkString(L, args, 0, "gsub")
+	pat := checkString(L, args, 1, "gsub")
+	repl := arg(args, 2)
+	switch repl.(type) {
+	case string, float64, *Table, *Closure, *GoFunction:
+	default:
+		typeError(L, args, 2, "gsub", "string/function/table")
+	}
+	maxN := optInt(L, args, 3, "gsub", len(src)+1)
+
+	anchor := len(pat) > 0 && pat[0] == '^'
+	p := 0
+	if anchor {
+		p = 1
+	}
+	ms := &matchState{L: L, src: src, pat: pat}
+	var out strings.Builder
+	s, n := 0, 0
+	for n < maxN {
+		ms.level = 0
+		e := ms.match(s, p)
+		if e != -1 {
+			n++
+			r := ms.replacement(repl, s, e)
+			L.checkStringLen(out.Len() + len(r))
+			out.WriteString(r)
+		}
+		if e != -1 && e > s {
+			s = e
+		} else if s < len(src) {
+			out.WriteByte(src[s])
+			s++
+		} else {
+			break
+		}
+		if anchor {
+			break
+		}
+	}
+	if s < len(src) {
+		out.WriteString(src[s:])
+	}
+	return []Value{out.String(), float64(n)}
+}
+
+// Computes the replacement of the match s..e for gsub
+func (ms *matchState) replacement(repl Value, s int, e int) string {
+	var value Value
+	switch r := repl.(type) {
+	case float64:
+		return NumberToString(r)
+	case string:
+		var out strings.Builder
+		for i := 0; i < len(r); i++ {
+			if r[i] != '%' || i+1 == len(r) {
+				out.WriteByte(r[i])
+				continue
+			}
+			i++
+			switch {
+			case !isDigit(r[i]):
+				out.WriteByte(r[i])
+			case r[i] == '0':
+				out.WriteString(ms.src[s:e])
+			default:
+				out.WriteString(ToString(ms.oneCapture(int(r[i]-'1'), s, e)))
+			}
+		}
+		return out.String()
+	case *Table:
+		value = ms.L.index(r, ms.oneCapture(0, s, e))
+	default:
+		value = first(ms.L.call(r, ms.captures(s, e, true)))
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ms.src[s:e]
+	case bool:
+		if !v {
+			return ms.src[s:e]
+		}
+	case string:
+		return v
+	case float64:
+		return NumberToString(v)
+	}
+	ms.L.RaiseError("invalid replacement value (a %s)", TypeName(value))
+	return ""
+}
+
+func strFormat(L *State, args []Value) []Value {
+	format := checkString(L, args, 0, "format")
+	var out strings.Builder
+	argIdx := 0
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			out.WriteByte(c)
+			continue
+		}
+		i++
+		if i < len(format) && format[i] == '%' {
+			out.WriteByte('%')
+			continue
+		}
+
+		//Flags, width and precision are copied to the Go format specifier
+		start := i
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		for i < len(format) && isDigit(format[i]) {
+			i++
+		}
+		hasPrecision := false
+		if i < len(format) && format[i] == '.' {
+			hasPrecision = true
+			i++
+			for i < len(format) && isDigit(format[i]) {
+				i++
+			}
+		}
+		if i >= len(format) {
+			L.RaiseError("invalid option '%%' to 'format'")
+		}
+		spec := "%" + format[start:i]
+		argIdx++
+		if argIdx >= len(args) {
+			argError(L, argIdx, "format", "no value")
+		}
+
+		switch verb := format[i]; verb {
+		case 'd', 'i':
+			out.WriteString(fmt.Sprintf(spec+"d", int64(checkNumber(L, args, argIdx, "format"))))
+		case 'u':
+			out.WriteString(fmt.Sprintf(spec+"d", uint64(checkNumber(L, args, argIdx, "format"))))
+		case 'c':
+			out.WriteByte(byte(checkNumber(L, args, argIdx, "format")))
+		case 'o', 'x', 'X':
+			out.WriteString(fmt.Sprintf(spec+string(verb), int64(checkNumber(L, args, argIdx, "format"))))
+		case 'e', 'E', 'f', 'g', 'G':
+			if !hasPrecision {
+				spec += ".6"
+			}
+			out.WriteString(fmt.Sprintf(spec+string(verb), checkNumber(L, args, argIdx, "format")))
+		case 'q':
+			out.WriteString(quoteString(checkString(L, args, argIdx, "format")))
+		case 's':
+			out.WriteString(fmt.Sprintf(spec+"s", checkString(L, args, argIdx, "format")))
+		default:
+			L.RaiseError("invalid option '%%%c' to 'format'", verb)
+		}
+		//INFO: fmt limits the width to a million characters, the output can grow that much per option
+		L.checkStringLen(out.Len())
+	}
+	return []Value{out.String()}
+}
+
+// Quotes a string so that it can be read back by Lua, the %q option of string.format
+func quoteString(s string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', '\n':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case '\r':
+			out.WriteString("\\r")
+		case 0:
+			out.WriteString("\\000")
+		default:
+			out.WriteByte(c)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
@@ -0,0 +1,519 @@
+package lua
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func arg(args []Value, i int) Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
+}
+
+func argError(L *State, i int, fname string, msg string) {
+	L.RaiseError("bad argument #%d to '%s' (%s)", i+1, fname, msg)
+}
+
+func typeError(L *State, args []Value, i int, fname string, expected string) {
+	got := "no value"
+	if i < len(args) {
+		got = TypeName(args[i])
+	}
+	argError(L, i, fname, expected+" expected, got "+got)
+}
+
+func checkTable(L *State, args []Value, i int, fname string) *Table {
+	t, ok := arg(args, i).(*Table)
+	if !ok {
+		typeError(L, args, i, fname, "table")
+	}
+	return t
+}
+
+func checkNumber(L *State, args []Value, i int, fname string) float64 {
+	n, ok := ToNumber(arg(args, i))
+	if !ok {
+		typeError(L, args, i, fname, "number")
+	}
+	return n
+}
+
+func checkInt(L *State, args []Value, i int, fname string) int {
+	return int(checkNumber(L, args, i, fname))
+}
+
+func optInt(L *State, args []Value, i int, fname string, def int) int {
+	if arg(args, i) == nil {
+		return def
+	}
+	return checkInt(L, args, i, fname)
+}
+
+func checkString(L *State, args []Value, i int, fname string) string {
+	switch v := arg(args, i).(type) {
+	case string:
+		return v
+	case float64:
+		return NumberToString(v)
+	}
+	typeError(L, args, i, fname, "string")
+	return ""
+}
+
+func register(t *Table, name string, fn func(L *State, args []Value) []Value) {
+	t.Set(name, &GoFunction{Name: name, Fn: fn})
+}
+
+func openBase(L *State) {
+	g := L.Globals
+	g.Set("_G", g)
+	g.Set("_VERSION", "Lua 5.1")
+
+	register(g, "assert", func(L *State, args []Value) []Value {
+		if !Truthy(arg(args, 0)) {
+			if msg := arg(args, 1); msg != nil {
+				L.Raise(msg)
+			}
+			L.RaiseError("assertion failed!")
+		}
+		return args
+	})
+	register(g, "error", func(L *State, args []Value) []Value {
+		msg := arg(args, 0)
+		if s, ok := msg.(string); ok && optInt(L, args, 1, "error", 1) > 0 {
+			msg = L.where() + s
+		}
+		L.Raise(msg)
+		return nil
+	})
+	register(g, "getmetatable", func(L *State, args []Value) []Value {
+		t, ok := arg(args, 0).(*Table)
+		if !ok || t.meta == nil {
+			return []Value{nil}
+		}
+		if protected := t.meta.Get("__metatable"); protected != nil {
+			return []Value{protected}
+		}
+		return []Value{t.meta}
+	})
+	register(g, "setmetatable", func(L *State, args []Value) []Value {
+		t := checkTable(L, args, 0, "setmetatable")
+		meta, ok := arg(args, 1).(*Table)
+		if !ok && arg(args, 1) != nil {
+			typeError(L, args, 1, "setmetatable", "nil or table")
+		}
+		if t.meta != nil && t.meta.Get("__metatable") != nil {
+			L.RaiseError("cannot change a protected metatable")
+		}
+		t.meta = meta
+		return []Value{t}
+	})
+	register(g, "ipairs", func(L *State, args []Value) []Value {
+		t := checkTable(L, args, 0, "ipairs")
+		iter := &GoFunction{Name: "ipairs_iterator", Fn: func(L *State, args []Value) []Value {
+			i := checkNumber(L, args, 1, "ipairs") + 1
+			v := t.Get(i)
+			if v == nil {
+				return []Value{nil}
+			}
+			return []Value{i, v}
+		}}
+		return []Value{iter, t, 0.0}
+	})
+	next := &GoFunction{Name: "next", Fn: func(L *State, args []Value) []Value {
+		t := checkTable(L, args, 0, "next")
+		k, v, ok := t.Next(arg(args, 1))
+		if !ok {
+			L.RaiseError("invalid key to 'next'")
+		}
+		if k == nil {
+			return []Value{nil}
+		}
+		return []Value{k, v}
+	}}
+	g.Set("next", next)
+	register(g, "pairs", func(L *State, args []Value) []Value {
+		return []Value{next, checkTable(L, args, 0, "pairs"), nil}
+	})
+	register(g, "pcall", func(L *State, args []Value) []Value {
+		if len(args) == 0 {
+			argError(L, 0, "pcall", "value expected")
+		}
+		return L.protectedCall(args[0], args[1:], nil)
+	})
+	register(g, "xpcall", func(L *State, args []Value) []Value {
+		return L.protectedCall(arg(args, 0), nil, arg(args, 1))
+	})
+	register(g, "rawequal", func(L *State, args []Value) []Value {
+		return []Value{rawEqual(arg(args, 0), arg(args, 1))}
+	})
+	register(g, "rawget", func(L *State, args []Value) []Value {
+		return []Value{checkTable(L, args, 0, "rawget").Get(arg(args, 1))}
+	})
+	register(g, "rawset", func(L *State, args []Value) []Value {
+		t := checkTable(L, args, 0, "rawset")
+		if msg := checkKey(arg(args, 1)); msg != "" {
+			L.RaiseError(msg)
+		}
+		t.Set(arg(args, 1), arg(args, 2))
+		return []Value{t}
+	})
+	register(g, "select", func(L *State, args []Value) []Value {
+		if s, ok := arg(args, 0).(string); ok && s == "#" {
+			return []Value{float64(len(args) - 1)}
+		}
+		n := checkInt(L, args, 0, "select")
+		if n < 0 {
+			n = len(args) + n
+		} else if n == 0 {
+			argError(L, 0, "select", "index out of range")
+		}
+		if n < 1 {
+			argError(L, 0, "select", "index out of range")
+		}
+		if n >= len(args) {
+			return nil
+		}
+		return args[n:]
+	})
+	register(g, "tonumber", func(L *State, args []Value) []Value {
+		base := optInt(L, args, 1, "tonumber", 10)
+		if base == 10 {
+			if n, ok := ToNumber(arg(args, 0)); ok {
+				return []Value{n}
+			}
+			return []Value{nil}
+		}
+		if base < 2 || base > 36 {
+			argError(L, 1, "tonumber", "base out of range")
+		}
+		s := strings.ToLower(strings.Trim(checkString(L, args, 0, "tonumber"), " \t\n\v\f\r"))
+		n, err := strconv.ParseInt(s, base, 64)
+		if err != nil {
+			return []Value{nil}
+		}
+		return []Value{float64(n)}
+	})
+	register(g, "tostring", func(L *State, args []Value) []Value {
+		return []Value{L.toString(arg(args, 0))}
+	})
+	register(g, "type", func(L *State, args []Value) []Value {
+		if len(args) == 0 {
+			argError(L, 0, "type", "value expected")
+		}
+		return []Value{TypeName(args[0])}
+	})
+	register(g, "unpack", func(L *State, args []Value) []Value {
+		t := checkTable(L, args, 0, "unpack")
+		i := optInt(L, args, 1, "unpack", 1)
+		j := optInt(L, args, 2, "unpack", t.Len())
+		if i > j {
+			return nil
+		}
+		if j-i >= 8000 {
+			L.RaiseError("too many results to unpack")
+		}
+		values := make([]Value, 0, j-i+1)
+		for ; i <= j; i++ {
+			values = append(values, t.Get(float64(i)))
+		}
+		return values
+	})
+}
+
+// Calls fn catching Lua errors, the result starts with true on success or false and the error.
+// When handler is set (xpcall) the error is replaced with the value returned by the handler.
+func (L *State) protectedCall(fn Value, args []Value, handler Value) (rets []Value) {
+	line, chunk := L.line, L.chunk
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			L.line, L.chunk = line, chunk
+			errValue := e.Value
+			if handler != nil {
+				errValue = first(L.call(handler, []Value{errValue}))
+			}
+			rets = []Value{false, errValue}
+		}
+	}()
+	return append([]Value{true}, L.call(fn, args)...)
+}
+
+// tostring() honouring the __tostring metamethod
+func (L *State) toString(v Value) string {
+	if t, ok := v.(*Table); ok && t.meta != nil {
+		if handler := t.meta.Get("__tostring"); handler != nil {
+			s, ok := first(L.call(handler, []Value{v})).(string)
+			if !ok {
+				L.RaiseError("'__tostring' must return a string")
+			}
+			return s
+		}
+	}
+	return ToString(v)
+}
+
+// Converts a position relative to the end of the string (negative) to an absolute one
+func relativePosition(pos int, length int) int {
+	if pos < 0 {
+		pos = length + pos + 1
+	}
+	if pos < 0 {
+		return 0
+	}
+	return pos
+}
+
+func openString(L *State) {
+	s := NewTable()
+	L.Globals.Set("string", s)
+	L.stringLib = s
+
+	register(s, "byte", func(L *State, args []Value) []Value {
+		str := checkString(L, args, 0, "byte")
+		i := relativePosition(optInt(L, args, 1, "byte", 1), len(str))
+		j := relativePosition(optInt(L, args, 2, "byte", i), len(str))
+		if i < 1 {
+			i = 1
+		}
+		if j > len(str) {
+			j = len(str)
+		}
+		var codes []Value
+		for ; i <= j; i++ {
+			codes = append(codes, float64(str[i-1]))
+		}
+		return codes
+	})
+	register(s, "char", func(L *State, args []Value) []Value {
+		b := make([]byte, len(args))
+		for i := range args {
+			c := checkInt(L, args, i, "char")
+			if c < 0 || c > 255 {
+				argError(L, i, "char", "invalid value")
+			}
+			b[i] = byte(c)
+		}
+		return []Value{string(b)}
+	})
+	register(s, "find", func(L *State, args []Value) []Value {
+		return strFind(L, args, true)
+	})
+	register(s, "match", func(L *State, args []Value) []Value {
+		return strFind(L, args, false)
+	})
+	register(s, "gmatch", strGmatch)
+	register(s, "gsub", strGsub)
+	register(s, "format", strFormat)
+	register(s, "len", func(L *State, args []Value) []Value {
+		return []Value{float64(len(checkString(L, args, 0, "len")))}
+	})
+	register(s, "lower", func(L *State, args []Value) []Value {
+		return []Value{strings.ToLower(checkString(L, args, 0, "lower"))}
+	})
+	register(s, "upper", func(L *State, args []Value) []Value {
+		return []Value{strings.ToUpper(checkString(L, args, 0, "upper"))}
+	})
+	register(s, "rep", func(L *State, args []Value) []Value {
+		str := checkString(L, args, 0, "rep")
+		n := checkInt(L, args, 1, "rep")
+		if n <= 0 {
+			return []Value{""}
+		}
+		//INFO: Checked before multiplying, n*len(str) can overflow
+		if len(str) > 0 && n > MaxStringLen/len(str) {
+			L.checkStringLen(-1)
+		}
+		return []Value{strings.Repeat(str, n)}
+	})
+	register(s, "reverse", func(L *State, args []Value) []Value {
+		b := []byte(checkString(L, args, 0, "reverse"))
+		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+			b[i], b[j] = b[j], b[i]
+		}
+		return []Value{string(b)}
+	})
+	register(s, "sub", func(L *State, args []Value) []Value {
+		str := checkString(L, args, 0, "sub")
+		i := relativePosition(optInt(L, args, 1, "sub", 1), len(str))
+		j := relativePosition(optInt(L, args, 2, "sub", -1), len(str))
+		if i < 1 {
+			i = 1
+		}
+		if j > len(str) {
+			j = len(str)
+		}
+		if i > j {
+			return []Value{""}
+		}
+		return []Value{str[i-1 : j]}
+	})
+}
+
+func openTable(L *State) {
+	t := NewTable()
+	L.Globals.Set("table", t)
+
+	register(t, "concat", func(L *State, args []Value) []Value {
+		tbl := checkTable(L, args, 0, "concat")
+		sep := ""
+		if arg(args, 1) != nil {
+			sep = checkString(L, args, 1, "concat")
+		}
+		i := optInt(L, args, 2, "concat", 1)
+		j := optInt(L, args, 3, "concat", tbl.Len())
+		parts := make([]string, 0)
+		size := 0
+		for ; i <= j; i++ {
+			switch v := tbl.Get(float64(i)).(type) {
+			case string:
+				parts = append(parts, v)
+			case float64:
+				parts = append(parts, NumberToString(v))
+			default:
+				L.RaiseError("invalid value (at index %d) in table for 'concat'", i)
+			}
+			size += len(parts[len(parts)-1])
+			if len(parts) > 1 {
+				size += len(sep)
+			}
+			L.checkStringLen(size)
+		}
+		return []Value{strings.Join(parts, sep)}
+	})
+	register(t, "insert", func(L *State, args []Value) []Value {
+		tbl := checkTable(L, args, 0, "insert")
+		n := tbl.Len()
+		switch len(args) {
+		case 2:
+			tbl.Set(float64(n+1), args[1])
+		case 3:
+			pos := checkInt(L, args, 1, "insert")
+			for i := n; i >= pos; i-- {
+				tbl.Set(float64(i+1), tbl.Get(float64(i)))
+			}
+			tbl.Set(float64(pos), args[2])
+		default:
+			L.RaiseError("wrong number of arguments to 'insert'")
+		}
+		return nil
+	})
+	register(t, "remove", func(L *State, args []Value) []Value {
+		tbl := checkTable(L, args, 0, "remove")
+		n := tbl.Len()
+		pos := optInt(L, args, 1, "remove", n)
+		if n == 0 {
+			return nil
+		}
+		removed := tbl.Get(float64(pos))
+		for i := pos; i < n; i++ {
+			tbl.Set(float64(i), tbl.Get(float64(i+1)))
+		}
+		tbl.Set(float64(n), nil)
+		return []Value{removed}
+	})
+	register(t, "getn", func(L *State, args []Value) []Value {
+		return []Value{float64(checkTable(L, args, 0, "getn").Len())}
+	})
+	register(t, "sort", func(L *State, args []Value) []Value {
+		tbl := checkTable(L, args, 0, "sort")
+		comp := arg(args, 1)
+		values := make([]Value, tbl.Len())
+		for i := range values {
+			values[i] = tbl.Get(float64(i + 1))
+		}
+		sort.SliceStable(values, func(i, j int) bool {
+			if comp != nil {
+				return Truthy(first(L.call(comp, []Value{values[i], values[j]})))
+			}
+			return L.lessThan(values[i], values[j])
+		})
+		for i, v := range values {
+			tbl.Set(float64(i+1), v)
+		}
+		return nil
+	})
+}
+
+func openMath(L *State) {
+	m := NewTable()
+	L.Globals.Set("math", m)
+	m.Set("pi", math.Pi)
+	m.Set("huge", math.Inf(1))
+
+	//INFO: Scripts must produce the same results every time they run,
+	//the random generator always starts from the same seed
+	rnd := rand.New(rand.NewSource(0))
+
+	unary := func(name string, fn func(float64) float64) {
+		register(m, name, func(L *State, args []Value) []Value {
+			return []Value{fn(checkNumber(L, args, 0, name))}
+		})
+	}
+	unary("abs", math.Abs)
+	unary("ceil", math.Ceil)
+	unary("floor", math.Floor)
+	unary("sqrt", math.Sqrt)
+	unary("exp", math.Exp)
+	unary("log", math.Log)
+	unary("log10", math.Log10)
+	unary("sin", math.Sin)
+	unary("cos", math.Cos)
+	unary("tan", math.Tan)
+
+	register(m, "pow", func(L *State, args []Value) []Value {
+		return []Value{math.Pow(checkNumber(L, args, 0, "pow"), checkNumber(L, args, 1, "pow"))}
+	})
+	register(m, "fmod", func(L *State, args []Value) []Value {
+		return []Value{math.Mod(checkNumber(L, args, 0, "fmod"), checkNumber(L, args, 1, "fmod"))}
+	})
+	register(m, "modf", func(L *State, args []Value) []Value {
+		i, f := math.Modf(checkNumber(L, args, 0, "modf"))
+		return []Value{i, f}
+	})
+	register(m, "max", func(L *State, args []Value) []Value {
+		best := checkNumber(L, args, 0, "max")
+		for i := 1; i < len(args); i++ {
+			best = math.Max(best, checkNumber(L, args, i, "max"))
+		}
+		return []Value{best}
+	})
+	register(m, "min", func(L *State, args []Value) []Value {
+		best := checkNumber(L, args, 0, "min")
+		for i := 1; i < len(args); i++ {
+			best = math.Min(best, checkNumber(L, args, i, "min"))
+		}
+		return []Value{best}
+	})
+	register(m, "random", func(L *State, args []Value) []Value {
+		r := rnd.Float64()
+		switch len(args) {
+		case 0:
+			return []Value{r}
+		case 1:
+			upper := checkInt(L, args, 0, "random")
+			if upper < 1 {
+				argError(L, 0, "random", "interval is empty")
+			}
+			return []Value{math.Floor(r*float64(upper)) + 1}
+		default:
+			lower, upper := checkInt(L, args, 0, "random"), checkInt(L, args, 1, "random")
+			if lower > upper {
+				argError(L, 1, "random", "interval is empty")
+			}
+			return []Value{math.Floor(r*float64(upper-lower+1)) + float64(lower)}
+		}
+	})
+	register(m, "randomseed", func(L *State, args []Value) []Value {
+		rnd.Seed(int64(checkNumber(L, args, 0, "randomseed")))
+		return nil
+	})
+}
@@ -0,0 +1,190 @@
+package lua
+
+import "math"
+
+/**
+Table is the Lua associative array.
+	- Consecutive integer keys starting at 1 are kept in the array part
+	- Every other key is kept in the hash part, which remembers the insertion order
+	  so that traversing a table with next()/pairs() is deterministic
+*/
+type Table struct {
+	array []Value
+
+	//Index of every key of the hash part in entries
+	hash    map[Value]int
+	entries []tableEntry
+	//Number of entries whose value was set to nil
+	deleted int
+
+	meta *Table
+}
+
+type tableEntry struct {
+	key   Value
+	value Value
+}
+
+func NewTable() *Table {
+	return &Table{}
+}
+
+// Returns the index in the array part for the key, or -1 if the key does not belong to it
+func (t *Table) arrayIndex(key Value) int {
+	n, ok := key.(float64)
+	if !ok || !isInteger(n) || n < 1 || n > float64(len(t.array)) {
+		return -1
+	}
+	return int(n) - 1
+}
+
+// Get reads t[key] without invoking metamethods (rawget)
+func (t *Table) Get(key Value) Value {
+	if i := t.arrayIndex(key); i >= 0 {
+		return t.array[i]
+	}
+	if idx, ok := t.hash[key]; ok {
+		return t.entries[idx].value
+	}
+	return nil
+}
+
+// Set assigns t[key] = value without invoking metamethods (rawset).
+// nil and NaN are not valid keys and must be rejected by the caller.
+func (t *Table) Set(key Value, value Value) {
+	if i := t.arrayIndex(key); i >= 0 {
+		t.array[i] = value
+		return
+	}
+
+	//Appending right after the array part grows it and moves
+	//the keys that now follow it from the hash part.
+	if n, ok := key.(float64); ok && value != nil && n == float64(len(t.array)+1) {
+		t.setHash(key, nil)
+		t.array = append(t.array, value)
+		for {
+			next := float64(len(t.array) + 1)
+			v := t.Get(next)
+			if _, inHash := t.hash[next]; !inHash || v == nil {
+				break
+			}
+			t.setHash(next, nil)
+			t.array = append(t.array, v)
+		}
+		return
+	}
+
+	t.setHash(key, value)
+}
+
+func (t *Table) setHash(key Value, value Value) {
+	if idx, ok := t.hash[key]; ok {
+		if t.entries[idx].value != nil && value == nil {
+			t.deleted++
+		} else if t.entries[idx].value == nil && value != nil {
+			t.deleted--
+		}
+		t.entries[idx].value = value
+		return
+	}
+	if value == nil {
+		return
+	}
+
+	//INFO: Deleted entries are kept so that next() can continue a traversal from a
+	//key that was removed during the traversal, adding new keys while traversing is not
+	//allowed in Lua, which makes it the right time to get rid of them.
+	if t.deleted > 16 && t.deleted > len(t.entries)/2 {
+		t.compact()
+	}
+	if t.hash == nil {
+		t.hash = make(map[Value]int)
+	}
+	t.hash[key] = len(t.entries)
+	t.entries = append(t.entries, tableEntry{key, value})
+}
+
+func (t *Table) compact() {
+	entries := make([]tableEntry, 0, len(t.entries)-t.deleted)
+	hash := make(map[Value]int, len(entries))
+	for _, e := range t.entries {
+		if e.value != nil {
+			hash[e.key] = len(entries)
+			entries = append(entries, e)
+		}
+	}
+	t.entries, t.hash, t.deleted = entries, hash, 0
+}
+
+// Len returns a border of the table, the length operator #
+func (t *Table) Len() int {
+	n := len(t.array)
+	if n == 0 || t.array[n-1] != nil {
+		return n
+	}
+
+	//Binary search for a border inside the array part
+	lo, hi := 0, n
+	for hi-lo > 1 {
+		m := (lo + hi) / 2
+		if t.array[m-1] == nil {
+			hi = m
+		} else {
+			lo = m
+		}
+	}
+	return lo
+}
+
+// Append adds the value at the end of the array part, t[#t+1] = value
+func (t *Table) Append(value Value) {
+	t.Set(float64(t.Len()+1), value)
+}
+
+// Next returns the key and value following the key in a traversal, starting with a nil key.
+// The returned key is nil once the traversal is over, ok is false if the key is not in the table.
+func (t *Table) Next(key Value) (Value, Value, bool) {
+	arrayStart, hashStart := 0, 0
+	if key != nil {
+		if i := t.arrayIndex(key); i >= 0 {
+			arrayStart = i + 1
+		} else if idx, ok := t.hash[key]; ok {
+			arrayStart, hashStart = len(t.array), idx+1
+		} else {
+			return nil, nil, false
+		}
+	}
+
+	for i := arrayStart; i < len(t.array); i++ {
+		if t.array[i] != nil {
+			return float64(i + 1), t.array[i], true
+		}
+	}
+	for i := hashStart; i < len(t.entries); i++ {
+		if t.entries[i].value != nil {
+			return t.entries[i].key, t.entries[i].value, true
+		}
+	}
+	return nil, nil, true
+}
+
+func (t *Table) Metatable() *Table {
+	return t.meta
+}
+
+func (t *Table) SetMetatable(meta *Table) {
+	t.meta = meta
+}
+
+// Returns the error message for keys that can not be assigned in a table, or "" if the key is valid
+func checkKey(key Value) string {
+	switch k := key.(type) {
+	case nil:
+		return "table index is nil"
+	case float64:
+		if math.IsNaN(k) {
+			return "table index is NaN"
+		}
+	}
+	return ""
+}
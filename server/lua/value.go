@@ -0,0 +1,154 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+Lua values are represented with plain Go values:
+	- nil      -> nil
+	- boolean  -> bool
+	- number   -> float64 (Lua 5.1 numbers are doubles)
+	- string   -> string
+	- table    -> *Table
+	- function -> *Closure (compiled from a script) or *GoFunction
+*/
+type Value interface{}
+
+// GoFunction is a function implemented in Go that can be called from scripts
+type GoFunction struct {
+	Name string
+	Fn   func(L *State, args []Value) []Value
+}
+
+// Closure is a function compiled from a script together with the variables it captured
+type Closure struct {
+	proto  *funcProto
+	upvals []*Value
+}
+
+func TypeName(v Value) string {
+	switch v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *Table:
+		return "table"
+	case *Closure, *GoFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+// Only nil and false are false in Lua, everything else (including 0 and "") is true
+func Truthy(v Value) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	}
+	return true
+}
+
+// Formats a number the way Lua does ("%.14g")
+func NumberToString(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "inf"
+	case math.IsInf(n, -1):
+		return "-inf"
+	case math.IsNaN(n):
+		return "nan"
+	}
+	return fmt.Sprintf("%.14g", n)
+}
+
+// Converts any value to a string the way tostring() does
+func ToString(v Value) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		if x {
+			return "true"
+		}
+		return "false"
+	case float64:
+		return NumberToString(x)
+	case string:
+		return x
+	case *Table:
+		return fmt.Sprintf("table: %p", x)
+	case *Closure:
+		return fmt.Sprintf("function: %p", x)
+	case *GoFunction:
+		return fmt.Sprintf("function: builtin: %p", x)
+	}
+	return fmt.Sprintf("userdata: %v", v)
+}
+
+// Converts numbers and numeric strings to a number, as Lua does for arithmetic
+func ToNumber(v Value) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case string:
+		return ParseNumber(x)
+	}
+	return 0, false
+}
+
+// Parses a Lua numeric literal: decimal numbers with an optional exponent or hexadecimal
+// integers, surrounded by optional whitespace.
+func ParseNumber(s string) (float64, bool) {
+	s = strings.Trim(s, " \t\n\v\f\r")
+	if s == "" {
+		return 0, false
+	}
+
+	body, neg := s, false
+	if body[0] == '-' || body[0] == '+' {
+		neg = body[0] == '-'
+		body = body[1:]
+	}
+	if len(body) > 2 && body[0] == '0' && (body[1] == 'x' || body[1] == 'X') {
+		n, err := strconv.ParseUint(body[2:], 16, 64)
+		if err != nil {
+			return 0, false
+		}
+		if neg {
+			return -float64(n), true
+		}
+		return float64(n), true
+	}
+
+	//INFO: ParseFloat also accepts words like "inf" or "nan" and
+	//underscores, which are not valid Lua numbers
+	for i := 0; i < len(s); i++ {
+		if !strings.ContainsRune("0123456789.eE+-", rune(s[i])) {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+			return n, true
+		}
+		return 0, false
+	}
+	return n, true
+}
+
+// Tells if the number has no fractional part
+func isInteger(n float64) bool {
+	return n == math.Trunc(n) && !math.IsInf(n, 0)
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/**
+Metrics in the Prometheus text exposition format (version 0.0.4):
+	- a family starts with its # HELP and # TYPE lines, followed by its samples
+	- labels are given as name, value pairs: Sample("requests_total", 3, "cmd", "get")
+	- a histogram is written as cumulative _bucket samples with an le label, then _sum and _count
+Histograms are not safe for concurrent use, the caller guards them.
+*/
+
+// ContentType of the exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Upper bounds in seconds of the buckets of latency histograms, from 10µs to 10s
+var LatencyBuckets = []float64{
+	0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds the value to the first bucket whose upper bound is at least the value
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type Writer struct {
+	buf bytes.Buffer
+}
+
+// Header starts a family, kind is counter, gauge or histogram
+func (w *Writer) Header(name string, kind string, help string) {
+	w.buf.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+	w.buf.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.buf.WriteString(name)
+	w.writeLabels(labels)
+	w.buf.WriteString(" " + formatValue(value) + "\n")
+}
+
+func (w *Writer) Histogram(name string, h *Histogram, labels ...string) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		w.Sample(name+"_bucket", float64(cumulative), append(labels[:len(labels):len(labels)], "le", formatValue(bound))...)
+	}
+	w.Sample(name+"_bucket", float64(h.count), append(labels[:len(labels):len(labels)], "le", "+Inf")...)
+	w.Sample(name+"_sum", h.sum, labels...)
+	w.Sample(name+"_count", float64(h.count), labels...)
+}
+
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *Writer) writeLabels(labels []string) {
+	if len(labels) == 0 {
+		return
+	}
+	w.buf.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			w.buf.WriteByte(',')
+		}
+		w.buf.WriteString(labels[i] + "=\"" + escapeLabelValue(labels[i+1]) + "\"")
+	}
+	w.buf.WriteByte('}')
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import "testing"
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var w Writer
+	w.Header("latency_seconds", "histogram", "Latency")
+	w.Histogram("latency_seconds", h, "cmd", "get")
+	expected := `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{cmd="get",le="0.1"} 1
+latency_seconds_bucket{cmd="get",le="1"} 2
+latency_seconds_bucket{cmd="get",le="+Inf"} 3
+latency_seconds_sum{cmd="get"} 5.55
+latency_seconds_count{cmd="get"} 3
+`
+	if got := string(w.Bytes()); got != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, got)
+	}
+}
+
+func TestSample(t *testing.T) {
+	cases := []struct {
+		labels   []string
+		value    float64
+		expected string
+	}{
+		{nil, 3, "m 3\n"},
+		{[]string{"db", "db0"}, 1.5, "m{db=\"db0\"} 1.5\n"},
+		{[]string{"a", "1", "b", "2"}, 0, "m{a=\"1\",b=\"2\"} 0\n"},
+		{[]string{"cmd", "say \"hi\"\\\n"}, 1, "m{cmd=\"say \\\"hi\\\"\\\\\\n\"} 1\n"},
+	}
+	for _, c := range cases {
+		var w Writer
+		w.Sample("m", c.value, c.labels...)
+		if got := string(w.Bytes()); got != c.expected {
+			t.Errorf("expected %q, got %q", c.expected, got)
+		}
+	}
+}
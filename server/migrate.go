@@ -0,0 +1,220 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Keys are moved to other servers one at a time, eg: to move a slot of a cluster to another node:
+	- DUMP returns the value of a key serialized by serializeValue, RESTORE creates a key from such a value.
+	  RESTORE-ASKING is a RESTORE that is served in a slot the node imports, without ASKING.
+	- MIGRATE moves keys to another server, it sends it a RESTORE-ASKING for every key then deletes the keys
+	  the server restored. The server is blocked meanwhile, so a key is never seen on both servers or on none.
+	  The keys moved are propagated to the replicas and the append only file as a DEL.
+*/
+
+// The timeout of MIGRATE when it is not positive
+const migrateDefaultTimeout = time.Second
+
+func (cmd *Command) evalDEL() ([]byte, error) {
+	deleted := 0
+	for _, key := range cmd.Args {
+		if deleteKey(key) {
+			signalModifiedKey(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+			deleted++
+		}
+	}
+	return response.Encode(deleted, false), nil
+}
+
+func (cmd *Command) evalDUMP() ([]byte, error) {
+	key := cmd.Args[0]
+	value, ok := keyspace[key]
+	if !ok {
+		signalKeyMiss(key)
+		return response.Encode(nil, false), nil
+	}
+	signalKeyHit(key)
+	return response.Encode(string(serializeValue(value)), false), nil
+}
+
+// RESTORE key ttl serialized-value [REPLACE], keys do not expire so the ttl must be 0
+func (cmd *Command) evalRESTORE() ([]byte, error) {
+	key := cmd.Args[0]
+	ttl, err := strconv.ParseInt(cmd.Args[1], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return nil, errors.New("ERR Invalid TTL value, must be >= 0")
+	}
+	if ttl > 0 {
+		return nil, errors.New("ERR Invalid TTL value, keys do not expire")
+	}
+	replace := false
+	for _, opt := range cmd.Args[3:] {
+		if !strings.EqualFold(opt, "replace") {
+			return nil, errors.New("ERR syntax error")
+		}
+		replace = true
+	}
+	if _, exists := keyspace[key]; exists && !replace {
+		return nil, errors.New("BUSYKEY Target key name already exists.")
+	}
+	value, err := deserializeValue([]byte(cmd.Args[2]))
+	if err != nil {
+		return nil, err
+	}
+	setKey(key, value)
+	signalModifiedKey(key)
+	notifyKeyspaceEvent(NOTIFY_GENERIC, "restore", key)
+	return response.Encode("OK", true), nil
+}
+
+// Returns the keys of MIGRATE, they follow its KEYS option when its key argument is empty
+func migrateKeys(args []string) []string {
+	if args[2] != "" {
+		return args[2:3]
+	}
+	for i := 5; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "auth":
+			i++
+		case "auth2":
+			i += 2
+		case "keys":
+			return args[i+1:]
+		}
+	}
+	return nil
+}
+
+/**
+MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [AUTH password] [AUTH2 username password] [KEYS key...]
+The keys are restored by the server at host:port then deleted, unless COPY is given. The server is connected to
+with TLS when tls-cluster is set and the timeout, in milliseconds, applies to every read and write.
+*/
+func (cmd *Command) evalMIGRATE() ([]byte, error) {
+	if cmd.Args[3] != "0" {
+		return nil, errors.New("ERR DB index is out of range")
+	}
+	ms, err := strconv.Atoi(cmd.Args[4])
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	timeout := time.Duration(ms) * time.Millisecond
+	if timeout <= 0 {
+		timeout = migrateDefaultTimeout
+	}
+	copyKeys, replace := false, false
+	var auth []string
+	for i := 5; i < len(cmd.Args); i++ {
+		switch strings.ToLower(cmd.Args[i]) {
+		case "copy":
+			copyKeys = true
+		case "replace":
+			replace = true
+		case "auth":
+			if i+1 >= len(cmd.Args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			auth = cmd.Args[i+1 : i+2]
+			i++
+		case "auth2":
+			if i+2 >= len(cmd.Args) {
+				return nil, errors.New("ERR syntax error")
+			}
+			auth = cmd.Args[i+1 : i+3]
+			i += 2
+		case "keys":
+			if cmd.Args[2] != "" {
+				return nil, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			i = len(cmd.Args)
+		default:
+			return nil, errors.New("ERR syntax error")
+		}
+	}
+
+	var keys []string
+	for _, key := range migrateKeys(cmd.Args) {
+		if _, ok := keyspace[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return response.Encode("NOKEY", true), nil
+	}
+
+	conn, err := dialBus(net.JoinHostPort(cmd.Args[0], cmd.Args[1]), timeout)
+	if err != nil {
+		return nil, fmt.Errorf("IOERR error or timeout connecting to the client: %v", err)
+	}
+	defer conn.Close()
+	var data []byte
+	if auth != nil {
+		data = append(data, (&Command{Cmd: "AUTH", Args: auth}).encode()...)
+	}
+	for _, key := range keys {
+		args := []string{key, "0", string(serializeValue(keyspace[key]))}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		data = append(data, (&Command{Cmd: "RESTORE-ASKING", Args: args}).encode()...)
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(data); err != nil {
+		return nil, errors.New("IOERR error or timeout writing to target instance")
+	}
+
+	rd := response.NewReader(conn)
+	readReply := func() (interface{}, error) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		reply, err := rd.ReadReply()
+		if err != nil {
+			return nil, errors.New("IOERR error or timeout reading to target instance")
+		}
+		if msg, ok := reply.(response.ErrorReply); ok {
+			return nil, fmt.Errorf("ERR Target instance replied with error: %s", msg)
+		}
+		return reply, nil
+	}
+	if auth != nil {
+		if _, err := readReply(); err != nil {
+			return nil, err
+		}
+	}
+	//INFO: The keys restored are deleted even when the target fails to restore the others
+	var moved []string
+	var migrateErr error
+	for _, key := range keys {
+		if _, err := readReply(); err != nil {
+			migrateErr = err
+			if strings.HasPrefix(err.Error(), "IOERR") {
+				break
+			}
+			continue
+		}
+		moved = append(moved, key)
+	}
+	if !copyKeys && len(moved) > 0 {
+		for _, key := range moved {
+			deleteKey(key)
+			signalModifiedKey(key)
+			notifyKeyspaceEvent(NOTIFY_GENERIC, "del", key)
+		}
+		propagate(&Command{Cmd: "DEL", Args: moved})
+	}
+	if migrateErr != nil {
+		return nil, migrateErr
+	}
+	return response.Encode("OK", true), nil
+}
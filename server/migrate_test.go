@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// A server keys are migrated to, it replies to the commands of the connection it accepts with the replies given
+func startTestMigrateTarget(t *testing.T, replies ...string) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	commands := make(chan []string, len(replies))
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := response.NewReader(conn)
+		for _, reply := range replies {
+			args, _, err := rd.ReadCommand()
+			if err != nil {
+				return
+			}
+			commands <- args
+			conn.Write([]byte(reply))
+		}
+	}()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), commands
+}
+
+func expectMigrated(t *testing.T, commands <-chan []string, expected ...[]string) {
+	t.Helper()
+	for _, args := range expected {
+		select {
+		case received := <-commands:
+			if !reflect.DeepEqual(received, args) {
+				t.Errorf("the target received %q, expected %q", received, args)
+			}
+		case <-time.After(testReplyTimeout):
+			t.Fatalf("the target did not receive %q", args)
+		}
+	}
+}
+
+func dumpKey(t *testing.T, key string) string {
+	t.Helper()
+	execMu.Lock()
+	defer execMu.Unlock()
+	return string(serializeValue(keyspace[key]))
+}
+
+func TestDumpRestore(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x", "y")
+	payload := c.do("DUMP", "a").(string)
+	c.expect(nil, "DUMP", "missing")
+	c.expect(replyOK, "RESTORE", "b", "0", payload)
+	c.expect(payload, "DUMP", "b")
+	c.expectError("BUSYKEY Target key name already exists.", "RESTORE", "b", "0", payload)
+	c.expect(int64(1), "SIM.ADD", "c", "z")
+	c.expect(replyOK, "RESTORE", "c", "0", payload, "REPLACE")
+	c.expect(payload, "DUMP", "c")
+	c.expectError("ERR DUMP payload version or checksum are wrong", "RESTORE", "d", "0", payload[:len(payload)-1]+"?")
+	c.expectError("ERR Invalid TTL value, must be >= 0", "RESTORE", "d", "-1", payload)
+	c.expectError("ERR Invalid TTL value, keys do not expire", "RESTORE", "d", "100", payload)
+	c.expectError("ERR syntax error", "RESTORE", "d", "0", payload, "ABSTTL")
+
+	c.expect(int64(2), "DEL", "a", "b", "missing")
+	c.expect(nil, "DUMP", "a")
+	c.expect(int64(0), "DEL", "a")
+}
+
+func TestMigrate(t *testing.T) {
+	setupTestServer(t)
+	name := startTestAppendOnlyFile(t, APPENDFSYNC_ALWAYS)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect(int64(1), "SIM.ADD", "b", "y")
+	a, b := dumpKey(t, "a"), dumpKey(t, "b")
+
+	//The keys restored by the target are deleted
+	port, commands := startTestMigrateTarget(t, "+OK\r\n", "+OK\r\n", "+OK\r\n")
+	c.expect(replyOK, "MIGRATE", "127.0.0.1", port, "", "0", "1000", "AUTH2", "u", "p", "KEYS", "a", "missing", "b")
+	expectMigrated(t, commands, []string{"AUTH", "u", "p"}, []string{"RESTORE-ASKING", "a", "0", a}, []string{"RESTORE-ASKING", "b", "0", b})
+	if hasKeys("a") || hasKeys("b") {
+		t.Error("the keys migrated were not deleted")
+	}
+	c.expect(response.SimpleString("NOKEY"), "MIGRATE", "127.0.0.1", port, "a", "0", "1000")
+
+	//The keys the target does not restore are kept
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect(int64(1), "SIM.ADD", "b", "y")
+	port, commands = startTestMigrateTarget(t, "+OK\r\n", "-BUSYKEY Target key name already exists.\r\n")
+	c.expectError("ERR Target instance replied with error: BUSYKEY", "MIGRATE", "127.0.0.1", port, "", "0", "1000", "REPLACE", "KEYS", "a", "b")
+	expectMigrated(t, commands, []string{"RESTORE-ASKING", "a", "0", a, "REPLACE"}, []string{"RESTORE-ASKING", "b", "0", b, "REPLACE"})
+	if hasKeys("a") || !hasKeys("b") {
+		t.Error("only the key restored by the target must be deleted")
+	}
+
+	//COPY keeps the keys
+	port, commands = startTestMigrateTarget(t, "+OK\r\n")
+	c.expect(replyOK, "MIGRATE", "127.0.0.1", port, "b", "0", "1000", "COPY")
+	expectMigrated(t, commands, []string{"RESTORE-ASKING", "b", "0", b})
+	if !hasKeys("b") {
+		t.Error("the key copied was deleted")
+	}
+
+	c.expectError("IOERR error or timeout connecting to the client", "MIGRATE", "127.0.0.1", "1", "b", "0", "1000")
+	c.expectError("ERR DB index is out of range", "MIGRATE", "127.0.0.1", port, "b", "1", "1000")
+	c.expectError("ERR When using MIGRATE KEYS option", "MIGRATE", "127.0.0.1", port, "b", "0", "1000", "KEYS", "a")
+	c.expectError("ERR syntax error", "MIGRATE", "127.0.0.1", port, "b", "0", "1000", "AUTH")
+
+	//The keys migrated are deleted from the append only file too
+	restartTestAppendOnlyFile(t)
+	if hasKeys("a") || !hasKeys("b") {
+		t.Errorf("%s did not delete the keys migrated", name)
+	}
+}
@@ -0,0 +1,299 @@
+package minhash
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+/**
+MinHash estimates the Jaccard similarity |A ∩ B| / |A ∪ B| of two sets without keeping the sets:
+	- A set is summarised by a signature: for each of NumHashes hash functions the minimum hash
+	  of all the elements of the set
+	- Two sets have the same minimum for a hash function with a probability equal to their
+	  Jaccard similarity, so the fraction of equal minimums estimates it
+	- The signature of the union of two sets is the element wise minimum of their signatures
+
+Locality Sensitive Hashing (LSH) finds the signatures similar to a given one without comparing it
+to every signature of the index: signatures are cut into Bands bands of Rows rows and two signatures
+become candidates when all the rows of at least one band are equal.
+*/
+
+const (
+	NumHashes = 128
+	Bands     = 32
+	Rows      = NumHashes / Bands
+)
+
+// Seeds of the hash functions, derived once from a fixed value so that
+// signatures are the same across restarts
+var seeds = func() [NumHashes]uint64 {
+	var s [NumHashes]uint64
+	x := uint64(0x5eed)
+	for i := range s {
+		x += 0x9e3779b97f4a7c15
+		s[i] = mix(x)
+	}
+	return s
+}()
+
+// splitmix64 finalizer
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+type Signature struct {
+	mins [NumHashes]uint64
+}
+
+// NewSignature returns the signature of the empty set
+func NewSignature() *Signature {
+	s := &Signature{}
+	for i := range s.mins {
+		s.mins[i] = math.MaxUint64
+	}
+	return s
+}
+
+// Add adds an element to the set, returns true if the signature changed
+func (s *Signature) Add(element string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	base := h.Sum64()
+
+	changed := false
+	for i := range s.mins {
+		if v := mix(base ^ seeds[i]); v < s.mins[i] {
+			s.mins[i] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Merge turns s into the signature of the union of both sets, returns true if s changed
+func (s *Signature) Merge(other *Signature) bool {
+	changed := false
+	for i, v := range other.mins {
+		if v < s.mins[i] {
+			s.mins[i] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (s *Signature) IsEmpty() bool {
+	for _, v := range s.mins {
+		if v != math.MaxUint64 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Signature) Clone() *Signature {
+	c := *s
+	return &c
+}
+
+// Jaccard estimates the Jaccard similarity of both sets, empty sets are not similar to anything
+func (s *Signature) Jaccard(other *Signature) float64 {
+	if s.IsEmpty() || other.IsEmpty() {
+		return 0
+	}
+	equal := 0
+	for i, v := range s.mins {
+		if v == other.mins[i] {
+			equal++
+		}
+	}
+	return float64(equal) / NumHashes
+}
+
+// Hash of the rows of a band, used as the bucket of the signature in that band
+func (s *Signature) bandHash(band int) uint64 {
+	h := uint64(band)
+	for _, v := range s.mins[band*Rows : (band+1)*Rows] {
+		h = mix(h ^ v)
+	}
+	return h
+}
+
+// Index is an LSH index of named signatures
+type Index struct {
+	buckets [Bands]map[uint64]map[string]struct{}
+	members map[string]*Signature
+}
+
+func NewIndex() *Index {
+	x := &Index{members: make(map[string]*Signature)}
+	for i := range x.buckets {
+		x.buckets[i] = make(map[uint64]map[string]struct{})
+	}
+	return x
+}
+
+// Add indexes a copy of the signature under name, replacing the previous one
+func (x *Index) Add(name string, sig *Signature) {
+	x.Remove(name)
+	sig = sig.Clone()
+	x.members[name] = sig
+	for band := range x.buckets {
+		h := sig.bandHash(band)
+		bucket, ok := x.buckets[band][h]
+		if !ok {
+			bucket = make(map[string]struct{})
+			x.buckets[band][h] = bucket
+		}
+		bucket[name] = struct{}{}
+	}
+}
+
+func (x *Index) Remove(name string) bool {
+	sig, ok := x.members[name]
+	if !ok {
+		return false
+	}
+	for band := range x.buckets {
+		h := sig.bandHash(band)
+		delete(x.buckets[band][h], name)
+		if len(x.buckets[band][h]) == 0 {
+			delete(x.buckets[band], h)
+		}
+	}
+	delete(x.members, name)
+	return true
+}
+
+func (x *Index) Len() int {
+	return len(x.members)
+}
+
+// Estimated number of bytes used by the signature
+func (s *Signature) MemoryUsage() int {
+	return NumHashes * 8
+}
+
+// Estimated number of bytes used by the index, each member is stored once with its signature
+// and once per band in a bucket
+func (x *Index) MemoryUsage() int {
+	usage := 0
+	for name, sig := range x.members {
+		usage += (len(name)+16)*(Bands+1) + sig.MemoryUsage()
+	}
+	return usage
+}
+
+type Match struct {
+	Name       string
+	Similarity float64
+}
+
+// Query returns the members sharing a band with sig whose estimated similarity is at least
+// threshold, the most similar first
+func (x *Index) Query(sig *Signature, threshold float64) []Match {
+	if sig.IsEmpty() {
+		return nil
+	}
+	candidates := make(map[string]struct{})
+	for band := range x.buckets {
+		for name := range x.buckets[band][sig.bandHash(band)] {
+			candidates[name] = struct{}{}
+		}
+	}
+
+	matches := make([]Match, 0, len(candidates))
+	for name := range candidates {
+		if j := sig.Jaccard(x.members[name]); j >= threshold {
+			matches = append(matches, Match{name, j})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Similarity != matches[j].Similarity {
+			return matches[i].Similarity > matches[j].Similarity
+		}
+		return matches[i].Name < matches[j].Name
+	})
+	return matches
+}
+
+// Size of the binary encoding of a signature
+const signatureLen = NumHashes * 8
+
+var errInvalidEncoding = errors.New("minhash: invalid encoding")
+
+// MarshalBinary encodes the signature as its NumHashes minimums, in big endian
+func (s *Signature) MarshalBinary() ([]byte, error) {
+	data := make([]byte, signatureLen)
+	for i, v := range s.mins {
+		binary.BigEndian.PutUint64(data[i*8:], v)
+	}
+	return data, nil
+}
+
+func (s *Signature) UnmarshalBinary(data []byte) error {
+	if len(data) != signatureLen {
+		return errInvalidEncoding
+	}
+	for i := range s.mins {
+		s.mins[i] = binary.BigEndian.Uint64(data[i*8:])
+	}
+	return nil
+}
+
+// MarshalBinary encodes the number of members followed by the length of the name, the name and
+// the signature of each member, by name. The buckets are not encoded, they are rebuilt from the members.
+func (x *Index) MarshalBinary() ([]byte, error) {
+	names := make([]string, 0, len(x.members))
+	for name := range x.members {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := appendUvarint(nil, uint64(len(names)))
+	for _, name := range names {
+		data = appendUvarint(data, uint64(len(name)))
+		data = append(data, name...)
+		sig, _ := x.members[name].MarshalBinary()
+		data = append(data, sig...)
+	}
+	return data, nil
+}
+
+func (x *Index) UnmarshalBinary(data []byte) error {
+	*x = *NewIndex()
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return errInvalidEncoding
+	}
+	data = data[n:]
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length+signatureLen {
+			return errInvalidEncoding
+		}
+		name := string(data[n : n+int(length)])
+		data = data[n+int(length):]
+		sig := &Signature{}
+		sig.UnmarshalBinary(data[:signatureLen])
+		data = data[signatureLen:]
+		x.Add(name, sig)
+	}
+	if len(data) != 0 {
+		return errInvalidEncoding
+	}
+	return nil
+}
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -0,0 +1,91 @@
+package minhash
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func signatureOf(from, to int) *Signature {
+	s := NewSignature()
+	for i := from; i < to; i++ {
+		s.Add(fmt.Sprintf("element-%d", i))
+	}
+	return s
+}
+
+func TestJaccardEstimate(t *testing.T) {
+	cases := []struct {
+		a, b     *Signature
+		expected float64
+	}{
+		{signatureOf(0, 1000), signatureOf(0, 1000), 1},
+		{signatureOf(0, 1000), signatureOf(500, 1500), 1.0 / 3},
+		{signatureOf(0, 1000), signatureOf(1000, 2000), 0},
+		{signatureOf(0, 1000), NewSignature(), 0},
+	}
+	for _, c := range cases {
+		if j := c.a.Jaccard(c.b); math.Abs(j-c.expected) > 0.1 {
+			t.Errorf("expected %v, estimated %v", c.expected, j)
+		}
+	}
+}
+
+func TestAddReportsChanges(t *testing.T) {
+	s := NewSignature()
+	if !s.Add("a") || s.Add("a") {
+		t.Fail()
+	}
+}
+
+func TestMergeIsUnion(t *testing.T) {
+	merged := signatureOf(0, 500)
+	merged.Merge(signatureOf(500, 1000))
+	if merged.Jaccard(signatureOf(0, 1000)) != 1 {
+		t.Fail()
+	}
+}
+
+func TestIndexQuery(t *testing.T) {
+	x := NewIndex()
+	x.Add("same", signatureOf(0, 1000))
+	x.Add("close", signatureOf(50, 1050))
+	x.Add("far", signatureOf(5000, 6000))
+
+	matches := x.Query(signatureOf(0, 1000), 0.8)
+	if len(matches) != 2 || matches[0].Name != "same" || matches[1].Name != "close" {
+		t.Errorf("unexpected matches %v", matches)
+	}
+
+	x.Remove("same")
+	if matches := x.Query(signatureOf(0, 1000), 0.8); len(matches) != 1 || x.Len() != 2 {
+		t.Errorf("unexpected matches after remove %v", matches)
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	sig := signatureOf(0, 100)
+	data, _ := sig.MarshalBinary()
+	decoded := &Signature{}
+	if err := decoded.UnmarshalBinary(data); err != nil || *decoded != *sig {
+		t.Errorf("signature not decoded back: %v", err)
+	}
+	if err := decoded.UnmarshalBinary(data[1:]); err == nil {
+		t.Error("a truncated signature was decoded")
+	}
+
+	x := NewIndex()
+	x.Add("a", signatureOf(0, 100))
+	x.Add("b", signatureOf(50, 150))
+	data, _ = x.MarshalBinary()
+	y := &Index{}
+	if err := y.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if y.Len() != 2 || len(y.Query(signatureOf(0, 100), 0.9)) != 1 {
+		t.Errorf("index not decoded back, %d members", y.Len())
+	}
+	if err := y.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("a truncated index was decoded")
+	}
+}
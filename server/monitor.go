@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+MONITOR turns the connection into a live feed of the commands processed by every client, one line each:
+	+1339518083.107412 [0 127.0.0.1:60866] "sim.add" "key" "element"
+Commands are fed as they are read by handleAsyncConnection, the commands called by scripts are shown with
+"lua" as the address. AUTH and HELLO AUTH arguments are redacted, the administrative commands (ACL, SLOWLOG,
+LATENCY, MONITOR...) and EXEC are not shown, like redis does.
+The feed goes through the output queue of the monitor, a monitor that does not read fast enough reaches
+its limit and is disconnected instead of making the server buffer the feed without bounds.
+*/
+
+// The clients that sent MONITOR, guarded by execMu
+var monitors = map[*Client]struct{}{}
+
+func (c *Client) monitor() []byte {
+	monitors[c] = struct{}{}
+	return response.Encode("OK", true)
+}
+
+// The address of the client as shown in the feed
+func (c *Client) monitorAddr() string {
+	if _, ok := c.conn.RemoteAddr().(*net.UnixAddr); ok {
+		return "unix:" + config.UnixSocket
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+// Sends the command to the monitors, addr tells where it comes from. Must be called holding execMu.
+func feedMonitors(addr string, cmd *Command) {
+	if len(monitors) == 0 || cmd.name() == COMMAND_EXEC {
+		return
+	}
+	for _, category := range commandTable[cmd.name()].categories {
+		if category == "admin" {
+			return
+		}
+	}
+
+	cmd = cmd.redacted()
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "+%d.%06d [0 %s]", now.Unix(), now.Nanosecond()/1000, addr)
+	for _, arg := range append([]string{cmd.Cmd}, cmd.Args...) {
+		b.WriteString(" " + quoteMonitorArg(arg))
+	}
+	b.WriteString("\r\n")
+
+	line := []byte(b.String())
+	for c := range monitors {
+		c.write(line)
+	}
+}
+
+// Quotes the argument escaping the quotes, backslashes and non printable characters so that
+// the line stays on a single line
+func quoteMonitorArg(arg string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(arg); i++ {
+		switch ch := arg[i]; ch {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(ch)
+		case '\n':
+			b.WriteString("\\n")
+		case '\r':
+			b.WriteString("\\r")
+		case '\t':
+			b.WriteString("\\t")
+		case '\a':
+			b.WriteString("\\a")
+		case '\b':
+			b.WriteString("\\b")
+		default:
+			if ch < ' ' || ch > '~' {
+				b.WriteString("\\x" + strconv.FormatUint(uint64(ch)>>4, 16) + strconv.FormatUint(uint64(ch)&0xf, 16))
+			} else {
+				b.WriteByte(ch)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
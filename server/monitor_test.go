@@ -0,0 +1,84 @@
+package server
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Fails the test unless the next line of the feed shows the command, from the address matching addr
+func expectMonitorLine(t *testing.T, mon *testClient, addr string, command string) {
+	t.Helper()
+	line, ok := mon.read().(response.SimpleString)
+	pattern := `^[0-9]+\.[0-9]{6} \[0 ` + addr + `\] ` + regexp.QuoteMeta(command) + `$`
+	if !ok || !regexp.MustCompile(pattern).MatchString(string(line)) {
+		t.Errorf("the monitor received %q, expected %s", line, pattern)
+	}
+}
+
+func TestMonitor(t *testing.T) {
+	setupTestServer(t)
+	mon := connect(t)
+	c := connect(t)
+
+	mon.expect(replyOK, "MONITOR")
+	c.expect(int64(1), "SIM.ADD", "a", "x y\n\"z\"\x01")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"SIM.ADD" "a" "x y\n\"z\"\x01"`)
+
+	//Passwords are redacted, administrative commands are not shown
+	c.do("AUTH", "default", "secret")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"AUTH" "(redacted)" "(redacted)"`)
+	c.expect(int64(0), "SLOWLOG", "LEN")
+	c.expect(array(), "LATENCY", "LATEST")
+
+	//The commands called by a script follow the script, EXEC is left out but not its commands
+	c.expect(int64(1), "EVAL", "return redis.call('sim.add', KEYS[1], 'y')", "1", "b")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"EVAL" "return redis.call('sim.add', KEYS[1], 'y')" "1" "b"`)
+	expectMonitorLine(t, mon, `lua`, `"sim.add" "b" "y"`)
+	c.expect(replyOK, "MULTI")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"MULTI"`)
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "c", "z")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"SIM.ADD" "c" "z"`)
+	c.expect(array(int64(1)), "EXEC")
+	if !mon.silent(50 * time.Millisecond) {
+		t.Error("EXEC was shown")
+	}
+
+	//Commands denied by the ACL rules are not shown
+	c.expect(replyOK, "ACL", "SETUSER", "limited", "on", "nopass", "+@all", "-sim.add")
+	c.expect(replyOK, "AUTH", "limited", "any")
+	expectMonitorLine(t, mon, `127\.0\.0\.1:[0-9]+`, `"AUTH" "(redacted)" "(redacted)"`)
+	c.expectError("NOPERM", "SIM.ADD", "a", "x")
+	if !mon.silent(50 * time.Millisecond) {
+		t.Error("a denied command was shown")
+	}
+}
+
+func TestMonitorSlowReader(t *testing.T) {
+	setupTestServer(t)
+	mon := connect(t)
+	c := connect(t)
+
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	mon.expect(replyOK, "MONITOR")
+	//The monitor does not read the feed, it is disconnected once its output queue is full
+	for i := 0; i < clientOutputQueueLen+2; i++ {
+		c.expect(int64(0), "SIM.ADD", "a", "x")
+	}
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		execMu.Lock()
+		n := len(monitors)
+		execMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the slow monitor was not disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	c.expect(int64(1), "SIM.ADD", "a", "y")
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Transactions:
+	- MULTI starts a transaction, every command sent after it is queued and replied with +QUEUED
+	- EXEC runs all the queued commands atomically and replies with an array of their replies
+	- DISCARD throws the queued commands away
+	- A command that fails to be queued (eg: wrong number of arguments) makes EXEC fail with EXECABORT
+	- WATCH key [key ...] makes EXEC reply with a null array if any watched key was modified
+	  after it was watched (optimistic locking), UNWATCH forgets all watched keys
+*/
+
+var (
+	//INFO: Commands are executed one at a time just like redis executes them on its single thread,
+	//a command (or a whole transaction on EXEC) runs while holding execMu which makes it atomic
+	//with respect to the commands sent by every other client.
+	execMu sync.Mutex
+
+	//The clients watching each key, guarded by execMu
+	watchedKeys = map[string]map[*Client]struct{}{}
+)
+
+// Tells if the command controls the transaction itself instead of being queued
+func isTransactionCommand(cmd *Command) bool {
+	switch cmd.name() {
+	case COMMAND_MULTI, COMMAND_EXEC, COMMAND_DISCARD, COMMAND_WATCH, COMMAND_UNWATCH:
+		return true
+	}
+	return false
+}
+
+// Evaluates the transaction commands, must be called holding execMu
+func (c *Client) evalTransactionCommand(cmd *Command) []byte {
+	if err := cmd.checkArity(); err != nil {
+		return response.EncodeError(err)
+	}
+
+	switch cmd.name() {
+	case COMMAND_MULTI:
+		return c.multi()
+	case COMMAND_EXEC:
+		return c.exec()
+	case COMMAND_DISCARD:
+		return c.discard()
+	case COMMAND_WATCH:
+		return c.watch(cmd.Args)
+	default:
+		c.unwatchAllKeys()
+		return response.Encode("OK", true)
+	}
+}
+
+func (c *Client) multi() []byte {
+	if c.inMulti {
+		return response.EncodeError(errors.New("ERR MULTI calls can not be nested"))
+	}
+	c.inMulti = true
+	return response.Encode("OK", true)
+}
+
+// Queues the command to be run on EXEC, commands that fail validation
+// are not queued and flag the transaction to be aborted.
+func (c *Client) queueCommand(cmd *Command) []byte {
+	if err := cmd.checkArity(); err != nil {
+		c.multiError = true
+		return response.EncodeError(err)
+	}
+	//The queued commands are run by Command.EvalCommand which knows nothing of the connection
+	if c.isConnectionCommand(cmd) {
+		c.multiError = true
+		return response.EncodeError(fmt.Errorf("ERR Command '%s' not allowed inside a transaction", cmd.name()))
+	}
+	c.multiQueue = append(c.multiQueue, cmd)
+	return response.Encode("QUEUED", true)
+}
+
+func (c *Client) exec() []byte {
+	if !c.inMulti {
+		return response.EncodeError(errors.New("ERR EXEC without MULTI"))
+	}
+	defer c.resetMulti()
+
+	if c.multiError {
+		return response.EncodeError(errors.New("EXECABORT Transaction discarded because of previous errors."))
+	}
+	if err := checkClusterRedirect(c.multiQueue...); err != nil {
+		return response.EncodeError(err)
+	}
+
+	//A watched key was touched, the transaction is not executed
+	if c.dirtyCAS {
+		return response.EncodeNullArray()
+	}
+
+	//The writes of the transaction are propagated together
+	beginPropagation()
+	defer endPropagation()
+	replies := make([][]byte, 0, len(c.multiQueue))
+	for _, cmd := range c.multiQueue {
+		replies = append(replies, evalCommand(cmd))
+	}
+	return response.EncodeArray(replies)
+}
+
+func (c *Client) discard() []byte {
+	if !c.inMulti {
+		return response.EncodeError(errors.New("ERR DISCARD without MULTI"))
+	}
+	c.resetMulti()
+	return response.Encode("OK", true)
+}
+
+// Clears the transaction state, EXEC and DISCARD also forget all the watched keys
+func (c *Client) resetMulti() {
+	c.inMulti = false
+	c.multiQueue = nil
+	c.multiError = false
+	c.unwatchAllKeys()
+}
+
+func (c *Client) watch(keys []string) []byte {
+	if c.inMulti {
+		return response.EncodeError(errors.New("ERR WATCH inside MULTI is not allowed"))
+	}
+	for _, key := range keys {
+		if _, ok := c.watchedKeys[key]; ok {
+			continue
+		}
+		c.watchedKeys[key] = struct{}{}
+		clients, ok := watchedKeys[key]
+		if !ok {
+			clients = make(map[*Client]struct{})
+			watchedKeys[key] = clients
+		}
+		clients[c] = struct{}{}
+	}
+	return response.Encode("OK", true)
+}
+
+func (c *Client) unwatchAllKeys() {
+	for key := range c.watchedKeys {
+		clients := watchedKeys[key]
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(watchedKeys, key)
+		}
+	}
+	c.watchedKeys = make(map[string]struct{})
+	c.dirtyCAS = false
+}
+
+// Flags the transaction of every client watching the key so that their EXEC fails
+func touchWatchedKey(key string) {
+	for c := range watchedKeys[key] {
+		c.dirtyCAS = true
+	}
+}
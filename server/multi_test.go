@@ -0,0 +1,113 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/inmemdb/inmem/server/response"
+)
+
+func TestMultiExec(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(replyOK, "MULTI")
+	c.expectError("ERR MULTI calls can not be nested", "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "PING")
+	c.expect(response.SimpleString("QUEUED"), "PING", "hello")
+	c.expect(array(replyPONG, "hello"), "EXEC")
+
+	c.expectError("ERR EXEC without MULTI", "EXEC")
+	c.expectError("ERR DISCARD without MULTI", "DISCARD")
+}
+
+func TestMultiDiscard(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "PING")
+	c.expect(replyOK, "DISCARD")
+	c.expect(replyPONG, "PING")
+}
+
+func TestMultiExecError(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	//A command failing when EXEC runs it does not stop the others
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "PING", "a", "b")
+	c.expect(response.SimpleString("QUEUED"), "PING")
+	c.expect(array(response.ErrorReply("ERR wrong number of arguments for 'ping' command"), replyPONG), "EXEC")
+}
+
+func TestMultiQueueError(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(replyOK, "MULTI")
+	c.expectError("ERR wrong number of arguments", "SIM.ADD", "a")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "a", "x")
+	c.expectError("EXECABORT", "EXEC")
+
+	//The transaction was discarded as a whole
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+}
+
+// Marks the key as modified like a write command does
+func modifyKey(key string) {
+	execMu.Lock()
+	signalModifiedKey(key)
+	execMu.Unlock()
+}
+
+func TestWatch(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	other := connect(t)
+
+	c.expect(replyOK, "WATCH", "a")
+	other.expect(replyOK, "WATCH", "a")
+	modifyKey("a")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "PING")
+	c.expect(nil, "EXEC")
+
+	//EXEC forgets the watched keys, the next transaction runs
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "PING")
+	c.expect(array(replyPONG), "EXEC")
+
+	c.expect(replyOK, "WATCH", "a")
+	c.expect(replyOK, "UNWATCH")
+	modifyKey("a")
+	c.expect(replyOK, "MULTI")
+	c.expectError("ERR WATCH inside MULTI is not allowed", "WATCH", "a")
+	c.expect(array(), "EXEC")
+
+	//Modifying a key only affects the clients watching it
+	c.expect(replyOK, "WATCH", "b")
+	modifyKey("a")
+	c.expect(replyOK, "MULTI")
+	c.expect(array(), "EXEC")
+}
+
+func TestWatchModifiedByCommand(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	other := connect(t)
+
+	c.expect(replyOK, "WATCH", "a", "b")
+	other.expect(int64(1), "SIM.ADD", "a", "x")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "y")
+	c.expect(nil, "EXEC")
+
+	//A command that does not change the key does not touch it
+	c.expect(replyOK, "WATCH", "a")
+	other.expect(int64(0), "SIM.ADD", "a", "x")
+	other.expect("0", "SIM.JACCARD", "a", "b")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "y")
+	c.expect(array(int64(1)), "EXEC")
+}
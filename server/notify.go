@@ -0,0 +1,101 @@
+package server
+
+import "errors"
+
+/**
+Keyspace notifications, enabled with the notify-keyspace-events setting. For every key modified by a
+command two pub/sub messages can be published:
+	- on __keyspace@0__:<key> with the name of the event as the message
+	- on __keyevent@0__:<event> with the key as the message
+The setting is a list of characters selecting what is published:
+	K keyspace events, E keyevent events (at least one of them is needed for anything to be published)
+	g generic commands, $ string, l list, s set, h hash, z sorted set, t stream commands
+	x expired keys, e evicted keys, m key misses, n new keys
+	A alias for g$lshzxet, so "AKE" means every event but m and n
+The similarity commands summarize sets, their events belong to the s class.
+There is only one database, so <db> is always 0.
+*/
+
+const (
+	NOTIFY_KEYSPACE = 1 << iota
+	NOTIFY_KEYEVENT
+	NOTIFY_GENERIC
+	NOTIFY_STRING
+	NOTIFY_LIST
+	NOTIFY_SET
+	NOTIFY_HASH
+	NOTIFY_ZSET
+	NOTIFY_EXPIRED
+	NOTIFY_EVICTED
+	NOTIFY_STREAM
+	NOTIFY_KEY_MISS
+	NOTIFY_NEW
+
+	NOTIFY_ALL = NOTIFY_GENERIC | NOTIFY_STRING | NOTIFY_LIST | NOTIFY_SET | NOTIFY_HASH | NOTIFY_ZSET |
+		NOTIFY_EXPIRED | NOTIFY_EVICTED | NOTIFY_STREAM
+)
+
+// Classes of events being published, set once at startup
+var notifyKeyspaceEvents int
+
+// Parses the notify-keyspace-events setting
+func keyspaceEventsFromString(flags string) (int, error) {
+	classes := 0
+	for _, c := range flags {
+		switch c {
+		case 'A':
+			classes |= NOTIFY_ALL
+		case 'g':
+			classes |= NOTIFY_GENERIC
+		case '$':
+			classes |= NOTIFY_STRING
+		case 'l':
+			classes |= NOTIFY_LIST
+		case 's':
+			classes |= NOTIFY_SET
+		case 'h':
+			classes |= NOTIFY_HASH
+		case 'z':
+			classes |= NOTIFY_ZSET
+		case 'x':
+			classes |= NOTIFY_EXPIRED
+		case 'e':
+			classes |= NOTIFY_EVICTED
+		case 'K':
+			classes |= NOTIFY_KEYSPACE
+		case 'E':
+			classes |= NOTIFY_KEYEVENT
+		case 't':
+			classes |= NOTIFY_STREAM
+		case 'm':
+			classes |= NOTIFY_KEY_MISS
+		case 'n':
+			classes |= NOTIFY_NEW
+		default:
+			return 0, errors.New("ERR Invalid event class character '" + string(c) + "' in notify-keyspace-events")
+		}
+	}
+	return classes, nil
+}
+
+func setNotifyKeyspaceEvents(flags string) error {
+	classes, err := keyspaceEventsFromString(flags)
+	if err != nil {
+		return err
+	}
+	notifyKeyspaceEvents = classes
+	return nil
+}
+
+// Publishes the event if its class is enabled, must be called holding execMu
+func notifyKeyspaceEvent(class int, event string, key string) {
+	if notifyKeyspaceEvents&class == 0 {
+		return
+	}
+	if notifyKeyspaceEvents&NOTIFY_KEYSPACE != 0 {
+		publish("__keyspace@0__:"+key, event)
+	}
+	if notifyKeyspaceEvents&NOTIFY_KEYEVENT != 0 {
+		publish("__keyevent@0__:"+event, key)
+	}
+}
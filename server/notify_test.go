@@ -0,0 +1,30 @@
+package server
+
+import "testing"
+
+func TestKeyspaceNotifications(t *testing.T) {
+	setupTestServer(t)
+	execMu.Lock()
+	err := setNotifyKeyspaceEvents("KEs")
+	execMu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := connect(t)
+	c := connect(t)
+
+	sub.expect(array("psubscribe", "__key*", int64(1)), "PSUBSCRIBE", "__key*")
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	sub.expectNext(array("pmessage", "__key*", "__keyspace@0__:a", "sim.add"))
+	sub.expectNext(array("pmessage", "__key*", "__keyevent@0__:sim.add", "a"))
+
+	//Nothing is published when the command does not modify the key, nor for the disabled classes
+	c.expect(int64(0), "SIM.ADD", "a", "x")
+	c.expect("0", "SIM.JACCARD", "a", "missing")
+	c.expect(replyOK, "SIM.MERGE", "b", "a")
+	sub.expectNext(array("pmessage", "__key*", "__keyspace@0__:b", "sim.merge"))
+
+	if _, err := keyspaceEventsFromString("KZ"); err == nil {
+		t.Error("expected an error for an unknown class")
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/metrics"
+)
+
+/**
+Prometheus metrics served over HTTP on metrics-addr at /metrics, disabled when it is empty.
+They come from the same statistics as INFO, plus latency histograms of every command and of the
+handling of the commands read from clients.
+The poller of AsyncServer hands each connection to a goroutine reading it until it closes, so a
+wait of the poller is followed by the whole life of a connection and is not timed. The handling of
+each command, including the wait for the commands of other clients, stands for the event loop
+iteration of a single threaded server.
+The endpoint is not authenticated, metrics-addr should only be reachable by the monitoring stack.
+*/
+
+var (
+	//Durations of the handling of the commands, guarded by commandHandlingMu as every connection has its own goroutine
+	commandHandlingMu      sync.Mutex
+	commandHandlingLatency = metrics.NewHistogram(metrics.LatencyBuckets)
+)
+
+// Records the time spent handling one command, from the end of its read to its reply being queued.
+// The idle wait for the next command is not part of it.
+func observeCommandHandling(duration time.Duration) {
+	commandHandlingMu.Lock()
+	commandHandlingLatency.Observe(duration.Seconds())
+	commandHandlingMu.Unlock()
+}
+
+// Creates the listener of the metrics endpoint, nil when metrics-addr is not set
+func createMetricsListener() net.Listener {
+	if config.MetricsAddr == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", config.MetricsAddr)
+	if err != nil {
+		panic(err)
+	}
+	return listener
+}
+
+func serveMetrics(listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metrics.ContentType)
+		w.Write(collectMetrics())
+	})
+	log.Println("Serving Prometheus metrics on", listener.Addr())
+	if err := http.Serve(listener, mux); err != nil {
+		log.Println("Metrics endpoint stopped, Err: ", err)
+	}
+}
+
+func collectMetrics() []byte {
+	var w metrics.Writer
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	execMu.Lock()
+	names := make([]string, 0, len(commandStats))
+	for name := range commandStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header("inmem_commands_total", "counter", "Number of calls of each command")
+	for _, name := range names {
+		w.Sample("inmem_commands_total", float64(commandStats[name].calls), "cmd", name)
+	}
+	w.Header("inmem_commands_failed_total", "counter", "Number of calls of each command that replied with an error")
+	for _, name := range names {
+		w.Sample("inmem_commands_failed_total", float64(commandStats[name].failedCalls), "cmd", name)
+	}
+	w.Header("inmem_commands_rejected_total", "counter", "Number of calls of each command refused before running, eg: by ACL rules")
+	for _, name := range names {
+		w.Sample("inmem_commands_rejected_total", float64(commandStats[name].rejectedCalls), "cmd", name)
+	}
+	w.Header("inmem_command_duration_seconds", "histogram", "Time spent running each command")
+	for _, name := range names {
+		w.Histogram("inmem_command_duration_seconds", commandStats[name].latency, "cmd", name)
+	}
+
+	w.Header("inmem_connected_clients", "gauge", "Number of connected clients")
+	w.Sample("inmem_connected_clients", float64(len(clients)))
+	w.Header("inmem_connections_received_total", "counter", "Number of connections accepted")
+	w.Sample("inmem_connections_received_total", float64(statNumConnections))
+	w.Header("inmem_protected_mode_rejected_connections_total", "counter", "Number of connections refused by protected mode")
+	w.Sample("inmem_protected_mode_rejected_connections_total", float64(statProtectedModeRejectedConn))
+
+	w.Header("inmem_db_keys", "gauge", "Number of keys of each database")
+	w.Sample("inmem_db_keys", float64(len(keyspace)), "db", "db0")
+	w.Header("inmem_db_keys_expiring", "gauge", "Number of keys with an expiration of each database")
+	w.Sample("inmem_db_keys_expiring", 0, "db", "db0")
+	w.Header("inmem_memory_dataset_bytes", "gauge", "Estimated number of bytes used by the keys and their values")
+	w.Sample("inmem_memory_dataset_bytes", float64(datasetMemory()))
+	w.Header("inmem_keyspace_hits_total", "counter", "Number of keys found by read commands")
+	w.Sample("inmem_keyspace_hits_total", float64(statKeyspaceHits))
+	w.Header("inmem_keyspace_misses_total", "counter", "Number of keys not found by read commands")
+	w.Sample("inmem_keyspace_misses_total", float64(statKeyspaceMisses))
+	w.Header("inmem_master_repl_offset", "gauge", "Replication offset of the master")
+	w.Sample("inmem_master_repl_offset", float64(masterReplOffset))
+	w.Header("inmem_connected_slaves", "gauge", "Number of connected replicas")
+	w.Sample("inmem_connected_slaves", float64(len(replicas)))
+	execMu.Unlock()
+
+	//INFO: Keys never expire nor are evicted, they are reported for the dashboards
+	w.Header("inmem_expired_keys_total", "counter", "Number of keys deleted because they expired")
+	w.Sample("inmem_expired_keys_total", 0)
+	w.Header("inmem_evicted_keys_total", "counter", "Number of keys evicted to stay under maxmemory")
+	w.Sample("inmem_evicted_keys_total", 0)
+
+	w.Header("inmem_commands_processed_total", "counter", "Number of commands run")
+	w.Sample("inmem_commands_processed_total", float64(atomic.LoadUint64(&statNumCommands)))
+	w.Header("inmem_net_input_bytes_total", "counter", "Number of bytes read from clients")
+	w.Sample("inmem_net_input_bytes_total", float64(atomic.LoadUint64(&statNetInputBytes)))
+	w.Header("inmem_net_output_bytes_total", "counter", "Number of bytes written to clients")
+	w.Sample("inmem_net_output_bytes_total", float64(atomic.LoadUint64(&statNetOutputBytes)))
+
+	w.Header("inmem_memory_used_bytes", "gauge", "Number of bytes allocated on the heap")
+	w.Sample("inmem_memory_used_bytes", float64(ms.Alloc))
+	w.Header("inmem_memory_sys_bytes", "gauge", "Number of bytes obtained from the operating system by the Go runtime")
+	w.Sample("inmem_memory_sys_bytes", float64(ms.Sys))
+	if rss, ok := residentSetSize(); ok {
+		w.Header("inmem_memory_rss_bytes", "gauge", "Resident set size of the process")
+		w.Sample("inmem_memory_rss_bytes", float64(rss))
+	}
+	w.Header("inmem_uptime_seconds", "gauge", "Number of seconds since the server started")
+	w.Sample("inmem_uptime_seconds", time.Since(serverStartTime).Seconds())
+
+	commandHandlingMu.Lock()
+	w.Header("inmem_command_handling_duration_seconds", "histogram", "Time spent handling each command read from a client, including the wait for the commands of other clients")
+	w.Histogram("inmem_command_handling_duration_seconds", commandHandlingLatency)
+	commandHandlingMu.Unlock()
+	return w.Bytes()
+}
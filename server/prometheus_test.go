@@ -0,0 +1,52 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/server/metrics"
+)
+
+// Returns the value of the sample of the metrics endpoint with the given name
+func metricsSample(t *testing.T, name string) float64 {
+	for _, line := range strings.Split(string(collectMetrics()), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			value := strings.TrimPrefix(line, name+" ")
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("sample %s has the value %q", name, value)
+			}
+			return f
+		}
+	}
+	t.Fatalf("no sample %s", name)
+	return 0
+}
+
+func TestCommandHandlingMetric(t *testing.T) {
+	setupTestServer(t)
+	commandHandlingMu.Lock()
+	commandHandlingLatency = metrics.NewHistogram(metrics.LatencyBuckets)
+	commandHandlingMu.Unlock()
+	c := connect(t)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		c.expect(int64(1), "SIM.ADD", "a", strconv.Itoa(i))
+	}
+
+	//The handling is recorded once the reply is queued, which can be after the client read it
+	deadline := time.Now().Add(testReplyTimeout)
+	for metricsSample(t, "inmem_command_handling_duration_seconds_count") != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("the handling of every command should be recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	//The client was idle for 150ms, the idle wait is not part of the handling
+	if sum := metricsSample(t, "inmem_command_handling_duration_seconds_sum"); sum >= 0.05 {
+		t.Errorf("the commands took %vs to handle", sum)
+	}
+}
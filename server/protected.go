@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+/**
+Protected mode, a safety net for servers reachable from the network without a password:
+	- when protected-mode is enabled and the default user needs no password, only the clients connecting
+	  through the loopback interface or the unix socket are served, the others are told why and disconnected
+	- a warning is logged at startup when the server listens on a non loopback address without a password
+The host setting accepts several addresses separated by spaces or commas, IPv4 and IPv6, eg: "127.0.0.1 ::1"
+The sync server does not authenticate clients, in protected mode it only serves local clients (see tcp_server.go).
+*/
+
+var errProtectedMode = errors.New("DENIED inmem is running in protected mode because protected mode is enabled and no password is set for the default user. In this mode connections are only accepted from the loopback interface and the unix socket. If you want to connect from external computers you may adopt one of the following solutions: 1) Restart the server with the '-protected-mode=false' option, however MAKE SURE it is not publicly accessible from internet if you do so. 2) Set up an authentication password for the default user with the '-requirepass' option or in the aclfile. NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.")
+
+// The addresses of the host setting
+func bindAddresses() []string {
+	return strings.FieldsFunc(config.Host, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+// Listens on the port of every bind address
+func listenTCP(port int) []net.Listener {
+	var listeners []net.Listener
+	for _, host := range bindAddresses() {
+		listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			panic(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		panic("no address to bind to, the host setting is empty")
+	}
+	return listeners
+}
+
+// Tells if the connection comes from the same machine, through the loopback interface or the unix socket
+func isLocalConn(conn net.Conn) bool {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// Tells if the client must be refused by protected mode, must be called holding execMu
+func protectedModeDenied(conn net.Conn) bool {
+	return config.ProtectedMode && !authRequired() && !isLocalConn(conn)
+}
+
+// Logs a warning when clients from other machines can connect without a password
+func warnUnprotectedBind() {
+	if config.Port == 0 && config.TLSPort == 0 || authRequired() {
+		return
+	}
+	var exposed []string
+	for _, host := range bindAddresses() {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			exposed = append(exposed, host)
+		}
+	}
+	if len(exposed) == 0 {
+		return
+	}
+
+	log.Println("**********************************************************************")
+	if config.ProtectedMode {
+		log.Println("WARNING: no password is set for the default user and the server listens on", strings.Join(exposed, " "))
+		log.Println("WARNING: protected mode is enabled, only loopback and unix socket clients will be served.")
+		log.Println("WARNING: set a password with -requirepass or bind to 127.0.0.1 to accept or avoid remote clients.")
+	} else {
+		log.Println("WARNING: no password is set for the default user, protected mode is disabled and the server listens on", strings.Join(exposed, " "))
+		log.Println("WARNING: anyone who can reach this server can read and modify all the data.")
+	}
+	log.Println("**********************************************************************")
+}
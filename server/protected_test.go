@@ -0,0 +1,69 @@
+package server
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+func TestProtectedMode(t *testing.T) {
+	setupTestServer(t)
+
+	//The client is refused as soon as it connects
+	c := connectFrom(t, "10.0.0.1")
+	if reply := c.read(); reply != response.ErrorReply(errProtectedMode.Error()) {
+		t.Errorf("unexpected reply %#v", reply)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	if _, err := c.conn.Read(make([]byte, 64)); err != io.EOF {
+		t.Errorf("the refused client was not disconnected: %v", err)
+	}
+
+	connectFrom(t, "::1").expect(replyPONG, "PING")
+
+	//A password protects the server, remote clients are then served and have to authenticate
+	admin := connect(t)
+	admin.expect(replyOK, "ACL", "SETUSER", "default", ">secret")
+	connectFrom(t, "10.0.0.1").expectError("NOAUTH", "PING")
+
+	admin.expect(replyOK, "ACL", "SETUSER", "default", "nopass")
+	config.ProtectedMode = false
+	connectFrom(t, "10.0.0.1").expect(replyPONG, "PING")
+}
+
+// The sync server does not authenticate clients, protected mode refuses every remote client
+func TestSyncProtectedMode(t *testing.T) {
+	setupTestServer(t)
+	remote := testConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}}
+	local := testConn{remote: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 40000}}
+
+	if !syncProtectedModeDenied(remote) || syncProtectedModeDenied(local) {
+		t.Error("protected mode must only serve local clients")
+	}
+	config.ProtectedMode = false
+	if syncProtectedModeDenied(remote) {
+		t.Error("remote clients must be served when protected mode is disabled")
+	}
+}
+
+func TestBindAddresses(t *testing.T) {
+	setupTestServer(t)
+	config.Host = "127.0.0.1, ::1\t0.0.0.0"
+	if got := bindAddresses(); !reflect.DeepEqual(got, []string{"127.0.0.1", "::1", "0.0.0.0"}) {
+		t.Errorf("unexpected addresses %q", got)
+	}
+
+	config.Host = "127.0.0.1,127.0.0.1"
+	listeners := listenTCP(0)
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if len(listeners) != 2 {
+		t.Errorf("expected a listener per address, got %d", len(listeners))
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/inmemdb/inmem/server/glob"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Publish/subscribe:
+	- SUBSCRIBE channel [channel ...] / UNSUBSCRIBE [channel ...] manage the channels of the client
+	- PSUBSCRIBE pattern [pattern ...] / PUNSUBSCRIBE [pattern ...] subscribe to every channel
+	  matching a glob style pattern
+	- PUBLISH channel message sends the message to every subscriber and replies with their number
+	- PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT describe the active subscriptions
+Messages are delivered as arrays in RESP2 and as push frames to clients which negotiated RESP3 with HELLO.
+A subscribed connection stays registered with the poller and is freed like any other when it is closed.
+*/
+
+var (
+	//The subscribers of each channel and pattern, guarded by execMu
+	pubsubChannels = map[string]map[*Client]struct{}{}
+	pubsubPatterns = map[string]map[*Client]struct{}{}
+)
+
+func (c *Client) subscriptionCount() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+// Encodes a message or subscription reply for the protocol of the client
+func (c *Client) pubsubFrame(values ...[]byte) []byte {
+	if c.resp == 3 {
+		return response.EncodePush(values)
+	}
+	return response.EncodeArray(values)
+}
+
+// Returns the subscriptions of the client, the server wide registry and the reply kind
+// for either channels or patterns
+func (c *Client) subscriptions(pattern bool) (map[string]struct{}, map[string]map[*Client]struct{}, string) {
+	if pattern {
+		return c.patterns, pubsubPatterns, "psubscribe"
+	}
+	return c.channels, pubsubChannels, "subscribe"
+}
+
+func (c *Client) subscribe(names []string, pattern bool) []byte {
+	subs, registry, kind := c.subscriptions(pattern)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if _, ok := subs[name]; !ok {
+			subs[name] = struct{}{}
+			clients, ok := registry[name]
+			if !ok {
+				clients = make(map[*Client]struct{})
+				registry[name] = clients
+			}
+			clients[c] = struct{}{}
+		}
+		buf.Write(c.pubsubFrame(response.Encode(kind, false), response.Encode(name, false), response.Encode(c.subscriptionCount(), false)))
+	}
+	return buf.Bytes()
+}
+
+// Unsubscribes from the given channels or patterns, or from all of them when none is given
+func (c *Client) unsubscribe(names []string, pattern bool) []byte {
+	subs, registry, _ := c.subscriptions(pattern)
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+
+	if len(names) == 0 {
+		for name := range subs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	//Unsubscribing without being subscribed to anything still gets a reply
+	if len(names) == 0 {
+		return c.pubsubFrame(response.Encode(kind, false), response.Encode(nil, false), response.Encode(c.subscriptionCount(), false))
+	}
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		if _, ok := subs[name]; ok {
+			delete(subs, name)
+			removeSubscriber(registry, name, c)
+		}
+		buf.Write(c.pubsubFrame(response.Encode(kind, false), response.Encode(name, false), response.Encode(c.subscriptionCount(), false)))
+	}
+	return buf.Bytes()
+}
+
+// Drops every subscription of the client without replying
+func (c *Client) unsubscribeAll() {
+	for name := range c.channels {
+		removeSubscriber(pubsubChannels, name, c)
+	}
+	for name := range c.patterns {
+		removeSubscriber(pubsubPatterns, name, c)
+	}
+	c.channels = make(map[string]struct{})
+	c.patterns = make(map[string]struct{})
+}
+
+func removeSubscriber(registry map[string]map[*Client]struct{}, name string, c *Client) {
+	clients := registry[name]
+	delete(clients, c)
+	if len(clients) == 0 {
+		delete(registry, name)
+	}
+}
+
+// Sends the message to the subscribers of the channel, returns the number of clients that received it.
+// Must be called holding execMu.
+func publish(channel string, message string) int {
+	receivers := 0
+	for c := range pubsubChannels[channel] {
+		c.write(c.pubsubFrame(response.Encode("message", false), response.Encode(channel, false), response.Encode(message, false)))
+		receivers++
+	}
+	for pattern, clients := range pubsubPatterns {
+		if !glob.Match(pattern, channel) {
+			continue
+		}
+		for c := range clients {
+			c.write(c.pubsubFrame(response.Encode("pmessage", false), response.Encode(pattern, false),
+				response.Encode(channel, false), response.Encode(message, false)))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+func (cmd *Command) evalPUBLISH() ([]byte, error) {
+	return response.Encode(publish(cmd.Args[0], cmd.Args[1]), false), nil
+}
+
+func (cmd *Command) evalPUBSUB() ([]byte, error) {
+	sub := strings.ToLower(cmd.Args[0])
+	switch {
+	case sub == "channels" && len(cmd.Args) <= 2:
+		var channels [][]byte
+		for channel := range pubsubChannels {
+			if len(cmd.Args) == 2 && !glob.Match(cmd.Args[1], channel) {
+				continue
+			}
+			channels = append(channels, response.Encode(channel, false))
+		}
+		return response.EncodeArray(channels), nil
+	case sub == "numsub":
+		replies := make([][]byte, 0, 2*(len(cmd.Args)-1))
+		for _, channel := range cmd.Args[1:] {
+			replies = append(replies, response.Encode(channel, false), response.Encode(len(pubsubChannels[channel]), false))
+		}
+		return response.EncodeArray(replies), nil
+	case sub == "numpat" && len(cmd.Args) == 1:
+		return response.Encode(len(pubsubPatterns), false), nil
+	case sub == "channels" || sub == "numpat":
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'pubsub|%s' command", sub)
+	}
+	return nil, errors.New("ERR unknown subcommand '" + cmd.Args[0] + "'. Try PUBSUB HELP.")
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPubSub(t *testing.T) {
+	setupTestServer(t)
+	sub := connect(t)
+	pub := connect(t)
+
+	sub.expect(array("subscribe", "news", int64(1)), "SUBSCRIBE", "news")
+	sub.expect(array("psubscribe", "n*", int64(2)), "PSUBSCRIBE", "n*")
+	sub.expect(array("pong", ""), "PING")
+	sub.expectError("ERR Can't execute 'sim.add'", "SIM.ADD", "a", "x")
+
+	pub.expect(int64(2), "PUBLISH", "news", "hello")
+	sub.expectNext(array("message", "news", "hello"))
+	sub.expectNext(array("pmessage", "n*", "news", "hello"))
+	pub.expect(int64(0), "PUBLISH", "weather", "sunny")
+
+	pub.expect(array("news"), "PUBSUB", "CHANNELS")
+	pub.expect(array(), "PUBSUB", "CHANNELS", "w*")
+	pub.expect(array("news", int64(1), "weather", int64(0)), "PUBSUB", "NUMSUB", "news", "weather")
+	pub.expect(int64(1), "PUBSUB", "NUMPAT")
+
+	sub.expect(array("unsubscribe", "news", int64(1)), "UNSUBSCRIBE", "news")
+	sub.expect(array("punsubscribe", "n*", int64(0)), "PUNSUBSCRIBE")
+	sub.expect(int64(1), "SIM.ADD", "a", "x")
+	pub.expect(int64(0), "PUBSUB", "NUMPAT")
+}
+
+func TestPubSubPatternBacktracking(t *testing.T) {
+	setupTestServer(t)
+	sub := connect(t)
+	pub := connect(t)
+
+	sub.expect(array("psubscribe", "*a*a*a*a*a*a*a*a*b", int64(1)), "PSUBSCRIBE", "*a*a*a*a*a*a*a*a*b")
+	start := time.Now()
+	pub.expect(int64(0), "PUBLISH", strings.Repeat("a", 60), "message")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("PUBLISH took %v", elapsed)
+	}
+}
@@ -0,0 +1,69 @@
+package raft
+
+// The entries of the log after the snapshot it was compacted into
+type raftLog struct {
+	entries []Entry
+	//Index and term of the last entry compacted
+	snapshotIndex uint64
+	snapshotTerm  uint64
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshotIndex + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	term, _ := l.term(l.lastIndex())
+	return term
+}
+
+// Term of the entry at index, false when it is compacted or not in the log yet
+func (l *raftLog) term(index uint64) (uint64, bool) {
+	switch {
+	case index == l.snapshotIndex:
+		return l.snapshotTerm, true
+	case index < l.snapshotIndex || index > l.lastIndex():
+		return 0, false
+	}
+	return l.entries[index-l.snapshotIndex-1].Term, true
+}
+
+func (l *raftLog) matchTerm(index uint64, term uint64) bool {
+	t, ok := l.term(index)
+	return ok && t == term
+}
+
+// Entries from lo to hi included, hi below lo is empty
+func (l *raftLog) slice(lo uint64, hi uint64) []Entry {
+	if hi < lo {
+		return nil
+	}
+	return append([]Entry(nil), l.entries[lo-l.snapshotIndex-1:hi-l.snapshotIndex]...)
+}
+
+// Appends the entries sent after the entry at index, the entries that conflict with them are dropped
+func (l *raftLog) appendAfter(index uint64, entries []Entry) {
+	for i, e := range entries {
+		if e.Index <= l.snapshotIndex {
+			continue
+		}
+		if term, ok := l.term(e.Index); ok && term == e.Term {
+			continue
+		}
+		//INFO: The first entry that differs and the ones after it are replaced
+		l.entries = append(l.entries[:e.Index-l.snapshotIndex-1], entries[i:]...)
+		return
+	}
+}
+
+// Drops the entries up to index, they are held by a snapshot
+func (l *raftLog) compact(index uint64, term uint64) {
+	l.entries = append([]Entry(nil), l.entries[index-l.snapshotIndex:]...)
+	l.snapshotIndex, l.snapshotTerm = index, term
+}
+
+// Replaces the log by a snapshot
+func (l *raftLog) restore(index uint64, term uint64) {
+	l.entries = nil
+	l.snapshotIndex, l.snapshotTerm = index, term
+}
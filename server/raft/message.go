@@ -0,0 +1,219 @@
+package raft
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+type EntryType uint8
+
+const (
+	//A proposal of the state machine, empty for the entry a new leader appends
+	EntryNormal EntryType = iota
+	//A ConfChange
+	EntryConfChange
+)
+
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type ConfChangeType uint8
+
+const (
+	ConfChangeAddNode ConfChangeType = iota
+	ConfChangeRemoveNode
+)
+
+// Adds or removes a node of the cluster
+type ConfChange struct {
+	Type   ConfChangeType
+	NodeID uint64
+	//Address of the node added
+	Addr string
+}
+
+// The state machine at an index of the log, with the configuration at that index
+type Snapshot struct {
+	Index uint64
+	Term  uint64
+	Peers map[uint64]string
+	Data  []byte
+}
+
+type MessageType uint8
+
+const (
+	//Asks for a vote, Index and LogTerm are the last entry of the candidate
+	MsgVote MessageType = iota
+	MsgVoteResp
+	//Entries appended after the entry at Index of term LogTerm, and the commit index of the leader
+	MsgApp
+	//Index is the last entry appended, or the entry not found when rejected, RejectHint the last entry of the follower
+	MsgAppResp
+	//Commit is the commit index the follower is known to have, Context the read confirmed by the heartbeat
+	MsgHeartbeat
+	MsgHeartbeatResp
+	//The snapshot of the leader, sent when the entries the follower needs are compacted
+	MsgSnap
+	//Asks if the node would vote for the candidate at Term, without changing the term of either
+	MsgPreVote
+	MsgPreVoteResp
+)
+
+var messageTypeNames = []string{"MsgVote", "MsgVoteResp", "MsgApp", "MsgAppResp", "MsgHeartbeat", "MsgHeartbeatResp", "MsgSnap", "MsgPreVote", "MsgPreVoteResp"}
+
+func (t MessageType) String() string {
+	if int(t) < len(messageTypeNames) {
+		return messageTypeNames[t]
+	}
+	return "MsgUnknown"
+}
+
+type Message struct {
+	Type       MessageType
+	From       uint64
+	To         uint64
+	Term       uint64
+	LogTerm    uint64
+	Index      uint64
+	Commit     uint64
+	Reject     bool
+	RejectHint uint64
+	Context    uint64
+	Entries    []Entry
+	Snapshot   *Snapshot
+}
+
+var errBadEncoding = errors.New("raft: bad encoding")
+
+/**
+Messages are encoded as uvarints, the byte slices as their length followed by their bytes:
+	type from to term logTerm index commit reject rejectHint context
+	count (term index type data)...
+	hasSnapshot [index term count (id addr)... data]
+*/
+func (m *Message) Marshal() []byte {
+	var buf []byte
+	reject := uint64(0)
+	if m.Reject {
+		reject = 1
+	}
+	for _, v := range []uint64{uint64(m.Type), m.From, m.To, m.Term, m.LogTerm, m.Index, m.Commit, reject, m.RejectHint, m.Context, uint64(len(m.Entries))} {
+		buf = appendUvarint(buf, v)
+	}
+	for _, e := range m.Entries {
+		buf = appendUvarint(buf, e.Term)
+		buf = appendUvarint(buf, e.Index)
+		buf = appendUvarint(buf, uint64(e.Type))
+		buf = appendBytes(buf, e.Data)
+	}
+	if m.Snapshot == nil {
+		return appendUvarint(buf, 0)
+	}
+	s := m.Snapshot
+	buf = appendUvarint(buf, 1)
+	buf = appendUvarint(buf, s.Index)
+	buf = appendUvarint(buf, s.Term)
+	ids := make([]uint64, 0, len(s.Peers))
+	for id := range s.Peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	buf = appendUvarint(buf, uint64(len(ids)))
+	for _, id := range ids {
+		buf = appendUvarint(buf, id)
+		buf = appendBytes(buf, []byte(s.Peers[id]))
+	}
+	return appendBytes(buf, s.Data)
+}
+
+func (m *Message) Unmarshal(data []byte) error {
+	d := decoder{data: data}
+	var fields [11]uint64
+	for i := range fields {
+		fields[i] = d.uvarint()
+	}
+	*m = Message{
+		Type: MessageType(fields[0]), From: fields[1], To: fields[2], Term: fields[3], LogTerm: fields[4],
+		Index: fields[5], Commit: fields[6], Reject: fields[7] == 1, RejectHint: fields[8], Context: fields[9],
+	}
+	for i := uint64(0); i < fields[10] && d.err == nil; i++ {
+		e := Entry{Term: d.uvarint(), Index: d.uvarint(), Type: EntryType(d.uvarint())}
+		e.Data = d.bytes()
+		m.Entries = append(m.Entries, e)
+	}
+	if d.uvarint() == 1 {
+		s := &Snapshot{Index: d.uvarint(), Term: d.uvarint(), Peers: map[uint64]string{}}
+		count := d.uvarint()
+		for i := uint64(0); i < count && d.err == nil; i++ {
+			id := d.uvarint()
+			s.Peers[id] = string(d.bytes())
+		}
+		s.Data = d.bytes()
+		m.Snapshot = s
+	}
+	if d.err == nil && len(d.data) > 0 {
+		return errBadEncoding
+	}
+	return d.err
+}
+
+func (cc *ConfChange) Marshal() []byte {
+	buf := appendUvarint(nil, uint64(cc.Type))
+	buf = appendUvarint(buf, cc.NodeID)
+	return appendBytes(buf, []byte(cc.Addr))
+}
+
+func (cc *ConfChange) Unmarshal(data []byte) error {
+	d := decoder{data: data}
+	*cc = ConfChange{Type: ConfChangeType(d.uvarint()), NodeID: d.uvarint()}
+	cc.Addr = string(d.bytes())
+	return d.err
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(data))), data...)
+}
+
+// Reads the fields of an encoding, the first error is kept and the following reads return zero values
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errBadEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if length > uint64(len(d.data)) {
+		d.err = errBadEncoding
+		return nil
+	}
+	b := append([]byte(nil), d.data[:length]...)
+	d.data = d.data[length:]
+	return b
+}
@@ -0,0 +1,173 @@
+package raft
+
+import "sort"
+
+/**
+Network connects Peers in the same process and delivers their messages deterministically, so that a whole
+cluster runs in a single test: the peers are advanced in the order of their ids and the messages are delivered
+in the order they were sent. Nothing runs in the background, the clock only moves with Tick.
+Peers can be stopped and links cut to simulate failures and partitions, the messages they would exchange are
+dropped.
+*/
+
+// A member of a Network
+type Peer interface {
+	ID() uint64
+	Step(m Message)
+	Tick()
+	//Processes what the peer produced, applying its committed entries, and returns the messages it sends
+	Advance() []Message
+}
+
+// A state machine the committed entries are applied to
+type StateMachine interface {
+	Apply(e Entry)
+	//The state once the entries applied so far are applied
+	Snapshot() []byte
+	Restore(data []byte)
+}
+
+// A Peer made of a Node and the state machine it applies its entries to
+type Member struct {
+	*Node
+	SM StateMachine
+	//Entries applied before the log is compacted into a snapshot, 0 never compacts
+	SnapshotEntries uint64
+	//The reads confirmed so far
+	ReadStates []ReadState
+}
+
+func (m *Member) ID() uint64 {
+	return m.id
+}
+
+func (m *Member) Advance() []Message {
+	rd := m.Ready()
+	if rd.Snapshot != nil {
+		m.SM.Restore(rd.Snapshot.Data)
+	}
+	for _, e := range rd.CommittedEntries {
+		m.SM.Apply(e)
+	}
+	m.ReadStates = append(m.ReadStates, rd.ReadStates...)
+	if m.SnapshotEntries > 0 && m.applied-m.snapshot.Index >= m.SnapshotEntries {
+		m.Compact(m.applied, m.SM.Snapshot())
+	}
+	return rd.Messages
+}
+
+type link struct {
+	from, to uint64
+}
+
+type Network struct {
+	peers   map[uint64]Peer
+	stopped map[uint64]bool
+	cut     map[link]bool
+	queue   []Message
+	//Called with every message delivered, eg: to drop some of them
+	Filter func(m Message) bool
+}
+
+func NewNetwork(peers ...Peer) *Network {
+	nw := &Network{peers: map[uint64]Peer{}, stopped: map[uint64]bool{}, cut: map[link]bool{}}
+	for _, p := range peers {
+		nw.Add(p)
+	}
+	return nw
+}
+
+func (nw *Network) Add(p Peer) {
+	nw.peers[p.ID()] = p
+}
+
+func (nw *Network) Peer(id uint64) Peer {
+	return nw.peers[id]
+}
+
+// Stops the peer, it neither ticks nor receives messages until it is started
+func (nw *Network) Stop(id uint64) {
+	nw.stopped[id] = true
+}
+
+func (nw *Network) Start(id uint64) {
+	delete(nw.stopped, id)
+}
+
+// Cuts the links between the peer and all the others
+func (nw *Network) Isolate(id uint64) {
+	for other := range nw.peers {
+		if other != id {
+			nw.Cut(id, other)
+		}
+	}
+}
+
+// Cuts the link between two peers, in both directions
+func (nw *Network) Cut(a uint64, b uint64) {
+	nw.cut[link{a, b}] = true
+	nw.cut[link{b, a}] = true
+}
+
+// Restores all the links
+func (nw *Network) Heal() {
+	nw.cut = map[link]bool{}
+}
+
+func (nw *Network) ids() []uint64 {
+	ids := make([]uint64, 0, len(nw.peers))
+	for id := range nw.peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (nw *Network) delivered(m Message) bool {
+	if nw.stopped[m.To] || nw.stopped[m.From] || nw.cut[link{m.From, m.To}] || nw.peers[m.To] == nil {
+		return false
+	}
+	return nw.Filter == nil || nw.Filter(m)
+}
+
+// Advances the peers and delivers their messages until none is left
+func (nw *Network) Flush() {
+	for {
+		for _, id := range nw.ids() {
+			if !nw.stopped[id] {
+				nw.queue = append(nw.queue, nw.peers[id].Advance()...)
+			}
+		}
+		if len(nw.queue) == 0 {
+			return
+		}
+		queue := nw.queue
+		nw.queue = nil
+		for _, m := range queue {
+			if nw.delivered(m) {
+				nw.peers[m.To].Step(m)
+			}
+		}
+	}
+}
+
+// Ticks every peer that is not stopped, then flushes the network
+func (nw *Network) Tick() {
+	for _, id := range nw.ids() {
+		if !nw.stopped[id] {
+			nw.peers[id].Tick()
+		}
+	}
+	nw.Flush()
+}
+
+// Ticks until done returns true, at most max times, tells if it did
+func (nw *Network) TickUntil(max int, done func() bool) bool {
+	for i := 0; i < max; i++ {
+		if done() {
+			return true
+		}
+		nw.Tick()
+	}
+	return done()
+}
@@ -0,0 +1,745 @@
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+/**
+Raft keeps a log of commands replicated on a set of nodes, an entry is committed once a majority of the nodes
+have it and every node applies the committed entries in the same order:
+	- a follower that hears nothing from a leader for its election timeout becomes candidate and asks for the
+	  votes of the others, a node votes once per term and only for a candidate whose log is as up to date as
+	  its own. The candidate that gets the votes of a majority becomes the leader of its term.
+	  Before that it asks for pre-votes without increasing its term, so that a node that was partitioned
+	  only disrupts the cluster when it could win the election.
+	- the leader appends the proposals to its log and sends them to the followers with the index and the term
+	  of the entry before them, a follower only accepts them when its log has that entry. An entry of the term
+	  of the leader is committed once a majority has it, the entries before it with it.
+	- the leader sends heartbeats every heartbeat timeout and steps down when it did not hear from a majority
+	  within an election timeout. Followers that hear from their leader ignore the votes asked by others, so
+	  that a node that was removed or partitioned does not disrupt the cluster.
+	- once applied the log can be compacted into a snapshot of the state machine, the followers that need
+	  the entries that were compacted receive the snapshot instead
+	- the nodes of the cluster are changed one at a time by committing a configuration change entry, it takes
+	  effect once applied. A node that is not part of the configuration never starts an election, a new node
+	  starts empty and receives the log, or a snapshot, from the leader.
+	- reads are linearizable with ReadIndex: the leader notes its commit index and confirms with a round of
+	  heartbeats that it is still the leader, the read is served once that index is applied
+The nodes of the initial cluster start with the same log: an entry adding each of them.
+
+A Node is a state machine, it does no I/O and has no goroutine: Tick advances its clock, Step gives it a
+message, Propose appends to its log and Ready returns what it produced, the messages to send and the entries
+to apply. A Node is not safe for concurrent use. The log is kept in memory.
+*/
+
+type StateType int
+
+const (
+	StateFollower StateType = iota
+	StatePreCandidate
+	StateCandidate
+	StateLeader
+)
+
+func (s StateType) String() string {
+	switch s {
+	case StatePreCandidate:
+		return "pre-candidate"
+	case StateCandidate:
+		return "candidate"
+	case StateLeader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Most entries sent in a single append
+const maxAppendEntries = 64
+
+var (
+	ErrNotLeader         = errors.New("raft: not the leader")
+	ErrNotReady          = errors.New("raft: the leader did not commit an entry of its term yet")
+	ErrConfChangePending = errors.New("raft: a configuration change is pending")
+	ErrUnknownNode       = errors.New("raft: unknown node")
+	ErrNodeExists        = errors.New("raft: the node is already part of the cluster")
+	ErrCompacted         = errors.New("raft: the index is already compacted")
+)
+
+type Config struct {
+	//Id of the node, 0 is not a valid id
+	ID uint64
+	//Nodes of the initial cluster and their address, empty for a node that joins an existing cluster
+	Peers map[uint64]string
+	//Ticks without hearing from a leader before an election, randomized between ElectionTick and 2*ElectionTick
+	ElectionTick int
+	//Ticks between the heartbeats of the leader
+	HeartbeatTick int
+	//Source of the randomized election timeouts, seeded from the time when nil
+	Rand *rand.Rand
+}
+
+// Replication state of a follower, kept by the leader
+type progress struct {
+	//Highest entry known to be replicated
+	match uint64
+	//Next entry to send
+	next uint64
+	//Set when the follower answered since the last quorum check
+	recentActive bool
+}
+
+// A read waiting for the leader to confirm it is still the leader
+type pendingRead struct {
+	id    uint64
+	index uint64
+	acks  map[uint64]bool
+}
+
+// A read ready once Index is applied, Lost when the node stopped being leader before it was confirmed
+type ReadState struct {
+	ID    uint64
+	Index uint64
+	Lost  bool
+}
+
+// What the node produced, returned by Ready
+type Ready struct {
+	//Messages to send to the other nodes
+	Messages []Message
+	//Snapshot to restore the state machine from, before applying CommittedEntries
+	Snapshot *Snapshot
+	//Entries to apply to the state machine, in order
+	CommittedEntries []Entry
+	ReadStates       []ReadState
+}
+
+type Node struct {
+	id    uint64
+	state StateType
+	term  uint64
+	vote  uint64
+	lead  uint64
+
+	log    raftLog
+	commit uint64
+	//Last entry returned by Ready
+	applied uint64
+	//Snapshot the log was compacted into, sent to the followers that need the compacted entries
+	snapshot Snapshot
+	//Snapshot received from the leader, the state machine is restored from it by Ready
+	pendingSnapshot *Snapshot
+
+	//Nodes of the configuration and their address
+	peers map[uint64]string
+	//Leader state
+	prs              map[uint64]*progress
+	pendingConfIndex uint64
+	//Candidate state
+	votes map[uint64]bool
+
+	electionTick              int
+	heartbeatTick             int
+	randomizedElectionTimeout int
+	electionElapsed           int
+	heartbeatElapsed          int
+	rand                      *rand.Rand
+
+	lastReadID   uint64
+	pendingReads []*pendingRead
+	readStates   []ReadState
+
+	msgs []Message
+}
+
+func NewNode(cfg Config) *Node {
+	n := &Node{
+		id:            cfg.ID,
+		peers:         map[uint64]string{},
+		electionTick:  cfg.ElectionTick,
+		heartbeatTick: cfg.HeartbeatTick,
+		rand:          cfg.Rand,
+	}
+	if n.electionTick <= 0 {
+		n.electionTick = 10
+	}
+	if n.heartbeatTick <= 0 {
+		n.heartbeatTick = 1
+	}
+	if n.rand == nil {
+		n.rand = rand.New(rand.NewSource(time.Now().UnixNano() + int64(cfg.ID)))
+	}
+
+	//INFO: The initial configuration is the first entries of the log so that the nodes added later learn it
+	//with the rest of the log, they are committed and applied from the start
+	ids := make([]uint64, 0, len(cfg.Peers))
+	for id := range cfg.Peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		cc := ConfChange{Type: ConfChangeAddNode, NodeID: id, Addr: cfg.Peers[id]}
+		n.log.entries = append(n.log.entries, Entry{Term: 1, Index: uint64(i + 1), Type: EntryConfChange, Data: cc.Marshal()})
+		n.peers[id] = cfg.Peers[id]
+	}
+	if len(ids) > 0 {
+		n.term = 1
+		n.commit, n.applied = uint64(len(ids)), uint64(len(ids))
+	}
+	n.becomeFollower(n.term, 0)
+	return n
+}
+
+func (n *Node) quorum() int {
+	return len(n.peers)/2 + 1
+}
+
+func (n *Node) isMember() bool {
+	_, ok := n.peers[n.id]
+	return ok
+}
+
+func (n *Node) send(m Message) {
+	m.From = n.id
+	if m.Term == 0 {
+		m.Term = n.term
+	}
+	n.msgs = append(n.msgs, m)
+}
+
+func (n *Node) reset(term uint64) {
+	if term != n.term {
+		n.term = term
+		n.vote = 0
+	}
+	n.lead = 0
+	n.electionElapsed = 0
+	n.heartbeatElapsed = 0
+	n.randomizedElectionTimeout = n.electionTick + n.rand.Intn(n.electionTick)
+	n.votes = nil
+	n.prs = nil
+	//INFO: The reads not confirmed yet are lost, the client retries them on the new leader
+	for _, read := range n.pendingReads {
+		n.readStates = append(n.readStates, ReadState{ID: read.id, Lost: true})
+	}
+	n.pendingReads = nil
+}
+
+func (n *Node) becomeFollower(term uint64, lead uint64) {
+	n.reset(term)
+	n.state = StateFollower
+	n.lead = lead
+}
+
+// Asks for pre-votes, the term is kept until a majority would vote for the node
+func (n *Node) becomePreCandidate() {
+	n.reset(n.term)
+	n.state = StatePreCandidate
+	n.votes = map[uint64]bool{n.id: true}
+}
+
+func (n *Node) becomeCandidate() {
+	n.reset(n.term + 1)
+	n.state = StateCandidate
+	n.vote = n.id
+	n.votes = map[uint64]bool{n.id: true}
+}
+
+func (n *Node) becomeLeader() {
+	n.reset(n.term)
+	n.state = StateLeader
+	n.lead = n.id
+	n.prs = map[uint64]*progress{}
+	for id := range n.peers {
+		n.prs[id] = &progress{next: n.log.lastIndex() + 1}
+	}
+	//INFO: The configuration entries of the former leaders may not be applied yet, no change until they are
+	n.pendingConfIndex = n.log.lastIndex()
+	//INFO: An empty entry of the new term commits the entries of the former terms, and lets reads be served
+	n.appendEntry(Entry{Type: EntryNormal})
+}
+
+func (n *Node) campaign(preVote bool) {
+	if n.quorum() == 1 {
+		n.becomeCandidate()
+		n.becomeLeader()
+		return
+	}
+	voteType := MsgVote
+	if preVote {
+		n.becomePreCandidate()
+		voteType = MsgPreVote
+	} else {
+		n.becomeCandidate()
+	}
+	//INFO: The pre-votes are asked for the term the node would campaign in
+	term := n.term
+	if preVote {
+		term++
+	}
+	for id := range n.peers {
+		if id != n.id {
+			n.send(Message{Type: voteType, To: id, Term: term, Index: n.log.lastIndex(), LogTerm: n.log.lastTerm()})
+		}
+	}
+}
+
+// Counts a vote, the node wins or loses once a majority answered the same
+func (n *Node) poll(from uint64, granted bool) (won bool, lost bool) {
+	n.votes[from] = granted
+	count := 0
+	for _, v := range n.votes {
+		if v {
+			count++
+		}
+	}
+	return count >= n.quorum(), len(n.votes)-count >= n.quorum()
+}
+
+// Advances the clock of the node by a tick
+func (n *Node) Tick() {
+	n.electionElapsed++
+	if n.state != StateLeader {
+		if n.electionElapsed >= n.randomizedElectionTimeout && n.isMember() {
+			n.campaign(true)
+		}
+		return
+	}
+
+	n.heartbeatElapsed++
+	if n.heartbeatElapsed >= n.heartbeatTick {
+		n.heartbeatElapsed = 0
+		n.broadcastHeartbeat(0)
+	}
+	//INFO: A leader that did not hear from a majority may have been replaced, it steps down
+	if n.electionElapsed >= n.electionTick {
+		n.electionElapsed = 0
+		active := 0
+		for id, pr := range n.prs {
+			if id == n.id || pr.recentActive {
+				active++
+			}
+			pr.recentActive = false
+		}
+		if active < n.quorum() {
+			n.becomeFollower(n.term, 0)
+		}
+	}
+}
+
+// Gives a message received from another node to the node
+func (n *Node) Step(m Message) {
+	switch {
+	case m.Term > n.term:
+		//INFO: A node that hears from its leader ignores the votes asked by others
+		if (m.Type == MsgVote || m.Type == MsgPreVote) && n.lead != 0 && n.electionElapsed < n.electionTick {
+			return
+		}
+		//INFO: Pre-votes are for a term the candidate is not in yet, they do not change the term
+		if m.Type == MsgPreVote || (m.Type == MsgPreVoteResp && !m.Reject) {
+			break
+		}
+		lead := uint64(0)
+		if m.Type == MsgApp || m.Type == MsgHeartbeat || m.Type == MsgSnap {
+			lead = m.From
+		}
+		n.becomeFollower(m.Term, lead)
+	case m.Term < n.term:
+		//INFO: A former leader learns the new term from the rejection and steps down
+		if m.Type == MsgApp || m.Type == MsgHeartbeat || m.Type == MsgSnap {
+			n.send(Message{Type: MsgAppResp, To: m.From, Reject: true})
+		} else if m.Type == MsgPreVote {
+			n.send(Message{Type: MsgPreVoteResp, To: m.From, Reject: true})
+		}
+		return
+	}
+
+	switch m.Type {
+	case MsgVote:
+		upToDate := m.LogTerm > n.log.lastTerm() || (m.LogTerm == n.log.lastTerm() && m.Index >= n.log.lastIndex())
+		if (n.vote == 0 || n.vote == m.From) && n.lead == 0 && upToDate {
+			n.vote = m.From
+			n.electionElapsed = 0
+			n.send(Message{Type: MsgVoteResp, To: m.From})
+		} else {
+			n.send(Message{Type: MsgVoteResp, To: m.From, Reject: true})
+		}
+	case MsgPreVote:
+		//INFO: The pre-vote is granted to any candidate whose log is up to date, it is not recorded
+		upToDate := m.LogTerm > n.log.lastTerm() || (m.LogTerm == n.log.lastTerm() && m.Index >= n.log.lastIndex())
+		if m.Term > n.term && upToDate {
+			n.send(Message{Type: MsgPreVoteResp, To: m.From, Term: m.Term})
+		} else {
+			n.send(Message{Type: MsgPreVoteResp, To: m.From, Reject: true})
+		}
+	case MsgPreVoteResp:
+		if n.state != StatePreCandidate {
+			return
+		}
+		if won, lost := n.poll(m.From, !m.Reject); won {
+			n.campaign(false)
+		} else if lost {
+			n.becomeFollower(n.term, 0)
+		}
+	case MsgVoteResp:
+		if n.state != StateCandidate {
+			return
+		}
+		if won, lost := n.poll(m.From, !m.Reject); won {
+			n.becomeLeader()
+		} else if lost {
+			n.becomeFollower(n.term, 0)
+		}
+	case MsgApp:
+		n.becomeFollowerOf(m.From)
+		n.handleAppend(m)
+	case MsgHeartbeat:
+		n.becomeFollowerOf(m.From)
+		if m.Commit > n.commit && m.Commit <= n.log.lastIndex() {
+			n.commit = m.Commit
+		}
+		n.send(Message{Type: MsgHeartbeatResp, To: m.From, Context: m.Context})
+	case MsgSnap:
+		n.becomeFollowerOf(m.From)
+		n.handleSnapshot(m)
+	case MsgAppResp:
+		n.handleAppendResponse(m)
+	case MsgHeartbeatResp:
+		n.handleHeartbeatResponse(m)
+	}
+}
+
+// A candidate that hears from the leader of its term becomes its follower
+func (n *Node) becomeFollowerOf(lead uint64) {
+	if n.state != StateFollower || n.lead != lead {
+		n.becomeFollower(n.term, lead)
+	}
+	n.electionElapsed = 0
+}
+
+func (n *Node) handleAppend(m Message) {
+	if m.Index < n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: n.commit})
+		return
+	}
+	if !n.log.matchTerm(m.Index, m.LogTerm) {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: m.Index, Reject: true, RejectHint: n.log.lastIndex()})
+		return
+	}
+	n.log.appendAfter(m.Index, m.Entries)
+	last := m.Index + uint64(len(m.Entries))
+	if commit := min(m.Commit, last); commit > n.commit {
+		n.commit = commit
+	}
+	n.send(Message{Type: MsgAppResp, To: m.From, Index: last})
+}
+
+func (n *Node) handleSnapshot(m Message) {
+	s := m.Snapshot
+	if s == nil || s.Index <= n.commit {
+		n.send(Message{Type: MsgAppResp, To: m.From, Index: n.commit})
+		return
+	}
+	n.log.restore(s.Index, s.Term)
+	n.commit, n.applied = s.Index, s.Index
+	n.snapshot = *s
+	n.pendingSnapshot = s
+	n.peers = copyPeers(s.Peers)
+	n.send(Message{Type: MsgAppResp, To: m.From, Index: s.Index})
+}
+
+func (n *Node) handleAppendResponse(m Message) {
+	pr := n.progressOf(m.From)
+	if pr == nil {
+		return
+	}
+	pr.recentActive = true
+	if m.Reject {
+		//INFO: The follower does not have the entry before the ones sent, the entries are sent from its last one
+		if m.Index > pr.match {
+			pr.next = max(min(m.Index, m.RejectHint+1), pr.match+1)
+			n.sendAppend(m.From, true)
+		}
+		return
+	}
+	if m.Index > pr.match {
+		pr.match = m.Index
+		if pr.next <= m.Index {
+			pr.next = m.Index + 1
+		}
+		if n.maybeCommit() {
+			n.broadcastAppend()
+			return
+		}
+	}
+	if pr.match < n.log.lastIndex() {
+		n.sendAppend(m.From, false)
+	}
+}
+
+func (n *Node) handleHeartbeatResponse(m Message) {
+	pr := n.progressOf(m.From)
+	if pr == nil {
+		return
+	}
+	pr.recentActive = true
+	//INFO: Entries may have been lost, they are sent again from the last one known to be replicated
+	if pr.match < n.log.lastIndex() {
+		pr.next = pr.match + 1
+		n.sendAppend(m.From, false)
+	}
+	if m.Context == 0 {
+		return
+	}
+	for _, read := range n.pendingReads {
+		if read.id <= m.Context {
+			read.acks[m.From] = true
+		}
+	}
+	for len(n.pendingReads) > 0 && len(n.pendingReads[0].acks) >= n.quorum() {
+		read := n.pendingReads[0]
+		n.pendingReads = n.pendingReads[1:]
+		n.readStates = append(n.readStates, ReadState{ID: read.id, Index: read.index})
+	}
+}
+
+func (n *Node) progressOf(id uint64) *progress {
+	if n.state != StateLeader {
+		return nil
+	}
+	return n.prs[id]
+}
+
+// Sends the entries the follower does not have, or the snapshot when they were compacted
+func (n *Node) sendAppend(to uint64, allowEmpty bool) {
+	pr := n.prs[to]
+	prev := pr.next - 1
+	prevTerm, ok := n.log.term(prev)
+	if !ok {
+		snapshot := n.snapshot
+		n.send(Message{Type: MsgSnap, To: to, Snapshot: &snapshot})
+		pr.next = snapshot.Index + 1
+		return
+	}
+	entries := n.log.slice(pr.next, min(n.log.lastIndex(), prev+maxAppendEntries))
+	if len(entries) == 0 && !allowEmpty {
+		return
+	}
+	n.send(Message{Type: MsgApp, To: to, Index: prev, LogTerm: prevTerm, Entries: entries, Commit: n.commit})
+	pr.next = prev + uint64(len(entries)) + 1
+}
+
+func (n *Node) broadcastAppend() {
+	for id := range n.prs {
+		if id != n.id {
+			n.sendAppend(id, true)
+		}
+	}
+}
+
+func (n *Node) broadcastHeartbeat(context uint64) {
+	for id, pr := range n.prs {
+		if id != n.id {
+			n.send(Message{Type: MsgHeartbeat, To: id, Commit: min(pr.match, n.commit), Context: context})
+		}
+	}
+}
+
+// Commits the entries a majority has, only counting the entries of the current term
+func (n *Node) maybeCommit() bool {
+	matches := make([]uint64, 0, len(n.peers))
+	for id := range n.peers {
+		if id == n.id {
+			matches = append(matches, n.log.lastIndex())
+		} else if pr := n.prs[id]; pr != nil {
+			matches = append(matches, pr.match)
+		} else {
+			matches = append(matches, 0)
+		}
+	}
+	if len(matches) == 0 {
+		return false
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	index := matches[n.quorum()-1]
+	if term, _ := n.log.term(index); index > n.commit && term == n.term {
+		n.commit = index
+		return true
+	}
+	return false
+}
+
+func (n *Node) appendEntry(e Entry) {
+	e.Term, e.Index = n.term, n.log.lastIndex()+1
+	n.log.entries = append(n.log.entries, e)
+	if pr := n.prs[n.id]; pr != nil {
+		pr.match, pr.next = e.Index, e.Index+1
+	}
+	n.maybeCommit()
+	n.broadcastAppend()
+}
+
+// Appends data to the log of the leader, returns the index and term of its entry
+func (n *Node) Propose(data []byte) (uint64, uint64, error) {
+	if n.state != StateLeader {
+		return 0, 0, ErrNotLeader
+	}
+	n.appendEntry(Entry{Type: EntryNormal, Data: data})
+	return n.log.lastIndex(), n.term, nil
+}
+
+// Proposes a change of the configuration, one at a time
+func (n *Node) ProposeConfChange(cc ConfChange) (uint64, uint64, error) {
+	if n.state != StateLeader {
+		return 0, 0, ErrNotLeader
+	}
+	if n.pendingConfIndex > n.applied {
+		return 0, 0, ErrConfChangePending
+	}
+	_, exists := n.peers[cc.NodeID]
+	switch {
+	case cc.NodeID == 0:
+		return 0, 0, ErrUnknownNode
+	case cc.Type == ConfChangeAddNode && exists:
+		return 0, 0, ErrNodeExists
+	case cc.Type == ConfChangeRemoveNode && !exists:
+		return 0, 0, ErrUnknownNode
+	}
+	n.appendEntry(Entry{Type: EntryConfChange, Data: cc.Marshal()})
+	n.pendingConfIndex = n.log.lastIndex()
+	return n.log.lastIndex(), n.term, nil
+}
+
+// Starts a linearizable read, its ReadState tells the index to apply before serving it
+func (n *Node) ReadIndex() (uint64, error) {
+	if n.state != StateLeader {
+		return 0, ErrNotLeader
+	}
+	if term, _ := n.log.term(n.commit); term != n.term {
+		return 0, ErrNotReady
+	}
+	n.lastReadID++
+	if n.quorum() == 1 {
+		n.readStates = append(n.readStates, ReadState{ID: n.lastReadID, Index: n.commit})
+		return n.lastReadID, nil
+	}
+	n.pendingReads = append(n.pendingReads, &pendingRead{id: n.lastReadID, index: n.commit, acks: map[uint64]bool{n.id: true}})
+	n.broadcastHeartbeat(n.lastReadID)
+	return n.lastReadID, nil
+}
+
+// Applies a configuration change once its entry is applied
+func (n *Node) applyConfChange(cc ConfChange) {
+	switch cc.Type {
+	case ConfChangeAddNode:
+		n.peers[cc.NodeID] = cc.Addr
+		if n.state == StateLeader && n.prs[cc.NodeID] == nil {
+			n.prs[cc.NodeID] = &progress{next: n.log.lastIndex() + 1, recentActive: true}
+			n.sendAppend(cc.NodeID, true)
+		}
+	case ConfChangeRemoveNode:
+		delete(n.peers, cc.NodeID)
+		if n.state != StateLeader {
+			return
+		}
+		delete(n.prs, cc.NodeID)
+		if cc.NodeID == n.id {
+			n.becomeFollower(n.term, 0)
+		} else if n.maybeCommit() {
+			//INFO: The majority is smaller, entries may be committed now
+			n.broadcastAppend()
+		}
+	}
+}
+
+// Returns what the node produced since the last call, the committed entries are then considered applied
+func (n *Node) Ready() Ready {
+	rd := Ready{Messages: n.msgs, Snapshot: n.pendingSnapshot, ReadStates: n.readStates}
+	n.msgs, n.pendingSnapshot, n.readStates = nil, nil, nil
+	if n.commit > n.applied {
+		rd.CommittedEntries = n.log.slice(n.applied+1, n.commit)
+		n.applied = n.commit
+		for _, e := range rd.CommittedEntries {
+			if e.Type == EntryConfChange {
+				var cc ConfChange
+				if cc.Unmarshal(e.Data) == nil {
+					n.applyConfChange(cc)
+				}
+			}
+		}
+		//INFO: Removing a node may have produced messages
+		rd.Messages = append(rd.Messages, n.msgs...)
+		n.msgs = nil
+	}
+	return rd
+}
+
+// Compacts the log up to index, which must be applied, into a snapshot of the state machine holding data
+func (n *Node) Compact(index uint64, data []byte) error {
+	if index > n.applied {
+		return errors.New("raft: compacting entries not applied")
+	}
+	term, ok := n.log.term(index)
+	if !ok || index <= n.snapshot.Index {
+		return ErrCompacted
+	}
+	//INFO: Compacting right after applying, the configuration is the one of the index
+	n.snapshot = Snapshot{Index: index, Term: term, Peers: copyPeers(n.peers), Data: data}
+	n.log.compact(index, term)
+	return nil
+}
+
+// State of the node, as reported by Status
+type Status struct {
+	ID            uint64
+	State         StateType
+	Term          uint64
+	Lead          uint64
+	Commit        uint64
+	Applied       uint64
+	LastIndex     uint64
+	SnapshotIndex uint64
+	//Nodes of the configuration and their address
+	Peers map[uint64]string
+	//Entries replicated on each node, only known by the leader
+	Match map[uint64]uint64
+}
+
+func (n *Node) Status() Status {
+	s := Status{
+		ID: n.id, State: n.state, Term: n.term, Lead: n.lead, Commit: n.commit, Applied: n.applied,
+		LastIndex: n.log.lastIndex(), SnapshotIndex: n.snapshot.Index, Peers: copyPeers(n.peers),
+	}
+	if n.state == StateLeader {
+		s.Match = map[uint64]uint64{}
+		for id, pr := range n.prs {
+			s.Match[id] = pr.match
+		}
+		s.Match[n.id] = n.log.lastIndex()
+	}
+	return s
+}
+
+func copyPeers(peers map[uint64]string) map[uint64]string {
+	c := make(map[uint64]string, len(peers))
+	for id, addr := range peers {
+		c[id] = addr
+	}
+	return c
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max(a, b uint64) uint64 {
+	if a > b {
+		return a
+	}
+	return b
+}
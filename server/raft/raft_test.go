@@ -0,0 +1,336 @@
+package raft
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Keeps the data of the entries applied
+type listMachine struct {
+	applied []string
+}
+
+func (sm *listMachine) Apply(e Entry) {
+	if e.Type == EntryNormal && len(e.Data) > 0 {
+		sm.applied = append(sm.applied, string(e.Data))
+	}
+}
+
+func (sm *listMachine) Snapshot() []byte {
+	return []byte(strings.Join(sm.applied, ","))
+}
+
+func (sm *listMachine) Restore(data []byte) {
+	sm.applied = nil
+	if len(data) > 0 {
+		sm.applied = strings.Split(string(data), ",")
+	}
+}
+
+func newTestMember(id uint64, peers map[uint64]string) *Member {
+	node := NewNode(Config{ID: id, Peers: peers, ElectionTick: 10, HeartbeatTick: 1, Rand: rand.New(rand.NewSource(int64(id)))})
+	return &Member{Node: node, SM: &listMachine{}}
+}
+
+// A network of nodes 1 to size
+func newTestCluster(size int) *Network {
+	peers := map[uint64]string{}
+	for id := uint64(1); id <= uint64(size); id++ {
+		peers[id] = fmt.Sprintf("node%d", id)
+	}
+	nw := NewNetwork()
+	for id := range peers {
+		nw.Add(newTestMember(id, peers))
+	}
+	return nw
+}
+
+func member(nw *Network, id uint64) *Member {
+	return nw.Peer(id).(*Member)
+}
+
+func applied(nw *Network, id uint64) []string {
+	return member(nw, id).SM.(*listMachine).applied
+}
+
+// The leader among the peers that are not stopped, 0 when there is none
+func leaderOf(nw *Network) uint64 {
+	for _, id := range nw.ids() {
+		if !nw.stopped[id] && member(nw, id).state == StateLeader {
+			return id
+		}
+	}
+	return 0
+}
+
+func electLeader(t *testing.T, nw *Network) *Member {
+	t.Helper()
+	if !nw.TickUntil(100, func() bool { return leaderOf(nw) != 0 }) {
+		t.Fatal("no leader was elected")
+	}
+	return member(nw, leaderOf(nw))
+}
+
+func propose(t *testing.T, m *Member, data string) {
+	t.Helper()
+	if _, _, err := m.Propose([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestElection(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	leaders := 0
+	for _, id := range nw.ids() {
+		m := member(nw, id)
+		if m.state == StateLeader {
+			leaders++
+		}
+		if m.term != leader.term || m.lead != leader.id {
+			t.Errorf("node %d is at term %d following %d", id, m.term, m.lead)
+		}
+	}
+	if leaders != 1 {
+		t.Errorf("%d leaders", leaders)
+	}
+	if _, _, err := member(nw, leader.id%3+1).Propose([]byte("x")); err != ErrNotLeader {
+		t.Errorf("a follower accepted a proposal: %v", err)
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	nw := newTestCluster(1)
+	leader := electLeader(t, nw)
+	propose(t, leader, "a")
+	nw.Flush()
+	if got := applied(nw, 1); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("applied %q", got)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	for i := 0; i < 200; i++ {
+		propose(t, leader, fmt.Sprint(i))
+	}
+	nw.Flush()
+	for _, id := range nw.ids() {
+		if got := applied(nw, id); len(got) != 200 || got[199] != "199" {
+			t.Errorf("node %d applied %d entries", id, len(got))
+		}
+	}
+}
+
+// The entries of an isolated leader are not committed, they are replaced by the ones of the new leader
+func TestLeaderFailure(t *testing.T) {
+	nw := newTestCluster(3)
+	old := electLeader(t, nw)
+	propose(t, old, "a")
+	nw.Flush()
+
+	nw.Isolate(old.id)
+	propose(t, old, "lost")
+	nw.Flush()
+	if !nw.TickUntil(100, func() bool { return leaderOf(nw) != old.id && leaderOf(nw) != 0 && old.state != StateLeader }) {
+		t.Fatal("no new leader, or the isolated leader did not step down")
+	}
+	leader := member(nw, leaderOf(nw))
+	propose(t, leader, "b")
+	nw.Flush()
+
+	nw.Heal()
+	nw.TickUntil(20, func() bool { return len(applied(nw, old.id)) == 2 })
+	for _, id := range nw.ids() {
+		if got := applied(nw, id); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("node %d applied %q", id, got)
+		}
+	}
+	if old.lead != leader.id || old.term != leader.term {
+		t.Errorf("the former leader follows %d at term %d", old.lead, old.term)
+	}
+}
+
+// A node that was partitioned does not disrupt the leader when it comes back
+func TestPartitionedFollowerDoesNotDisrupt(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	follower := member(nw, leader.id%3+1)
+	nw.Isolate(follower.id)
+	nw.TickUntil(100, func() bool { return follower.term > leader.term+2 })
+	term := leader.term
+
+	nw.Heal()
+	nw.TickUntil(30, func() bool { return false })
+	if leaderOf(nw) != leader.id || leader.term != term {
+		t.Errorf("the leader changed to %d at term %d", leaderOf(nw), leader.term)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	nw := newTestCluster(3)
+	for _, id := range nw.ids() {
+		member(nw, id).SnapshotEntries = 10
+	}
+	leader := electLeader(t, nw)
+	lagging := member(nw, leader.id%3+1)
+	nw.Stop(lagging.id)
+	for i := 0; i < 50; i++ {
+		propose(t, leader, fmt.Sprint(i))
+		nw.Flush()
+	}
+	if leader.snapshot.Index == 0 || leader.log.snapshotIndex != leader.snapshot.Index {
+		t.Fatalf("the log of the leader was not compacted")
+	}
+
+	nw.Start(lagging.id)
+	nw.TickUntil(20, func() bool { return len(applied(nw, lagging.id)) == 50 })
+	if got := applied(nw, lagging.id); !reflect.DeepEqual(got, applied(nw, leader.id)) {
+		t.Errorf("the lagging node applied %q", got)
+	}
+	propose(t, leader, "after")
+	nw.Flush()
+	if got := applied(nw, lagging.id); len(got) != 51 || got[50] != "after" {
+		t.Errorf("the lagging node applied %d entries", len(got))
+	}
+}
+
+func TestMembershipChange(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	propose(t, leader, "a")
+	nw.Flush()
+
+	//A new node starts empty and receives the log from the leader
+	nw.Add(newTestMember(4, nil))
+	if _, _, err := leader.ProposeConfChange(ConfChange{Type: ConfChangeAddNode, NodeID: 4, Addr: "node4"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := leader.ProposeConfChange(ConfChange{Type: ConfChangeRemoveNode, NodeID: 1}); err != ErrConfChangePending {
+		t.Errorf("a second change was accepted: %v", err)
+	}
+	nw.Flush()
+	added := member(nw, 4)
+	if !reflect.DeepEqual(applied(nw, 4), []string{"a"}) || len(added.peers) != 4 {
+		t.Errorf("the new node applied %q with peers %v", applied(nw, 4), added.peers)
+	}
+	if _, _, err := leader.ProposeConfChange(ConfChange{Type: ConfChangeAddNode, NodeID: 4}); err != ErrNodeExists {
+		t.Errorf("adding the node again: %v", err)
+	}
+
+	//The leader removes itself, the others elect a new leader among them
+	if _, _, err := leader.ProposeConfChange(ConfChange{Type: ConfChangeRemoveNode, NodeID: leader.id}); err != nil {
+		t.Fatal(err)
+	}
+	nw.Flush()
+	if leader.state == StateLeader {
+		t.Fatal("the removed leader is still leader")
+	}
+	if !nw.TickUntil(100, func() bool { return leaderOf(nw) != 0 }) {
+		t.Fatal("no leader after the removal")
+	}
+	newLeader := member(nw, leaderOf(nw))
+	propose(t, newLeader, "b")
+	nw.Flush()
+	for id := range newLeader.peers {
+		if got := applied(nw, id); !reflect.DeepEqual(got, []string{"a", "b"}) {
+			t.Errorf("node %d applied %q", id, got)
+		}
+	}
+	if _, ok := newLeader.peers[leader.id]; ok || len(newLeader.peers) != 3 {
+		t.Errorf("peers after the removal: %v", newLeader.peers)
+	}
+
+	//The removed node never starts an election
+	nw.TickUntil(50, func() bool { return false })
+	if leader.state != StateFollower || leaderOf(nw) != newLeader.id {
+		t.Errorf("the removed node disrupted the cluster")
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	propose(t, leader, "a")
+	nw.Flush()
+
+	id, err := leader.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw.Flush()
+	if !reflect.DeepEqual(leader.ReadStates, []ReadState{{ID: id, Index: leader.commit}}) {
+		t.Errorf("read states %v", leader.ReadStates)
+	}
+
+	//An isolated leader can not confirm the read, it is lost once it steps down
+	leader.ReadStates = nil
+	nw.Isolate(leader.id)
+	id, err = leader.ReadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nw.TickUntil(100, func() bool { return leader.state != StateLeader })
+	if !reflect.DeepEqual(leader.ReadStates, []ReadState{{ID: id, Lost: true}}) {
+		t.Errorf("read states %v", leader.ReadStates)
+	}
+	if _, err := leader.ReadIndex(); err != ErrNotLeader {
+		t.Errorf("a follower served a read: %v", err)
+	}
+}
+
+// Messages are lost, the entries are sent again
+func TestLostMessages(t *testing.T) {
+	nw := newTestCluster(3)
+	leader := electLeader(t, nw)
+	dropped := 0
+	nw.Filter = func(m Message) bool {
+		if m.Type == MsgApp && len(m.Entries) > 0 && dropped < 5 {
+			dropped++
+			return false
+		}
+		return true
+	}
+	for i := 0; i < 5; i++ {
+		propose(t, leader, fmt.Sprint(i))
+	}
+	nw.Flush()
+	nw.TickUntil(10, func() bool { return len(applied(nw, 1)) == 5 && len(applied(nw, 2)) == 5 && len(applied(nw, 3)) == 5 })
+	for _, id := range nw.ids() {
+		if got := applied(nw, id); len(got) != 5 {
+			t.Errorf("node %d applied %q", id, got)
+		}
+	}
+}
+
+func TestMessageEncoding(t *testing.T) {
+	cc := ConfChange{Type: ConfChangeRemoveNode, NodeID: 7, Addr: "10.0.0.1:17379"}
+	messages := []Message{
+		{Type: MsgVote, From: 1, To: 2, Term: 3, LogTerm: 2, Index: 10},
+		{Type: MsgAppResp, From: 2, To: 1, Term: 3, Index: 9, Reject: true, RejectHint: 4},
+		{Type: MsgApp, From: 1, To: 2, Term: 3, LogTerm: 2, Index: 10, Commit: 9, Entries: []Entry{
+			{Term: 3, Index: 11, Type: EntryNormal, Data: []byte("*1\r\n$4\r\nPING\r\n")},
+			{Term: 3, Index: 12, Type: EntryConfChange, Data: cc.Marshal()},
+		}},
+		{Type: MsgSnap, From: 1, To: 3, Term: 3, Snapshot: &Snapshot{Index: 12, Term: 3, Peers: map[uint64]string{1: "a:1", 2: "b:2"}, Data: []byte("state")}},
+		{Type: MsgHeartbeat, From: 1, To: 2, Term: 3, Commit: 5, Context: 42},
+	}
+	for _, m := range messages {
+		var decoded Message
+		if err := decoded.Unmarshal(m.Marshal()); err != nil || !reflect.DeepEqual(decoded, m) {
+			t.Errorf("decoded %+v, %v, expected %+v", decoded, err, m)
+		}
+	}
+	var decodedCC ConfChange
+	if err := decodedCC.Unmarshal(cc.Marshal()); err != nil || decodedCC != cc {
+		t.Errorf("decoded %+v, %v", decodedCC, err)
+	}
+	var m Message
+	if err := m.Unmarshal(messages[2].Marshal()[:20]); err == nil {
+		t.Error("a truncated message was decoded")
+	}
+}
@@ -0,0 +1,686 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/raft"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Raft mode, enabled by raft-id, replicates the dataset with the raft package (see raft/raft.go) on a cluster of
+nodes, the writes are committed to a majority of the nodes before they are applied:
+	- the write commands, EVAL, EVALSHA and the transactions do not run when they are received. The leader
+	  appends them to the raft log as an entry, every node applies the entries in the order of the log once
+	  a majority has them, and the client of the leader receives the reply of its command as it was applied.
+	  Command.EvalCommand refuses the writes that are not applied from the log.
+	- EVALSHA is appended as the EVAL of the script, the other nodes may not have it in their cache. WATCH is
+	  refused: whether a transaction runs must be decided the same way on every node.
+	- the read commands are linearizable, they run once the leader confirmed with a round of heartbeats that
+	  it still leads and applied the log up to its commit index at the time of the read
+	- the followers refuse the reads and the writes with -NOTLEADER <id> <raft address> of the leader, or
+	  -CLUSTERDOWN while no leader is known
+	- the nodes exchange the raft messages on the raft bus, at raft-addr, as RAFT.MESSAGE <message> commands
+	  and with TLS when tls-cluster is set. The raft bus is not authenticated, it must only be reachable by the
+	  nodes, or use TLS with client certificates.
+	- the log is kept in memory and compacted every raft-snapshot-entries applied entries into a snapshot of
+	  the dataset, the nodes that need the entries compacted receive the snapshot. A node that restarts starts
+	  empty, it must be removed and added again with a new id.
+	- RAFT ADDNODE <id> <raft address> and RAFT REMOVENODE <id> change the nodes of the cluster one at a time,
+	  a node joining the cluster starts with an empty raft-peers
+The node is guarded by raftMu, which can be taken holding execMu but not the reverse. A single goroutine ticks
+the node, processes what it produced and applies the committed entries holding execMu.
+*/
+
+const (
+	raftTickPeriod = 100 * time.Millisecond
+	//Ticks without hearing from the leader before an election, and between the heartbeats of the leader
+	raftElectionTicks  = 10
+	raftHeartbeatTicks = 1
+	//How long a client waits for its write to be applied or its read to be confirmed
+	raftTimeout = 5 * time.Second
+	//Messages waiting to be sent to each node, the messages sent to a node that does not keep up are dropped
+	raftOutboundQueueLen = 1024
+)
+
+// A write appended to the log by a client of the leader, replied once it was applied
+type raftProposal struct {
+	term   uint64
+	client *Client
+	done   chan []byte
+}
+
+// A read waiting for the leader to confirm it leads, ready once the log is applied up to index
+type raftRead struct {
+	index     uint64
+	confirmed bool
+	lost      bool
+	ready     chan struct{}
+}
+
+// The link to the raft bus of a node, the messages are sent in order by its goroutine
+type raftLink struct {
+	addr  string
+	queue chan []byte
+	stop  chan struct{}
+}
+
+var (
+	raftMu sync.Mutex
+	//The node of the server, nil when raft mode is disabled. Guarded by raftMu.
+	raftNode *raft.Node
+
+	//Signalled to process what the node produced
+	raftWake = make(chan struct{}, 1)
+	//Closed to stop the goroutine of the node and the raft bus, raftDone once the goroutine returned
+	raftStop     chan struct{}
+	raftDone     chan struct{}
+	raftListener net.Listener
+
+	//The proposals of the clients by index, the reads by id and the last entry applied, guarded by execMu
+	raftProposals = map[uint64]*raftProposal{}
+	raftReads     = map[uint64]*raftRead{}
+	raftApplied   uint64
+	//The entry the log was last compacted at, guarded by execMu
+	raftSnapshotIndex uint64
+	//Set while the entries of the log are applied
+	applyingRaftLog bool
+
+	//The links to the other nodes and their address, only used by the goroutine of the node
+	raftLinks = map[uint64]*raftLink{}
+	raftAddrs map[uint64]string
+
+	errRaftDisabled    = errors.New("ERR This instance has raft mode disabled")
+	errRaftNotApplied  = errors.New("ERR In raft mode writes are only applied from the raft log")
+	errRaftWatch       = errors.New("ERR WATCH is not supported in raft mode")
+	errRaftReplicaOf   = errors.New("ERR REPLICAOF is not allowed in raft mode")
+	errRaftNoLeader    = errors.New("CLUSTERDOWN No raft leader is known")
+	errRaftNotReady    = errors.New("TRYAGAIN The raft leader did not commit an entry of its term yet")
+	errRaftTimeout     = errors.New("TIMEOUT The raft cluster did not answer in time")
+	errRaftLost        = errors.New("TRYAGAIN The raft leader changed before the command was committed")
+	errRaftInvalidNode = errors.New("ERR Invalid raft node id")
+)
+
+// Parses raft-peers, "id=host:port,..."
+func parseRaftPeers(s string) (map[uint64]string, error) {
+	peers := map[uint64]string{}
+	for _, peer := range strings.Split(s, ",") {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		parts := strings.SplitN(peer, "=", 2)
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || id == 0 || len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid raft peer %q, expected id=host:port", peer)
+		}
+		peers[id] = parts[1]
+	}
+	return peers, nil
+}
+
+func newRaftNode(id uint64, peers map[uint64]string) *raft.Node {
+	return raft.NewNode(raft.Config{ID: id, Peers: peers, ElectionTick: raftElectionTicks, HeartbeatTick: raftHeartbeatTicks})
+}
+
+// Starts the raft node configured by raft-id, its raft bus and its goroutine
+func startRaft() error {
+	if config.RaftID == 0 {
+		return nil
+	}
+	//INFO: The raft log is in memory, a node replaying its append only file would apply the log a second time
+	if config.AppendOnly {
+		return errors.New("appendonly can not be used in raft mode")
+	}
+	if config.ReplicaOf != "" {
+		return errors.New("replicaof can not be used in raft mode")
+	}
+	peers, err := parseRaftPeers(config.RaftPeers)
+	if err != nil {
+		return err
+	}
+	addr := config.RaftAddr
+	if addr == "" {
+		if addr = peers[config.RaftID]; addr == "" {
+			return errors.New("raft-addr must be set for a node that is not in raft-peers")
+		}
+	}
+	listener, err := listenBus(addr)
+	if err != nil {
+		return err
+	}
+
+	raftMu.Lock()
+	raftNode = newRaftNode(config.RaftID, peers)
+	raftMu.Unlock()
+	raftAddrs, raftListener, raftStop, raftDone = peers, listener, make(chan struct{}), make(chan struct{})
+	log.Printf("Raft node %d listening on %s", config.RaftID, addr)
+	go acceptRaftConns(listener)
+	go runRaft(raftStop, raftDone)
+	return nil
+}
+
+// Stops the raft node, its raft bus and its goroutine
+func stopRaft() {
+	if raftStop != nil {
+		close(raftStop)
+		<-raftDone
+		raftListener.Close()
+		raftStop, raftDone, raftListener = nil, nil, nil
+	}
+	for id, link := range raftLinks {
+		close(link.stop)
+		delete(raftLinks, id)
+	}
+	raftAddrs = nil
+	raftMu.Lock()
+	raftNode = nil
+	raftMu.Unlock()
+}
+
+func acceptRaftConns(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go serveRaftConn(conn)
+	}
+}
+
+// Steps the messages received from a node until it closes the connection
+func serveRaftConn(conn net.Conn) {
+	defer conn.Close()
+	rd := response.NewReader(conn)
+	for {
+		args, _, err := rd.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				log.Println("Error reading from the raft bus:", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		var m raft.Message
+		if len(args) != 2 || !strings.EqualFold(args[0], "raft.message") {
+			log.Println("Unexpected command on the raft bus:", conn.RemoteAddr(), args[0])
+			return
+		}
+		if err := m.Unmarshal([]byte(args[1])); err != nil {
+			log.Println("Invalid raft message:", conn.RemoteAddr(), err)
+			return
+		}
+		raftStep(m)
+		raftWakeUp()
+	}
+}
+
+func raftWakeUp() {
+	select {
+	case raftWake <- struct{}{}:
+	default:
+	}
+}
+
+func runRaft(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(raftTickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			raftTick()
+		case <-raftWake:
+		}
+		raftSend(raftAdvance())
+	}
+}
+
+func raftStep(m raft.Message) {
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	if raftNode != nil && m.To == config.RaftID {
+		raftNode.Step(m)
+	}
+}
+
+func raftTick() {
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	raftNode.Tick()
+}
+
+/**
+Applies what the node produced: the snapshot received from the leader, the committed entries and the reads
+confirmed, then compacts the log when raft-snapshot-entries were applied since the last snapshot. Returns the
+messages to send.
+*/
+func raftAdvance() []raft.Message {
+	raftMu.Lock()
+	rd := raftNode.Ready()
+	raftMu.Unlock()
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	if rd.Snapshot != nil {
+		keys, err := parseSnapshot(rd.Snapshot.Data)
+		if err != nil {
+			//INFO: The snapshot comes from the leader, it can only be invalid when the nodes run different versions
+			log.Println("Error loading the raft snapshot:", err)
+			keys = map[string]interface{}{}
+		}
+		loadDataset(keys)
+		raftApplied, raftSnapshotIndex = rd.Snapshot.Index, rd.Snapshot.Index
+	}
+	for _, e := range rd.CommittedEntries {
+		raftApplyEntry(e)
+	}
+	for _, rs := range rd.ReadStates {
+		if read := raftReads[rs.ID]; read != nil {
+			read.confirmed, read.lost, read.index = true, rs.Lost, rs.Index
+		}
+	}
+	for id, read := range raftReads {
+		if read.confirmed && (read.lost || read.index <= raftApplied) {
+			close(read.ready)
+			delete(raftReads, id)
+		}
+	}
+
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	if rd.Snapshot != nil || len(rd.CommittedEntries) > 0 {
+		raftAddrs = raftNode.Status().Peers
+	}
+	if config.RaftSnapshotEntries > 0 && raftApplied-raftSnapshotIndex >= uint64(config.RaftSnapshotEntries) {
+		if err := raftNode.Compact(raftApplied, createSnapshot()); err == nil {
+			raftSnapshotIndex = raftApplied
+		}
+	}
+	return rd.Messages
+}
+
+// Applies a committed entry and replies to the client that proposed it, must be called holding execMu
+func raftApplyEntry(e raft.Entry) {
+	raftApplied = e.Index
+	p := raftProposals[e.Index]
+	delete(raftProposals, e.Index)
+	//INFO: Another leader replaced the entry of the proposal
+	if p != nil && p.term != e.Term {
+		p.done <- response.EncodeError(errRaftLost)
+		p = nil
+	}
+
+	var reply []byte
+	switch {
+	case e.Type == raft.EntryConfChange:
+		reply = response.Encode("OK", true)
+	case len(e.Data) > 0:
+		var c *Client
+		if p != nil {
+			c = p.client
+		}
+		reply = raftApplyCommands(e.Data, c)
+	}
+	if p != nil {
+		p.done <- reply
+	}
+}
+
+// Runs the commands of an entry, a transaction when they start with MULTI, and returns the reply
+func raftApplyCommands(data []byte, c *Client) []byte {
+	var cmds []*Command
+	rd := response.NewReader(bytes.NewReader(data))
+	for {
+		args, _, err := rd.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Println("Error decoding a raft entry:", err)
+			return response.EncodeError(fmt.Errorf("ERR invalid raft entry: %v", err))
+		}
+		cmds = append(cmds, &Command{Cmd: args[0], Args: args[1:]})
+	}
+	if len(cmds) == 0 {
+		return nil
+	}
+
+	currentClient, applyingRaftLog = c, true
+	defer func() { currentClient, applyingRaftLog = nil, false }()
+	if c != nil {
+		defer func() { c.woff = masterReplOffset }()
+	}
+	if cmds[0].name() != COMMAND_MULTI {
+		return evalCommand(cmds[0])
+	}
+	//INFO: The transaction is MULTI, the queued commands and EXEC
+	beginPropagation()
+	defer endPropagation()
+	replies := make([][]byte, 0, len(cmds)-2)
+	for _, cmd := range cmds[1 : len(cmds)-1] {
+		replies = append(replies, evalCommand(cmd))
+	}
+	return response.EncodeArray(replies)
+}
+
+// Sends the messages on the raft bus, to the address of their node
+func raftSend(msgs []raft.Message) {
+	for _, m := range msgs {
+		link := raftLinks[m.To]
+		if link != nil && link.addr != raftAddrs[m.To] {
+			close(link.stop)
+			delete(raftLinks, m.To)
+			link = nil
+		}
+		if link == nil {
+			addr, ok := raftAddrs[m.To]
+			if !ok {
+				continue
+			}
+			link = &raftLink{addr: addr, queue: make(chan []byte, raftOutboundQueueLen), stop: make(chan struct{})}
+			raftLinks[m.To] = link
+			go link.run()
+		}
+		select {
+		case link.queue <- (&Command{Cmd: "RAFT.MESSAGE", Args: []string{string(m.Marshal())}}).encode():
+		default:
+			//INFO: The message is dropped, raft sends the entries again
+		}
+	}
+}
+
+// Writes the messages queued to the node, connecting again when the connection is lost
+func (l *raftLink) run() {
+	var conn net.Conn
+	connected := true
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case data := <-l.queue:
+			if conn == nil {
+				var err error
+				if conn, err = dialBus(l.addr, raftTickPeriod*raftElectionTicks); err != nil {
+					//INFO: Logged once, the node is dialed for every message while it is down
+					if connected {
+						log.Println("Error connecting to the raft bus of", l.addr, err)
+					}
+					connected = false
+					continue
+				}
+				connected = true
+			}
+			conn.SetWriteDeadline(time.Now().Add(raftTickPeriod * raftElectionTicks))
+			if _, err := conn.Write(data); err != nil {
+				conn.Close()
+				conn = nil
+			}
+		}
+	}
+}
+
+// Converts an error of the node for the client, must be called holding raftMu
+func raftError(err error) error {
+	switch err {
+	case nil:
+		return nil
+	case raft.ErrNotLeader:
+		status := raftNode.Status()
+		if status.Lead == 0 {
+			return errRaftNoLeader
+		}
+		return fmt.Errorf("NOTLEADER %d %s", status.Lead, status.Peers[status.Lead])
+	case raft.ErrNotReady:
+		return errRaftNotReady
+	}
+	return fmt.Errorf("ERR %v", err)
+}
+
+// Refuses the writes that are not applied from the raft log, must be called holding execMu
+func checkRaftApply(cmd *Command) error {
+	if raftNode == nil || applyingRaftLog || applyingMasterStream {
+		return nil
+	}
+	if commandTable[cmd.name()].flags&CMD_FLAG_WRITE != 0 {
+		return errRaftNotApplied
+	}
+	return nil
+}
+
+// Runs the command in raft mode, returns false for the commands that run like outside raft mode
+func (c *Client) raftCommand(cmd *Command) bool {
+	name := cmd.name()
+	switch {
+	case name == COMMAND_RAFT:
+		c.raftConfChange(cmd)
+	case name == COMMAND_WATCH:
+		c.reject(cmd, errRaftWatch)
+	case name == COMMAND_REPLICAOF:
+		c.reject(cmd, errRaftReplicaOf)
+	case name == COMMAND_EXEC:
+		if !c.inMulti {
+			return false
+		}
+		c.raftExec(cmd)
+	case name == COMMAND_EVAL || name == COMMAND_EVALSHA || commandTable[name].flags&CMD_FLAG_WRITE != 0:
+		c.raftWrite(cmd)
+	case name == COMMAND_EVAL_RO || commandTable[name].flags&CMD_FLAG_READONLY != 0:
+		c.raftRead(cmd)
+	default:
+		return false
+	}
+	return true
+}
+
+// Encodes the command for the log, EVALSHA is encoded as the EVAL of its script. Must be called holding execMu.
+func raftEncode(cmd *Command) ([]byte, error) {
+	if cmd.name() != COMMAND_EVALSHA {
+		return cmd.encode(), nil
+	}
+	sha := strings.ToLower(cmd.Args[0])
+	script := scriptCache[sha]
+	if script == nil {
+		return nil, errNoScript
+	}
+	args := append([]string{script.body}, cmd.Args[1:]...)
+	return (&Command{Cmd: "EVAL", Args: args}).encode(), nil
+}
+
+func (c *Client) raftWrite(cmd *Command) {
+	if err := cmd.checkArity(); err != nil {
+		c.reject(cmd, err)
+		return
+	}
+	if !lockExecMu(c, cmd) {
+		return
+	}
+	data, err := raftEncode(cmd)
+	if err != nil {
+		execMu.Unlock()
+		c.reject(cmd, err)
+		return
+	}
+	c.raftPropose(cmd, func(n *raft.Node) (uint64, uint64, error) { return n.Propose(data) })
+}
+
+// Appends the transaction to the log as MULTI, the queued commands and EXEC
+func (c *Client) raftExec(cmd *Command) {
+	if !lockExecMu(c, cmd) {
+		return
+	}
+	if c.multiError || len(c.multiQueue) == 0 {
+		reply := c.exec()
+		execMu.Unlock()
+		c.write(reply)
+		return
+	}
+	data := (&Command{Cmd: "MULTI"}).encode()
+	for _, queued := range c.multiQueue {
+		encoded, err := raftEncode(queued)
+		if err != nil {
+			c.resetMulti()
+			execMu.Unlock()
+			c.reject(cmd, err)
+			return
+		}
+		data = append(data, encoded...)
+	}
+	data = append(data, cmd.encode()...)
+	c.resetMulti()
+	c.raftPropose(cmd, func(n *raft.Node) (uint64, uint64, error) { return n.Propose(data) })
+}
+
+// RAFT ADDNODE <id> <address> | REMOVENODE <id>
+func (c *Client) raftConfChange(cmd *Command) {
+	if err := cmd.checkArity(); err != nil {
+		c.reject(cmd, err)
+		return
+	}
+	var cc raft.ConfChange
+	switch sub := strings.ToLower(cmd.Args[0]); {
+	case sub == "addnode" && len(cmd.Args) == 3:
+		cc = raft.ConfChange{Type: raft.ConfChangeAddNode, Addr: cmd.Args[2]}
+	case sub == "removenode" && len(cmd.Args) == 2:
+		cc = raft.ConfChange{Type: raft.ConfChangeRemoveNode}
+	default:
+		c.reject(cmd, fmt.Errorf("ERR unknown subcommand or wrong number of arguments for '%s'. Try ADDNODE or REMOVENODE.", cmd.Args[0]))
+		return
+	}
+	id, err := strconv.ParseUint(cmd.Args[1], 10, 64)
+	if err != nil || id == 0 {
+		c.reject(cmd, errRaftInvalidNode)
+		return
+	}
+	cc.NodeID = id
+	if !lockExecMu(c, cmd) {
+		return
+	}
+	c.raftPropose(cmd, func(n *raft.Node) (uint64, uint64, error) { return n.ProposeConfChange(cc) })
+}
+
+// Proposes an entry and replies once it was applied, must be called holding execMu which it releases
+func (c *Client) raftPropose(cmd *Command, propose func(n *raft.Node) (uint64, uint64, error)) {
+	raftMu.Lock()
+	index, term, err := propose(raftNode)
+	err = raftError(err)
+	raftMu.Unlock()
+	if err != nil {
+		execMu.Unlock()
+		c.reject(cmd, err)
+		return
+	}
+	p := &raftProposal{term: term, client: c, done: make(chan []byte, 1)}
+	raftProposals[index] = p
+	execMu.Unlock()
+	raftWakeUp()
+
+	timer := time.NewTimer(raftTimeout)
+	defer timer.Stop()
+	select {
+	case reply := <-p.done:
+		if reply != nil {
+			c.write(reply)
+		}
+	case <-timer.C:
+		execMu.Lock()
+		if raftProposals[index] == p {
+			delete(raftProposals, index)
+		}
+		execMu.Unlock()
+		c.reject(cmd, errRaftTimeout)
+	}
+}
+
+// Runs the read once the leader confirmed it leads and applied the log up to its commit index
+func (c *Client) raftRead(cmd *Command) {
+	if !lockExecMu(c, cmd) {
+		return
+	}
+	raftMu.Lock()
+	id, err := raftNode.ReadIndex()
+	err = raftError(err)
+	raftMu.Unlock()
+	if err != nil {
+		execMu.Unlock()
+		c.reject(cmd, err)
+		return
+	}
+	read := &raftRead{ready: make(chan struct{})}
+	raftReads[id] = read
+	execMu.Unlock()
+	raftWakeUp()
+
+	timer := time.NewTimer(raftTimeout)
+	defer timer.Stop()
+	select {
+	case <-read.ready:
+	case <-timer.C:
+		execMu.Lock()
+		delete(raftReads, id)
+		execMu.Unlock()
+		c.reject(cmd, errRaftTimeout)
+		return
+	}
+	if read.lost {
+		c.reject(cmd, errRaftLost)
+		return
+	}
+	respondAsyncClient(c, cmd)
+}
+
+// RAFT is run by raftCommand in raft mode
+func (cmd *Command) evalRAFT() ([]byte, error) {
+	return nil, errRaftDisabled
+}
+
+// Lines of INFO raft, must be called holding execMu
+func infoRaft() []string {
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	if raftNode == nil {
+		return []string{"raft_enabled:0"}
+	}
+	s := raftNode.Status()
+	lines := []string{
+		"raft_enabled:1",
+		fmt.Sprintf("raft_node_id:%d", s.ID),
+		"raft_state:" + s.State.String(),
+		fmt.Sprintf("raft_term:%d", s.Term),
+		fmt.Sprintf("raft_leader_id:%d", s.Lead),
+		fmt.Sprintf("raft_commit_index:%d", s.Commit),
+		fmt.Sprintf("raft_applied_index:%d", raftApplied),
+		fmt.Sprintf("raft_last_index:%d", s.LastIndex),
+		fmt.Sprintf("raft_snapshot_index:%d", s.SnapshotIndex),
+		fmt.Sprintf("raft_nodes:%d", len(s.Peers)),
+	}
+	ids := make([]uint64, 0, len(s.Peers))
+	for id := range s.Peers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		line := fmt.Sprintf("node%d:addr=%s", id, s.Peers[id])
+		if match, ok := s.Match[id]; ok {
+			line += fmt.Sprintf(",match=%d", match)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/raft"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// The server as a peer of a raft.Network, its node is driven by the test instead of its goroutine
+type testRaftPeer struct{}
+
+func (testRaftPeer) ID() uint64              { return config.RaftID }
+func (testRaftPeer) Step(m raft.Message)     { raftStep(m) }
+func (testRaftPeer) Tick()                   { raftTick() }
+func (testRaftPeer) Advance() []raft.Message { return raftAdvance() }
+
+// Records the entries applied by the nodes that are not the server, Snapshot returns the snapshot it is given
+type testStateMachine struct {
+	entries  []string
+	snapshot []byte
+}
+
+func (sm *testStateMachine) Apply(e raft.Entry) {
+	if e.Type == raft.EntryNormal && len(e.Data) > 0 {
+		sm.entries = append(sm.entries, string(e.Data))
+	}
+}
+
+func (sm *testStateMachine) Snapshot() []byte {
+	return sm.snapshot
+}
+
+func (sm *testStateMachine) Restore(data []byte) {
+	sm.entries, sm.snapshot = nil, data
+}
+
+// The server, node 1, and the nodes 2 and 3 ticked in the background like by the goroutine of a node
+type testRaftCluster struct {
+	t  *testing.T
+	mu sync.Mutex
+	nw *raft.Network
+}
+
+var testRaftPeers = map[uint64]string{1: "node1", 2: "node2", 3: "node3"}
+
+func newTestRaftMember(id uint64, peers map[uint64]string, electionTick int) *raft.Member {
+	node := raft.NewNode(raft.Config{ID: id, Peers: peers, ElectionTick: electionTick, HeartbeatTick: 1, Rand: rand.New(rand.NewSource(int64(id)))})
+	return &raft.Member{Node: node, SM: &testStateMachine{}}
+}
+
+// Starts the cluster, the other nodes wait electionTick ticks before an election and the server raftElectionTicks
+func startTestRaft(t *testing.T, electionTick int) *testRaftCluster {
+	config.RaftID = 1
+	raftMu.Lock()
+	raftNode = newRaftNode(1, testRaftPeers)
+	raftMu.Unlock()
+
+	cl := &testRaftCluster{t: t, nw: raft.NewNetwork(testRaftPeer{})}
+	for _, id := range []uint64{2, 3} {
+		cl.nw.Add(newTestRaftMember(id, testRaftPeers, electionTick))
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				cl.mu.Lock()
+				cl.nw.Tick()
+				cl.mu.Unlock()
+			case <-raftWake:
+				cl.mu.Lock()
+				cl.nw.Flush()
+				cl.mu.Unlock()
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		<-done
+	})
+	return cl
+}
+
+func (cl *testRaftCluster) member(id uint64) *raft.Member {
+	return cl.nw.Peer(id).(*raft.Member)
+}
+
+// Waits until done returns true, it is called holding the lock of the cluster
+func (cl *testRaftCluster) waitFor(what string, done func() bool) {
+	cl.t.Helper()
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		cl.mu.Lock()
+		ok := done()
+		cl.mu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			cl.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func serverRaftStatus() raft.Status {
+	raftMu.Lock()
+	defer raftMu.Unlock()
+	return raftNode.Status()
+}
+
+// Waits until the server knows a leader with an entry of its term committed, and applied it
+func (cl *testRaftCluster) waitLeader() uint64 {
+	cl.t.Helper()
+	var lead uint64
+	cl.waitFor("a leader", func() bool {
+		s := serverRaftStatus()
+		execMu.Lock()
+		applied := raftApplied
+		execMu.Unlock()
+		if s.Lead == 0 || s.Lead != 1 && cl.member(s.Lead).Status().State != raft.StateLeader {
+			return false
+		}
+		lead = s.Lead
+		return s.Commit == s.LastIndex && applied == s.Commit
+	})
+	return lead
+}
+
+func hasKey(key string) bool {
+	execMu.Lock()
+	defer execMu.Unlock()
+	_, ok := keyspace[key]
+	return ok
+}
+
+func encodeCommands(cmds ...[]string) string {
+	var b strings.Builder
+	for _, args := range cmds {
+		b.Write((&Command{Cmd: args[0], Args: args[1:]}).encode())
+	}
+	return b.String()
+}
+
+func TestRaftLeader(t *testing.T) {
+	setupTestServer(t)
+	cl := startTestRaft(t, 50)
+	if lead := cl.waitLeader(); lead != 1 {
+		t.Fatalf("node %d was elected", lead)
+	}
+	c := connect(t)
+	queued := response.SimpleString("QUEUED")
+	script := "return redis.call('sim.add', KEYS[1], ARGV[1])"
+
+	c.expect(int64(1), "SIM.ADD", "a", "x", "y")
+	c.expect("1", "SIM.JACCARD", "a", "a")
+	c.expect(replyOK, "MULTI")
+	c.expect(queued, "SIM.ADD", "b", "x", "y")
+	c.expect(queued, "SIM.JACCARD", "a", "b")
+	c.expect(array(int64(1), "1"), "EXEC")
+	sha := c.do("SCRIPT", "LOAD", script).(string)
+	c.expect(int64(1), "EVALSHA", sha, "1", "c", "x")
+	c.expectError("NOSCRIPT", "EVALSHA", strings.Repeat("0", 40), "0")
+	c.expectError("ERR WATCH is not supported in raft mode", "WATCH", "a")
+	c.expectError("ERR wrong number of arguments", "SIM.ADD", "a")
+
+	//Every node applied the same commands, EVALSHA as the EVAL of its script
+	expected := []string{
+		encodeCommands([]string{"SIM.ADD", "a", "x", "y"}),
+		encodeCommands([]string{"MULTI"}, []string{"SIM.ADD", "b", "x", "y"}, []string{"SIM.JACCARD", "a", "b"}, []string{"EXEC"}),
+		encodeCommands([]string{"EVAL", script, "1", "c", "x"}),
+	}
+	for _, id := range []uint64{2, 3} {
+		sm := cl.member(id).SM.(*testStateMachine)
+		cl.waitFor("the entries to be applied", func() bool { return len(sm.entries) == len(expected) })
+		cl.mu.Lock()
+		if !reflect.DeepEqual(sm.entries, expected) {
+			t.Errorf("node %d applied %q", id, sm.entries)
+		}
+		cl.mu.Unlock()
+	}
+
+	//The writes that do not come from the log are refused
+	execMu.Lock()
+	reply := evalCommand(&Command{Cmd: "SIM.ADD", Args: []string{"d", "x"}})
+	execMu.Unlock()
+	if !strings.HasPrefix(string(reply), "-ERR In raft mode writes are only applied from the raft log") {
+		t.Errorf("a write outside the log replied %q", reply)
+	}
+
+	info := c.do("INFO", "raft").(string)
+	for _, line := range []string{"raft_enabled:1", "raft_node_id:1", "raft_state:leader", "raft_leader_id:1", "raft_nodes:3", "node2:addr=node2,match="} {
+		if !strings.Contains(info, line) {
+			t.Errorf("INFO raft has no %q: %s", line, info)
+		}
+	}
+}
+
+func TestRaftFollower(t *testing.T) {
+	setupTestServer(t)
+	cl := startTestRaft(t, 2)
+	lead := cl.waitLeader()
+	if lead == 1 {
+		t.Fatal("the server was elected")
+	}
+	c := connect(t)
+	notLeader := "NOTLEADER " + testRaftPeers[lead][len("node"):] + " " + testRaftPeers[lead]
+	c.expectError(notLeader, "SIM.ADD", "a", "x")
+	c.expectError(notLeader, "SIM.JACCARD", "a", "a")
+	c.expectError(notLeader, "RAFT", "REMOVENODE", "2")
+	c.expect(replyPONG, "PING")
+
+	//The entries of the leader are applied by the server
+	cl.mu.Lock()
+	if _, _, err := cl.member(lead).Propose([]byte(encodeCommands([]string{"SIM.ADD", "a", "x"}))); err != nil {
+		t.Fatal(err)
+	}
+	cl.mu.Unlock()
+	cl.waitFor("the entry to be applied", func() bool { return hasKey("a") })
+}
+
+// A server that missed the compacted entries receives the snapshot of the leader
+func TestRaftFollowerSnapshot(t *testing.T) {
+	setupTestServer(t)
+	cl := startTestRaft(t, 2)
+	lead := cl.waitLeader()
+
+	execMu.Lock()
+	applyingRaftLog = true
+	evalCommand(&Command{Cmd: "SIM.ADD", Args: []string{"a", "x"}})
+	applyingRaftLog = false
+	snapshot := createSnapshot()
+	keyspace = map[string]interface{}{}
+	execMu.Unlock()
+
+	cl.mu.Lock()
+	cl.nw.Stop(1)
+	leader := cl.member(lead)
+	leader.SM.(*testStateMachine).snapshot = snapshot
+	leader.SnapshotEntries = 1
+	for i := 0; i < 10; i++ {
+		leader.Propose([]byte(encodeCommands([]string{"SIM.ADD", "ignored", "x"})))
+		cl.nw.Flush()
+	}
+	if leader.Status().SnapshotIndex == 0 {
+		t.Fatal("the leader did not compact its log")
+	}
+	leader.Propose([]byte(encodeCommands([]string{"SIM.ADD", "b", "x"})))
+	cl.nw.Start(1)
+	cl.mu.Unlock()
+
+	cl.waitFor("the snapshot and the entry after it to be applied", func() bool { return hasKey("a") && hasKey("b") })
+	if hasKey("ignored") {
+		t.Error("the entries compacted were applied")
+	}
+}
+
+func TestRaftMembership(t *testing.T) {
+	setupTestServer(t)
+	config.RaftSnapshotEntries = 2
+	cl := startTestRaft(t, 50)
+	cl.waitLeader()
+	c := connect(t)
+	for _, key := range []string{"a", "b", "c"} {
+		c.expect(int64(1), "SIM.ADD", key, "x")
+	}
+
+	//The new node receives the snapshot of the server, the entries were compacted
+	cl.mu.Lock()
+	cl.nw.Add(newTestRaftMember(4, nil, 50))
+	cl.mu.Unlock()
+	c.expect(replyOK, "RAFT", "ADDNODE", "4", "node4")
+	sm := cl.member(4).SM.(*testStateMachine)
+	cl.waitFor("the snapshot to be sent", func() bool { return sm.snapshot != nil })
+	keys, err := parseSnapshot(sm.snapshot)
+	if err != nil || len(keys) != 3 {
+		t.Errorf("the new node restored %v, %v", keys, err)
+	}
+
+	c.expectError("ERR raft: the node is already part of the cluster", "RAFT", "ADDNODE", "4", "node4")
+	c.expectError("ERR Invalid raft node id", "RAFT", "REMOVENODE", "0")
+	c.expectError("ERR unknown subcommand", "RAFT", "NODES", "1")
+	c.expect(replyOK, "RAFT", "REMOVENODE", "3")
+	if info := c.do("INFO", "raft").(string); !strings.Contains(info, "raft_nodes:3") || strings.Contains(info, "node3:") {
+		t.Errorf("INFO raft after the removal: %s", info)
+	}
+	c.expect(int64(1), "SIM.ADD", "d", "x")
+}
+
+// The messages go through the raft bus of the nodes
+func TestRaftBus(t *testing.T) {
+	setupTestServer(t)
+	config.RaftID = 1
+	raftMu.Lock()
+	raftNode = newRaftNode(1, testRaftPeers)
+	raftMu.Unlock()
+	bus, err := listenBus("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Close()
+	go acceptRaftConns(bus)
+	node2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node2.Close()
+	raftAddrs = map[uint64]string{1: bus.Addr().String(), 2: node2.Addr().String()}
+
+	//A heartbeat of node 2, sent to the bus of the server, makes the server follow it
+	raftSend([]raft.Message{{Type: raft.MsgHeartbeat, From: 2, To: 1, Term: 5}})
+	deadline := time.Now().Add(testReplyTimeout)
+	for s := serverRaftStatus(); s.Lead != 2 || s.Term != 5; s = serverRaftStatus() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the server did not receive the heartbeat: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	//The server answers on its link to node 2
+	raftSend(raftAdvance())
+	conn, err := node2.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	args, _, err := response.NewReader(conn).ReadCommand()
+	if err != nil || len(args) != 2 || args[0] != "RAFT.MESSAGE" {
+		t.Fatalf("node 2 received %q, %v", args, err)
+	}
+	var m raft.Message
+	if err := m.Unmarshal([]byte(args[1])); err != nil || m.Type != raft.MsgHeartbeatResp || m.From != 1 || m.To != 2 || m.Term != 5 {
+		t.Errorf("node 2 received %+v, %v", m, err)
+	}
+}
+
+func TestRaftDisabled(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expectError("ERR This instance has raft mode disabled", "RAFT", "ADDNODE", "2", "node2")
+	if info := c.do("INFO", "raft").(string); !strings.Contains(info, "raft_enabled:0") {
+		t.Errorf("INFO raft: %s", info)
+	}
+}
@@ -0,0 +1,476 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+REPLICAOF host port makes the server a replica of the master at host:port, REPLICAOF NO ONE makes it a master
+again keeping its dataset. The replica keeps a link to its master (see replication.go for the side of the master):
+	- it connects, with TLS when tls-replication is set, PINGs the master, authenticates with masteruser and
+	  masterauth, tells its port with REPLCONF listening-port and sends PSYNC <replid> <offset> to continue
+	  the stream it has, or PSYNC ? -1 when it has none
+	- the master replies +CONTINUE <replid> when it can continue the stream from its backlog, or +FULLRESYNC
+	  <replid> <offset> and a snapshot. The dataset of the replica is then replaced by the snapshot.
+	- then the write stream of the master is applied as it comes. It is read with response.Reader, the stream
+	  is not split in reads like the commands of clients. The stream is forwarded to the replicas of the replica
+	  as it was received so that they have the same replication id and offsets.
+	- the replica acknowledges the stream it applied, and the part of it fsynced to its append only file, with
+	  REPLCONF ACK <offset> FACK <aof offset> every replAckPeriod, and right away when the master sends
+	  REPLCONF GETACK *. The writes of the master are appended to the append only file of the replica.
+	- when the link is lost, or the master is silent for repl-timeout, the replica connects again
+The replicas refuse the write commands of their clients unless replica-read-only is disabled.
+The link is guarded by execMu, only its goroutine reads from its connection.
+*/
+
+// States of the link to the master, as reported by ROLE
+const (
+	REPL_STATE_CONNECT    = "connect"
+	REPL_STATE_CONNECTING = "connecting"
+	REPL_STATE_SYNC       = "sync"
+	REPL_STATE_CONNECTED  = "connected"
+)
+
+// How long a replica waits before connecting again to its master
+const replReconnectPeriod = time.Second
+
+var (
+	//The link to the master, nil when the server is a master
+	replicaOf *masterLink
+
+	errReadOnlyReplica = errors.New("READONLY You can't write against a read only replica.")
+	errLinkClosed      = errors.New("the replication link was closed")
+)
+
+type masterLink struct {
+	host string
+	port int
+
+	state string
+	//The connection to the master, nil while not connected
+	conn net.Conn
+	//When data was last received from the master
+	lastIO time.Time
+
+	//Set by REPLICAOF when the server stops replicating from this master
+	closed bool
+	stop   chan struct{}
+	//Closed once the goroutine of the link returned
+	done chan struct{}
+	//Signalled when the master asks for an acknowledgement with REPLCONF GETACK
+	ackNow chan struct{}
+
+	//The commands of a MULTI received from the master, applied at once on EXEC, and their encoding
+	inMulti    bool
+	multiQueue []*Command
+	multiRaw   []byte
+}
+
+// Refuses the write commands of clients on a read only replica, must be called holding execMu
+func checkReplicaReadOnly(cmd *Command) error {
+	if replicaOf == nil || !config.ReplicaReadOnly || applyingMasterStream {
+		return nil
+	}
+	if commandTable[cmd.name()].flags&CMD_FLAG_WRITE != 0 {
+		return errReadOnlyReplica
+	}
+	return nil
+}
+
+// REPLICAOF host port | NO ONE
+func (cmd *Command) evalREPLICAOF() ([]byte, error) {
+	if cluster != nil {
+		return nil, errors.New("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	host, port := cmd.Args[0], cmd.Args[1]
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		stopReplication()
+		return response.Encode("OK", true), nil
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return nil, errors.New("ERR Invalid master port")
+	}
+	if replicaOf != nil && replicaOf.host == host && replicaOf.port == p {
+		return response.Encode("OK Already connected to specified master", true), nil
+	}
+	startReplication(host, p)
+	return response.Encode("OK", true), nil
+}
+
+// Makes the server a master again keeping its dataset, must be called holding execMu
+func stopReplication() {
+	if replicaOf == nil {
+		return
+	}
+	replicaOf.close()
+	replicaOf = nil
+	//INFO: The replicas of this server continue with the new replication id
+	shiftReplicationID()
+	disconnectReplicas()
+	log.Println("MASTER MODE enabled")
+}
+
+// Starts replicating from host:port, must be called holding execMu
+func startReplication(host string, port int) {
+	if replicaOf != nil {
+		replicaOf.close()
+	}
+	//INFO: The replicas of this server must sync again with the dataset of the new master
+	disconnectReplicas()
+	replicaOf = &masterLink{host: host, port: port, state: REPL_STATE_CONNECT, stop: make(chan struct{}), done: make(chan struct{}), ackNow: make(chan struct{}, 1)}
+	log.Printf("Connecting to MASTER %s:%d", host, port)
+	go replicaOf.run()
+}
+
+// Parses the replicaof setting, "host port", and starts replicating
+func startConfiguredReplication() error {
+	if config.ReplicaOf == "" {
+		return nil
+	}
+	fields := strings.Fields(config.ReplicaOf)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid replicaof '%s', it must be \"host port\"", config.ReplicaOf)
+	}
+	port, err := strconv.Atoi(fields[1])
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid replicaof port '%s'", fields[1])
+	}
+	execMu.Lock()
+	startReplication(fields[0], port)
+	execMu.Unlock()
+	return nil
+}
+
+// Stops the link, must be called holding execMu
+func (l *masterLink) close() {
+	l.closed = true
+	close(l.stop)
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+// Keeps the link to the master until it is closed
+func (l *masterLink) run() {
+	defer close(l.done)
+	for {
+		err := l.sync()
+
+		execMu.Lock()
+		closed := l.closed
+		l.conn, l.state = nil, REPL_STATE_CONNECT
+		l.inMulti, l.multiQueue, l.multiRaw = false, nil, nil
+		execMu.Unlock()
+		if closed {
+			return
+		}
+		log.Printf("Lost the link to MASTER %s:%d, Err: %v", l.host, l.port, err)
+
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(replReconnectPeriod):
+		}
+	}
+}
+
+func (l *masterLink) timeout() time.Duration {
+	return time.Duration(config.ReplTimeout) * time.Second
+}
+
+// Every read from the master must come within repl-timeout
+type timeoutReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r timeoutReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(p)
+}
+
+// Connects to the master, syncs with it and applies its write stream until the link is lost
+func (l *masterLink) sync() error {
+	conn, err := dialInstance(l.host, l.port, l.timeout())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	execMu.Lock()
+	if l.closed {
+		execMu.Unlock()
+		return errLinkClosed
+	}
+	l.conn, l.state, l.lastIO = conn, REPL_STATE_CONNECTING, time.Now()
+	user, password, port := config.MasterUser, config.MasterAuth, config.Port
+	//INFO: A server that has a backlog asks to continue its stream, it may be the stream of the master
+	//that it replicated from before or its own stream when the master was its replica
+	psyncID, psyncOffset := "?", "-1"
+	if replBacklog != nil {
+		psyncID, psyncOffset = replicationID, strconv.FormatInt(masterReplOffset+1, 10)
+	}
+	execMu.Unlock()
+
+	rd := response.NewReader(timeoutReader{conn, l.timeout()})
+	send := func(args ...string) (interface{}, error) {
+		conn.SetWriteDeadline(time.Now().Add(l.timeout()))
+		if _, err := conn.Write((&Command{Cmd: args[0], Args: args[1:]}).encode()); err != nil {
+			return nil, err
+		}
+		return rd.ReadReply()
+	}
+
+	//INFO: A master requiring a password replies NOAUTH to the PING, it is enough to know it is alive
+	reply, err := send("PING")
+	if err != nil {
+		return err
+	}
+	if e, ok := reply.(response.ErrorReply); ok && !strings.HasPrefix(string(e), "NOAUTH") && !strings.HasPrefix(string(e), "NOPERM") {
+		return fmt.Errorf("error reply to PING from master: %s", e)
+	}
+	if password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		if reply, err = send(args...); err != nil {
+			return err
+		}
+		if e, ok := reply.(response.ErrorReply); ok {
+			return fmt.Errorf("unable to AUTH to MASTER: %s", e)
+		}
+	}
+	if reply, err = send("REPLCONF", "listening-port", strconv.Itoa(port)); err != nil {
+		return err
+	}
+	if e, ok := reply.(response.ErrorReply); ok {
+		log.Println("(Non critical) Master does not understand REPLCONF listening-port:", e)
+	}
+
+	if reply, err = send("PSYNC", psyncID, psyncOffset); err != nil {
+		return err
+	}
+	line, _ := reply.(response.SimpleString)
+	fields := strings.Fields(string(line))
+	switch {
+	case len(fields) == 2 && fields[0] == "CONTINUE":
+		err = l.continueSync(fields[1])
+	case len(fields) == 3 && fields[0] == "FULLRESYNC":
+		err = l.fullSync(rd, fields[1], fields[2])
+	default:
+		err = fmt.Errorf("unexpected reply to PSYNC from master: %v", reply)
+	}
+	if err != nil {
+		return err
+	}
+
+	acksDone := make(chan struct{})
+	defer close(acksDone)
+	go l.sendAcks(conn, acksDone)
+
+	for {
+		tokens, raw, err := rd.ReadCommand()
+		if err != nil {
+			return err
+		}
+		execMu.Lock()
+		if l.closed {
+			execMu.Unlock()
+			return errLinkClosed
+		}
+		l.lastIO = time.Now()
+		if applied := l.apply(&Command{Cmd: tokens[0], Args: tokens[1:]}, raw); applied != nil {
+			feedReplicationStream(applied)
+		}
+		flushAppendOnlyFile()
+		execMu.Unlock()
+	}
+}
+
+// Continues the stream of the master from the offset of the replica, the master may have a new replication id
+func (l *masterLink) continueSync(replid string) error {
+	execMu.Lock()
+	defer execMu.Unlock()
+	if l.closed {
+		return errLinkClosed
+	}
+	if replid != replicationID {
+		//INFO: The master was promoted, the replicas of this server continue from the former id
+		replicationID2, secondReplOffset = replicationID, masterReplOffset+1
+		replicationID = replid
+		disconnectReplicas()
+		log.Println("Master replication ID changed to", replid)
+	}
+	l.state, l.lastIO = REPL_STATE_CONNECTED, time.Now()
+	log.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+	return nil
+}
+
+// Replaces the dataset by the snapshot sent by the master
+func (l *masterLink) fullSync(rd *response.Reader, replid string, offsetArg string) error {
+	offset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid offset in the reply to PSYNC from master: %s", offsetArg)
+	}
+	execMu.Lock()
+	l.state = REPL_STATE_SYNC
+	execMu.Unlock()
+	log.Printf("Full resync from master: %s:%d", replid, offset)
+	payload, err := rd.ReadPayload()
+	if err != nil {
+		return err
+	}
+	keys, err := parseSnapshot(payload)
+	if err != nil {
+		return err
+	}
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	if l.closed {
+		return errLinkClosed
+	}
+	loadDataset(keys)
+	replicationID, masterReplOffset = replid, offset
+	clearReplicationID2()
+	replBacklog = newReplicationBacklog(config.ReplBacklogSize, offset+1)
+	if err := rewriteAppendOnlyFile(); err != nil {
+		log.Println("Error rewriting the AOF file with the dataset of the master:", err)
+		aofLastWriteErr = err
+	}
+	l.state, l.lastIO = REPL_STATE_CONNECTED, time.Now()
+	log.Println("MASTER <-> REPLICA sync: Finished with success")
+	return nil
+}
+
+// Sends REPLCONF ACK <offset> FACK <aof offset> every replAckPeriod, or when asked, until done is closed
+func (l *masterLink) sendAcks(conn net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		execMu.Lock()
+		ack := (&Command{Cmd: "REPLCONF", Args: []string{
+			"ACK", strconv.FormatInt(masterReplOffset, 10), "FACK", strconv.FormatInt(appendOnlyFileOffset(), 10),
+		}}).encode()
+		execMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(l.timeout()))
+		if _, err := conn.Write(ack); err != nil {
+			conn.Close()
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		case <-l.ackNow:
+		}
+	}
+}
+
+/**
+Applies a command of the write stream, must be called holding execMu. Returns the part of the stream that was
+applied, the offset of the replica only moves past a transaction once its EXEC was applied, so that a replica
+losing the link in the middle of a transaction gets it again from the start when it continues.
+*/
+func (l *masterLink) apply(cmd *Command, raw []byte) []byte {
+	switch cmd.name() {
+	case COMMAND_PING:
+		return raw
+	case COMMAND_REPLCONF:
+		if len(cmd.Args) > 0 && strings.EqualFold(cmd.Args[0], "getack") {
+			select {
+			case l.ackNow <- struct{}{}:
+			default:
+			}
+		}
+		return raw
+	case COMMAND_MULTI:
+		l.inMulti, l.multiQueue, l.multiRaw = true, nil, raw
+		return nil
+	case COMMAND_EXEC:
+		queue, applied := l.multiQueue, append(l.multiRaw, raw...)
+		l.inMulti, l.multiQueue, l.multiRaw = false, nil, nil
+		for _, queued := range queue {
+			l.runCommand(queued)
+		}
+		feedAppendOnlyFile(applied)
+		return applied
+	}
+	if l.inMulti {
+		l.multiQueue = append(l.multiQueue, cmd)
+		l.multiRaw = append(l.multiRaw, raw...)
+		return nil
+	}
+	l.runCommand(cmd)
+	feedAppendOnlyFile(raw)
+	return raw
+}
+
+func (l *masterLink) runCommand(cmd *Command) {
+	applyingMasterStream = true
+	defer func() { applyingMasterStream = false }()
+	if reply := evalCommand(cmd); len(reply) > 0 && reply[0] == '-' {
+		log.Printf("Error applying a command of the master: %v %s", cmd.redacted(), reply)
+	}
+}
+
+// Replaces the dataset by the one received from the master, must be called holding execMu
+func loadDataset(keys map[string]interface{}) {
+	//INFO: The replicas of this server must sync again with the new dataset
+	disconnectReplicas()
+	for key := range keyspace {
+		if _, ok := keys[key]; !ok {
+			touchWatchedKey(key)
+			touchWatchedQueries(key)
+			trackingInvalidateKey(key)
+		}
+	}
+	keyspace = keys
+	if cluster != nil {
+		clusterIndexKeys()
+	}
+	for key := range keyspace {
+		touchWatchedKey(key)
+		touchWatchedQueries(key)
+		trackingInvalidateKey(key)
+	}
+}
+
+// Lines of INFO replication only reported by replicas
+func infoReplicaLink() []string {
+	status, lastIO, syncing := "down", "-1", "0"
+	switch replicaOf.state {
+	case REPL_STATE_CONNECTED:
+		status = "up"
+		lastIO = strconv.Itoa(int(time.Since(replicaOf.lastIO).Seconds()))
+	case REPL_STATE_SYNC:
+		syncing = "1"
+	}
+	readOnly := "0"
+	if config.ReplicaReadOnly {
+		readOnly = "1"
+	}
+	return []string{
+		"master_host:" + replicaOf.host,
+		"master_port:" + strconv.Itoa(replicaOf.port),
+		"master_link_status:" + status,
+		"master_last_io_seconds_ago:" + lastIO,
+		"master_sync_in_progress:" + syncing,
+		"slave_read_repl_offset:" + strconv.FormatInt(masterReplOffset, 10),
+		"slave_repl_offset:" + strconv.FormatInt(masterReplOffset, 10),
+		"slave_priority:100",
+		"slave_read_only:" + readOnly,
+		"replica_announced:1",
+	}
+}
@@ -0,0 +1,354 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Replication keeps replicas with a copy of the dataset of their master, this file is the side of the master
+(see replica.go for the side of the replica):
+	- a replica connects like a client, tells its port with REPLCONF listening-port and sends PSYNC (or SYNC).
+	  The master replies +FULLRESYNC <replid> <offset> followed by a snapshot of its dataset (see snapshot.go)
+	  sent as `$<length>\r\n<snapshot>`, and the client becomes one of its replicas
+	- from then on every command that modified the dataset is propagated: once it ran it is sent to the
+	  replicas as it was received. The write stream is captured in Command.EvalCommand, where the writes are
+	  applied, so the writes of EXEC and of scripts are propagated as well. They are wrapped in MULTI / EXEC
+	  so that the replicas apply them at once.
+	- the replication offset counts the bytes of the stream, the snapshot holds the dataset at its offset.
+	  A stream is identified by its replication id, a replica that reconnects sends PSYNC <replid> <offset>
+	  and continues where it stopped when the backlog still holds the stream from its offset (see backlog.go)
+	- a replica promoted to master with REPLICAOF NO ONE starts a new replication id, the id of its former
+	  master is kept as replid2 until second_repl_offset, so that the other replicas of that master can
+	  continue from it
+	- the master PINGs its replicas through the stream every replPingPeriod so that they notice a lost link,
+	  the replicas send REPLCONF ACK <offset> FACK <aof offset> every second so that it notices a lost replica.
+	  The acknowledged offsets are what WAIT and WAITAOF wait for (see wait.go), they send REPLCONF GETACK *
+	  through the stream so that the replicas acknowledge right away.
+The snapshot is created holding execMu, commands wait for it. The stream is queued to the replicas like
+replies, a replica that falls clientOutputQueueLen writes behind is disconnected and syncs again.
+The replication state is guarded by execMu.
+*/
+
+const (
+	//How often the master PINGs its replicas
+	replPingPeriod = 10 * time.Second
+	//How often the replicas acknowledge the stream they applied
+	replAckPeriod = time.Second
+)
+
+// Replication state of a client, set by REPLCONF and PSYNC
+type replicaState struct {
+	//Port the replica listens on, told with REPLCONF listening-port
+	listeningPort int
+	//Set once the client synchronized with PSYNC or SYNC, it then receives the write stream
+	online bool
+	//Offset acknowledged with REPLCONF ACK and when it was received
+	ackOffset int64
+	ackTime   time.Time
+	//Offset up to which the replica fsynced its append only file, told with REPLCONF ACK <offset> FACK <offset>
+	ackAOFOffset int64
+}
+
+var (
+	//The clients that are replicas of this server
+	replicas = map[*Client]struct{}{}
+
+	//Id of the replication stream and offset of its end
+	replicationID    = randomHex(40)
+	masterReplOffset int64
+
+	//Id of the stream of the former master and the offset up to which this stream is the same, after a promotion
+	replicationID2   = strings.Repeat("0", 40)
+	secondReplOffset int64 = -1
+
+	//The end of the stream, created when the first replica syncs
+	replBacklog *replicationBacklog
+
+	//Nesting of the commands running, the writes they propagate are queued until the outermost one ran
+	propagationDepth int
+	propagationQueue [][]byte
+
+	//Set while the commands received from the master run, they are forwarded to the replicas as they were received
+	applyingMasterStream bool
+)
+
+// Encodes the command like clients send it
+func (cmd *Command) encode() []byte {
+	tokens := make([][]byte, 0, len(cmd.Args)+1)
+	tokens = append(tokens, response.Encode(cmd.Cmd, false))
+	for _, arg := range cmd.Args {
+		tokens = append(tokens, response.Encode(arg, false))
+	}
+	return response.EncodeArray(tokens)
+}
+
+// Called before running a command that can propagate writes, must be called holding execMu
+func beginPropagation() {
+	propagationDepth++
+}
+
+// Called once the command ran, the writes it propagated are sent when the outermost command ran
+func endPropagation() {
+	propagationDepth--
+	if propagationDepth > 0 || len(propagationQueue) == 0 {
+		return
+	}
+	queue := propagationQueue
+	propagationQueue = nil
+	if len(queue) > 1 {
+		queue = append([][]byte{(&Command{Cmd: "MULTI"}).encode()}, queue...)
+		queue = append(queue, (&Command{Cmd: "EXEC"}).encode())
+	}
+	for _, data := range queue {
+		feedReplicationStream(data)
+		feedAppendOnlyFile(data)
+	}
+	flushAppendOnlyFile()
+}
+
+// Propagates a command that modified the dataset, must be called holding execMu
+func propagate(cmd *Command) {
+	if applyingMasterStream || (len(replicas) == 0 && replBacklog == nil && aofFile == nil) {
+		return
+	}
+	propagationQueue = append(propagationQueue, cmd.encode())
+}
+
+// Appends data to the replication stream, must be called holding execMu
+func feedReplicationStream(data []byte) {
+	masterReplOffset += int64(len(data))
+	if replBacklog != nil {
+		replBacklog.feed(data)
+	}
+	for c := range replicas {
+		c.write(data)
+	}
+}
+
+// Disconnects the replicas, they sync again when they reconnect, must be called holding execMu
+func disconnectReplicas() {
+	for c := range replicas {
+		c.conn.Close()
+		delete(replicas, c)
+	}
+}
+
+// Starts a new replication id once promoted to master, the former one is kept as replid2, must be called holding execMu
+func shiftReplicationID() {
+	replicationID2, secondReplOffset = replicationID, masterReplOffset+1
+	replicationID = randomHex(40)
+	log.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s", replicationID2, secondReplOffset, replicationID)
+}
+
+// Forgets the stream of the former master, must be called holding execMu
+func clearReplicationID2() {
+	replicationID2, secondReplOffset = strings.Repeat("0", 40), -1
+}
+
+// PINGs the replicas every replPingPeriod and disconnects the ones that did not acknowledge the stream within repl-timeout
+func replicationCron() {
+	ticks := 0
+	for range time.Tick(replAckPeriod) {
+		ticks++
+		execMu.Lock()
+		if len(replicas) > 0 && ticks%int(replPingPeriod/replAckPeriod) == 0 {
+			feedReplicationStream((&Command{Cmd: "PING"}).encode())
+		}
+		for c := range replicas {
+			if time.Since(c.replica.ackTime) > time.Duration(config.ReplTimeout)*time.Second {
+				log.Println("Disconnecting timedout replica:", c.conn.RemoteAddr())
+				c.conn.Close()
+				delete(replicas, c)
+			}
+		}
+		execMu.Unlock()
+	}
+}
+
+// REPLCONF option value ..., sent by replicas before PSYNC
+func (c *Client) replconf(args []string) []byte {
+	if len(args)%2 != 0 {
+		return response.EncodeError(errors.New("ERR syntax error"))
+	}
+	//INFO: Acknowledgements have no reply, the master would read it as part of the stream
+	ack := false
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToLower(args[i]) {
+		case "listening-port":
+			port, err := strconv.Atoi(args[i+1])
+			if err != nil || port < 0 || port > 65535 {
+				return response.EncodeError(errors.New("ERR value is not an integer or out of range"))
+			}
+			c.replica.listeningPort = port
+		case "capa":
+			//INFO: The capabilities of the replica are only needed by the features of redis that are not supported
+		case "ack", "fack":
+			ack = true
+			offset, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				continue
+			}
+			if strings.EqualFold(args[i], "fack") {
+				c.replica.ackAOFOffset = offset
+			} else if offset > c.replica.ackOffset {
+				c.replica.ackOffset = offset
+			}
+			c.replica.ackTime = time.Now()
+		default:
+			return response.EncodeError(fmt.Errorf("ERR Unrecognized REPLCONF option: %s", args[i]))
+		}
+	}
+	if ack {
+		wakeWaitingClients()
+		return nil
+	}
+	return response.Encode("OK", true)
+}
+
+// PSYNC replid offset and SYNC, the client becomes a replica once it received a snapshot of the dataset
+func (c *Client) psync(cmd *Command) []byte {
+	if c.replica.online {
+		return nil
+	}
+	if replicaOf != nil && replicaOf.state != REPL_STATE_CONNECTED {
+		return response.EncodeError(errors.New("NOMASTERLINK Can't SYNC while not connected with my master"))
+	}
+
+	if cmd.name() == COMMAND_PSYNC {
+		if reply, ok := c.partialResync(cmd.Args[0], cmd.Args[1]); ok {
+			c.addReplica()
+			return reply
+		}
+	}
+
+	if replBacklog == nil {
+		replBacklog = newReplicationBacklog(config.ReplBacklogSize, masterReplOffset+1)
+		//INFO: Replicas of the former master can not continue from a stream that was not kept
+		clearReplicationID2()
+	}
+	snapshot := createSnapshot()
+	log.Println("Replica", c.conn.RemoteAddr(), "asks for synchronization, full resync at offset", masterReplOffset)
+	var reply []byte
+	if cmd.name() == COMMAND_PSYNC {
+		reply = []byte(fmt.Sprintf("+FULLRESYNC %s %d\r\n", replicationID, masterReplOffset))
+	}
+	reply = append(reply, fmt.Sprintf("$%d\r\n", len(snapshot))...)
+	reply = append(reply, snapshot...)
+
+	c.addReplica()
+	return reply
+}
+
+func (c *Client) addReplica() {
+	c.replica.online = true
+	c.replica.ackTime = time.Now()
+	c.replica.ackAOFOffset = -1
+	replicas[c] = struct{}{}
+}
+
+// Replies +CONTINUE and the rest of the stream when the replica can continue from the backlog
+func (c *Client) partialResync(replid string, offsetArg string) ([]byte, bool) {
+	offset, err := strconv.ParseInt(offsetArg, 10, 64)
+	if err != nil || replBacklog == nil {
+		return nil, false
+	}
+	if replid != replicationID && (replid != replicationID2 || offset > secondReplOffset) {
+		if replid != "?" {
+			log.Printf("Partial resynchronization not accepted: Replication ID mismatch (Replica asked for '%s', my replication IDs are '%s' and '%s')", replid, replicationID, replicationID2)
+		}
+		return nil, false
+	}
+	if !replBacklog.contains(offset) {
+		log.Printf("Unable to partial resync with replica %s for lack of backlog (Replica request was: %d).", c.conn.RemoteAddr(), offset)
+		return nil, false
+	}
+
+	data := replBacklog.from(offset)
+	log.Printf("Partial resynchronization request from %s accepted. Sending %d bytes of backlog starting from offset %d.", c.conn.RemoteAddr(), len(data), offset)
+	return append([]byte("+CONTINUE "+replicationID+"\r\n"), data...), true
+}
+
+// Address of the replica: the IP it connects from and the port it listens on
+func (c *Client) replicaAddr() (string, int) {
+	ip, _, err := net.SplitHostPort(c.conn.RemoteAddr().String())
+	if err != nil {
+		ip = c.conn.RemoteAddr().String()
+	}
+	return ip, c.replica.listeningPort
+}
+
+// The replicas in the order they connected
+func sortedReplicas() []*Client {
+	sorted := make([]*Client, 0, len(replicas))
+	for c := range replicas {
+		sorted = append(sorted, c)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].id < sorted[j].id })
+	return sorted
+}
+
+/**
+ROLE tells the role of the server:
+	- a master replies master, its replication offset and its replicas as [ip, port, offset]
+	- a replica replies slave, the host and port of its master, the state of the link and its offset
+	- a sentinel replies sentinel and the names of the masters it monitors
+*/
+func (cmd *Command) evalROLE() ([]byte, error) {
+	if sentinel != nil {
+		names := make([]string, 0, len(sentinel.masters))
+		for name := range sentinel.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([][]byte, len(names))
+		for i, name := range names {
+			list[i] = response.Encode(name, false)
+		}
+		return response.EncodeArray([][]byte{response.Encode("sentinel", false), response.EncodeArray(list)}), nil
+	}
+	if replicaOf != nil {
+		return response.EncodeArray([][]byte{
+			response.Encode("slave", false),
+			response.Encode(replicaOf.host, false),
+			response.Encode(replicaOf.port, false),
+			response.Encode(replicaOf.state, false),
+			response.Encode(masterReplOffset, false),
+		}), nil
+	}
+
+	var list [][]byte
+	for _, c := range sortedReplicas() {
+		ip, port := c.replicaAddr()
+		list = append(list, response.EncodeArray([][]byte{
+			response.Encode(ip, false),
+			response.Encode(strconv.Itoa(port), false),
+			response.Encode(strconv.FormatInt(c.replica.ackOffset, 10), false),
+		}))
+	}
+	return response.EncodeArray([][]byte{
+		response.Encode("master", false),
+		response.Encode(masterReplOffset, false),
+		response.EncodeArray(list),
+	}), nil
+}
+
+// The role reported by HELLO
+func serverRole() string {
+	if sentinel != nil {
+		return "sentinel"
+	}
+	if replicaOf != nil {
+		return "replica"
+	}
+	return "master"
+}
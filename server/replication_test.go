@@ -0,0 +1,435 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/minhash"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+// Reads the replication stream of a test replica or the commands sent to a test master
+type testStream struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *response.Reader
+	//Number of bytes of the stream read so far
+	read int64
+}
+
+func newTestStream(t *testing.T, conn net.Conn) *testStream {
+	return &testStream{t: t, conn: conn, rd: response.NewReader(conn)}
+}
+
+// Fails the test unless the next command of the stream is the expected one
+func (s *testStream) expectCommand(expected ...string) {
+	s.t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	tokens, raw, err := s.rd.ReadCommand()
+	if err != nil {
+		s.t.Fatalf("reading %q: %v", expected, err)
+	}
+	s.read += int64(len(raw))
+	if !reflect.DeepEqual(tokens, expected) {
+		s.t.Errorf("received %q, expected %q", tokens, expected)
+	}
+}
+
+func (s *testStream) reply(data string) {
+	s.conn.Write([]byte(data))
+}
+
+// Sends PSYNC from the test replica, returns the replication id and offset of the full resync and the snapshot
+func (tc *testClient) fullResync(stream *testStream) (string, int64, map[string]interface{}) {
+	tc.t.Helper()
+	tc.send("PSYNC", "?", "-1")
+	tc.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	reply, err := stream.rd.ReadReply()
+	line, _ := reply.(response.SimpleString)
+	fields := strings.Fields(string(line))
+	if err != nil || len(fields) != 3 || fields[0] != "FULLRESYNC" {
+		tc.t.Fatalf("PSYNC replied %#v, %v", reply, err)
+	}
+	offset, _ := strconv.ParseInt(fields[2], 10, 64)
+	payload, err := stream.rd.ReadPayload()
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	keys, err := parseSnapshot(payload)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	return fields[1], offset, keys
+}
+
+func TestReplicationMaster(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+
+	replica := connect(t)
+	replica.expect(replyOK, "REPLCONF", "listening-port", "6380", "capa", "psync2")
+	stream := newTestStream(t, replica.conn)
+	replid, offset, keys := replica.fullResync(stream)
+	if replid != replicationID || offset != 0 {
+		t.Errorf("full resync from %s %d", replid, offset)
+	}
+	if sig, ok := keys["a"].(*minhash.Signature); !ok || len(keys) != 1 || sig.IsEmpty() {
+		t.Errorf("unexpected snapshot %v", keys)
+	}
+
+	//Writes are propagated once they ran, writes that modified nothing are not
+	c.expect(int64(1), "SIM.ADD", "a", "y")
+	stream.expectCommand("SIM.ADD", "a", "y")
+	c.expect(int64(0), "SIM.ADD", "a", "y")
+	c.expect("1", "SIM.JACCARD", "a", "a")
+
+	//The writes of a transaction or a script are applied at once
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "1")
+	c.expect(response.SimpleString("QUEUED"), "SIM.ADD", "b", "2")
+	c.expect(array(int64(1), int64(1)), "EXEC")
+	stream.expectCommand("MULTI")
+	stream.expectCommand("SIM.ADD", "b", "1")
+	stream.expectCommand("SIM.ADD", "b", "2")
+	stream.expectCommand("EXEC")
+	c.expect(int64(1), "EVAL", "redis.call('sim.add', KEYS[1], 'x') return redis.call('sim.add', KEYS[1], 'y')", "1", "s")
+	stream.expectCommand("MULTI")
+	stream.expectCommand("sim.add", "s", "x")
+	stream.expectCommand("sim.add", "s", "y")
+	stream.expectCommand("EXEC")
+
+	c.expect(array("master", stream.read, array(array("127.0.0.1", "6380", "0"))), "ROLE")
+	info := c.do("INFO", "replication").(string)
+	for _, field := range []string{"role:master", "connected_slaves:1", "slave0:ip=127.0.0.1,port=6380,state=online",
+		"master_repl_offset:" + strconv.FormatInt(stream.read, 10)} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO replication misses %s:\n%s", field, info)
+		}
+	}
+}
+
+// Replies to the handshake of the replica as a master, until its PSYNC
+func serveTestHandshake(stream *testStream, psync ...string) {
+	stream.t.Helper()
+	stream.expectCommand("PING")
+	stream.reply("+PONG\r\n")
+	if config.MasterAuth != "" {
+		stream.expectCommand("AUTH", config.MasterAuth)
+		stream.reply("+OK\r\n")
+	}
+	stream.expectCommand("REPLCONF", "listening-port", strconv.Itoa(config.Port))
+	stream.reply("+OK\r\n")
+	stream.expectCommand(append([]string{"PSYNC"}, psync...)...)
+}
+
+// Replies to PSYNC with a full resync to a snapshot holding the key, the replica then acknowledges the offset,
+// as fsynced when it has an append only file
+func serveTestFullResync(stream *testStream, replid string, offset int64, key string) {
+	stream.t.Helper()
+	sig := minhash.NewSignature()
+	sig.Add("x")
+	snapshot := response.EncodeArray([][]byte{response.Encode(key, false), response.Encode(string(serializeValue(sig)), false)})
+	stream.reply("+FULLRESYNC " + replid + " " + strconv.FormatInt(offset, 10) + "\r\n$" + strconv.Itoa(len(snapshot)) + "\r\n" + string(snapshot))
+	aofOffset := int64(-1)
+	if config.AppendOnly {
+		aofOffset = offset
+	}
+	stream.expectAck(offset, aofOffset)
+}
+
+// Fails the test unless the next command is the acknowledgement of the offsets by the replica
+func (s *testStream) expectAck(offset int64, aofOffset int64) {
+	s.t.Helper()
+	s.expectCommand("REPLCONF", "ACK", strconv.FormatInt(offset, 10), "FACK", strconv.FormatInt(aofOffset, 10))
+}
+
+// Fails the test unless the connection is closed by the server, what is received before is skipped
+func (s *testStream) expectClosed() {
+	s.t.Helper()
+	s.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	for {
+		if _, err := s.rd.ReadRaw(); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.t.Error("the connection was not closed")
+			}
+			return
+		}
+	}
+}
+
+// Waits until the reply of the replica to ROLE is the expected one
+func waitRole(c *testClient, expected interface{}) {
+	c.t.Helper()
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		role := c.do("ROLE")
+		if reflect.DeepEqual(role, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("ROLE replied %#v, expected %#v", role, expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationReplica(t *testing.T) {
+	setupTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	masterPort, _ := strconv.Atoi(port)
+
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "old", "x")
+	c.expectError("ERR Invalid master port", "REPLICAOF", host, "none")
+	c.expect(replyOK, "REPLICAOF", host, port)
+	c.expect(response.SimpleString("OK Already connected to specified master"), "REPLICAOF", host, port)
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := newTestStream(t, conn)
+	replid := strings.Repeat("a", 40)
+	serveTestHandshake(master, "?", "-1")
+	serveTestFullResync(master, replid, 100, "k")
+	waitRole(c, array("slave", host, int64(masterPort), "connected", int64(100)))
+
+	//The dataset is replaced by the snapshot
+	c.expect("0", "SIM.JACCARD", "old", "old")
+	c.expect("1", "SIM.JACCARD", "k", "k")
+	c.expectError("READONLY", "SIM.ADD", "k", "y")
+
+	//Replicas of the replica get the replication id and stream of the master
+	sub := connect(t)
+	subStream := newTestStream(t, sub.conn)
+	if subReplid, offset, keys := sub.fullResync(subStream); subReplid != replid || offset != 100 || len(keys) != 1 {
+		t.Errorf("the replica of the replica synced from %s %d with %d keys", subReplid, offset, len(keys))
+	}
+
+	write := (&Command{Cmd: "SIM.ADD", Args: []string{"k2", "x"}}).encode()
+	multi := "*1\r\n$5\r\nMULTI\r\n" + string(write) + "*1\r\n$4\r\nEXEC\r\n"
+	master.reply(string(write) + multi)
+	offset := int64(100 + len(write) + len(multi))
+	waitRole(c, array("slave", host, int64(masterPort), "connected", offset))
+	c.expect("1", "SIM.JACCARD", "k2", "k2")
+	subStream.expectCommand("SIM.ADD", "k2", "x")
+	subStream.expectCommand("MULTI")
+	subStream.expectCommand("SIM.ADD", "k2", "x")
+	subStream.expectCommand("EXEC")
+
+	info := c.do("INFO", "replication").(string)
+	for _, field := range []string{"role:slave", "master_host:" + host, "master_link_status:up", "master_sync_in_progress:0",
+		"slave_repl_offset:" + strconv.FormatInt(offset, 10), "slave_read_only:1", "connected_slaves:1", "master_replid:" + replid} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO replication misses %s:\n%s", field, info)
+		}
+	}
+
+	//The replica connects again when the link is lost, and syncs again
+	execMu.Lock()
+	config.MasterAuth = "pw"
+	execMu.Unlock()
+	conn.Close()
+	if conn, err = listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	master = newTestStream(t, conn)
+	serveTestHandshake(master, replid, strconv.FormatInt(offset+1, 10))
+	serveTestFullResync(master, replid, 500, "k3")
+	waitRole(c, array("slave", host, int64(masterPort), "connected", int64(500)))
+	c.expect("0", "SIM.JACCARD", "k", "k")
+
+	//The replica of the replica was disconnected to sync with the new dataset
+	subStream.expectClosed()
+
+	c.expect(replyOK, "REPLICAOF", "NO", "ONE")
+	c.expect(array("master", int64(500), array()), "ROLE")
+	c.expect(int64(1), "SIM.ADD", "k3", "y")
+	master.expectClosed()
+}
+
+func TestReplicaReadOnlyDisabled(t *testing.T) {
+	setupTestServer(t)
+	config.ReplicaReadOnly = false
+	c := connect(t)
+	//Nothing listens on the port, the replica keeps trying to connect
+	c.expect(replyOK, "REPLICAOF", "127.0.0.1", "1")
+	c.expect(array("slave", "127.0.0.1", int64(1), "connect", int64(0)), "ROLE")
+	c.expect(int64(1), "SIM.ADD", "k", "x")
+
+	replica := connect(t)
+	replica.expectError("NOMASTERLINK", "PSYNC", "?", "-1")
+}
+
+func TestReplicationBacklog(t *testing.T) {
+	b := newReplicationBacklog(8, 1)
+	b.feed([]byte("abc"))
+	if !b.contains(1) || !b.contains(4) || b.contains(5) || string(b.from(2)) != "bc" || len(b.from(4)) != 0 {
+		t.Errorf("unexpected backlog %+v", b)
+	}
+	//Once full the oldest bytes are dropped
+	b.feed([]byte("defghij"))
+	if b.contains(2) || !b.contains(3) || string(b.from(3)) != "cdefghij" || string(b.from(9)) != "ij" {
+		t.Errorf("unexpected backlog %+v", b)
+	}
+	b.feed([]byte("0123456789"))
+	if b.offset != 13 || string(b.from(13)) != "23456789" {
+		t.Errorf("unexpected backlog %+v", b)
+	}
+}
+
+func TestPartialResyncMaster(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+
+	replica := connect(t)
+	stream := newTestStream(t, replica.conn)
+	replid, _, _ := replica.fullResync(stream)
+	c.expect(int64(1), "SIM.ADD", "a", "y")
+	stream.expectCommand("SIM.ADD", "a", "y")
+
+	//Acknowledgements have no reply
+	replica.send("REPLCONF", "ACK", strconv.FormatInt(stream.read, 10))
+	if !replica.silent(100 * time.Millisecond) {
+		t.Error("REPLCONF ACK was replied")
+	}
+	c.expect(array("master", stream.read, array(array("127.0.0.1", "0", strconv.FormatInt(stream.read, 10)))), "ROLE")
+
+	//The writes made while the replica is away are kept in the backlog
+	replica.conn.Close()
+	waitRole(c, array("master", stream.read, array()))
+	c.expect(int64(1), "SIM.ADD", "b", "x")
+
+	replica = connect(t)
+	next := strconv.FormatInt(stream.read+1, 10)
+	stream = newTestStream(t, replica.conn)
+	replica.send("PSYNC", replid, next)
+	replica.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	if reply, err := stream.rd.ReadReply(); err != nil || reply != response.SimpleString("CONTINUE "+replid) {
+		t.Fatalf("PSYNC replied %#v, %v", reply, err)
+	}
+	stream.expectCommand("SIM.ADD", "b", "x")
+	info := c.do("INFO", "replication").(string)
+	for _, field := range []string{"repl_backlog_active:1", "repl_backlog_first_byte_offset:1", "connected_slaves:1"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO replication misses %s:\n%s", field, info)
+		}
+	}
+
+	//An unknown replication id, or an offset the backlog does not hold, needs a full resync
+	for _, psync := range [][]string{{strings.Repeat("b", 40), "1"}, {replid, "100000"}} {
+		other := connect(t)
+		other.send(append([]string{"PSYNC"}, psync...)...)
+		if reply := other.read(); !strings.HasPrefix(fmt.Sprint(reply), "FULLRESYNC "+replid) {
+			t.Errorf("PSYNC %q replied %#v", psync, reply)
+		}
+	}
+}
+
+func TestPartialResyncReplica(t *testing.T) {
+	setupTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	masterPort, _ := strconv.ParseInt(port, 10, 64)
+
+	c := connect(t)
+	c.expect(replyOK, "REPLICAOF", host, port)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := newTestStream(t, conn)
+	replid := strings.Repeat("a", 40)
+	serveTestHandshake(master, "?", "-1")
+	serveTestFullResync(master, replid, 100, "k")
+
+	//The link is lost in the middle of a transaction, it is not applied
+	write := string((&Command{Cmd: "SIM.ADD", Args: []string{"k2", "x"}}).encode())
+	multi := "*1\r\n$5\r\nMULTI\r\n" + string((&Command{Cmd: "SIM.ADD", Args: []string{"k3", "x"}}).encode())
+	master.reply(write + multi)
+	offset := int64(100 + len(write))
+	waitRole(c, array("slave", host, masterPort, "connected", offset))
+	conn.Close()
+
+	//The replica continues from the start of the transaction, the promoted master has a new replication id
+	if conn, err = listener.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	master = newTestStream(t, conn)
+	serveTestHandshake(master, replid, strconv.FormatInt(offset+1, 10))
+	newReplid := strings.Repeat("b", 40)
+	master.reply("+CONTINUE " + newReplid + "\r\n")
+	master.expectAck(offset, -1)
+	master.reply(multi + "*1\r\n$4\r\nEXEC\r\n")
+	offset += int64(len(multi) + 14)
+	waitRole(c, array("slave", host, masterPort, "connected", offset))
+	c.expect("1", "SIM.JACCARD", "k", "k")
+	c.expect("1", "SIM.JACCARD", "k3", "k3")
+
+	info := c.do("INFO", "replication").(string)
+	for _, field := range []string{"master_replid:" + newReplid, "master_replid2:" + replid,
+		"second_repl_offset:" + strconv.Itoa(101+len(write)), "repl_backlog_active:1"} {
+		if !strings.Contains(info, field) {
+			t.Errorf("INFO replication misses %s:\n%s", field, info)
+		}
+	}
+}
+
+func TestPromotionKeepsReplicationID(t *testing.T) {
+	setupTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	c := connect(t)
+	c.expect(replyOK, "REPLICAOF", host, port)
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := newTestStream(t, conn)
+	replid := strings.Repeat("a", 40)
+	serveTestHandshake(master, "?", "-1")
+	serveTestFullResync(master, replid, 100, "k")
+	c.expect(replyOK, "REPLICAOF", "NO", "ONE")
+	master.expectClosed()
+
+	info := c.do("INFO", "replication").(string)
+	if !strings.Contains(info, "master_replid2:"+replid) || !strings.Contains(info, "second_repl_offset:101") ||
+		strings.Contains(info, "master_replid:"+replid) {
+		t.Errorf("unexpected replication ids:\n%s", info)
+	}
+
+	//The other replicas of the former master continue from the promoted replica
+	replica := connect(t)
+	replica.send("PSYNC", replid, "101")
+	if reply := replica.read(); !strings.HasPrefix(fmt.Sprint(reply), "CONTINUE ") || strings.HasSuffix(fmt.Sprint(reply), replid) {
+		t.Errorf("PSYNC replied %#v", reply)
+	}
+	//Unless they went further than the promoted replica
+	other := connect(t)
+	other.send("PSYNC", replid, "102")
+	if reply := other.read(); !strings.HasPrefix(fmt.Sprint(reply), "FULLRESYNC ") {
+		t.Errorf("PSYNC replied %#v", reply)
+	}
+}
@@ -34,33 +34,70 @@ import (
          - `- Key Not Found \r\n`
 */
 
+// Simple strings and errors are decoded into plain strings by Decode, DecodeReply decodes them
+// into these types so that replies like +OK and -ERR can be told apart from bulk strings.
+type SimpleString string
+type ErrorReply string
+
 func Decode(data []byte) (interface{}, error) {
 	if len(data) == 0 {
 		return nil, errors.New("no data")
 	}
-	value, _, err := decodeFirstElement(data)
+	value, _, err := decodeFirstElement(data, false)
+	return value, err
+}
+
+/**
+Decodes a reply sent by the server, unlike Decode:
+	- simple strings are decoded as SimpleString and errors as ErrorReply
+	- null bulk strings ($-1) and null arrays (*-1) are decoded as nil
+*/
+func DecodeReply(data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, errors.New("no data")
+	}
+	value, _, err := decodeFirstElement(data, true)
 	return value, err
 }
 
-func decodeFirstElement(data []byte) (interface{}, int, error) {
+func decodeFirstElement(data []byte, typed bool) (interface{}, int, error) {
 	if len(data) == 0 {
 		return nil, 0, errors.New("no data")
 	}
 	switch data[0] {
 	case '+':
-		return readSimpleString(data)
+		s, delta, err := readSimpleString(data)
+		if typed {
+			return SimpleString(s), delta, err
+		}
+		return s, delta, err
 	case '-':
-		return readError(data)
+		s, delta, err := readError(data)
+		if typed {
+			return ErrorReply(s), delta, err
+		}
+		return s, delta, err
 	case ':':
 		return readInt64(data)
 	case '$':
+		if typed && isNull(data) {
+			return nil, 5, nil
+		}
 		return readBulkString(data)
 	case '*':
-		return readArray(data)
+		if typed && isNull(data) {
+			return nil, 5, nil
+		}
+		return readArray(data, typed)
 	}
 	return nil, 0, nil
 }
 
+// Tells if data starts with a null bulk string or a null array: $-1\r\n or *-1\r\n
+func isNull(data []byte) bool {
+	return len(data) >= 5 && data[1] == '-' && data[2] == '1'
+}
+
 // reads the length typically the first integer of the string
 // until hit by an non-digit byte and returns
 // the integer and the delta = length + 2 (CRLF)
@@ -102,11 +139,16 @@ func readInt64(data []byte) (int64, int, error) {
 	pos := 1
 	var value int64 = 0
 
+	sign := int64(1)
+	if data[pos] == '-' {
+		sign = -1
+		pos++
+	}
 	for ; data[pos] != '\r'; pos++ {
 		value = value*10 + int64(data[pos]-'0')
 	}
 
-	return value, pos + 2, nil
+	return sign * value, pos + 2, nil
 }
 
 // reads a RESP encoded string from data and returns
@@ -126,7 +168,7 @@ func readBulkString(data []byte) (string, int, error) {
 
 // reads a RESP encoded array from data and returns
 // the array, the delta, and the error
-func readArray(data []byte) (interface{}, int, error) {
+func readArray(data []byte, typed bool) (interface{}, int, error) {
 	// first character *
 	pos := 1
 
@@ -136,7 +178,7 @@ func readArray(data []byte) (interface{}, int, error) {
 
 	var elems []interface{} = make([]interface{}, count)
 	for i := range elems {
-		elem, delta, err := decodeFirstElement(data[pos:])
+		elem, delta, err := decodeFirstElement(data[pos:], typed)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -33,6 +33,7 @@ func TestInt64(t *testing.T) {
 	cases := map[string]int64{
 		":0\r\n":    0,
 		":1000\r\n": 1000,
+		":-42\r\n":  -42,
 	}
 	for k, v := range cases {
 		value, _ := Decode([]byte(k))
@@ -76,3 +77,26 @@ func TestArrayDecode(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeReply(t *testing.T) {
+	cases := map[string]interface{}{
+		"+OK\r\n":         SimpleString("OK"),
+		"-ERR failed\r\n": ErrorReply("ERR failed"),
+		"$-1\r\n":         nil,
+		"*-1\r\n":         nil,
+		"$5\r\nhello\r\n": "hello",
+		":-3\r\n":         int64(-3),
+	}
+	for k, v := range cases {
+		value, _ := DecodeReply([]byte(k))
+		if v != value {
+			t.Fail()
+		}
+	}
+
+	value, _ := DecodeReply([]byte("*3\r\n+OK\r\n$-1\r\n-ERR x\r\n"))
+	array := value.([]interface{})
+	if array[0] != SimpleString("OK") || array[1] != nil || array[2] != ErrorReply("ERR x") {
+		t.Fail()
+	}
+}
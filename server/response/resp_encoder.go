@@ -1,18 +1,29 @@
 package response
 
-import "fmt"
+import (
+	"bytes"
+	"fmt"
+)
 
 /**
 This function is used to Encode the response from the server in RESP form before sending back to the client.
-	- Currently we have added all response to be encoded as string or binary string (Bulk string)
+	- Strings are encoded as simple strings or binary strings (Bulk string)
+	- Integers are encoded as RESP integers
+	- nil is encoded as a null bulk string
 */
 func Encode(value interface{}, isSimple bool) []byte {
 	switch v := value.(type) {
+	case nil:
+		return []byte("$-1\r\n")
 	case string:
 		if isSimple {
 			return []byte(fmt.Sprintf("+%s\r\n", v))
 		}
 		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(v), v))
+	case int:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
+	case int64:
+		return []byte(fmt.Sprintf(":%d\r\n", v))
 	}
 	return []byte{}
 }
@@ -20,3 +31,50 @@ func Encode(value interface{}, isSimple bool) []byte {
 func EncodeError(err error) []byte {
 	return []byte(fmt.Sprintf("-%s\r\n", err))
 }
+
+/**
+Wraps a list of already RESP encoded values into a RESP array
+	Input: ["+OK\r\n", ":1\r\n"]
+	Output: *2\r\n+OK\r\n:1\r\n
+*/
+func EncodeArray(values [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("*%d\r\n", len(values)))
+	for _, v := range values {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+// Null array: `*-1\r\n`
+func EncodeNullArray() []byte {
+	return []byte("*-1\r\n")
+}
+
+/**
+RESP3 push frame, used for out of band data like pub/sub messages
+	Input: ["$7\r\nmessage\r\n", "$4\r\nnews\r\n", "$2\r\nhi\r\n"]
+	Output: >3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$2\r\nhi\r\n
+*/
+func EncodePush(values [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf(">%d\r\n", len(values)))
+	for _, v := range values {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
+
+/**
+RESP3 map of already encoded keys and values, the values slice alternates keys and values
+	Input: ["$5\r\nproto\r\n", ":3\r\n"]
+	Output: %1\r\n$5\r\nproto\r\n:3\r\n
+*/
+func EncodeMap(values [][]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("%%%d\r\n", len(values)/2))
+	for _, v := range values {
+		buf.Write(v)
+	}
+	return buf.Bytes()
+}
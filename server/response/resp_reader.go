@@ -0,0 +1,157 @@
+package response
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+/**
+Decode expects a buffer holding whole elements, it is enough for the commands of clients which fit in a
+single read. The replication link is a stream: the elements are split over reads and several of them can
+come in one read. Reader frames the elements of such a stream and decodes them like Decode does:
+	- ReadRaw returns the encoding of the next element, as it was sent
+	- ReadReply decodes it like DecodeReply and ReadCommand like DecodeInputCommand
+	- ReadPayload reads a snapshot sent as `$<length>\r\n` followed by length bytes, without the CRLF
+	  that ends the bulk strings
+*/
+
+// Largest bulk string accepted by the reader, like the proto-max-bulk-len of redis
+const MaxBulkLen = 512 * 1024 * 1024
+
+var errProtocol = errors.New("ERR Protocol error")
+
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReader(r)}
+}
+
+// Reads the next element and returns its encoding
+func (r *Reader) ReadRaw() ([]byte, error) {
+	return r.readElement(nil)
+}
+
+// Reads the next element, decoded by DecodeReply
+func (r *Reader) ReadReply() (interface{}, error) {
+	raw, err := r.ReadRaw()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReply(raw)
+}
+
+// Reads the next command, an array of bulk strings, and returns its tokens and its encoding
+func (r *Reader) ReadCommand() ([]string, []byte, error) {
+	raw, err := r.ReadRaw()
+	if err != nil {
+		return nil, nil, err
+	}
+	value, err := Decode(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	elems, ok := value.([]interface{})
+	if !ok || len(elems) == 0 {
+		return nil, nil, fmt.Errorf("%s: expected a command, got %q", errProtocol, raw)
+	}
+	tokens := make([]string, len(elems))
+	for i, elem := range elems {
+		if tokens[i], ok = elem.(string); !ok {
+			return nil, nil, fmt.Errorf("%s: expected a command, got %q", errProtocol, raw)
+		}
+	}
+	return tokens, raw, nil
+}
+
+// Reads a payload sent as `$<length>\r\n` followed by length bytes
+func (r *Reader) ReadPayload() ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '$' {
+		return nil, fmt.Errorf("%s: expected a payload, got %q", errProtocol, line)
+	}
+	length, err := parseLength(line)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%s: invalid payload length %q", errProtocol, line)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Appends the encoding of the next element to buf
+func (r *Reader) readElement(buf []byte) ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, line...)
+
+	switch line[0] {
+	case '+', '-', ':':
+		return buf, nil
+	case '$':
+		length, err := parseLength(line)
+		if err != nil || length > MaxBulkLen {
+			return nil, fmt.Errorf("%s: invalid bulk length %q", errProtocol, line)
+		}
+		if length < 0 {
+			return buf, nil
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, length+2)...)
+		if _, err := io.ReadFull(r.r, buf[start:]); err != nil {
+			return nil, err
+		}
+		if buf[len(buf)-2] != '\r' || buf[len(buf)-1] != '\n' {
+			return nil, fmt.Errorf("%s: bulk string not ended by CRLF", errProtocol)
+		}
+		return buf, nil
+	case '*':
+		count, err := parseLength(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid array length %q", errProtocol, line)
+		}
+		for i := 0; i < count; i++ {
+			if buf, err = r.readElement(buf); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("%s: unexpected %q", errProtocol, line)
+}
+
+// Reads a line ended by CRLF, the CRLF included
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("%s: line too long", errProtocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("%s: invalid line %q", errProtocol, line)
+	}
+	//INFO: The slice is only valid until the next read, it is copied
+	return append([]byte(nil), line...), nil
+}
+
+// Parses the length of a `$<length>\r\n` or `*<count>\r\n` line, -1 is the only negative length
+func parseLength(line []byte) (int, error) {
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil || n < -1 {
+		return 0, errProtocol
+	}
+	return n, nil
+}
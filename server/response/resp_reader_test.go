@@ -0,0 +1,88 @@
+package response
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// Writes the stream one byte at a time, so that every element is split over reads
+type byteReader struct {
+	data []byte
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestReaderFramesStream(t *testing.T) {
+	elements := []string{
+		"+FULLRESYNC abc 0\r\n",
+		"*3\r\n$7\r\nSIM.ADD\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n",
+		"$-1\r\n",
+		"*2\r\n*1\r\n:1\r\n-ERR x\r\n",
+		":-7\r\n",
+	}
+	var stream []byte
+	for _, e := range elements {
+		stream = append(stream, e...)
+	}
+
+	r := NewReader(&byteReader{stream})
+	for _, e := range elements {
+		raw, err := r.ReadRaw()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != e {
+			t.Errorf("read %q, expected %q", raw, e)
+		}
+	}
+	if _, err := r.ReadRaw(); err != io.EOF {
+		t.Errorf("expected EOF at the end of the stream, got %v", err)
+	}
+}
+
+func TestReaderCommandsAndReplies(t *testing.T) {
+	stream := "+OK\r\n*2\r\n$4\r\nPING\r\n$2\r\nhi\r\n$3\r\n\x00\x01\x02" + "*1\r\n:1\r\n"
+	r := NewReader(bytes.NewBufferString(stream))
+
+	if reply, err := r.ReadReply(); err != nil || reply != SimpleString("OK") {
+		t.Errorf("read %#v, %v", reply, err)
+	}
+	tokens, raw, err := r.ReadCommand()
+	if err != nil || !reflect.DeepEqual(tokens, []string{"PING", "hi"}) || len(raw) != 22 {
+		t.Errorf("read %q %q, %v", tokens, raw, err)
+	}
+	if payload, err := r.ReadPayload(); err != nil || string(payload) != "\x00\x01\x02" {
+		t.Errorf("read payload %q, %v", payload, err)
+	}
+	if _, _, err := r.ReadCommand(); err == nil {
+		t.Error("an array of integers is not a command")
+	}
+}
+
+func TestReaderProtocolErrors(t *testing.T) {
+	for _, stream := range []string{
+		"?\r\n",
+		"$abc\r\n",
+		"$-2\r\n",
+		"$3\r\nabcde\r\n",
+		"*x\r\n",
+		"+OK\n",
+	} {
+		if _, err := NewReader(bytes.NewBufferString(stream)).ReadRaw(); err == nil || err == io.EOF {
+			t.Errorf("%q: expected a protocol error, got %v", stream, err)
+		}
+	}
+	//A truncated element is not returned
+	if _, err := NewReader(bytes.NewBufferString("$5\r\nab")).ReadRaw(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a truncated element to fail, got %v", err)
+	}
+}
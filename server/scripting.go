@@ -0,0 +1,496 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/lua"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Scripting:
+	- EVAL script numkeys key [key ...] arg [arg ...] runs a Lua script, keys and args are available
+	  to the script in the KEYS and ARGV tables
+	- EVALSHA sha1 numkeys ... runs a script cached by EVAL or SCRIPT LOAD
+	- EVAL_RO runs a script which can only call read only commands
+	- redis.call() / redis.pcall() run commands through the same dispatch as Command.EvalCommand,
+	  replies are converted to Lua values and the value returned by the script is converted back to RESP
+	- A script runs atomically while holding execMu, once it runs longer than lua-time-limit the
+	  other clients get a BUSY error and can stop it with SCRIPT KILL
+*/
+
+var (
+	//Compiled scripts by the SHA1 digest of their body, guarded by execMu
+	scriptCache = map[string]*cachedScript{}
+
+	//INFO: The running script is looked at by the connection loop of the other clients while the
+	//script holds execMu, so it is guarded by its own lock.
+	scriptMu      sync.Mutex
+	runningScript *scriptRun
+
+	errNoScript     = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+	errScriptKilled = errors.New("ERR Script killed by user with SCRIPT KILL...")
+)
+
+// State of a script while it runs
+type scriptRun struct {
+	sha      string
+	start    time.Time
+	readOnly bool
+
+	//Guarded by scriptMu
+	killed    bool
+	wroteData bool
+	slowLog   bool
+}
+
+func sha1hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// A script of the cache, its body is kept for the commands that need to send it again
+type cachedScript struct {
+	body  string
+	proto *lua.Proto
+}
+
+// Compiles the script and adds it to the cache
+func loadScript(body string) (string, *lua.Proto, error) {
+	sha := sha1hex(body)
+	if script, ok := scriptCache[sha]; ok {
+		return sha, script.proto, nil
+	}
+	proto, err := lua.Compile(body, "user_script")
+	if err != nil {
+		return "", nil, fmt.Errorf("ERR Error compiling script (new function): %s", err)
+	}
+	scriptCache[sha] = &cachedScript{body: body, proto: proto}
+	return sha, proto, nil
+}
+
+func (cmd *Command) evalEVAL() ([]byte, error) {
+	var sha string
+	var proto *lua.Proto
+	if cmd.name() == COMMAND_EVALSHA {
+		sha = strings.ToLower(cmd.Args[0])
+		script := scriptCache[sha]
+		if script == nil {
+			return nil, errNoScript
+		}
+		proto = script.proto
+	} else {
+		var err error
+		if sha, proto, err = loadScript(cmd.Args[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	numKeys, err := strconv.Atoi(cmd.Args[1])
+	if err != nil {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	if numKeys < 0 {
+		return nil, errors.New("ERR Number of keys can't be negative")
+	}
+	if numKeys > len(cmd.Args)-2 {
+		return nil, errors.New("ERR Number of keys can't be greater than number of args")
+	}
+
+	run := &scriptRun{sha: sha, start: time.Now(), readOnly: cmd.name() == COMMAND_EVAL_RO}
+	return run.execute(proto, cmd.Args[2:2+numKeys], cmd.Args[2+numKeys:])
+}
+
+func (run *scriptRun) execute(proto *lua.Proto, keys []string, args []string) ([]byte, error) {
+	L := lua.NewState()
+	L.SetGlobal("KEYS", stringsToTable(keys))
+	L.SetGlobal("ARGV", stringsToTable(args))
+	L.SetGlobal("redis", run.redisLib())
+	L.Hook = run.hook
+	protectGlobals(L)
+
+	scriptMu.Lock()
+	runningScript = run
+	scriptMu.Unlock()
+	defer func() {
+		scriptMu.Lock()
+		runningScript = nil
+		scriptMu.Unlock()
+	}()
+
+	rets, err := L.Call(L.NewFunction(proto))
+	if err != nil {
+		if err == errScriptKilled {
+			return nil, err
+		}
+		if e, ok := err.(*lua.Error); ok {
+			//Errors raised with a table, like the ones of redis.call(), are replied as they are
+			if t, ok := e.Value.(*lua.Table); ok {
+				if msg, ok := t.Get("err").(string); ok {
+					return nil, errors.New(msg)
+				}
+			}
+		}
+		return nil, fmt.Errorf("ERR Error running script (call to f_%s): @%s", run.sha, err)
+	}
+
+	var result lua.Value
+	if len(rets) > 0 {
+		result = rets[0]
+	}
+	return luaToResp(result, 0), nil
+}
+
+// Called periodically by the interpreter, stops the script once it is killed
+func (run *scriptRun) hook() error {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+	if run.killed {
+		return errScriptKilled
+	}
+	if elapsed := time.Since(run.start); !run.slowLog && elapsed > time.Duration(config.LuaTimeLimit)*time.Millisecond {
+		run.slowLog = true
+		log.Println("Slow script detected: still in execution after", elapsed.Milliseconds(), "milliseconds. You can try killing the script using the SCRIPT KILL command.")
+	}
+	return nil
+}
+
+// Creates the redis table scripts use to talk to the server
+func (run *scriptRun) redisLib() *lua.Table {
+	lib := lua.NewTable()
+	register := func(name string, fn func(L *lua.State, args []lua.Value) []lua.Value) {
+		lib.Set(name, &lua.GoFunction{Name: name, Fn: fn})
+	}
+
+	register("call", func(L *lua.State, args []lua.Value) []lua.Value {
+		return run.call(L, args, true)
+	})
+	register("pcall", func(L *lua.State, args []lua.Value) []lua.Value {
+		return run.call(L, args, false)
+	})
+	register("error_reply", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{replyTable("err", stringArg(L, args, "error_reply"))}
+	})
+	register("status_reply", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{replyTable("ok", stringArg(L, args, "status_reply"))}
+	})
+	register("sha1hex", func(L *lua.State, args []lua.Value) []lua.Value {
+		return []lua.Value{sha1hex(stringArg(L, args, "sha1hex"))}
+	})
+	register("log", func(L *lua.State, args []lua.Value) []lua.Value {
+		if len(args) < 2 {
+			L.RaiseError("redis.log() requires two arguments or more.")
+		}
+		parts := make([]string, 0, len(args)-1)
+		for _, a := range args[1:] {
+			parts = append(parts, lua.ToString(a))
+		}
+		log.Println("Script log:", strings.Join(parts, " "))
+		return nil
+	})
+	lib.Set("LOG_DEBUG", 0.0)
+	lib.Set("LOG_VERBOSE", 1.0)
+	lib.Set("LOG_NOTICE", 2.0)
+	lib.Set("LOG_WARNING", 3.0)
+	return lib
+}
+
+// redis.call() and redis.pcall(), raise tells if an error reply is raised as a Lua error
+func (run *scriptRun) call(L *lua.State, args []lua.Value, raise bool) []lua.Value {
+	if len(args) == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+	tokens := make([]string, len(args))
+	for i, a := range args {
+		switch v := a.(type) {
+		case string:
+			tokens[i] = v
+		case float64:
+			tokens[i] = lua.NumberToString(v)
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	cmd := &Command{Cmd: tokens[0], Args: tokens[1:]}
+	var reply []byte
+	if err := run.checkCommand(cmd); err != nil {
+		reply = response.EncodeError(err)
+	} else {
+		feedMonitors("lua", cmd)
+		reply = evalCommand(cmd)
+	}
+
+	value, err := response.DecodeReply(reply)
+	if err != nil {
+		L.RaiseError("ERR failed to decode the reply of '%s': %s", cmd.name(), err)
+	}
+	if e, ok := value.(response.ErrorReply); ok && raise {
+		L.Raise(replyTable("err", string(e)))
+	}
+	return []lua.Value{respToLua(value)}
+}
+
+// Validates a command called by the script
+func (run *scriptRun) checkCommand(cmd *Command) error {
+	spec, ok := commandTable[cmd.name()]
+	if !ok {
+		return errors.New("ERR Unknown Redis command called from script")
+	}
+	if spec.flags&CMD_FLAG_NOSCRIPT != 0 {
+		return errors.New("ERR This Redis command is not allowed from script")
+	}
+	if err := cmd.checkArity(); err != nil {
+		return err
+	}
+	if currentClient != nil {
+		if err := currentClient.checkPermissions(cmd, "lua"); err != nil {
+			return err
+		}
+	}
+	if spec.flags&CMD_FLAG_WRITE != 0 {
+		if run.readOnly {
+			return errors.New("ERR Write commands are not allowed from read-only scripts.")
+		}
+		scriptMu.Lock()
+		run.wroteData = true
+		scriptMu.Unlock()
+	}
+	return nil
+}
+
+func stringArg(L *lua.State, args []lua.Value, fname string) string {
+	if len(args) == 0 {
+		L.RaiseError("wrong number or type of arguments")
+	}
+	s, ok := args[0].(string)
+	if !ok {
+		if n, isNumber := args[0].(float64); isNumber {
+			return lua.NumberToString(n)
+		}
+		L.RaiseError("bad argument #1 to '%s' (string expected, got %s)", fname, lua.TypeName(args[0]))
+	}
+	return s
+}
+
+// Status and error replies are tables with a single ok or err field
+func replyTable(field string, msg string) *lua.Table {
+	t := lua.NewTable()
+	t.Set(field, msg)
+	return t
+}
+
+func stringsToTable(values []string) *lua.Table {
+	t := lua.NewTable()
+	for _, v := range values {
+		t.Append(v)
+	}
+	return t
+}
+
+// Scripts can not create global variables nor read undefined ones
+func protectGlobals(L *lua.State) {
+	meta := lua.NewTable()
+	meta.Set("__newindex", &lua.GoFunction{Name: "__newindex", Fn: func(L *lua.State, args []lua.Value) []lua.Value {
+		L.RaiseError("Script attempted to create global variable '%s'", lua.ToString(args[1]))
+		return nil
+	}})
+	meta.Set("__index", &lua.GoFunction{Name: "__index", Fn: func(L *lua.State, args []lua.Value) []lua.Value {
+		L.RaiseError("Script attempted to access nonexistent global variable '%s'", lua.ToString(args[1]))
+		return nil
+	}})
+	//INFO: The metatable can not be read nor replaced, and rawset can not create globals either
+	meta.Set("__metatable", false)
+	rawset := L.GetGlobal("rawset").(*lua.GoFunction)
+	L.SetGlobal("rawset", &lua.GoFunction{Name: "rawset", Fn: func(L *lua.State, args []lua.Value) []lua.Value {
+		if len(args) > 1 && args[0] == L.Globals && L.Globals.Get(args[1]) == nil {
+			L.RaiseError("Script attempted to create global variable '%s'", lua.ToString(args[1]))
+		}
+		return rawset.Fn(L, args)
+	}})
+	L.Globals.SetMetatable(meta)
+}
+
+/**
+Converts a reply decoded with response.DecodeReply to a Lua value:
+	- integers -> numbers, bulk strings -> strings, arrays -> tables
+	- null bulk strings and null arrays -> false
+	- status replies -> table with an ok field, error replies -> table with an err field
+*/
+func respToLua(value interface{}) lua.Value {
+	switch v := value.(type) {
+	case int64:
+		return float64(v)
+	case string:
+		return v
+	case response.SimpleString:
+		return replyTable("ok", string(v))
+	case response.ErrorReply:
+		return replyTable("err", string(v))
+	case []interface{}:
+		t := lua.NewTable()
+		for _, elem := range v {
+			t.Append(respToLua(elem))
+		}
+		return t
+	}
+	return false
+}
+
+// Tables nested deeper than this can not be converted to a reply
+const maxReplyDepth = 100
+
+/**
+Converts the value returned by a script to a RESP reply:
+	- numbers -> integers (the fractional part is dropped), strings -> bulk strings
+	- true -> 1, false and nil -> null bulk string
+	- tables with an ok or err field -> status or error reply
+	- other tables -> arrays, up to the first nil element
+*/
+func luaToResp(value lua.Value, depth int) []byte {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return response.Encode(1, false)
+		}
+	case float64:
+		return response.Encode(int64(v), false)
+	case string:
+		return response.Encode(v, false)
+	case *lua.Table:
+		if ok, isString := v.Get("ok").(string); isString {
+			return response.Encode(ok, true)
+		}
+		if msg, isString := v.Get("err").(string); isString {
+			return response.EncodeError(errors.New(msg))
+		}
+		if depth >= maxReplyDepth {
+			return response.EncodeError(errors.New("ERR reached lua stack limit"))
+		}
+		var items [][]byte
+		for i := 1; ; i++ {
+			elem := v.Get(float64(i))
+			if elem == nil {
+				break
+			}
+			items = append(items, luaToResp(elem, depth+1))
+		}
+		return response.EncodeArray(items)
+	}
+	return response.Encode(nil, false)
+}
+
+func (cmd *Command) evalSCRIPT() ([]byte, error) {
+	switch strings.ToLower(cmd.Args[0]) {
+	case "load":
+		if len(cmd.Args) != 2 {
+			return nil, errors.New("ERR wrong number of arguments for 'script|load' command")
+		}
+		sha, _, err := loadScript(cmd.Args[1])
+		if err != nil {
+			return nil, err
+		}
+		return response.Encode(sha, false), nil
+	case "exists":
+		if len(cmd.Args) < 2 {
+			return nil, errors.New("ERR wrong number of arguments for 'script|exists' command")
+		}
+		replies := make([][]byte, 0, len(cmd.Args)-1)
+		for _, sha := range cmd.Args[1:] {
+			exists := 0
+			if _, ok := scriptCache[strings.ToLower(sha)]; ok {
+				exists = 1
+			}
+			replies = append(replies, response.Encode(exists, false))
+		}
+		return response.EncodeArray(replies), nil
+	case "flush":
+		if len(cmd.Args) > 2 || (len(cmd.Args) == 2 && !strings.EqualFold(cmd.Args[1], "sync") && !strings.EqualFold(cmd.Args[1], "async")) {
+			return nil, errors.New("ERR SCRIPT FLUSH only support SYNC|ASYNC option")
+		}
+		scriptCache = map[string]*cachedScript{}
+		return response.Encode("OK", true), nil
+	case "kill":
+		//A script that is still running is killed by busyScriptReply before the command gets here
+		return nil, errors.New("NOTBUSY No scripts in execution right now.")
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try SCRIPT HELP.", cmd.Args[0])
+}
+
+/**
+While a script runs past lua-time-limit, the commands of the other clients are not queued
+behind it but answered right away: SCRIPT KILL stops the script, everything else gets BUSY.
+Like when no script runs, a command the user of the client is not allowed to run is refused first.
+Returns false when no script is busy and the command must be executed normally.
+*/
+func busyScriptReply(c *Client, cmd *Command) ([]byte, bool) {
+	scriptMu.Lock()
+	defer scriptMu.Unlock()
+
+	run := runningScript
+	if run == nil || time.Since(run.start) < time.Duration(config.LuaTimeLimit)*time.Millisecond {
+		return nil, false
+	}
+	context := "toplevel"
+	if c.inMulti {
+		context = "multi"
+	}
+	if err := c.checkPermissions(cmd, context); err != nil {
+		if c.inMulti {
+			c.multiError = true
+		}
+		return response.EncodeError(err), true
+	}
+	if cmd.name() == COMMAND_SCRIPT && len(cmd.Args) == 1 && strings.EqualFold(cmd.Args[0], "kill") {
+		if run.wroteData {
+			return response.EncodeError(errors.New("UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.")), true
+		}
+		run.killed = true
+		return response.Encode("OK", true), true
+	}
+	return response.EncodeError(errors.New("BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.")), true
+}
+
+// How often a command waiting for execMu checks if the script holding it went past lua-time-limit
+const busyScriptCheckInterval = 10 * time.Millisecond
+
+// Takes execMu to run the command of the client. A command that was already waiting when the script
+// holding execMu went past lua-time-limit gets the reply of busyScriptReply instead, it is written
+// and false is returned without holding execMu.
+func lockExecMu(c *Client, cmd *Command) bool {
+	if execMu.TryLock() {
+		return true
+	}
+	locked := make(chan struct{})
+	go func() {
+		execMu.Lock()
+		close(locked)
+	}()
+	ticker := time.NewTicker(busyScriptCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-locked:
+			return true
+		case <-ticker.C:
+			if reply, busy := busyScriptReply(c, cmd); busy {
+				//INFO: The lock is still taken once the script is done, it is released right away
+				go func() {
+					<-locked
+					execMu.Unlock()
+				}()
+				c.write(reply)
+				return false
+			}
+		}
+	}
+}
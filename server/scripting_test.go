@@ -0,0 +1,129 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+func TestEval(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(replyPONG, "EVAL", "return redis.call('ping')", "0")
+	c.expect("hello", "EVAL", "return redis.call('ping', ARGV[1])", "0", "hello")
+	c.expect(array(int64(1), "two", "a"), "EVAL", "return {1, 'two', KEYS[1]}", "1", "a")
+	c.expectError("ERR Number of keys can't be greater than number of args", "EVAL", "return 1", "2", "a")
+	c.expectError("ERR wrong number of arguments for 'ping' command", "EVAL", "return redis.call('ping', 'a', 'b')", "0")
+	c.expect(response.ErrorReply("ERR wrong number of arguments for 'ping' command"), "EVAL", "return redis.pcall('ping', 'a', 'b')", "0")
+
+	sha := c.do("SCRIPT", "LOAD", "return ARGV[1]")
+	c.expect(array(int64(1), int64(0)), "SCRIPT", "EXISTS", sha.(string), "0000")
+	c.expect("hello", "EVALSHA", sha.(string), "0", "hello")
+	c.expect(replyOK, "SCRIPT", "FLUSH")
+	c.expectError("NOSCRIPT", "EVALSHA", sha.(string), "0")
+}
+
+func TestEvalSandbox(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	cases := map[string]string{
+		"return string.rep('x', 2^40)": "string length overflow",
+		"x = 1":                        "Script attempted to create global variable 'x'",
+		"rawset(_G, 'x', 1)":           "Script attempted to create global variable 'x'",
+		"setmetatable(_G, nil) x = 1":  "cannot change a protected metatable",
+		"return y":                     "Script attempted to access nonexistent global variable 'y'",
+	}
+	for script, expected := range cases {
+		reply, ok := c.do("EVAL", script, "0").(response.ErrorReply)
+		if !ok || !strings.HasPrefix(string(reply), "ERR Error running script") || !strings.Contains(string(reply), expected) {
+			t.Errorf("%q replied %#v, expected %q", script, reply, expected)
+		}
+	}
+	//Existing globals can still be replaced
+	c.expect(int64(1), "EVAL", "rawset(_G, 'KEYS', 1) return KEYS", "0")
+	//The metatable guarding the globals is hidden
+	c.expect(nil, "EVAL", "return getmetatable(_G)", "0")
+}
+
+// Waits until the server replies BUSY to the client, the script started by another client runs past lua-time-limit
+func waitBusy(t *testing.T, c *testClient) {
+	deadline := time.Now().Add(testReplyTimeout)
+	for time.Now().Before(deadline) {
+		if err, ok := c.do("PING").(response.ErrorReply); ok && string(err[:4]) == "BUSY" {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("the script never became busy")
+}
+
+func TestScriptKill(t *testing.T) {
+	setupTestServer(t)
+	config.LuaTimeLimit = 10
+	script := connect(t)
+	admin := connect(t)
+
+	admin.expectError("NOTBUSY", "SCRIPT", "KILL")
+	script.send("EVAL", "while true do end", "0")
+	waitBusy(t, admin)
+
+	admin.expect(replyOK, "SCRIPT", "KILL")
+	if reply := script.read(); reply != response.ErrorReply(errScriptKilled.Error()) {
+		t.Errorf("the script replied %#v", reply)
+	}
+	admin.expect(replyPONG, "PING")
+}
+
+// The ACL rules are checked before SCRIPT KILL and BUSY replies
+// The commands sent before the script went past lua-time-limit wait for it, they get BUSY once it does
+func TestScriptBusyWaiters(t *testing.T) {
+	setupTestServer(t)
+	config.LuaTimeLimit = 200
+	script := connect(t)
+	waiter := connect(t)
+	killer := connect(t)
+	//INFO: The connections are registered holding execMu, they must be served before the script takes it
+	waiter.expect(replyPONG, "PING")
+	killer.expect(replyPONG, "PING")
+
+	script.send("EVAL", "while true do end", "0")
+	waitScriptRunning(t)
+	waiter.send("SIM.ADD", "a", "x")
+	//INFO: SCRIPT KILL is only sent once the waiting command got BUSY, the script could be killed before
+	if reply, ok := waiter.read().(response.ErrorReply); !ok || !strings.HasPrefix(string(reply), "BUSY") {
+		t.Errorf("the waiting command replied %#v", reply)
+	}
+	killer.expect(replyOK, "SCRIPT", "KILL")
+	if reply := script.read(); reply != response.ErrorReply(errScriptKilled.Error()) {
+		t.Errorf("the script replied %#v", reply)
+	}
+	waiter.expect(int64(1), "SIM.ADD", "a", "x")
+}
+
+func TestScriptKillPermissions(t *testing.T) {
+	setupTestServer(t)
+	config.LuaTimeLimit = 10
+	script := connect(t)
+	admin := connect(t)
+	limited := connect(t)
+
+	admin.expect(replyOK, "ACL", "SETUSER", "limited", "on", "nopass", "+@all", "-@scripting", "-sim.add")
+	limited.expect(replyOK, "AUTH", "limited", "any")
+
+	script.send("EVAL", "while true do end", "0")
+	waitBusy(t, admin)
+
+	//A user that can not run SCRIPT can not kill the script, nor learn that one is running
+	limited.expectError("NOPERM User limited has no permissions to run the 'script' command", "SCRIPT", "KILL")
+	limited.expectError("NOPERM User limited has no permissions to run the 'sim.add' command", "SIM.ADD", "a", "x")
+	limited.expectError("BUSY", "PING")
+	admin.expect(replyOK, "SCRIPT", "KILL")
+	if reply := script.read(); reply != response.ErrorReply(errScriptKilled.Error()) {
+		t.Errorf("the script replied %#v", reply)
+	}
+}
@@ -0,0 +1,964 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Sentinel mode, enabled by sentinel, monitors a master and its replicas like redis sentinel does. The server then
+serves no dataset, only the SENTINEL command and the commands of pub/sub:
+	- the master is given by sentinel-monitor, or by SENTINEL MONITOR. The sentinel PINGs it every second, sends
+	  it INFO every 10 seconds and learns its replicas from the INFO replication section, then monitors the
+	  replicas the same way. The instances are sent RESP and their replies are read with response.Reader, with
+	  masteruser and masterauth to authenticate and with TLS when tls-replication is set.
+	- the sentinels monitoring the same master find each other through the __sentinel__:hello channel of the
+	  monitored instances: every 2 seconds each sentinel publishes its address, its id, its epoch and the
+	  address and config epoch of the master, and it subscribes to the channel
+	- an instance that does not answer for sentinel-down-after-milliseconds is subjectively down (SDOWN). A
+	  master is objectively down (ODOWN) once quorum sentinels, asked every second with SENTINEL
+	  IS-MASTER-DOWN-BY-ADDR, agree it is down.
+	- a master that is ODOWN is failed over by a sentinel elected by the others, see sentinel_failover.go
+SENTINEL GET-MASTER-ADDR-BY-NAME, MASTERS, MASTER, REPLICAS and SENTINELS report the state of the sentinel. The
+events are published on the pub/sub channel of their name, eg: +sdown or +switch-master, so that clients follow
+the master. The state of the sentinel is kept in memory and guarded by execMu, only the goroutines of an
+instance use the connections to it.
+*/
+
+// Flags of the instances, as reported by SENTINEL MASTERS, REPLICAS and SENTINELS
+const (
+	SRI_MASTER = 1 << iota
+	SRI_SLAVE
+	SRI_SENTINEL
+	SRI_S_DOWN
+	SRI_O_DOWN
+	//The sentinel said the master is down
+	SRI_MASTER_DOWN
+	SRI_FAILOVER_IN_PROGRESS
+	//The replica promoted by the failover
+	SRI_PROMOTED
+	//The replica was told to replicate the promoted replica, then it replicated it
+	SRI_RECONF_SENT
+	SRI_RECONF_DONE
+	//The failover was asked with SENTINEL FAILOVER, the sentinel runs it without being elected
+	SRI_FORCE_FAILOVER
+)
+
+var sentinelFlagNames = []struct {
+	flag int
+	name string
+}{
+	{SRI_MASTER, "master"},
+	{SRI_SLAVE, "slave"},
+	{SRI_SENTINEL, "sentinel"},
+	{SRI_S_DOWN, "s_down"},
+	{SRI_O_DOWN, "o_down"},
+	{SRI_MASTER_DOWN, "master_down"},
+	{SRI_FAILOVER_IN_PROGRESS, "failover_in_progress"},
+	{SRI_PROMOTED, "promoted"},
+	{SRI_RECONF_SENT, "reconf_sent"},
+	{SRI_RECONF_DONE, "reconf_done"},
+	{SRI_FORCE_FAILOVER, "force_failover"},
+}
+
+const (
+	//How often the sentinel cron runs, and the commands due are sent to the instances
+	sentinelTickPeriod  = 100 * time.Millisecond
+	sentinelPingPeriod  = time.Second
+	sentinelInfoPeriod  = 10 * time.Second
+	sentinelHelloPeriod = 2 * time.Second
+	//How often the other sentinels are asked if a master that is SDOWN is down
+	sentinelAskPeriod = time.Second
+
+	sentinelHelloChannel = "__sentinel__:hello"
+)
+
+type sentinelInstance struct {
+	flags int
+	//The name of a master, ip:port for a replica and the id of a sentinel
+	name string
+	ip   string
+	port int
+	//The id the instance reports, the run_id of INFO for the servers
+	runid string
+	//The master of a replica or of a sentinel, nil for a master
+	master *sentinelInstance
+
+	//Closed when the goroutines of the instance must stop
+	stop    chan struct{}
+	stopped bool
+	//The connection commands are sent on and the connection the hello messages are read from
+	conn      net.Conn
+	pubsub    net.Conn
+	connected bool
+	//Commands queued for the instance, eg: the REPLICAOF of a failover
+	pending [][]string
+
+	//When the instance last answered a PING, when the oldest PING it did not answer was sent and when the last
+	//PING was sent
+	lastAvail time.Time
+	pingSent  time.Time
+	lastPing  time.Time
+	//When INFO was last sent and answered
+	lastInfo    time.Time
+	infoRefresh time.Time
+	lastHello   time.Time
+	sdownSince  time.Time
+
+	//The role the instance reports in INFO and since when, and for a replica the link to its master
+	role         string
+	roleReported time.Time
+	masterHost   string
+	masterPort   int
+	masterLinkUp bool
+	replOffset   int64
+	priority     int
+	//When the replica was last told to replicate the master it should
+	lastReconf time.Time
+
+	//A master: the sentinels that must agree it is down, its replicas by ip:port and the other sentinels by id
+	quorum      int
+	replicas    map[string]*sentinelInstance
+	sentinels   map[string]*sentinelInstance
+	odownSince  time.Time
+	configEpoch uint64
+	//The sentinel this sentinel voted for to fail the master over and the epoch of the vote. For another
+	//sentinel the sentinel it voted for.
+	leader      string
+	leaderEpoch uint64
+
+	//A sentinel: when it was last asked, and answered, if the master is down
+	lastAsk             time.Time
+	lastMasterDownReply time.Time
+
+	//The failover of a master, see sentinel_failover.go
+	failoverState       int
+	failoverEpoch       uint64
+	failoverStart       time.Time
+	failoverStateChange time.Time
+	promoted            *sentinelInstance
+}
+
+type sentinelState struct {
+	myid         string
+	currentEpoch uint64
+	masters      map[string]*sentinelInstance
+	stop         chan struct{}
+	//The goroutines of the sentinel, stopSentinel waits for them
+	running sync.WaitGroup
+}
+
+var (
+	//The state of the sentinel, nil when sentinel mode is disabled. Guarded by execMu.
+	sentinel *sentinelState
+
+	errSentinelDisabled = errors.New("ERR This instance has sentinel support disabled")
+	errNoSuchMaster     = errors.New("ERR No such master with that name")
+)
+
+// Starts sentinel mode when it is enabled, monitoring the master of sentinel-monitor
+func startConfiguredSentinel() error {
+	if !config.Sentinel {
+		return nil
+	}
+	if config.ClusterEnabled || config.RaftID != 0 || config.ReplicaOf != "" || config.AppendOnly {
+		return errors.New("sentinel can not be used with cluster-enabled, raft-id, replicaof or appendonly")
+	}
+	execMu.Lock()
+	defer execMu.Unlock()
+	startSentinel()
+	if config.SentinelMonitor == "" {
+		return nil
+	}
+	fields := strings.Fields(config.SentinelMonitor)
+	if len(fields) != 4 {
+		return fmt.Errorf("sentinel-monitor must be \"name host port quorum\", got %q", config.SentinelMonitor)
+	}
+	return sentinelMonitor(fields[0], fields[1], fields[2], fields[3])
+}
+
+// Starts sentinel mode monitoring no master, must be called holding execMu
+func startSentinel() {
+	sentinel = &sentinelState{
+		myid:    randomHex(40),
+		masters: map[string]*sentinelInstance{},
+		stop:    make(chan struct{}),
+	}
+	log.Println("Sentinel ID is", sentinel.myid)
+	sentinel.running.Add(1)
+	go sentinelCron(sentinel.stop, &sentinel.running)
+}
+
+// Stops sentinel mode, the connections to the instances are closed and its goroutines are waited for
+func stopSentinel() {
+	execMu.Lock()
+	state := sentinel
+	if state == nil {
+		execMu.Unlock()
+		return
+	}
+	close(state.stop)
+	for _, master := range state.masters {
+		master.closeAll()
+	}
+	sentinel = nil
+	execMu.Unlock()
+	state.running.Wait()
+}
+
+func sentinelCron(stop <-chan struct{}, running *sync.WaitGroup) {
+	defer running.Done()
+	ticker := time.NewTicker(sentinelTickPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		execMu.Lock()
+		if sentinel != nil {
+			now := time.Now()
+			for _, master := range sentinel.masters {
+				sentinelHandleMaster(master, now)
+			}
+		}
+		execMu.Unlock()
+	}
+}
+
+// In sentinel mode the server serves no dataset, the other commands are unknown like they are to redis sentinel
+func checkSentinelCommand(cmd *Command) error {
+	if sentinel == nil {
+		return nil
+	}
+	switch cmd.name() {
+	case COMMAND_PING, COMMAND_SENTINEL, COMMAND_INFO, COMMAND_ROLE, COMMAND_PUBLISH, COMMAND_PUBSUB:
+		return nil
+	}
+	var args strings.Builder
+	for _, arg := range cmd.Args {
+		fmt.Fprintf(&args, "'%s' ", arg)
+	}
+	return fmt.Errorf("ERR unknown command '%s', with args beginning with: %s", cmd.Cmd, args.String())
+}
+
+// Creates the instance and starts its goroutines, must be called holding execMu
+func newSentinelInstance(flags int, name string, ip string, port int, master *sentinelInstance) *sentinelInstance {
+	ri := &sentinelInstance{
+		flags:     flags,
+		name:      name,
+		ip:        ip,
+		port:      port,
+		master:    master,
+		stop:      make(chan struct{}),
+		lastAvail: time.Now(),
+		priority:  100,
+	}
+	if flags&SRI_MASTER != 0 {
+		ri.replicas = map[string]*sentinelInstance{}
+		ri.sentinels = map[string]*sentinelInstance{}
+	}
+	sentinel.running.Add(1)
+	go ri.run(&sentinel.running)
+	if flags&SRI_SENTINEL == 0 {
+		sentinel.running.Add(1)
+		go ri.subscribeHello(&sentinel.running)
+	}
+	return ri
+}
+
+// Stops the goroutines of the instance and closes its connections, must be called holding execMu
+func (ri *sentinelInstance) close() {
+	if ri.stopped {
+		return
+	}
+	ri.stopped = true
+	close(ri.stop)
+	if ri.conn != nil {
+		ri.conn.Close()
+	}
+	if ri.pubsub != nil {
+		ri.pubsub.Close()
+	}
+}
+
+// Closes the master, its replicas and its sentinels
+func (ri *sentinelInstance) closeAll() {
+	ri.close()
+	for _, replica := range ri.replicas {
+		replica.close()
+	}
+	for _, si := range ri.sentinels {
+		si.close()
+	}
+}
+
+func (ri *sentinelInstance) addr() string {
+	return net.JoinHostPort(ri.ip, strconv.Itoa(ri.port))
+}
+
+// The master of a replica or of a sentinel, the instance itself for a master
+func (ri *sentinelInstance) monitored() *sentinelInstance {
+	if ri.master != nil {
+		return ri.master
+	}
+	return ri
+}
+
+func sentinelDownAfter() time.Duration {
+	return time.Duration(config.SentinelDownAfter) * time.Millisecond
+}
+
+func sentinelFailoverTimeout() time.Duration {
+	return time.Duration(config.SentinelFailoverTimeout) * time.Millisecond
+}
+
+// The instances are PINGed every second, or every down-after when it is shorter
+func sentinelInstancePingPeriod() time.Duration {
+	if downAfter := sentinelDownAfter(); downAfter < sentinelPingPeriod {
+		return downAfter
+	}
+	return sentinelPingPeriod
+}
+
+// The replicas of a master that is down, or that is failed over, are sent INFO every second to follow their role
+func (ri *sentinelInstance) infoPeriod() time.Duration {
+	if ri.flags&SRI_SLAVE != 0 && ri.master.flags&(SRI_O_DOWN|SRI_FAILOVER_IN_PROGRESS) != 0 {
+		return time.Second
+	}
+	return sentinelInfoPeriod
+}
+
+// Describes the instance in the events as <type> <name> <ip> <port>, followed by @ <master name> <ip> <port> for
+// the replicas and the sentinels
+func (ri *sentinelInstance) describe() string {
+	typ := "master"
+	switch {
+	case ri.flags&SRI_SLAVE != 0:
+		typ = "slave"
+	case ri.flags&SRI_SENTINEL != 0:
+		typ = "sentinel"
+	}
+	s := fmt.Sprintf("%s %s %s %d", typ, ri.name, ri.ip, ri.port)
+	if ri.master != nil {
+		s += fmt.Sprintf(" @ %s %s %d", ri.master.name, ri.master.ip, ri.master.port)
+	}
+	return s
+}
+
+// Logs the event and publishes it on the channel of its name. The message describes the instance, when there is
+// one, followed by the details.
+func sentinelEvent(event string, ri *sentinelInstance, details string) {
+	message := details
+	if ri != nil {
+		message = strings.TrimSpace(ri.describe() + " " + details)
+	}
+	log.Println(event, message)
+	publish(event, message)
+}
+
+// Connects to the instance and authenticates with masteruser and masterauth when masterauth is set
+func (ri *sentinelInstance) connect() (net.Conn, *response.Reader, error) {
+	conn, err := dialInstance(ri.ip, ri.port, sentinelDownAfter())
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := response.NewReader(conn)
+	if user, password := config.MasterUser, config.MasterAuth; password != "" {
+		args := []string{"AUTH", password}
+		if user != "" {
+			args = []string{"AUTH", user, password}
+		}
+		reply, err := sentinelSend(conn, rd, args)
+		if err == nil {
+			if e, ok := reply.(response.ErrorReply); ok {
+				err = fmt.Errorf("unable to AUTH to %s: %s", ri.addr(), e)
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, rd, nil
+}
+
+// Sends the command and reads its reply, the instance must reply within down-after
+func sentinelSend(conn net.Conn, rd *response.Reader, args []string) (interface{}, error) {
+	conn.SetDeadline(time.Now().Add(sentinelDownAfter()))
+	if _, err := conn.Write((&Command{Cmd: args[0], Args: args[1:]}).encode()); err != nil {
+		return nil, err
+	}
+	return rd.ReadReply()
+}
+
+// Connects to the instance and sends it the commands due every tick until it is closed
+func (ri *sentinelInstance) run(running *sync.WaitGroup) {
+	defer running.Done()
+	ticker := time.NewTicker(sentinelTickPeriod)
+	defer ticker.Stop()
+	var conn net.Conn
+	var rd *response.Reader
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	for {
+		select {
+		case <-ri.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if conn == nil {
+			c, r, err := ri.connect()
+			execMu.Lock()
+			if ri.stopped {
+				if err == nil {
+					c.Close()
+				}
+				execMu.Unlock()
+				return
+			}
+			if err == nil {
+				conn, rd = c, r
+				ri.conn, ri.connected = conn, true
+			}
+			execMu.Unlock()
+			if err != nil {
+				continue
+			}
+		}
+
+		execMu.Lock()
+		if ri.stopped {
+			execMu.Unlock()
+			return
+		}
+		commands := ri.dueCommands(time.Now(), conn)
+		execMu.Unlock()
+
+		for _, args := range commands {
+			reply, err := sentinelSend(conn, rd, args)
+			execMu.Lock()
+			if ri.stopped {
+				execMu.Unlock()
+				return
+			}
+			if err != nil {
+				conn.Close()
+				conn, rd = nil, nil
+				ri.conn, ri.connected = nil, false
+				execMu.Unlock()
+				break
+			}
+			ri.processReply(args, reply, time.Now())
+			execMu.Unlock()
+		}
+	}
+}
+
+// Returns the commands to send to the instance now: the commands queued, INFO, the hello message, the question
+// to the other sentinels and PING. Must be called holding execMu.
+func (ri *sentinelInstance) dueCommands(now time.Time, conn net.Conn) [][]string {
+	commands := ri.pending
+	ri.pending = nil
+	master := ri.monitored()
+	if ri.flags&SRI_SENTINEL == 0 {
+		//INFO is sent again until it is answered
+		if (ri.infoRefresh.IsZero() || now.Sub(ri.infoRefresh) >= ri.infoPeriod()) && now.Sub(ri.lastInfo) >= sentinelPingPeriod {
+			commands = append(commands, []string{"INFO"})
+			ri.lastInfo = now
+		}
+		if now.Sub(ri.lastHello) >= sentinelHelloPeriod {
+			commands = append(commands, []string{"PUBLISH", sentinelHelloChannel, sentinelHello(master, conn)})
+			ri.lastHello = now
+		}
+	} else if master.flags&SRI_S_DOWN != 0 && now.Sub(ri.lastAsk) >= sentinelAskPeriod {
+		//The sentinel asks for votes while it fails the master over
+		runid := "*"
+		if master.failoverState != SENTINEL_FAILOVER_STATE_NONE {
+			runid = sentinel.myid
+		}
+		commands = append(commands, []string{"SENTINEL", "IS-MASTER-DOWN-BY-ADDR", master.ip, strconv.Itoa(master.port),
+			strconv.FormatUint(sentinel.currentEpoch, 10), runid})
+		ri.lastAsk = now
+	}
+	period := sentinelInstancePingPeriod()
+	if now.Sub(ri.lastAvail) > period && now.Sub(ri.lastPing) > period/2 {
+		commands = append(commands, []string{"PING"})
+		if ri.pingSent.IsZero() {
+			ri.pingSent = now
+		}
+		ri.lastPing = now
+	}
+	return commands
+}
+
+// The hello message: the address, id and epoch of this sentinel then the name, address and config epoch of the master
+func sentinelHello(master *sentinelInstance, conn net.Conn) string {
+	ip := config.SentinelAnnounceIP
+	if ip == "" {
+		ip, _, _ = net.SplitHostPort(conn.LocalAddr().String())
+	}
+	return fmt.Sprintf("%s,%d,%s,%d,%s,%s,%d,%d", ip, config.Port, sentinel.myid, sentinel.currentEpoch,
+		master.name, master.ip, master.port, master.configEpoch)
+}
+
+// Processes the reply of the instance to the command, must be called holding execMu
+func (ri *sentinelInstance) processReply(args []string, reply interface{}, now time.Time) {
+	e, failed := reply.(response.ErrorReply)
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		//INFO: An instance loading its dataset, or a replica refusing reads without a master, is alive
+		if !failed || strings.HasPrefix(string(e), "LOADING") || strings.HasPrefix(string(e), "MASTERDOWN") {
+			ri.lastAvail, ri.pingSent = now, time.Time{}
+			return
+		}
+	case "INFO":
+		if info, ok := reply.(string); ok {
+			sentinelRefreshInfo(ri, info, now)
+			return
+		}
+	case "SENTINEL":
+		if !failed {
+			sentinelReceiveIsMasterDown(ri, reply, now)
+			return
+		}
+	}
+	if failed {
+		log.Printf("-error %s replied to %s: %s", ri.describe(), strings.Join(args, " "), e)
+	}
+}
+
+// Updates the instance from its INFO, the replicas of a master are discovered from it. Must be called holding execMu.
+func sentinelRefreshInfo(ri *sentinelInstance, info string, now time.Time) {
+	ri.infoRefresh = now
+	role := ""
+	for _, line := range strings.Split(info, "\r\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "run_id":
+			if ri.runid != "" && ri.runid != value {
+				sentinelEvent("+reboot", ri, "")
+			}
+			ri.runid = value
+		case "role":
+			role = value
+		case "master_host":
+			ri.masterHost = value
+		case "master_port":
+			ri.masterPort, _ = strconv.Atoi(value)
+		case "master_link_status":
+			ri.masterLinkUp = value == "up"
+		case "slave_repl_offset":
+			ri.replOffset, _ = strconv.ParseInt(value, 10, 64)
+		case "slave_priority":
+			ri.priority, _ = strconv.Atoi(value)
+		default:
+			//slave<n>:ip=<ip>,port=<port>,... lists the replicas of a master
+			if _, err := strconv.Atoi(strings.TrimPrefix(key, "slave")); err != nil || !strings.HasPrefix(key, "slave") || ri.flags&SRI_MASTER == 0 {
+				continue
+			}
+			var ip string
+			var port int
+			for _, field := range strings.Split(value, ",") {
+				name, v, _ := strings.Cut(field, "=")
+				switch name {
+				case "ip":
+					ip = v
+				case "port":
+					port, _ = strconv.Atoi(v)
+				}
+			}
+			if ip != "" && port > 0 {
+				sentinelAddReplica(ri, ip, port)
+			}
+		}
+	}
+	if role != ri.role {
+		ri.role, ri.roleReported = role, now
+	}
+	if ri.flags&SRI_SLAVE != 0 {
+		sentinelRefreshReplicaRole(ri, now)
+	}
+}
+
+// Monitors the replica of the master unless it is known already, must be called holding execMu
+func sentinelAddReplica(master *sentinelInstance, ip string, port int) {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if master.replicas[addr] != nil || (ip == master.ip && port == master.port) {
+		return
+	}
+	replica := newSentinelInstance(SRI_SLAVE, addr, ip, port, master)
+	master.replicas[addr] = replica
+	sentinelEvent("+slave", replica, "")
+}
+
+// Subscribes to the hello channel of the instance and processes the hello messages of the other sentinels
+func (ri *sentinelInstance) subscribeHello(running *sync.WaitGroup) {
+	defer running.Done()
+	for {
+		conn, rd, err := ri.connect()
+		if err == nil {
+			execMu.Lock()
+			if ri.stopped {
+				conn.Close()
+				execMu.Unlock()
+				return
+			}
+			ri.pubsub = conn
+			execMu.Unlock()
+			ri.readHello(conn, rd)
+			conn.Close()
+		}
+		select {
+		case <-ri.stop:
+			return
+		case <-time.After(sentinelPingPeriod):
+		}
+	}
+}
+
+// Reads the hello messages until the connection is lost or closed
+func (ri *sentinelInstance) readHello(conn net.Conn, rd *response.Reader) {
+	if _, err := sentinelSend(conn, rd, []string{"SUBSCRIBE", sentinelHelloChannel}); err != nil {
+		return
+	}
+	//INFO: The messages of the channel are not replies, they can be far apart
+	conn.SetDeadline(time.Time{})
+	for {
+		reply, err := rd.ReadReply()
+		if err != nil {
+			return
+		}
+		message, ok := reply.([]interface{})
+		if !ok || len(message) != 3 || message[0] != "message" {
+			continue
+		}
+		payload, _ := message[2].(string)
+		execMu.Lock()
+		if ri.stopped {
+			execMu.Unlock()
+			return
+		}
+		sentinelProcessHello(payload, time.Now())
+		execMu.Unlock()
+	}
+}
+
+/**
+Processes the hello message of a sentinel: the sentinel is added to the sentinels of the master, and when the
+master has a greater config epoch than the one known it was failed over by another sentinel, the master is
+switched to the address in the message. Must be called holding execMu.
+*/
+func sentinelProcessHello(payload string, now time.Time) {
+	fields := strings.Split(payload, ",")
+	if len(fields) != 8 {
+		return
+	}
+	ip, runid, name, masterIP := fields[0], fields[2], fields[4], fields[5]
+	port, err1 := strconv.Atoi(fields[1])
+	epoch, err2 := strconv.ParseUint(fields[3], 10, 64)
+	masterPort, err3 := strconv.Atoi(fields[6])
+	configEpoch, err4 := strconv.ParseUint(fields[7], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil || runid == sentinel.myid {
+		return
+	}
+	master := sentinel.masters[name]
+	if master == nil {
+		return
+	}
+
+	si := master.sentinels[runid]
+	if si != nil && (si.ip != ip || si.port != port) {
+		si.close()
+		delete(master.sentinels, runid)
+		si = nil
+	}
+	if si == nil {
+		//A sentinel that restarted at the same address has a new id
+		for id, other := range master.sentinels {
+			if other.ip == ip && other.port == port {
+				other.close()
+				delete(master.sentinels, id)
+			}
+		}
+		si = newSentinelInstance(SRI_SENTINEL, runid, ip, port, master)
+		si.runid = runid
+		master.sentinels[runid] = si
+		sentinelEvent("+sentinel", si, "")
+	}
+
+	if epoch > sentinel.currentEpoch {
+		sentinel.currentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, strconv.FormatUint(epoch, 10))
+	}
+	if configEpoch > master.configEpoch {
+		master.configEpoch = configEpoch
+		if masterIP != master.ip || masterPort != master.port {
+			sentinelEvent("+config-update-from", si, "")
+			sentinelSwitchMaster(master, masterIP, masterPort, now)
+		}
+	}
+}
+
+// Monitors the master, must be called holding execMu
+func sentinelMonitor(name string, host string, portArg string, quorumArg string) error {
+	port, err := strconv.Atoi(portArg)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.New("ERR Invalid port")
+	}
+	quorum, err := strconv.Atoi(quorumArg)
+	if err != nil || quorum <= 0 {
+		return errors.New("ERR Quorum must be 1 or greater.")
+	}
+	if sentinel.masters[name] != nil {
+		return errors.New("ERR Duplicated master name")
+	}
+	master := newSentinelInstance(SRI_MASTER, name, host, port, nil)
+	master.quorum = quorum
+	sentinel.masters[name] = master
+	sentinelEvent("+monitor", master, "quorum "+strconv.Itoa(quorum))
+	return nil
+}
+
+// The master monitored at the address, nil when none is
+func sentinelMasterByAddr(ip string, port int) *sentinelInstance {
+	for _, master := range sentinel.masters {
+		if master.ip == ip && master.port == port {
+			return master
+		}
+	}
+	return nil
+}
+
+var sentinelSubcommandArity = map[string]int{
+	"myid": 2, "masters": 2, "master": 3, "replicas": 3, "slaves": 3, "sentinels": 3, "get-master-addr-by-name": 3,
+	"is-master-down-by-addr": 6, "monitor": 6, "remove": 3, "failover": 3,
+}
+
+func (cmd *Command) evalSENTINEL() ([]byte, error) {
+	if sentinel == nil {
+		return nil, errSentinelDisabled
+	}
+	sub := strings.ToLower(cmd.Args[0])
+	arity, ok := sentinelSubcommandArity[sub]
+	if !ok {
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", cmd.Args[0])
+	}
+	tokens := len(cmd.Args) + 1
+	if (arity > 0 && tokens != arity) || (arity < 0 && tokens < -arity) {
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'sentinel|%s' command", sub)
+	}
+	args := cmd.Args[1:]
+	now := time.Now()
+
+	switch sub {
+	case "myid":
+		return response.Encode(sentinel.myid, false), nil
+	case "masters":
+		var names []string
+		for name := range sentinel.masters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([][]byte, len(names))
+		for i, name := range names {
+			list[i] = sentinelInstanceReply(sentinel.masters[name], now)
+		}
+		return response.EncodeArray(list), nil
+	case "get-master-addr-by-name":
+		master := sentinel.masters[args[0]]
+		if master == nil {
+			return response.EncodeNullArray(), nil
+		}
+		//INFO: Once the promoted replica is a master its address is given, before the failover ends
+		addr := master
+		if master.failoverState >= SENTINEL_FAILOVER_STATE_RECONF_SLAVES && master.promoted != nil {
+			addr = master.promoted
+		}
+		return response.EncodeArray([][]byte{response.Encode(addr.ip, false), response.Encode(strconv.Itoa(addr.port), false)}), nil
+	case "is-master-down-by-addr":
+		return sentinelIsMasterDownByAddr(args, now)
+	case "monitor":
+		if err := sentinelMonitor(args[0], args[1], args[2], args[3]); err != nil {
+			return nil, err
+		}
+		return response.Encode("OK", true), nil
+	}
+
+	master := sentinel.masters[args[0]]
+	if master == nil {
+		return nil, errNoSuchMaster
+	}
+	switch sub {
+	case "master":
+		return sentinelInstanceReply(master, now), nil
+	case "replicas", "slaves", "sentinels":
+		instances := master.replicas
+		if sub == "sentinels" {
+			instances = master.sentinels
+		}
+		var names []string
+		for name := range instances {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([][]byte, len(names))
+		for i, name := range names {
+			list[i] = sentinelInstanceReply(instances[name], now)
+		}
+		return response.EncodeArray(list), nil
+	case "remove":
+		master.closeAll()
+		delete(sentinel.masters, master.name)
+		sentinelEvent("-monitor", master, "")
+		return response.Encode("OK", true), nil
+	case "failover":
+		if err := sentinelForceFailover(master, now); err != nil {
+			return nil, err
+		}
+		return response.Encode("OK", true), nil
+	}
+	return nil, nil
+}
+
+/**
+SENTINEL IS-MASTER-DOWN-BY-ADDR <ip> <port> <current epoch> <runid> tells another sentinel if this sentinel
+thinks the master at ip:port is down. With a runid instead of * the sentinel asks for the vote of this sentinel to
+fail the master over in the epoch. The reply is [down, the leader voted for or *, the epoch of the vote].
+*/
+func sentinelIsMasterDownByAddr(args []string, now time.Time) ([]byte, error) {
+	port, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("ERR Invalid port")
+	}
+	epoch, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR Invalid epoch")
+	}
+	master := sentinelMasterByAddr(args[0], port)
+	down, leader, leaderEpoch := 0, "*", uint64(0)
+	if master != nil && master.flags&SRI_S_DOWN != 0 {
+		down = 1
+	}
+	if master != nil && args[3] != "*" {
+		leader, leaderEpoch = sentinelVoteLeader(master, epoch, args[3], now)
+	}
+	return response.EncodeArray([][]byte{
+		response.Encode(down, false),
+		response.Encode(leader, false),
+		response.Encode(int64(leaderEpoch), false),
+	}), nil
+}
+
+// Records the reply of a sentinel to SENTINEL IS-MASTER-DOWN-BY-ADDR, must be called holding execMu
+func sentinelReceiveIsMasterDown(si *sentinelInstance, reply interface{}, now time.Time) {
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 3 {
+		return
+	}
+	down, ok1 := values[0].(int64)
+	leader, ok2 := values[1].(string)
+	epoch, ok3 := values[2].(int64)
+	if !ok1 || !ok2 || !ok3 {
+		return
+	}
+	si.lastMasterDownReply = now
+	if down == 1 {
+		si.flags |= SRI_MASTER_DOWN
+	} else {
+		si.flags &^= SRI_MASTER_DOWN
+	}
+	if leader != "*" {
+		si.leader, si.leaderEpoch = leader, uint64(epoch)
+	}
+}
+
+func (ri *sentinelInstance) flagsString() string {
+	var names []string
+	for _, f := range sentinelFlagNames {
+		if ri.flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	if !ri.connected {
+		names = append(names, "disconnected")
+	}
+	return strings.Join(names, ",")
+}
+
+// Describes the instance as a list of field names and values, like redis sentinel does
+func sentinelInstanceReply(ri *sentinelInstance, now time.Time) []byte {
+	ms := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(now.Sub(t).Milliseconds(), 10)
+	}
+	fields := []string{
+		"name", ri.name,
+		"ip", ri.ip,
+		"port", strconv.Itoa(ri.port),
+		"runid", ri.runid,
+		"flags", ri.flagsString(),
+		"last-ping-sent", ms(ri.pingSent),
+		"last-ok-ping-reply", ms(ri.lastAvail),
+		"down-after-milliseconds", strconv.Itoa(config.SentinelDownAfter),
+	}
+	if ri.flags&SRI_S_DOWN != 0 {
+		fields = append(fields, "s-down-time", ms(ri.sdownSince))
+	}
+	if ri.flags&SRI_SENTINEL == 0 {
+		fields = append(fields, "info-refresh", ms(ri.infoRefresh), "role-reported", ri.role, "role-reported-time", ms(ri.roleReported))
+	}
+	switch {
+	case ri.flags&SRI_MASTER != 0:
+		if ri.flags&SRI_O_DOWN != 0 {
+			fields = append(fields, "o-down-time", ms(ri.odownSince))
+		}
+		fields = append(fields,
+			"config-epoch", strconv.FormatUint(ri.configEpoch, 10),
+			"num-slaves", strconv.Itoa(len(ri.replicas)),
+			"num-other-sentinels", strconv.Itoa(len(ri.sentinels)),
+			"quorum", strconv.Itoa(ri.quorum),
+			"failover-timeout", strconv.Itoa(config.SentinelFailoverTimeout),
+			"failover-state", sentinelFailoverStateNames[ri.failoverState],
+		)
+	case ri.flags&SRI_SLAVE != 0:
+		status := "err"
+		if ri.masterLinkUp {
+			status = "ok"
+		}
+		fields = append(fields,
+			"master-link-status", status,
+			"master-host", ri.masterHost,
+			"master-port", strconv.Itoa(ri.masterPort),
+			"slave-priority", strconv.Itoa(ri.priority),
+			"slave-repl-offset", strconv.FormatInt(ri.replOffset, 10),
+		)
+	case ri.flags&SRI_SENTINEL != 0 && ri.leader != "":
+		fields = append(fields, "voted-leader", ri.leader, "voted-leader-epoch", strconv.FormatUint(ri.leaderEpoch, 10))
+	}
+	values := make([][]byte, len(fields))
+	for i, field := range fields {
+		values[i] = response.Encode(field, false)
+	}
+	return response.EncodeArray(values)
+}
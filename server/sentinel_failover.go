@@ -0,0 +1,425 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+The failover of a master by the sentinels, like redis sentinel does it:
+	- the sentinel cron checks every instance: one that did not answer a PING for down-after is SDOWN, and so is a
+	  master reporting it is a replica for too long. A master that is SDOWN is ODOWN once quorum sentinels,
+	  counting this one, said it is down.
+	- a sentinel that sees the master ODOWN starts a failover in a new epoch and asks the other sentinels for
+	  their vote with SENTINEL IS-MASTER-DOWN-BY-ADDR. A sentinel votes once per epoch, for the first sentinel
+	  asking. The sentinel voted for by a majority of the sentinels, and by at least quorum, is the leader and
+	  runs the failover, the others wait for twice the failover timeout before trying again.
+	- the leader selects the replica to promote: a replica that is not down and answered recently, with the
+	  lowest priority, then the greatest replication offset, then the smallest run id. It sends it
+	  REPLICAOF NO ONE and waits for its INFO to report it is a master, the master then takes the epoch of
+	  the failover as its config epoch.
+	- the other replicas are sent REPLICAOF <promoted ip> <promoted port>, the failover ends once they
+	  replicate the promoted replica, or after the failover timeout
+	- the sentinel then monitors the promoted replica as the master, the former master and the other replicas
+	  as its replicas, and publishes +switch-master <name> <old ip> <old port> <new ip> <new port>. The other
+	  sentinels follow from the config epoch of the hello messages.
+	- a replica that still reports being a master, like the former master coming back, or that replicates
+	  another master, is sent REPLICAOF to replicate the master once it reported it for a while
+SENTINEL FAILOVER fails the master over without asking the other sentinels.
+*/
+
+// States of the failover of a master
+const (
+	SENTINEL_FAILOVER_STATE_NONE = iota
+	//Waiting to be elected leader
+	SENTINEL_FAILOVER_STATE_WAIT_START
+	SENTINEL_FAILOVER_STATE_SELECT_SLAVE
+	SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE
+	//Waiting for the promoted replica to report it is a master
+	SENTINEL_FAILOVER_STATE_WAIT_PROMOTION
+	//The other replicas are told to replicate the promoted replica
+	SENTINEL_FAILOVER_STATE_RECONF_SLAVES
+	//The promoted replica is monitored as the master
+	SENTINEL_FAILOVER_STATE_UPDATE_CONFIG
+)
+
+var sentinelFailoverStateNames = []string{
+	"none", "wait_start", "select_slave", "send_slaveof_noone", "wait_promotion", "reconf_slaves", "update_config",
+}
+
+const (
+	//The longest a sentinel waits to be elected, the failover timeout when shorter
+	sentinelElectionTimeout = 10 * time.Second
+	//The sentinels start their failovers at random times within this delay, so that they do not ask for votes at once
+	sentinelMaxDesync = time.Second
+	//How long a replica reports a role, or a master, different from the configuration before it is reconfigured
+	sentinelReconfWait = 4 * sentinelHelloPeriod
+)
+
+// Runs the checks of the master and of its instances, and its failover. Must be called holding execMu.
+func sentinelHandleMaster(master *sentinelInstance, now time.Time) {
+	sentinelCheckSubjectivelyDown(master, now)
+	for _, replica := range master.replicas {
+		sentinelCheckSubjectivelyDown(replica, now)
+		sentinelCheckReplicaConfig(replica, now)
+	}
+	for _, si := range master.sentinels {
+		sentinelCheckSubjectivelyDown(si, now)
+		//INFO: The opinion of a sentinel that no longer answers expires
+		if now.Sub(si.lastMasterDownReply) > 5*sentinelAskPeriod {
+			si.flags &^= SRI_MASTER_DOWN
+			si.leader = ""
+		}
+	}
+	sentinelCheckObjectivelyDown(master, now)
+	if master.flags&SRI_O_DOWN != 0 && master.flags&SRI_FAILOVER_IN_PROGRESS == 0 &&
+		now.Sub(master.failoverStart) >= 2*sentinelFailoverTimeout() {
+		sentinelStartFailover(master, now)
+	}
+	sentinelFailoverStateMachine(master, now)
+}
+
+// Flags the instance SDOWN when it did not answer a PING for down-after, must be called holding execMu
+func sentinelCheckSubjectivelyDown(ri *sentinelInstance, now time.Time) {
+	var elapsed time.Duration
+	if !ri.pingSent.IsZero() {
+		elapsed = now.Sub(ri.pingSent)
+	} else if !ri.connected {
+		elapsed = now.Sub(ri.lastAvail)
+	}
+	//INFO: A master that says it is a replica is down as well, unless this sentinel is failing it over
+	roleDown := ri.flags&SRI_MASTER != 0 && ri.role == "slave" && ri.failoverState == SENTINEL_FAILOVER_STATE_NONE &&
+		now.Sub(ri.roleReported) > sentinelDownAfter()+2*sentinelInfoPeriod
+	if elapsed > sentinelDownAfter() || roleDown {
+		if ri.flags&SRI_S_DOWN == 0 {
+			ri.flags |= SRI_S_DOWN
+			ri.sdownSince = now
+			sentinelEvent("+sdown", ri, "")
+		}
+	} else if ri.flags&SRI_S_DOWN != 0 {
+		ri.flags &^= SRI_S_DOWN
+		sentinelEvent("-sdown", ri, "")
+	}
+}
+
+// Flags the master ODOWN when quorum sentinels think it is down, must be called holding execMu
+func sentinelCheckObjectivelyDown(master *sentinelInstance, now time.Time) {
+	votes := 0
+	if master.flags&SRI_S_DOWN != 0 {
+		votes = 1
+		for _, si := range master.sentinels {
+			if si.flags&SRI_MASTER_DOWN != 0 {
+				votes++
+			}
+		}
+	}
+	if master.flags&SRI_S_DOWN != 0 && votes >= master.quorum {
+		if master.flags&SRI_O_DOWN == 0 {
+			master.flags |= SRI_O_DOWN
+			master.odownSince = now
+			sentinelEvent("+odown", master, fmt.Sprintf("#quorum %d/%d", votes, master.quorum))
+		}
+	} else if master.flags&SRI_O_DOWN != 0 {
+		master.flags &^= SRI_O_DOWN
+		sentinelEvent("-odown", master, "")
+	}
+}
+
+// Starts the failover of the master in a new epoch, must be called holding execMu
+func sentinelStartFailover(master *sentinelInstance, now time.Time) {
+	sentinel.currentEpoch++
+	master.failoverState = SENTINEL_FAILOVER_STATE_WAIT_START
+	master.flags |= SRI_FAILOVER_IN_PROGRESS
+	master.failoverEpoch = sentinel.currentEpoch
+	sentinelEvent("+new-epoch", nil, strconv.FormatUint(sentinel.currentEpoch, 10))
+	sentinelEvent("+try-failover", master, "")
+	master.failoverStart = now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+	master.failoverStateChange = now
+}
+
+// Fails the master over without the agreement of the other sentinels, for SENTINEL FAILOVER
+func sentinelForceFailover(master *sentinelInstance, now time.Time) error {
+	if master.flags&SRI_FAILOVER_IN_PROGRESS != 0 {
+		return errors.New("INPROG Failover already in progress")
+	}
+	if sentinelSelectReplica(master, now) == nil {
+		return errors.New("NOGOODSLAVE No suitable replica to promote")
+	}
+	sentinelStartFailover(master, now)
+	master.flags |= SRI_FORCE_FAILOVER
+	return nil
+}
+
+/**
+Votes for the sentinel to fail the master over in the epoch, unless this sentinel voted in this epoch already.
+Returns the sentinel voted for and the epoch of the vote. Must be called holding execMu.
+*/
+func sentinelVoteLeader(master *sentinelInstance, epoch uint64, runid string, now time.Time) (string, uint64) {
+	if epoch > sentinel.currentEpoch {
+		sentinel.currentEpoch = epoch
+		sentinelEvent("+new-epoch", nil, strconv.FormatUint(epoch, 10))
+	}
+	if master.leaderEpoch < epoch && sentinel.currentEpoch <= epoch {
+		master.leader, master.leaderEpoch = runid, sentinel.currentEpoch
+		sentinelEvent("+vote-for-leader", nil, fmt.Sprintf("%s %d", runid, master.leaderEpoch))
+		//INFO: Another sentinel fails the master over, this one does not try before the failover could end
+		if runid != sentinel.myid {
+			master.failoverStart = now.Add(time.Duration(rand.Int63n(int64(sentinelMaxDesync))))
+		}
+	}
+	if master.leader == "" {
+		return "*", 0
+	}
+	return master.leader, master.leaderEpoch
+}
+
+/**
+Returns the leader elected to fail the master over in the epoch, empty when none is. This sentinel votes for the
+sentinel with the most votes, or for itself when no sentinel has a vote. The leader needs the votes of a majority
+of the sentinels, and at least quorum votes. Must be called holding execMu.
+*/
+func sentinelGetLeader(master *sentinelInstance, epoch uint64, now time.Time) string {
+	votes := map[string]int{}
+	for _, si := range master.sentinels {
+		if si.leader != "" && si.leaderEpoch == epoch {
+			votes[si.leader]++
+		}
+	}
+	winner, max := "", 0
+	for runid, count := range votes {
+		if count > max || (count == max && runid < winner) {
+			winner, max = runid, count
+		}
+	}
+	myvote := sentinel.myid
+	if winner != "" {
+		myvote = winner
+	}
+	if leader, leaderEpoch := sentinelVoteLeader(master, epoch, myvote, now); leader != "*" && leaderEpoch == epoch {
+		votes[leader]++
+		if votes[leader] > max {
+			winner, max = leader, votes[leader]
+		}
+	}
+	voters := len(master.sentinels) + 1
+	if max < voters/2+1 || max < master.quorum {
+		return ""
+	}
+	return winner
+}
+
+/**
+Selects the replica to promote: it must not be down, must have answered a PING recently and must have sent its INFO
+recently. The replica with the lowest priority is selected, then the one with the greatest replication offset,
+then the one with the smallest run id. Replicas with priority 0 are never promoted.
+*/
+func sentinelSelectReplica(master *sentinelInstance, now time.Time) *sentinelInstance {
+	infoValidity := 3 * sentinelInfoPeriod
+	if master.flags&SRI_S_DOWN != 0 {
+		infoValidity = 5 * sentinelPingPeriod
+	}
+	var candidates []*sentinelInstance
+	for _, replica := range master.replicas {
+		if replica.flags&(SRI_S_DOWN|SRI_O_DOWN) != 0 || !replica.connected || replica.priority == 0 ||
+			now.Sub(replica.lastAvail) > 5*sentinelPingPeriod || now.Sub(replica.infoRefresh) > infoValidity {
+			continue
+		}
+		candidates = append(candidates, replica)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.replOffset != b.replOffset {
+			return a.replOffset > b.replOffset
+		}
+		return a.runid < b.runid
+	})
+	return candidates[0]
+}
+
+func sentinelSetFailoverState(master *sentinelInstance, state int, now time.Time) {
+	master.failoverState = state
+	master.failoverStateChange = now
+}
+
+// Ends the failover without promoting a replica, it is tried again after twice the failover timeout
+func sentinelAbortFailover(master *sentinelInstance, now time.Time) {
+	master.flags &^= SRI_FAILOVER_IN_PROGRESS | SRI_FORCE_FAILOVER
+	sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_NONE, now)
+	if master.promoted != nil {
+		master.promoted.flags &^= SRI_PROMOTED
+		master.promoted = nil
+	}
+}
+
+// Runs the step of the failover of the master, must be called holding execMu
+func sentinelFailoverStateMachine(master *sentinelInstance, now time.Time) {
+	timedOut := now.Sub(master.failoverStateChange) > sentinelFailoverTimeout()
+	switch master.failoverState {
+	case SENTINEL_FAILOVER_STATE_WAIT_START:
+		if master.flags&SRI_FORCE_FAILOVER == 0 && sentinelGetLeader(master, master.failoverEpoch, now) != sentinel.myid {
+			electionTimeout := sentinelElectionTimeout
+			if sentinelFailoverTimeout() < electionTimeout {
+				electionTimeout = sentinelFailoverTimeout()
+			}
+			if now.Sub(master.failoverStart) > electionTimeout {
+				sentinelEvent("-failover-abort-not-elected", master, "")
+				sentinelAbortFailover(master, now)
+			}
+			return
+		}
+		sentinelEvent("+elected-leader", master, "")
+		sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_SELECT_SLAVE, now)
+		sentinelEvent("+failover-state-select-slave", master, "")
+
+	case SENTINEL_FAILOVER_STATE_SELECT_SLAVE:
+		replica := sentinelSelectReplica(master, now)
+		if replica == nil {
+			sentinelEvent("-failover-abort-no-good-slave", master, "")
+			sentinelAbortFailover(master, now)
+			return
+		}
+		sentinelEvent("+selected-slave", replica, "")
+		replica.flags |= SRI_PROMOTED
+		master.promoted = replica
+		sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE, now)
+		sentinelEvent("+failover-state-send-slaveof-noone", replica, "")
+
+	case SENTINEL_FAILOVER_STATE_SEND_SLAVEOF_NOONE:
+		if !master.promoted.connected {
+			if timedOut {
+				sentinelEvent("-failover-abort-slave-timeout", master, "")
+				sentinelAbortFailover(master, now)
+			}
+			return
+		}
+		master.promoted.pending = append(master.promoted.pending, []string{"REPLICAOF", "NO", "ONE"})
+		sentinelEvent("+failover-state-wait-promotion", master.promoted, "")
+		sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_WAIT_PROMOTION, now)
+
+	case SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		//INFO: The INFO of the promoted replica moves the failover on, see sentinelRefreshReplicaRole
+		if timedOut {
+			sentinelEvent("-failover-abort-slave-timeout", master, "")
+			sentinelAbortFailover(master, now)
+		}
+
+	case SENTINEL_FAILOVER_STATE_RECONF_SLAVES:
+		done := true
+		for _, replica := range master.replicas {
+			if replica.flags&(SRI_PROMOTED|SRI_RECONF_DONE) != 0 || replica.flags&SRI_S_DOWN != 0 {
+				continue
+			}
+			done = false
+			if replica.flags&SRI_RECONF_SENT == 0 {
+				replica.pending = append(replica.pending, []string{"REPLICAOF", master.promoted.ip, strconv.Itoa(master.promoted.port)})
+				replica.flags |= SRI_RECONF_SENT
+				replica.lastReconf = now
+				sentinelEvent("+slave-reconf-sent", replica, "")
+			}
+		}
+		if !done && !timedOut {
+			return
+		}
+		if !done {
+			sentinelEvent("+failover-end-for-timeout", master, "")
+		}
+		sentinelEvent("+failover-end", master, "")
+		sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_UPDATE_CONFIG, now)
+
+	case SENTINEL_FAILOVER_STATE_UPDATE_CONFIG:
+		sentinelSwitchMaster(master, master.promoted.ip, master.promoted.port, now)
+	}
+}
+
+// Moves the failover on from the INFO of a replica, must be called holding execMu
+func sentinelRefreshReplicaRole(replica *sentinelInstance, now time.Time) {
+	master := replica.master
+	promoted := master.promoted
+	switch {
+	case replica.role == "master" && replica.flags&SRI_PROMOTED != 0 && master.failoverState == SENTINEL_FAILOVER_STATE_WAIT_PROMOTION:
+		master.configEpoch = master.failoverEpoch
+		sentinelEvent("+promoted-slave", replica, "")
+		sentinelSetFailoverState(master, SENTINEL_FAILOVER_STATE_RECONF_SLAVES, now)
+		sentinelEvent("+failover-state-reconf-slaves", master, "")
+	case replica.role == "slave" && replica.flags&SRI_RECONF_SENT != 0 && promoted != nil &&
+		replica.masterHost == promoted.ip && replica.masterPort == promoted.port && replica.masterLinkUp:
+		replica.flags = replica.flags&^SRI_RECONF_SENT | SRI_RECONF_DONE
+		sentinelEvent("+slave-reconf-done", replica, "")
+	}
+}
+
+/**
+Sends REPLICAOF to a replica that reports being a master, or that replicates another master than the one
+monitored, once it reported it for sentinelReconfWait. It is not done during a failover or while the master is
+down. Must be called holding execMu.
+*/
+func sentinelCheckReplicaConfig(replica *sentinelInstance, now time.Time) {
+	master := replica.master
+	if master.failoverState != SENTINEL_FAILOVER_STATE_NONE || master.flags&SRI_S_DOWN != 0 || master.role != "master" ||
+		replica.flags&SRI_S_DOWN != 0 || now.Sub(replica.roleReported) < sentinelReconfWait || now.Sub(replica.lastReconf) < sentinelReconfWait {
+		return
+	}
+	var event string
+	switch {
+	case replica.role == "master":
+		event = "+convert-to-slave"
+	case replica.role == "slave" && (replica.masterHost != master.ip || replica.masterPort != master.port):
+		event = "+fix-slave-config"
+	default:
+		return
+	}
+	replica.pending = append(replica.pending, []string{"REPLICAOF", master.ip, strconv.Itoa(master.port)})
+	replica.lastReconf = now
+	sentinelEvent(event, replica, "")
+}
+
+/**
+Monitors the instance at ip:port as the master: the former master and the replicas are monitored as its replicas,
+the sentinels are kept. Must be called holding execMu.
+*/
+func sentinelSwitchMaster(master *sentinelInstance, ip string, port int, now time.Time) {
+	oldIP, oldPort := master.ip, master.port
+	type address struct {
+		ip   string
+		port int
+	}
+	var replicas []address
+	for _, replica := range master.replicas {
+		if replica.ip != ip || replica.port != port {
+			replicas = append(replicas, address{replica.ip, replica.port})
+		}
+		replica.close()
+	}
+	if oldIP != ip || oldPort != port {
+		replicas = append(replicas, address{oldIP, oldPort})
+	}
+	master.close()
+
+	switched := newSentinelInstance(SRI_MASTER, master.name, ip, port, nil)
+	switched.quorum = master.quorum
+	switched.configEpoch = master.configEpoch
+	switched.leader, switched.leaderEpoch = master.leader, master.leaderEpoch
+	switched.failoverStart = master.failoverStart
+	switched.failoverStateChange = now
+	switched.sentinels = master.sentinels
+	for _, si := range switched.sentinels {
+		si.master = switched
+		si.flags &^= SRI_MASTER_DOWN
+		si.leader = ""
+	}
+	sentinel.masters[master.name] = switched
+	for _, replica := range replicas {
+		sentinelAddReplica(switched, replica.ip, replica.port)
+	}
+	sentinelEvent("+switch-master", nil, fmt.Sprintf("%s %s %d %s %d", master.name, oldIP, oldPort, ip, port))
+}
@@ -0,0 +1,468 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The sentinel is tested against fake instances: they answer the commands of the sentinel from a model of their
+role and of the replication between them, and the fake sentinels answer SENTINEL IS-MASTER-DOWN-BY-ADDR.
+*/
+
+// A failover takes a few INFO periods of the replicas
+const testFailoverTimeout = 20 * time.Second
+
+type fakeInstances struct {
+	mu        sync.Mutex
+	instances []*fakeInstance
+}
+
+type fakeInstance struct {
+	group *fakeInstances
+	port  int
+	runid string
+
+	role       string
+	masterPort int
+	offset     int64
+	//A down instance reads the commands without answering them
+	down bool
+	//A fake sentinel says if the master is down and votes for the first sentinel asking in an epoch
+	masterDown  bool
+	votes       map[int64]string
+	subscribers map[net.Conn]bool
+	//The REPLICAOF commands received and the messages published
+	replicaofs []string
+	published  []string
+}
+
+func (g *fakeInstances) add(t *testing.T, role string, masterPort int, offset int64) *fakeInstance {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	fi := &fakeInstance{
+		group:       g,
+		port:        listener.Addr().(*net.TCPAddr).Port,
+		runid:       randomHex(40),
+		role:        role,
+		masterPort:  masterPort,
+		offset:      offset,
+		votes:       map[int64]string{},
+		subscribers: map[net.Conn]bool{},
+	}
+	g.mu.Lock()
+	g.instances = append(g.instances, fi)
+	g.mu.Unlock()
+	go fi.serve(listener)
+	return fi
+}
+
+func (fi *fakeInstance) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			rd := response.NewReader(conn)
+			for {
+				args, _, err := rd.ReadCommand()
+				if err != nil {
+					return
+				}
+				fi.group.mu.Lock()
+				if reply := fi.reply(conn, args); reply != nil {
+					conn.Write(reply)
+				}
+				fi.group.mu.Unlock()
+			}
+		}()
+	}
+}
+
+func (fi *fakeInstance) reply(conn net.Conn, args []string) []byte {
+	if fi.down {
+		return nil
+	}
+	ok := response.Encode("OK", true)
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return response.Encode("PONG", true)
+	case "INFO":
+		return response.Encode(fi.info(), false)
+	case "REPLICAOF":
+		fi.replicaofs = append(fi.replicaofs, strings.Join(args, " "))
+		if strings.EqualFold(args[1], "no") {
+			fi.role, fi.masterPort = "master", 0
+		} else {
+			fi.role = "slave"
+			fi.masterPort, _ = strconv.Atoi(args[2])
+		}
+		return ok
+	case "SUBSCRIBE":
+		fi.subscribers[conn] = true
+		return response.EncodeArray([][]byte{response.Encode("subscribe", false), response.Encode(args[1], false), response.Encode(1, false)})
+	case "PUBLISH":
+		fi.published = append(fi.published, args[2])
+		return response.Encode(fi.publish(args[2]), false)
+	case "SENTINEL":
+		leader, epoch := "*", int64(0)
+		if args[5] != "*" {
+			epoch, _ = strconv.ParseInt(args[4], 10, 64)
+			if fi.votes[epoch] == "" {
+				fi.votes[epoch] = args[5]
+			}
+			leader = fi.votes[epoch]
+		}
+		down := 0
+		if fi.masterDown {
+			down = 1
+		}
+		return response.EncodeArray([][]byte{response.Encode(down, false), response.Encode(leader, false), response.Encode(epoch, false)})
+	}
+	return ok
+}
+
+// The INFO of the instance, a master lists the instances replicating it
+func (fi *fakeInstance) info() string {
+	lines := []string{"# Server", "run_id:" + fi.runid, "# Replication", "role:" + fi.role}
+	if fi.role == "master" {
+		i := 0
+		for _, replica := range fi.group.instances {
+			if replica.role == "slave" && replica.masterPort == fi.port {
+				lines = append(lines, fmt.Sprintf("slave%d:ip=127.0.0.1,port=%d,state=online,offset=%d,lag=0", i, replica.port, replica.offset))
+				i++
+			}
+		}
+	} else {
+		lines = append(lines, "master_host:127.0.0.1", "master_port:"+strconv.Itoa(fi.masterPort), "master_link_status:up",
+			"slave_repl_offset:"+strconv.FormatInt(fi.offset, 10), "slave_priority:100")
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Sends the message of the hello channel to the subscribers, must be called holding the lock of the group
+func (fi *fakeInstance) publish(message string) int {
+	for conn := range fi.subscribers {
+		conn.Write(response.EncodeArray([][]byte{response.Encode("message", false), response.Encode(sentinelHelloChannel, false), response.Encode(message, false)}))
+	}
+	return len(fi.subscribers)
+}
+
+func (fi *fakeInstance) set(update func()) {
+	fi.group.mu.Lock()
+	defer fi.group.mu.Unlock()
+	update()
+}
+
+func (fi *fakeInstance) replicaofsReceived() []string {
+	fi.group.mu.Lock()
+	defer fi.group.mu.Unlock()
+	return append([]string{}, fi.replicaofs...)
+}
+
+// Publishes the hello of the fake sentinel on the instance once the sentinel subscribed to it
+func (fi *fakeInstance) hello(t *testing.T, on *fakeInstance, name string, master *fakeInstance, configEpoch int) {
+	t.Helper()
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		on.group.mu.Lock()
+		receivers := on.publish(fmt.Sprintf("127.0.0.1,%d,%s,0,%s,127.0.0.1,%d,%d", fi.port, fi.runid, name, master.port, configEpoch))
+		on.group.mu.Unlock()
+		if receivers > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the sentinel did not subscribe to the hello channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startTestSentinel(t *testing.T, monitor string) {
+	config.Sentinel = true
+	config.SentinelMonitor = monitor
+	if err := startConfiguredSentinel(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Waits until done returns true, it is called holding execMu
+func waitSentinel(t *testing.T, what string, timeout time.Duration, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		execMu.Lock()
+		ok := done()
+		execMu.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// The fields of an instance replied by SENTINEL MASTERS, REPLICAS or SENTINELS
+func sentinelFields(reply interface{}) map[string]string {
+	values, _ := reply.([]interface{})
+	fields := map[string]string{}
+	for i := 0; i+1 < len(values); i += 2 {
+		fields[values[i].(string)], _ = values[i+1].(string)
+	}
+	return fields
+}
+
+func TestSentinelMonitor(t *testing.T) {
+	setupTestServer(t)
+	g := &fakeInstances{}
+	m := g.add(t, "master", 0, 0)
+	g.add(t, "slave", m.port, 10)
+	g.add(t, "slave", m.port, 20)
+	startTestSentinel(t, "mymaster 127.0.0.1 "+strconv.Itoa(m.port)+" 2")
+	c := connect(t)
+	events := connect(t)
+	events.expect(array("subscribe", "+sentinel", int64(1)), "SUBSCRIBE", "+sentinel")
+
+	c.expect(array("127.0.0.1", strconv.Itoa(m.port)), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+	c.expect(nil, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "other")
+	c.expectError("ERR No such master with that name", "SENTINEL", "REPLICAS", "other")
+	waitSentinel(t, "the replicas", testReplyTimeout, func() bool { return len(sentinel.masters["mymaster"].replicas) == 2 })
+	waitSentinel(t, "the INFO of the replicas", testReplyTimeout, func() bool {
+		for _, replica := range sentinel.masters["mymaster"].replicas {
+			if replica.role != "slave" {
+				return false
+			}
+		}
+		return true
+	})
+	masters := c.do("SENTINEL", "MASTERS").([]interface{})
+	if len(masters) != 1 {
+		t.Fatalf("SENTINEL MASTERS: %q", masters)
+	}
+	fields := sentinelFields(masters[0])
+	if fields["name"] != "mymaster" || fields["flags"] != "master" || fields["runid"] != m.runid || fields["num-slaves"] != "2" ||
+		fields["quorum"] != "2" || fields["role-reported"] != "master" || fields["failover-state"] != "none" {
+		t.Errorf("SENTINEL MASTERS: %q", fields)
+	}
+	replicas := c.do("SENTINEL", "REPLICAS", "mymaster").([]interface{})
+	if len(replicas) != 2 {
+		t.Fatalf("SENTINEL REPLICAS: %q", replicas)
+	}
+	if fields := sentinelFields(replicas[0]); fields["flags"] != "slave" || fields["master-port"] != strconv.Itoa(m.port) ||
+		fields["master-link-status"] != "ok" || fields["slave-repl-offset"] == "0" {
+		t.Errorf("SENTINEL REPLICAS: %q", fields)
+	}
+
+	//The sentinels find each other on the hello channel of the monitored instances
+	myid := c.do("SENTINEL", "MYID").(string)
+	s2 := g.add(t, "sentinel", 0, 0)
+	s2.hello(t, m, "mymaster", m, 0)
+	waitSentinel(t, "the other sentinel", testReplyTimeout, func() bool { return len(sentinel.masters["mymaster"].sentinels) == 1 })
+	sentinels := c.do("SENTINEL", "SENTINELS", "mymaster").([]interface{})
+	if fields := sentinelFields(sentinels[0]); len(sentinels) != 1 || fields["name"] != s2.runid || fields["port"] != strconv.Itoa(s2.port) {
+		t.Errorf("SENTINEL SENTINELS: %q", sentinels)
+	}
+	events.expectNext(array("message", "+sentinel", fmt.Sprintf("sentinel %s 127.0.0.1 %d @ mymaster 127.0.0.1 %d", s2.runid, s2.port, m.port)))
+	hello := fmt.Sprintf("127.0.0.1,%d,%s,0,mymaster,127.0.0.1,%d,0", config.Port, myid, m.port)
+	m.set(func() {
+		if len(m.published) == 0 || m.published[0] != hello {
+			t.Errorf("the sentinel published %q", m.published)
+		}
+	})
+
+	c.expect(array("sentinel", array("mymaster")), "ROLE")
+	if info := c.do("INFO", "server").(string); !strings.Contains(info, "redis_mode:sentinel\r\n") {
+		t.Errorf("INFO: %s", info)
+	}
+	c.expectError("ERR unknown command 'SIM.ADD', with args beginning with: 'a' 'b' ", "SIM.ADD", "a", "b")
+	c.expectError("ERR Duplicated master name", "SENTINEL", "MONITOR", "mymaster", "127.0.0.1", "7000", "2")
+	c.expectError("ERR Quorum must be 1 or greater.", "SENTINEL", "MONITOR", "other", "127.0.0.1", "7000", "0")
+	c.expectError("ERR Invalid port", "SENTINEL", "MONITOR", "other", "127.0.0.1", "port", "1")
+	c.expectError("ERR unknown subcommand 'FOO'. Try SENTINEL HELP.", "SENTINEL", "FOO")
+	c.expect(replyOK, "SENTINEL", "MONITOR", "other", "127.0.0.1", "7000", "1")
+	c.expect(array("sentinel", array("mymaster", "other")), "ROLE")
+	c.expect(replyOK, "SENTINEL", "REMOVE", "other")
+	c.expect(nil, "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "other")
+}
+
+func TestSentinelDisabled(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expectError("ERR This instance has sentinel support disabled", "SENTINEL", "MASTERS")
+	if info := c.do("INFO", "server").(string); !strings.Contains(info, "redis_mode:standalone\r\n") {
+		t.Errorf("INFO: %s", info)
+	}
+}
+
+func TestSentinelVote(t *testing.T) {
+	setupTestServer(t)
+	config.SentinelDownAfter = 200
+	g := &fakeInstances{}
+	m := g.add(t, "master", 0, 0)
+	startTestSentinel(t, "mymaster 127.0.0.1 "+strconv.Itoa(m.port)+" 2")
+	c := connect(t)
+	port := strconv.Itoa(m.port)
+	a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+
+	//A single vote per epoch, for the first sentinel asking
+	c.expect(array(int64(0), "*", int64(0)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "5", "*")
+	c.expect(array(int64(0), a, int64(5)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "5", a)
+	c.expect(array(int64(0), a, int64(5)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "5", b)
+	c.expect(array(int64(0), a, int64(5)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "4", b)
+	c.expect(array(int64(0), b, int64(6)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "6", b)
+	c.expect(array(int64(0), "*", int64(0)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", "1", "7", b)
+
+	//The master does not answer, it is SDOWN but not ODOWN without a second sentinel
+	events := connect(t)
+	events.expect(array("subscribe", "+sdown", int64(1)), "SUBSCRIBE", "+sdown")
+	m.set(func() { m.down = true })
+	events.expectNext(array("message", "+sdown", "master mymaster 127.0.0.1 "+port))
+	c.expect(array(int64(1), "*", int64(0)), "SENTINEL", "IS-MASTER-DOWN-BY-ADDR", "127.0.0.1", port, "6", "*")
+	if fields := sentinelFields(c.do("SENTINEL", "MASTER", "mymaster")); fields["flags"] != "master,s_down,disconnected" && fields["flags"] != "master,s_down" {
+		t.Errorf("SENTINEL MASTER: %q", fields)
+	}
+	c.expectError("NOGOODSLAVE No suitable replica to promote", "SENTINEL", "FAILOVER", "mymaster")
+	c.expectError("ERR No such master with that name", "SENTINEL", "FAILOVER", "other")
+
+	//The master answers again
+	events.expect(array("subscribe", "-sdown", int64(2)), "SUBSCRIBE", "-sdown")
+	m.set(func() { m.down = false })
+	events.expectNext(array("message", "-sdown", "master mymaster 127.0.0.1 "+port))
+}
+
+func TestSentinelFailover(t *testing.T) {
+	setupTestServer(t)
+	config.SentinelDownAfter = 300
+	config.SentinelFailoverTimeout = 10000
+	g := &fakeInstances{}
+	m := g.add(t, "master", 0, 0)
+	r1 := g.add(t, "slave", m.port, 100)
+	r2 := g.add(t, "slave", m.port, 50)
+	s2 := g.add(t, "sentinel", 0, 0)
+	s3 := g.add(t, "sentinel", 0, 0)
+	startTestSentinel(t, "mymaster 127.0.0.1 "+strconv.Itoa(m.port)+" 2")
+	c := connect(t)
+	odown := connect(t)
+	odown.expect(array("subscribe", "+odown", int64(1)), "SUBSCRIBE", "+odown")
+	switched := connect(t)
+	switched.expect(array("subscribe", "+switch-master", int64(1)), "SUBSCRIBE", "+switch-master")
+	myid := c.do("SENTINEL", "MYID").(string)
+
+	waitSentinel(t, "the replicas", testReplyTimeout, func() bool { return len(sentinel.masters["mymaster"].replicas) == 2 })
+	s2.hello(t, m, "mymaster", m, 0)
+	s3.hello(t, m, "mymaster", m, 0)
+	waitSentinel(t, "the other sentinels", testReplyTimeout, func() bool { return len(sentinel.masters["mymaster"].sentinels) == 2 })
+
+	//The other sentinels agree the master is down and vote for this sentinel
+	m.set(func() {
+		m.down = true
+		s2.masterDown = true
+		s3.masterDown = true
+	})
+	odown.expectNext(array("message", "+odown", fmt.Sprintf("master mymaster 127.0.0.1 %d #quorum 3/2", m.port)))
+	waitSentinel(t, "the failover", testFailoverTimeout, func() bool {
+		return sentinel.masters["mymaster"].port == r1.port
+	})
+	switched.expectNext(array("message", "+switch-master", fmt.Sprintf("mymaster 127.0.0.1 %d 127.0.0.1 %d", m.port, r1.port)))
+	c.expect(array("127.0.0.1", strconv.Itoa(r1.port)), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+
+	//The replica with the greatest offset was promoted, the other replicates it
+	if received := r1.replicaofsReceived(); len(received) != 1 || received[0] != "REPLICAOF NO ONE" {
+		t.Errorf("the promoted replica received %q", received)
+	}
+	if received := r2.replicaofsReceived(); len(received) != 1 || received[0] != "REPLICAOF 127.0.0.1 "+strconv.Itoa(r1.port) {
+		t.Errorf("the other replica received %q", received)
+	}
+	for _, s := range []*fakeInstance{s2, s3} {
+		s.group.mu.Lock()
+		if s.votes[1] != myid {
+			t.Errorf("the sentinel voted %q", s.votes)
+		}
+		s.group.mu.Unlock()
+	}
+	if fields := sentinelFields(c.do("SENTINEL", "MASTER", "mymaster")); fields["config-epoch"] != "1" || fields["num-slaves"] != "2" {
+		t.Errorf("SENTINEL MASTER: %q", fields)
+	}
+
+	//The former master comes back as a master, it is made a replica of the promoted replica
+	m.set(func() { m.down = false })
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(m.port))
+	waitSentinel(t, "the INFO of the former master", testFailoverTimeout, func() bool {
+		former := sentinel.masters["mymaster"].replicas[addr]
+		if former == nil || former.role != "master" {
+			return false
+		}
+		former.roleReported = former.roleReported.Add(-sentinelReconfWait)
+		return true
+	})
+	waitSentinel(t, "the conversion of the former master", testReplyTimeout, func() bool {
+		return len(m.replicaofsReceived()) == 1
+	})
+	if received := m.replicaofsReceived(); received[0] != "REPLICAOF 127.0.0.1 "+strconv.Itoa(r1.port) {
+		t.Errorf("the former master received %q", received)
+	}
+}
+
+func TestSentinelForcedFailover(t *testing.T) {
+	setupTestServer(t)
+	g := &fakeInstances{}
+	m := g.add(t, "master", 0, 0)
+	r := g.add(t, "slave", m.port, 0)
+	startTestSentinel(t, "mymaster 127.0.0.1 "+strconv.Itoa(m.port)+" 2")
+	c := connect(t)
+	waitSentinel(t, "the replica", testReplyTimeout, func() bool {
+		master := sentinel.masters["mymaster"]
+		return len(master.replicas) == 1 && sentinelSelectReplica(master, time.Now()) != nil
+	})
+
+	//No other sentinel is needed, the master is not down
+	c.expect(replyOK, "SENTINEL", "FAILOVER", "mymaster")
+	c.expectError("INPROG Failover already in progress", "SENTINEL", "FAILOVER", "mymaster")
+	waitSentinel(t, "the failover", testFailoverTimeout, func() bool { return sentinel.masters["mymaster"].port == r.port })
+	if fields := sentinelFields(c.do("SENTINEL", "MASTER", "mymaster")); fields["config-epoch"] != "1" || fields["failover-state"] != "none" {
+		t.Errorf("SENTINEL MASTER: %q", fields)
+	}
+	replicas := c.do("SENTINEL", "REPLICAS", "mymaster").([]interface{})
+	if fields := sentinelFields(replicas[0]); len(replicas) != 1 || fields["port"] != strconv.Itoa(m.port) {
+		t.Errorf("SENTINEL REPLICAS: %q", replicas)
+	}
+}
+
+func TestSentinelConfigUpdate(t *testing.T) {
+	setupTestServer(t)
+	g := &fakeInstances{}
+	m := g.add(t, "master", 0, 0)
+	r := g.add(t, "slave", m.port, 0)
+	s2 := g.add(t, "sentinel", 0, 0)
+	startTestSentinel(t, "mymaster 127.0.0.1 "+strconv.Itoa(m.port)+" 1")
+	c := connect(t)
+	events := connect(t)
+	events.expect(array("subscribe", "+switch-master", int64(1)), "SUBSCRIBE", "+switch-master")
+
+	//Another sentinel failed the master over in epoch 3, its hello gives the new master
+	waitSentinel(t, "the replica", testReplyTimeout, func() bool { return len(sentinel.masters["mymaster"].replicas) == 1 })
+	s2.hello(t, r, "mymaster", r, 3)
+	events.expectNext(array("message", "+switch-master", fmt.Sprintf("mymaster 127.0.0.1 %d 127.0.0.1 %d", m.port, r.port)))
+	c.expect(array("127.0.0.1", strconv.Itoa(r.port)), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+	if fields := sentinelFields(c.do("SENTINEL", "MASTER", "mymaster")); fields["config-epoch"] != "3" || fields["num-other-sentinels"] != "1" {
+		t.Errorf("SENTINEL MASTER: %q", fields)
+	}
+	//An older configuration is ignored
+	s2.hello(t, r, "mymaster", m, 2)
+	c.expect(array("127.0.0.1", strconv.Itoa(r.port)), "SENTINEL", "GET-MASTER-ADDR-BY-NAME", "mymaster")
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Connection level tests: every test client is one end of a net.Pipe, the other end is served by
+handleAsyncConnection like a connection accepted by the AsyncServer. The configuration is reset to the
+defaults of the flags, and the server wide state is reset, before every test.
+*/
+
+// Replies are expected within this time, a test waiting longer fails instead of hanging
+const testReplyTimeout = 5 * time.Second
+
+// The poller of the test server, the connections are served by calling handleAsyncConnection directly
+type testPoller struct{}
+
+func (testPoller) Add(conn net.Conn) error                           { return nil }
+func (testPoller) Close(closeConns bool) error                       { return nil }
+func (testPoller) WaitForCurrentConn(c net.Conn) ([]net.Conn, error) { return []net.Conn{c}, nil }
+func (testPoller) Remove(conn net.Conn) error                        { return conn.Close() }
+func (testPoller) API() string                                       { return "test" }
+
+// A pipe that reports the address of a TCP client, net.Pipe has no real address
+type testConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+var (
+	lastTestPort int32 = 40000
+
+	//The connections of the running test, closed when it ends
+	testConns []net.Conn
+	//The connections being served, the next test starts once all of them are done
+	testServing sync.WaitGroup
+)
+
+func setupTestServer(t *testing.T) {
+	config.Host = "127.0.0.1"
+	config.Port = 7379
+	config.LuaTimeLimit = 5000
+	config.WatchQueryDebounce = 50
+	config.WatchQueryMaxPerClient = 16
+	config.NotifyKeyspaceEvents = ""
+	config.TrackingTableMaxKeys = 1000000
+	config.RequirePass = ""
+	config.ACLFile = ""
+	config.ACLLogMaxLen = 128
+	config.UnixSocket = ""
+	config.UnixSocketPerm = ""
+	config.ProtectedMode = true
+	config.SlowlogLogSlowerThan = 10000
+	config.SlowlogMaxLen = 128
+	config.LatencyMonitorThreshold = 0
+	config.ReplicaOf = ""
+	config.ReplicaReadOnly = true
+	config.MasterUser = ""
+	config.MasterAuth = ""
+	config.ReplTimeout = 60
+	config.ReplBacklogSize = 1024 * 1024
+	config.TLSReplication = false
+	config.AppendOnly = false
+	config.AppendFilename = "appendonly.aof"
+	config.AppendFsync = APPENDFSYNC_EVERYSEC
+	config.MinReplicasToWrite = 0
+	config.MinReplicasMaxLag = 10
+	config.RaftID = 0
+	config.RaftPeers = ""
+	config.RaftAddr = ""
+	config.RaftSnapshotEntries = 10000
+	config.TLSCluster = false
+	config.ClusterEnabled = false
+	config.ClusterPort = 0
+	config.ClusterNodeTimeout = 15000
+	config.ClusterAnnounceIP = ""
+	config.Sentinel = false
+	config.SentinelMonitor = ""
+	config.SentinelDownAfter = 30000
+	config.SentinelFailoverTimeout = 180000
+	config.SentinelAnnounceIP = ""
+
+	//INFO: Cleanups run last to first, the raft node and the cluster are stopped once the clients using them are gone
+	t.Cleanup(stopRaft)
+	t.Cleanup(stopCluster)
+	t.Cleanup(stopSentinel)
+	t.Cleanup(closeTestConns)
+	t.Cleanup(stopTestReplication)
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	keyspace = map[string]interface{}{}
+	watchedKeys = map[string]map[*Client]struct{}{}
+	pubsubChannels = map[string]map[*Client]struct{}{}
+	pubsubPatterns = map[string]map[*Client]struct{}{}
+	queryDeps = map[string]map[*watchedQuery]struct{}{}
+	trackingTable = map[string]map[uint64]struct{}{}
+	trackingPrefixes = map[string]map[*Client]struct{}{}
+	scriptCache = map[string]*cachedScript{}
+	monitors = map[*Client]struct{}{}
+	commandStats = map[string]*commandStat{}
+	latencyEvents = map[string]*latencyTimeSeries{}
+	slowlog, lastSlowlogID = nil, 0
+	aclLog, lastACLLogID = nil, 0
+	statKeyspaceHits, statKeyspaceMisses, statErrorReplies, statDirty = 0, 0, 0, 0
+	multiplexingAPI = testPoller{}.API()
+	replicas = map[*Client]struct{}{}
+	masterReplOffset, replBacklog = 0, nil
+	clearReplicationID2()
+	stopAppendOnlyFile()
+	waitingClients = map[*waitingClient]struct{}{}
+	raftProposals, raftReads = map[uint64]*raftProposal{}, map[uint64]*raftRead{}
+	raftApplied, raftSnapshotIndex = 0, 0
+	if err := setNotifyKeyspaceEvents(config.NotifyKeyspaceEvents); err != nil {
+		t.Fatal(err)
+	}
+	if err := initACL(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Closes the connections of the test, the next test must not see their clients so it waits
+// until the server noticed and freed them
+func closeTestConns() {
+	for _, conn := range testConns {
+		conn.Close()
+	}
+	testConns = nil
+	testServing.Wait()
+}
+
+// Stops the link of a replica to its master, the next test must not see it
+func stopTestReplication() {
+	execMu.Lock()
+	link := replicaOf
+	if link != nil {
+		link.close()
+		replicaOf = nil
+	}
+	execMu.Unlock()
+	if link != nil {
+		<-link.done
+	}
+}
+
+// Serves the server end of a connection like the AsyncServer does
+func serveTestConn(conn net.Conn) {
+	testServing.Add(1)
+	go func() {
+		defer testServing.Done()
+		(&AsyncServer{poller: testPoller{}}).handleAsyncConnection(conn)
+	}()
+}
+
+// Connects a client from the loopback interface
+func connect(t *testing.T) *testClient {
+	return connectFrom(t, "127.0.0.1")
+}
+
+// Connects a client from the ip
+func connectFrom(t *testing.T, ip string) *testClient {
+	serverConn, clientConn := net.Pipe()
+	remote := &net.TCPAddr{IP: net.ParseIP(ip), Port: int(atomic.AddInt32(&lastTestPort, 1))}
+	serveTestConn(testConn{serverConn, remote})
+
+	testConns = append(testConns, clientConn)
+	return &testClient{t, clientConn}
+}
+
+// Sends the command without waiting for its reply
+func (tc *testClient) send(args ...string) {
+	tc.t.Helper()
+	tokens := make([][]byte, len(args))
+	for i, arg := range args {
+		tokens[i] = response.Encode(arg, false)
+	}
+	tc.conn.SetWriteDeadline(time.Now().Add(testReplyTimeout))
+	if _, err := tc.conn.Write(response.EncodeArray(tokens)); err != nil {
+		tc.t.Fatalf("sending %q: %v", args, err)
+	}
+}
+
+// Reads the next reply or message, decoded by response.DecodeReply
+func (tc *testClient) read() interface{} {
+	tc.t.Helper()
+	buf := make([]byte, 64*1024)
+	tc.conn.SetReadDeadline(time.Now().Add(testReplyTimeout))
+	n, err := tc.conn.Read(buf)
+	if err != nil {
+		tc.t.Fatalf("reading a reply: %v", err)
+	}
+	value, err := response.DecodeReply(buf[:n])
+	if err != nil {
+		tc.t.Fatalf("decoding %q: %v", buf[:n], err)
+	}
+	return value
+}
+
+// Tells if nothing is received within the duration
+func (tc *testClient) silent(d time.Duration) bool {
+	tc.conn.SetReadDeadline(time.Now().Add(d))
+	_, err := tc.conn.Read(make([]byte, 1))
+	return err != nil
+}
+
+// Sends the command and returns its reply
+func (tc *testClient) do(args ...string) interface{} {
+	tc.t.Helper()
+	tc.send(args...)
+	return tc.read()
+}
+
+// Sends the command and fails the test unless the reply is the expected one
+func (tc *testClient) expect(expected interface{}, args ...string) {
+	tc.t.Helper()
+	if reply := tc.do(args...); !reflect.DeepEqual(reply, expected) {
+		tc.t.Errorf("%q replied %#v, expected %#v", args, reply, expected)
+	}
+}
+
+// Fails the test unless the next reply or message is the expected one
+func (tc *testClient) expectNext(expected interface{}) {
+	tc.t.Helper()
+	if reply := tc.read(); !reflect.DeepEqual(reply, expected) {
+		tc.t.Errorf("received %#v, expected %#v", reply, expected)
+	}
+}
+
+// Sends the command and fails the test unless it replies with an error starting with prefix
+func (tc *testClient) expectError(prefix string, args ...string) {
+	tc.t.Helper()
+	reply := tc.do(args...)
+	if err, ok := reply.(response.ErrorReply); !ok || len(err) < len(prefix) || string(err[:len(prefix)]) != prefix {
+		tc.t.Errorf("%q replied %#v, expected a %s error", args, reply, prefix)
+	}
+}
+
+var (
+	replyOK   = response.SimpleString("OK")
+	replyPONG = response.SimpleString("PONG")
+)
+
+// Builds the expected decoded array, an empty array is decoded as an empty slice
+func array(values ...interface{}) []interface{} {
+	return append([]interface{}{}, values...)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/inmemdb/inmem/server/minhash"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Set similarity commands, backed by MinHash signatures and LSH indexes (see server/minhash):
+	- SIM.ADD key element [element ...]: adds elements to the set summarised by the signature at key
+	- SIM.JACCARD key1 key2: estimated Jaccard similarity of both sets, missing keys are empty sets
+	- SIM.MERGE destkey sourcekey [sourcekey ...]: stores the union of all the sets at destkey
+	- SIM.INDEX.ADD idx key [key ...]: indexes the current signatures of the keys in the LSH index idx
+	- SIM.INDEX.QUERY idx key threshold: keys of idx whose estimated similarity with key is at least
+	  threshold, the most similar first
+*/
+
+// Returns the signature at key, nil if the key does not exist
+func lookupSignature(key string) (*minhash.Signature, error) {
+	value, ok := keyspace[key]
+	if !ok {
+		return nil, nil
+	}
+	sig, ok := value.(*minhash.Signature)
+	if !ok {
+		return nil, errWrongType
+	}
+	return sig, nil
+}
+
+// Returns the LSH index at key, nil if the key does not exist
+func lookupIndex(key string) (*minhash.Index, error) {
+	value, ok := keyspace[key]
+	if !ok {
+		return nil, nil
+	}
+	index, ok := value.(*minhash.Index)
+	if !ok {
+		return nil, errWrongType
+	}
+	return index, nil
+}
+
+func (cmd *Command) evalSIMADD() ([]byte, error) {
+	key := cmd.Args[0]
+	sig, err := lookupSignature(key)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := 0
+	if sig == nil {
+		sig = minhash.NewSignature()
+		setKey(key, sig)
+		updated = 1
+	}
+	for _, element := range cmd.Args[1:] {
+		if sig.Add(element) {
+			updated = 1
+		}
+	}
+	if updated == 1 {
+		signalModifiedKey(key)
+		notifyKeyspaceEvent(NOTIFY_SET, "sim.add", key)
+	}
+	return response.Encode(updated, false), nil
+}
+
+func (cmd *Command) evalSIMJACCARD() ([]byte, error) {
+	a, err := lookupSignature(cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	b, err := lookupSignature(cmd.Args[1])
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		signalKeyMiss(cmd.Args[0])
+	} else {
+		signalKeyHit(cmd.Args[0])
+	}
+	if b == nil {
+		signalKeyMiss(cmd.Args[1])
+	} else {
+		signalKeyHit(cmd.Args[1])
+	}
+
+	similarity := 0.0
+	if a != nil && b != nil {
+		similarity = a.Jaccard(b)
+	}
+	return response.Encode(strconv.FormatFloat(similarity, 'f', -1, 64), false), nil
+}
+
+func (cmd *Command) evalSIMMERGE() ([]byte, error) {
+	dest := cmd.Args[0]
+	merged, err := lookupSignature(dest)
+	if err != nil {
+		return nil, err
+	}
+	if merged == nil {
+		merged = minhash.NewSignature()
+	} else {
+		merged = merged.Clone()
+	}
+
+	for _, key := range cmd.Args[1:] {
+		sig, err := lookupSignature(key)
+		if err != nil {
+			return nil, err
+		}
+		if sig != nil {
+			merged.Merge(sig)
+		}
+	}
+
+	setKey(dest, merged)
+	signalModifiedKey(dest)
+	notifyKeyspaceEvent(NOTIFY_SET, "sim.merge", dest)
+	return response.Encode("OK", true), nil
+}
+
+func (cmd *Command) evalSIMINDEXADD() ([]byte, error) {
+	name := cmd.Args[0]
+	index, err := lookupIndex(name)
+	if err != nil {
+		return nil, err
+	}
+
+	//All the keys are validated first so that the index is either fully updated or left untouched
+	sigs := make([]*minhash.Signature, 0, len(cmd.Args)-1)
+	for _, key := range cmd.Args[1:] {
+		sig, err := lookupSignature(key)
+		if err != nil {
+			return nil, err
+		}
+		if sig == nil {
+			return nil, errors.New("ERR no such key")
+		}
+		sigs = append(sigs, sig)
+	}
+
+	if index == nil {
+		index = minhash.NewIndex()
+		setKey(name, index)
+	}
+	for i, key := range cmd.Args[1:] {
+		index.Add(key, sigs[i])
+	}
+	signalModifiedKey(name)
+	notifyKeyspaceEvent(NOTIFY_SET, "sim.index.add", name)
+	return response.Encode(len(sigs), false), nil
+}
+
+func (cmd *Command) evalSIMINDEXQUERY() ([]byte, error) {
+	index, err := lookupIndex(cmd.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	key := cmd.Args[1]
+	sig, err := lookupSignature(key)
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := strconv.ParseFloat(cmd.Args[2], 64)
+	if err != nil || threshold < 0 || threshold > 1 {
+		return nil, errors.New("ERR threshold must be a number between 0 and 1")
+	}
+	if index == nil {
+		signalKeyMiss(cmd.Args[0])
+	} else {
+		signalKeyHit(cmd.Args[0])
+	}
+	if sig == nil {
+		signalKeyMiss(key)
+	} else {
+		signalKeyHit(key)
+	}
+
+	var replies [][]byte
+	if index != nil && sig != nil {
+		for _, match := range index.Query(sig, threshold) {
+			//The queried key is always similar to itself
+			if match.Name == key {
+				continue
+			}
+			replies = append(replies, response.Encode(match.Name, false))
+		}
+	}
+	return response.EncodeArray(replies), nil
+}
@@ -0,0 +1,36 @@
+package server
+
+import "testing"
+
+func TestSim(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(int64(1), "SIM.ADD", "a", "x", "y", "z")
+	c.expect(int64(0), "SIM.ADD", "a", "x")
+	c.expect(int64(1), "SIM.ADD", "b", "x", "y", "z")
+	c.expect(int64(1), "SIM.ADD", "c", "u", "v", "w")
+	c.expect("1", "SIM.JACCARD", "a", "b")
+	c.expect("0", "SIM.JACCARD", "a", "missing")
+
+	c.expect(replyOK, "SIM.MERGE", "ac", "a", "c")
+	c.expect("1", "SIM.JACCARD", "ac", "ac")
+
+	c.expect(int64(3), "SIM.INDEX.ADD", "idx", "a", "b", "c")
+	c.expect(array("b"), "SIM.INDEX.QUERY", "idx", "a", "0.9")
+	c.expect(array(), "SIM.INDEX.QUERY", "missing", "a", "0.9")
+
+	c.expectError("ERR no such key", "SIM.INDEX.ADD", "idx", "missing")
+	c.expectError("ERR threshold must be a number between 0 and 1", "SIM.INDEX.QUERY", "idx", "a", "2")
+	c.expectError("WRONGTYPE", "SIM.ADD", "idx", "x")
+	c.expectError("WRONGTYPE", "SIM.INDEX.QUERY", "a", "a", "0.5")
+}
+
+func TestSimFromScripts(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expect(int64(1), "EVAL", "return redis.call('sim.add', KEYS[1], ARGV[1])", "1", "a", "x")
+	c.expect("1", "EVAL_RO", "return redis.call('sim.jaccard', KEYS[1], KEYS[1])", "1", "a")
+	c.expectError("ERR Write commands are not allowed from read-only scripts", "EVAL_RO", "return redis.call('sim.add', KEYS[1], 'x')", "1", "a")
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+The slow log remembers the commands that ran for longer than slowlog-log-slower-than microseconds:
+	- SLOWLOG GET [count] returns the newest entries, 10 by default and all of them with -1
+	- SLOWLOG LEN / RESET
+Each entry has an id, the unix time it was logged at, the duration in microseconds, the arguments,
+and the address and name of the client. Only the commands sent by clients are logged, the commands
+run by EXEC or by a script are part of its duration. At most slowlog-max-len entries are kept.
+*/
+
+const (
+	//Arguments past the limits are replaced by a note telling how much was left out, like redis does
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+var (
+	//The slow commands, the newest first, guarded by execMu
+	slowlog       []*slowlogEntry
+	lastSlowlogID int64
+)
+
+type slowlogEntry struct {
+	id         int64
+	time       time.Time
+	duration   time.Duration
+	args       []string
+	clientAddr string
+	clientName string
+}
+
+// Logs the command when it was slow, must be called holding execMu
+func slowlogPushEntryIfNeeded(c *Client, cmd *Command, duration time.Duration) {
+	if config.SlowlogLogSlowerThan < 0 || duration.Microseconds() < int64(config.SlowlogLogSlowerThan) {
+		return
+	}
+
+	cmd = cmd.redacted()
+	argv := append([]string{cmd.Cmd}, cmd.Args...)
+	argc := len(argv)
+	if argc > slowlogMaxArgc {
+		argc = slowlogMaxArgc
+	}
+	args := make([]string, 0, argc)
+	for i := 0; i < argc; i++ {
+		if i == slowlogMaxArgc-1 && len(argv) > slowlogMaxArgc {
+			args = append(args, fmt.Sprintf("... (%d more arguments)", len(argv)-slowlogMaxArgc+1))
+			break
+		}
+		arg := argv[i]
+		if len(arg) > slowlogMaxArgLen {
+			arg = fmt.Sprintf("%s... (%d more bytes)", arg[:slowlogMaxArgLen], len(arg)-slowlogMaxArgLen)
+		}
+		args = append(args, arg)
+	}
+
+	lastSlowlogID++
+	entry := &slowlogEntry{
+		id:         lastSlowlogID,
+		time:       time.Now(),
+		duration:   duration,
+		args:       args,
+		clientAddr: c.conn.RemoteAddr().String(),
+		clientName: c.name,
+	}
+	slowlog = append([]*slowlogEntry{entry}, slowlog...)
+	if len(slowlog) > config.SlowlogMaxLen {
+		slowlog = slowlog[:config.SlowlogMaxLen]
+	}
+}
+
+func (cmd *Command) evalSLOWLOG() ([]byte, error) {
+	sub := strings.ToLower(cmd.Args[0])
+	switch {
+	case sub == "get" && len(cmd.Args) <= 2:
+		count := 10
+		if len(cmd.Args) == 2 {
+			n, err := strconv.Atoi(cmd.Args[1])
+			if err != nil || n < -1 {
+				return nil, errors.New("ERR count should be greater than or equal to -1")
+			}
+			count = n
+		}
+		if count == -1 || count > len(slowlog) {
+			count = len(slowlog)
+		}
+
+		entries := make([][]byte, 0, count)
+		for _, e := range slowlog[:count] {
+			args := make([][]byte, 0, len(e.args))
+			for _, arg := range e.args {
+				args = append(args, response.Encode(arg, false))
+			}
+			entries = append(entries, response.EncodeArray([][]byte{
+				response.Encode(e.id, false),
+				response.Encode(e.time.Unix(), false),
+				response.Encode(e.duration.Microseconds(), false),
+				response.EncodeArray(args),
+				response.Encode(e.clientAddr, false),
+				response.Encode(e.clientName, false),
+			}))
+		}
+		return response.EncodeArray(entries), nil
+	case sub == "len" && len(cmd.Args) == 1:
+		return response.Encode(len(slowlog), false), nil
+	case sub == "reset" && len(cmd.Args) == 1:
+		slowlog = nil
+		return response.Encode("OK", true), nil
+	case sub == "get" || sub == "len" || sub == "reset":
+		return nil, fmt.Errorf("ERR wrong number of arguments for 'slowlog|%s' command", sub)
+	}
+	return nil, fmt.Errorf("ERR unknown subcommand '%s'. Try SLOWLOG HELP.", cmd.Args[0])
+}
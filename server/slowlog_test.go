@@ -0,0 +1,115 @@
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+func TestSlowlog(t *testing.T) {
+	setupTestServer(t)
+	config.SlowlogLogSlowerThan = 0
+	c := connect(t)
+
+	c.expect(replyOK, "CLIENT", "SETNAME", "worker")
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	c.do("AUTH", "default", "secret")
+
+	entries, ok := c.do("SLOWLOG", "GET", "2").([]interface{})
+	if !ok || len(entries) != 2 {
+		t.Fatalf("SLOWLOG GET 2 replied %#v", entries)
+	}
+	//The newest entry comes first and the password is not logged
+	auth := entries[0].([]interface{})
+	if auth[0] != int64(3) || !reflect.DeepEqual(auth[3], array("AUTH", "(redacted)", "(redacted)")) {
+		t.Errorf("the AUTH entry is %#v", auth)
+	}
+	add := entries[1].([]interface{})
+	if add[0] != int64(2) || !reflect.DeepEqual(add[3], array("SIM.ADD", "a", "x")) {
+		t.Errorf("the SIM.ADD entry is %#v", add)
+	}
+	if logged := add[1].(int64); time.Since(time.Unix(logged, 0)) > time.Minute {
+		t.Errorf("the entry was logged at %d", logged)
+	}
+	if usec := add[2].(int64); usec < 0 {
+		t.Errorf("the entry took %dus", usec)
+	}
+	if addr := add[4].(string); !strings.HasPrefix(addr, "127.0.0.1:") || add[5] != "worker" {
+		t.Errorf("the entry comes from %q named %q", addr, add[5])
+	}
+
+	//SLOWLOG GET was logged once it replied
+	c.expect(int64(4), "SLOWLOG", "LEN")
+	c.expect(replyOK, "SLOWLOG", "RESET")
+	c.expect(int64(1), "SLOWLOG", "LEN")
+	entries = c.do("SLOWLOG", "GET", "-1").([]interface{})
+	if len(entries) != 2 {
+		t.Errorf("SLOWLOG GET -1 returned %d entries", len(entries))
+	}
+}
+
+func TestSlowlogRedactsACLPasswords(t *testing.T) {
+	setupTestServer(t)
+	config.SlowlogLogSlowerThan = 0
+	c := connect(t)
+
+	hash := strings.Repeat("a", 64)
+	c.expect(replyOK, "ACL", "SETUSER", "eve", "on", ">old", "<old", "#"+hash, "!"+hash, "~*", "+@all")
+	entry := c.do("SLOWLOG", "GET", "1").([]interface{})[0].([]interface{})
+	expected := array("ACL", "SETUSER", "eve", "on", "(redacted)", "(redacted)", "(redacted)", "(redacted)", "~*", "+@all")
+	if !reflect.DeepEqual(entry[3], expected) {
+		t.Errorf("the ACL SETUSER entry is %#v", entry[3])
+	}
+}
+
+func TestSlowlogArgumentLimits(t *testing.T) {
+	setupTestServer(t)
+	config.SlowlogLogSlowerThan = 0
+	c := connect(t)
+
+	args := []string{"SIM.ADD", "a", strings.Repeat("x", 200)}
+	for len(args) < 40 {
+		args = append(args, "y")
+	}
+	c.expect(int64(1), args...)
+
+	entry := c.do("SLOWLOG", "GET", "1").([]interface{})[0].([]interface{})
+	logged := entry[3].([]interface{})
+	if len(logged) != slowlogMaxArgc {
+		t.Fatalf("%d arguments were logged", len(logged))
+	}
+	if logged[2] != strings.Repeat("x", 128)+"... (72 more bytes)" {
+		t.Errorf("the long argument was logged as %q", logged[2])
+	}
+	if logged[slowlogMaxArgc-1] != "... (9 more arguments)" {
+		t.Errorf("the last argument was logged as %q", logged[slowlogMaxArgc-1])
+	}
+}
+
+func TestSlowlogConfig(t *testing.T) {
+	setupTestServer(t)
+	config.SlowlogLogSlowerThan = 0
+	config.SlowlogMaxLen = 2
+	c := connect(t)
+
+	for _, element := range []string{"x", "y", "z"} {
+		c.expect(int64(1), "SIM.ADD", "a", element)
+	}
+	c.expect(int64(2), "SLOWLOG", "LEN")
+
+	//A negative threshold disables the slow log, a high one only logs the slow commands
+	config.SlowlogLogSlowerThan = -1
+	c.expect(replyOK, "SLOWLOG", "RESET")
+	c.expect(int64(1), "SIM.ADD", "a", "w")
+	c.expect(int64(0), "SLOWLOG", "LEN")
+	config.SlowlogLogSlowerThan = 1000000
+	c.expect(int64(1), "SIM.ADD", "a", "v")
+	c.expect(int64(0), "SLOWLOG", "LEN")
+
+	c.expectError("ERR count should be greater than or equal to -1", "SLOWLOG", "GET", "-2")
+	c.expectError("ERR wrong number of arguments for 'slowlog|len' command", "SLOWLOG", "LEN", "x")
+	c.expectError("ERR unknown subcommand 'NOPE'", "SLOWLOG", "NOPE")
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/inmemdb/inmem/server/minhash"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Values are serialized to be copied to other servers, eg: in the snapshot sent to a replica. A serialized value is:
+	- a byte telling the type of the value, VALUE_TYPE_SIGNATURE or VALUE_TYPE_INDEX
+	- the binary encoding of the value by the minhash package
+	- the version of the format on one byte, followed by the CRC32 of everything before it, in big endian
+A snapshot of the dataset is a RESP array of every key followed by its serialized value.
+*/
+
+const (
+	VALUE_TYPE_SIGNATURE = 1
+	VALUE_TYPE_INDEX     = 2
+
+	serializationVersion = 1
+)
+
+var errBadPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// Serializes the value of a key
+func serializeValue(value interface{}) []byte {
+	var data []byte
+	switch v := value.(type) {
+	case *minhash.Signature:
+		encoded, _ := v.MarshalBinary()
+		data = append([]byte{VALUE_TYPE_SIGNATURE}, encoded...)
+	case *minhash.Index:
+		encoded, _ := v.MarshalBinary()
+		data = append([]byte{VALUE_TYPE_INDEX}, encoded...)
+	default:
+		panic(fmt.Sprintf("no serialization for values of type %T", value))
+	}
+	data = append(data, serializationVersion)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(data))
+	return append(data, crc[:]...)
+}
+
+// Deserializes a value serialized by serializeValue
+func deserializeValue(data []byte) (interface{}, error) {
+	if len(data) < 6 {
+		return nil, errBadPayload
+	}
+	body, footer := data[:len(data)-4], data[len(data)-4:]
+	if body[len(body)-1] != serializationVersion || binary.BigEndian.Uint32(footer) != crc32.ChecksumIEEE(body) {
+		return nil, errBadPayload
+	}
+	encoded := body[1 : len(body)-1]
+
+	switch body[0] {
+	case VALUE_TYPE_SIGNATURE:
+		sig := &minhash.Signature{}
+		if err := sig.UnmarshalBinary(encoded); err != nil {
+			return nil, errBadPayload
+		}
+		return sig, nil
+	case VALUE_TYPE_INDEX:
+		x := &minhash.Index{}
+		if err := x.UnmarshalBinary(encoded); err != nil {
+			return nil, errBadPayload
+		}
+		return x, nil
+	}
+	return nil, errBadPayload
+}
+
+// Creates a snapshot of the dataset, must be called holding execMu
+func createSnapshot() []byte {
+	keys := make([]string, 0, len(keyspace))
+	for key := range keyspace {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	elems := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		elems = append(elems, response.Encode(key, false), response.Encode(string(serializeValue(keyspace[key])), false))
+	}
+	return response.EncodeArray(elems)
+}
+
+// Parses a snapshot created by createSnapshot into the keys and their values
+func parseSnapshot(snapshot []byte) (map[string]interface{}, error) {
+	raw, err := response.NewReader(bytes.NewReader(snapshot)).ReadRaw()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) != len(snapshot) {
+		return nil, errors.New("ERR unexpected data after the snapshot")
+	}
+	value, err := response.Decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	elems, ok := value.([]interface{})
+	if !ok || len(elems)%2 != 0 {
+		return nil, errors.New("ERR the snapshot is not an array of keys and values")
+	}
+
+	keys := make(map[string]interface{}, len(elems)/2)
+	for i := 0; i < len(elems); i += 2 {
+		key, ok := elems[i].(string)
+		data, ok2 := elems[i+1].(string)
+		if !ok || !ok2 {
+			return nil, errors.New("ERR the snapshot is not an array of keys and values")
+		}
+		if keys[key], err = deserializeValue([]byte(data)); err != nil {
+			return nil, fmt.Errorf("%s, key '%s'", err, key)
+		}
+	}
+	return keys, nil
+}
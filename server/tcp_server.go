@@ -1,41 +1,90 @@
 package server
 
 import (
+	"errors"
 	"github.com/inmemdb/inmem/config"
 	"github.com/inmemdb/inmem/server/response"
 	"io"
 	"log"
 	"net"
-	"strconv"
 )
 
+/**
+The sync server serves one client at a time and runs the commands with Command.EvalCommand, it has no
+connection state so it does not authenticate clients. The clients of every bind address and of the TLS
+port are served in the order they connect.
+Since no client authenticates, protected mode refuses every client that is not on the loopback interface,
+and the server refuses to start when a password is set with requirepass or the users come from an aclfile.
+*/
+
+var errSyncAuth = errors.New("the sync server does not authenticate clients, it can not run with requirepass or aclfile")
+
+var errSyncProtectedMode = errors.New("DENIED inmem is running in protected mode and the sync server does not authenticate clients, so connections are only accepted from the loopback interface. If you want to connect from external computers restart the server with the '-protected-mode=false' option, however MAKE SURE it is not publicly accessible from internet if you do so.")
+
 func RunInMemDBSyncServer() {
+	if err := checkSyncServerConfig(); err != nil {
+		panic(err)
+	}
 	log.Println("Running Sync TCP server on", config.Host, config.Port)
 	var clients int
 
 	//INFO: 1. Listen call:
 	//This creates a new server socket and binds it with the network address (host:port) on which the server process keeps waiting
 	//for a new tcp connection from a client
-	srvListnerSockt, err := net.Listen("tcp", config.Host+":"+strconv.Itoa(config.Port))
-	if err != nil {
-		panic(err)
+	//INFO: Every bind address and the TLS port have their own listener, the accepted connections are
+	//handed over one at a time
+	conns := make(chan net.Conn)
+	for _, listener := range listenTCP(config.Port) {
+		go acceptSyncConnections(listener, conns)
 	}
+	for _, listener := range createTLSListeners() {
+		log.Println("Running Sync TLS server on", listener.Addr())
+		go acceptSyncConnections(listener, conns)
+	}
+
+	for newClientConn := range conns {
+		if syncProtectedModeDenied(newClientConn) {
+			log.Println("Protected mode refused the client", newClientConn.RemoteAddr())
+			newClientConn.Write(response.EncodeError(errSyncProtectedMode))
+			newClientConn.Close()
+			continue
+		}
+
+		clients += 1
+		log.Println("New Client is Connected to our server with address: ", newClientConn.RemoteAddr(), "Client Numer=", clients)
+		handleConnection(newClientConn, clients)
+		clients -= 1
+	}
+}
+
+func acceptSyncConnections(listener net.Listener, conns chan<- net.Conn) {
 	for {
 		//INFO: 2: Accept call:
 		//Accept creates a new socket for a new TCP client connection, it is a blocking call
 		//and waits until the client has successfully established the TCP connection with the server
 		// When a successful connection is established it returnes a new connection (socket) for the
 		//TCP client
-		newClientConn, err := srvListnerSockt.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			panic(err)
+			log.Println("Error in establishing Client Connection, Err: ", err)
+			continue
 		}
+		conns <- conn
+	}
+}
 
-		clients += 1
-		log.Println("New Client is Connected to our server with address: ", newClientConn.RemoteAddr(), "Client Numer=", clients)
-		handleConnection(newClientConn, clients)
-		clients -= 1
+// The clients of the sync server run commands without authenticating, so it must not be started
+// when the configuration expects them to
+func checkSyncServerConfig() error {
+	if config.RequirePass != "" || config.ACLFile != "" {
+		return errSyncAuth
 	}
+	return nil
+}
+
+// Tells if the client must be refused by protected mode
+func syncProtectedModeDenied(conn net.Conn) bool {
+	return config.ProtectedMode && !isLocalConn(conn)
 }
 
 func handleConnection(newConnSocket net.Conn, clients int) error {
@@ -57,7 +106,7 @@ func handleConnection(newConnSocket net.Conn, clients int) error {
 			log.Println("Read Connection Error: ", err)
 			break
 		}
-		log.Println("Req Sent is: ", req)
+		log.Println("Req Sent is: ", req.redacted())
 		if err = respond(req, newConnSocket); err != nil {
 			log.Println("error responding to client: ", err)
 		}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/tlsconf"
+)
+
+// Creates the listeners of the TLS port on every bind address, none when TLS is disabled
+func createTLSListeners() []net.Listener {
+	if config.TLSPort == 0 {
+		return nil
+	}
+	loader, err := tlsconf.New(tlsconf.Options{
+		CertFile:    config.TLSCertFile,
+		KeyFile:     config.TLSKeyFile,
+		CACertFile:  config.TLSCACertFile,
+		AuthClients: config.TLSAuthClients,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	var listeners []net.Listener
+	for _, listener := range listenTCP(config.TLSPort) {
+		listeners = append(listeners, tls.NewListener(listener, loader.Config()))
+	}
+	return listeners
+}
+
+// Listens for the connections of the other nodes on the raft bus or the cluster bus, with TLS when tls-cluster is set
+func listenBus(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil || !config.TLSCluster {
+		return listener, err
+	}
+	loader, err := tlsconf.New(tlsconf.Options{
+		CertFile:    config.TLSCertFile,
+		KeyFile:     config.TLSKeyFile,
+		CACertFile:  config.TLSCACertFile,
+		AuthClients: config.TLSAuthClients,
+	})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, loader.Config()), nil
+}
+
+// Connects to the bus or to the clients port of another node of the cluster, with TLS when tls-cluster is set
+func dialBus(addr string, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !config.TLSCluster {
+		return dialer.Dial("tcp", addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := tlsconf.ClientConfig(tlsconf.Options{
+		CertFile:   config.TLSCertFile,
+		KeyFile:    config.TLSKeyFile,
+		CACertFile: config.TLSCACertFile,
+	}, host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
+
+// Connects to the clients port of another server, with TLS when tls-replication is set. Replicas connect to their
+// master and sentinels to the instances they monitor this way.
+func dialInstance(host string, port int, timeout time.Duration) (net.Conn, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	dialer := &net.Dialer{Timeout: timeout}
+	if !config.TLSReplication {
+		return dialer.Dial("tcp", addr)
+	}
+	tlsConfig, err := tlsconf.ClientConfig(tlsconf.Options{
+		CertFile:   config.TLSCertFile,
+		KeyFile:    config.TLSKeyFile,
+		CACertFile: config.TLSCACertFile,
+	}, host)
+	if err != nil {
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+}
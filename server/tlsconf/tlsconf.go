@@ -0,0 +1,191 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+TLS configuration of the server listeners:
+	- the certificate and private key are read from tls-cert-file and tls-key-file
+	- tls-auth-clients yes|optional|no tells if clients must present a certificate signed by one of
+	  the certificates of tls-ca-cert-file (mutual TLS), may present one, or are not asked for one
+	- the files are reloaded when they change on disk, new connections use the new certificates
+	  while the established ones keep going. A file that fails to load keeps the previous certificates.
+The links the server opens to other servers, like the one of a replica to its master, use ClientConfig:
+the server certificate is presented as the client certificate and the other server must present a
+certificate signed by one of the certificates of tls-ca-cert-file. The files are read for every link.
+*/
+
+// How often the files are checked for changes, at most once per handshake
+const reloadCheckInterval = time.Second
+
+type Options struct {
+	CertFile    string
+	KeyFile     string
+	CACertFile  string
+	AuthClients string
+}
+
+type Loader struct {
+	opts Options
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// Loads the certificates, returns an error if they can not be used
+func New(opts Options) (*Loader, error) {
+	l := &Loader{opts: opts}
+	config, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.config = config
+	l.modTimes = l.fileModTimes()
+	l.lastCheck = time.Now()
+	return l, nil
+}
+
+// The configuration to use for a listener, every handshake uses the latest certificates
+func (l *Loader) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.current(), nil
+		},
+	}
+}
+
+func (l *Loader) current() *tls.Config {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.lastCheck) < reloadCheckInterval {
+		return l.config
+	}
+	l.lastCheck = time.Now()
+
+	modTimes := l.fileModTimes()
+	if equalTimes(modTimes, l.modTimes) {
+		return l.config
+	}
+	config, err := l.load()
+	if err != nil {
+		log.Println("Failed to reload the TLS certificates, the previous ones are kept. Err: ", err)
+		return l.config
+	}
+	log.Println("TLS certificates reloaded")
+	l.config = config
+	l.modTimes = modTimes
+	return l.config
+}
+
+func (l *Loader) files() []string {
+	files := []string{l.opts.CertFile, l.opts.KeyFile}
+	if l.opts.CACertFile != "" {
+		files = append(files, l.opts.CACertFile)
+	}
+	return files
+}
+
+func (l *Loader) fileModTimes() []time.Time {
+	var modTimes []time.Time
+	for _, file := range l.files() {
+		var modTime time.Time
+		if info, err := os.Stat(file); err == nil {
+			modTime = info.ModTime()
+		}
+		modTimes = append(modTimes, modTime)
+	}
+	return modTimes
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Loader) load() (*tls.Config, error) {
+	if l.opts.CertFile == "" || l.opts.KeyFile == "" {
+		return nil, errors.New("tls-cert-file and tls-key-file are required to enable TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(l.opts.CertFile, l.opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+
+	switch strings.ToLower(l.opts.AuthClients) {
+	case "no":
+		config.ClientAuth = tls.NoClientCert
+		return config, nil
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "yes", "":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("invalid tls-auth-clients '%s', must be yes, optional or no", l.opts.AuthClients)
+	}
+
+	if l.opts.CACertFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to authenticate clients, set tls-auth-clients to no to disable it")
+	}
+	pem, err := os.ReadFile(l.opts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", l.opts.CACertFile)
+	}
+	config.ClientCAs = pool
+	return config, nil
+}
+
+// The configuration to connect to the server at host, reading the files of opts
+func ClientConfig(opts Options, host string) (*tls.Config, error) {
+	if opts.CACertFile == "" {
+		return nil, errors.New("tls-ca-cert-file is required to verify the certificates of other servers")
+	}
+	pem, err := os.ReadFile(opts.CACertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", opts.CACertFile)
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+		ServerName: host,
+	}
+	if opts.CertFile != "" && opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,220 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Creates a certificate signed by parent, or a self signed CA when parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert, key, der}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600)
+	if keyFile != "" {
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// Connects to the listener and returns the common name of the server certificate
+func handshake(t *testing.T, addr string, ca *testCert, client *testCert) (string, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	//With TLS 1.3 a rejected client certificate is only noticed on the first read
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ping"))
+	if _, err = conn.Read(make([]byte, 4)); err != nil {
+		return "", err
+	}
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestMutualTLSAndReload(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		CertFile:    filepath.Join(dir, "server.crt"),
+		KeyFile:     filepath.Join(dir, "server.key"),
+		CACertFile:  filepath.Join(dir, "ca.crt"),
+		AuthClients: "yes",
+	}
+	ca := newTestCert(t, "ca", nil)
+	ca.write(t, opts.CACertFile, "")
+	newTestCert(t, "server-1", ca).write(t, opts.CertFile, opts.KeyFile)
+
+	loader, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", loader.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 4)
+				if n, err := conn.Read(buf); err == nil {
+					conn.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	client := newTestCert(t, "client", ca)
+	if name, err := handshake(t, addr, ca, client); err != nil || name != "server-1" {
+		t.Fatalf("expected server-1, got %q %v", name, err)
+	}
+	if _, err := handshake(t, addr, ca, nil); err == nil {
+		t.Error("a client without certificate must be rejected")
+	}
+
+	newTestCert(t, "server-2", ca).write(t, opts.CertFile, opts.KeyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(opts.CertFile, future, future)
+	loader.mu.Lock()
+	loader.lastCheck = time.Time{}
+	loader.mu.Unlock()
+	if name, err := handshake(t, addr, ca, client); err != nil || name != "server-2" {
+		t.Errorf("expected the reloaded server-2 certificate, got %q %v", name, err)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	newTestCert(t, "server", ca).write(t, certFile, keyFile)
+
+	cases := []Options{
+		{CertFile: certFile},
+		{CertFile: certFile, KeyFile: keyFile, AuthClients: "sometimes"},
+		{CertFile: certFile, KeyFile: keyFile, AuthClients: "yes"},
+		{CertFile: filepath.Join(dir, "missing.crt"), KeyFile: keyFile, AuthClients: "no"},
+	}
+	for _, opts := range cases {
+		if _, err := New(opts); err == nil {
+			t.Errorf("expected an error for %+v", opts)
+		}
+	}
+	if _, err := New(Options{CertFile: certFile, KeyFile: keyFile, AuthClients: "no"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{
+		CertFile:    filepath.Join(dir, "server.crt"),
+		KeyFile:     filepath.Join(dir, "server.key"),
+		CACertFile:  filepath.Join(dir, "ca.crt"),
+		AuthClients: "yes",
+	}
+	ca := newTestCert(t, "ca", nil)
+	ca.write(t, opts.CACertFile, "")
+	newTestCert(t, "server", ca).write(t, opts.CertFile, opts.KeyFile)
+
+	loader, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", loader.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		conn.Read(make([]byte, 1))
+	}()
+
+	//The server certificate is accepted as a client certificate by another server
+	config, err := ClientConfig(opts, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 4)); err != nil {
+		t.Errorf("the link was refused: %v", err)
+	}
+
+	if _, err := ClientConfig(Options{CertFile: opts.CertFile, KeyFile: opts.KeyFile}, "127.0.0.1"); err == nil {
+		t.Error("a link can not be verified without tls-ca-cert-file")
+	}
+}
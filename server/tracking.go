@@ -0,0 +1,273 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Client side caching:
+	- CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST] [OPTIN] [OPTOUT] [NOLOOP]
+	- CLIENT CACHING YES|NO marks whether the keys read by the next command are tracked in OPTIN/OPTOUT mode
+	- CLIENT GETREDIR returns the client invalidation messages are redirected to
+In the default mode the server remembers the keys read by each tracking client in the tracking table,
+and sends an invalidation message the first time a remembered key is modified. The table holds at most
+tracking-table-max-keys keys (0 for no limit), past it random keys are forgotten and invalidated like redis does.
+In BCAST mode nothing is remembered, the client is told about every modified key starting with one of
+its prefixes (any key when it has none).
+Invalidations are push frames in RESP3. A RESP2 client redirects them with REDIRECT to another
+connection subscribed to __redis__:invalidate, which receives them as pub/sub messages.
+*/
+
+const trackingInvalidateChannel = "__redis__:invalidate"
+
+var (
+	//The ids of the clients which read each key, guarded by execMu
+	trackingTable = map[string]map[uint64]struct{}{}
+
+	//The clients in BCAST mode by prefix, guarded by execMu
+	trackingPrefixes = map[string]map[*Client]struct{}{}
+)
+
+// Tracking state of a client
+type tracking struct {
+	enabled    bool
+	bcast      bool
+	optIn      bool
+	optOut     bool
+	noLoop     bool
+	redirect   uint64
+	prefixes   []string
+	redirBroke bool
+
+	//Set by CLIENT CACHING for the next command
+	caching bool
+}
+
+func (c *Client) clientTracking(args []string) []byte {
+	var next tracking
+	switch strings.ToLower(args[0]) {
+	case "on":
+		next.enabled = true
+	case "off":
+	default:
+		return response.EncodeError(errors.New("ERR syntax error"))
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "redirect":
+			if i+1 >= len(args) {
+				return response.EncodeError(errors.New("ERR syntax error"))
+			}
+			i++
+			id, err := strconv.ParseUint(args[i], 10, 64)
+			if err != nil {
+				return response.EncodeError(errors.New("ERR value is not an integer or out of range"))
+			}
+			if next.redirect != 0 {
+				return response.EncodeError(errors.New("ERR A client can only redirect to a single other client"))
+			}
+			if _, ok := clients[id]; !ok || id == c.id {
+				return response.EncodeError(errors.New("ERR The client ID you want redirect to does not exist"))
+			}
+			next.redirect = id
+		case "prefix":
+			if i+1 >= len(args) {
+				return response.EncodeError(errors.New("ERR syntax error"))
+			}
+			i++
+			next.prefixes = append(next.prefixes, args[i])
+		case "bcast":
+			next.bcast = true
+		case "optin":
+			next.optIn = true
+		case "optout":
+			next.optOut = true
+		case "noloop":
+			next.noLoop = true
+		default:
+			return response.EncodeError(errors.New("ERR syntax error"))
+		}
+	}
+
+	if !next.enabled {
+		c.disableTracking()
+		return response.Encode("OK", true)
+	}
+
+	if c.tracking.enabled && c.tracking.bcast != next.bcast {
+		return response.EncodeError(errors.New("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."))
+	}
+	if len(next.prefixes) > 0 && !next.bcast {
+		return response.EncodeError(errors.New("ERR PREFIX option requires BCAST mode to be enabled"))
+	}
+	if next.optIn && next.optOut {
+		return response.EncodeError(errors.New("ERR You can't use both OPTIN and OPTOUT"))
+	}
+	if next.bcast && (next.optIn || next.optOut) {
+		return response.EncodeError(errors.New("ERR OPTIN and OPTOUT are not compatible with BCAST"))
+	}
+
+	c.disableTracking()
+	if next.bcast && len(next.prefixes) == 0 {
+		next.prefixes = []string{""}
+	}
+	for _, prefix := range next.prefixes {
+		subscribers, ok := trackingPrefixes[prefix]
+		if !ok {
+			subscribers = make(map[*Client]struct{})
+			trackingPrefixes[prefix] = subscribers
+		}
+		subscribers[c] = struct{}{}
+	}
+	c.tracking = next
+	return response.Encode("OK", true)
+}
+
+func (c *Client) clientCaching(args []string) []byte {
+	if !c.tracking.enabled || !(c.tracking.optIn || c.tracking.optOut) {
+		return response.EncodeError(errors.New("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"))
+	}
+	switch strings.ToLower(args[0]) {
+	case "yes":
+		if !c.tracking.optIn {
+			return response.EncodeError(errors.New("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."))
+		}
+	case "no":
+		if !c.tracking.optOut {
+			return response.EncodeError(errors.New("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."))
+		}
+	default:
+		return response.EncodeError(errors.New("ERR syntax error"))
+	}
+	c.tracking.caching = true
+	return response.Encode("OK", true)
+}
+
+func (c *Client) clientGetRedir() []byte {
+	if !c.tracking.enabled {
+		return response.Encode(-1, false)
+	}
+	return response.Encode(int64(c.tracking.redirect), false)
+}
+
+// Stops tracking, the keys already in the tracking table are forgotten lazily
+func (c *Client) disableTracking() {
+	for _, prefix := range c.tracking.prefixes {
+		subscribers := trackingPrefixes[prefix]
+		delete(subscribers, c)
+		if len(subscribers) == 0 {
+			delete(trackingPrefixes, prefix)
+		}
+	}
+	c.tracking = tracking{}
+}
+
+// Remembers the keys read by the command for the client running it, must be called holding execMu
+func trackKeysRead(cmd *Command) {
+	c := currentClient
+	if c == nil || !c.tracking.enabled || c.tracking.bcast {
+		return
+	}
+	//OPTIN only tracks after CLIENT CACHING YES, OPTOUT tracks unless CLIENT CACHING NO was sent
+	if (c.tracking.optIn && !c.tracking.caching) || (c.tracking.optOut && c.tracking.caching) {
+		return
+	}
+	for _, key := range cmd.keys() {
+		ids, ok := trackingTable[key]
+		if !ok {
+			ids = make(map[uint64]struct{})
+			trackingTable[key] = ids
+		}
+		ids[c.id] = struct{}{}
+	}
+	limitTrackingTable()
+}
+
+// Forgets keys of the tracking table past tracking-table-max-keys, their clients
+// are told to invalidate them since they will not be told when they change. 0 means no limit.
+func limitTrackingTable() {
+	if config.TrackingTableMaxKeys == 0 {
+		return
+	}
+	//INFO: Map iteration order is random, which picks the keys to forget at random
+	for key := range trackingTable {
+		if len(trackingTable) <= config.TrackingTableMaxKeys {
+			break
+		}
+		invalidateTrackedKey(key, nil)
+	}
+}
+
+// Sends invalidation messages for the modified key, must be called holding execMu
+func trackingInvalidateKey(key string) {
+	if len(trackingTable) > 0 {
+		invalidateTrackedKey(key, currentClient)
+	}
+	if len(trackingPrefixes) == 0 {
+		return
+	}
+	//A client with several matching prefixes is only told once
+	notified := map[*Client]struct{}{}
+	for prefix, subscribers := range trackingPrefixes {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		for c := range subscribers {
+			if _, ok := notified[c]; ok || (c.tracking.noLoop && c == currentClient) {
+				continue
+			}
+			notified[c] = struct{}{}
+			c.sendInvalidation(key)
+		}
+	}
+}
+
+// Invalidates the key for the clients which read it and removes it from the tracking table.
+// The client that modified the key is skipped when it asked for NOLOOP.
+func invalidateTrackedKey(key string, modifiedBy *Client) {
+	ids, ok := trackingTable[key]
+	if !ok {
+		return
+	}
+	delete(trackingTable, key)
+	for id := range ids {
+		c, ok := clients[id]
+		if !ok || !c.tracking.enabled || c.tracking.bcast {
+			continue
+		}
+		if c.tracking.noLoop && c == modifiedBy {
+			continue
+		}
+		c.sendInvalidation(key)
+	}
+}
+
+func (c *Client) sendInvalidation(key string) {
+	target := c
+	if c.tracking.redirect != 0 {
+		var ok bool
+		if target, ok = clients[c.tracking.redirect]; !ok {
+			//The client is told once that its invalidations are lost
+			if c.resp == 3 && !c.tracking.redirBroke {
+				c.tracking.redirBroke = true
+				c.write(response.EncodePush([][]byte{response.Encode("tracking-redir-broken", false), response.Encode(int64(c.tracking.redirect), false)}))
+			}
+			return
+		}
+	}
+
+	keys := response.EncodeArray([][]byte{response.Encode(key, false)})
+	if target.resp == 3 {
+		target.write(response.EncodePush([][]byte{response.Encode("invalidate", false), keys}))
+		return
+	}
+	if _, ok := target.channels[trackingInvalidateChannel]; ok {
+		target.write(response.EncodeArray([][]byte{response.Encode("message", false), response.Encode(trackingInvalidateChannel, false), keys}))
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+// Connects a client subscribed to the invalidation channel and a client tracking
+// keys with its invalidations redirected to it
+func connectTracking(t *testing.T, options ...string) (*testClient, *testClient) {
+	redir := connect(t)
+	tracker := connect(t)
+	id := redir.do("CLIENT", "ID")
+	redir.expect(array("subscribe", trackingInvalidateChannel, int64(1)), "SUBSCRIBE", trackingInvalidateChannel)
+	tracker.expect(replyOK, append([]string{"CLIENT", "TRACKING", "ON", "REDIRECT", strconv.FormatInt(id.(int64), 10)}, options...)...)
+	tracker.expect(id, "CLIENT", "GETREDIR")
+	return redir, tracker
+}
+
+func TestTracking(t *testing.T) {
+	setupTestServer(t)
+	redir, tracker := connectTracking(t)
+	writer := connect(t)
+
+	tracker.expect("0", "SIM.JACCARD", "a", "b")
+	writer.expect(int64(1), "SIM.ADD", "a", "x")
+	redir.expectNext(array("message", trackingInvalidateChannel, array("a")))
+
+	//A key is only invalidated once, until it is read again
+	writer.expect(int64(1), "SIM.ADD", "a", "y")
+	writer.expect(int64(1), "SIM.ADD", "b", "x")
+	redir.expectNext(array("message", trackingInvalidateChannel, array("b")))
+
+	tracker.expect(replyOK, "CLIENT", "TRACKING", "OFF")
+	tracker.expect(int64(-1), "CLIENT", "GETREDIR")
+	tracker.do("SIM.JACCARD", "a", "b")
+	writer.expect(int64(1), "SIM.ADD", "a", "z")
+	if !redir.silent(20 * time.Millisecond) {
+		t.Error("a key read without tracking was invalidated")
+	}
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	setupTestServer(t)
+	redir, _ := connectTracking(t, "BCAST", "PREFIX", "user:")
+	writer := connect(t)
+
+	writer.expect(int64(1), "SIM.ADD", "cache:1", "x")
+	writer.expect(int64(1), "SIM.ADD", "user:1", "x")
+	redir.expectNext(array("message", trackingInvalidateChannel, array("user:1")))
+}
+
+func TestTrackingTableMaxKeys(t *testing.T) {
+	setupTestServer(t)
+	config.TrackingTableMaxKeys = 1
+	redir, tracker := connectTracking(t)
+
+	//Past the limit keys are forgotten and invalidated right away
+	tracker.expect("0", "SIM.JACCARD", "c", "d")
+	if reply := redir.read(); len(reply.([]interface{})) != 3 {
+		t.Errorf("unexpected invalidation %#v", reply)
+	}
+}
+
+func TestTrackingTableNoLimit(t *testing.T) {
+	setupTestServer(t)
+	config.TrackingTableMaxKeys = 0
+	redir, tracker := connectTracking(t)
+	writer := connect(t)
+
+	//0 means no limit, the keys read stay tracked until they are modified
+	tracker.expect("0", "SIM.JACCARD", "a", "b")
+	if !redir.silent(20 * time.Millisecond) {
+		t.Fatal("a tracked key was invalidated before being modified")
+	}
+	writer.expect(int64(1), "SIM.ADD", "a", "x")
+	redir.expectNext(array("message", trackingInvalidateChannel, array("a")))
+}
+
+func TestTrackingErrors(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+
+	c.expectError("ERR PREFIX option requires BCAST mode to be enabled", "CLIENT", "TRACKING", "ON", "PREFIX", "a")
+	c.expectError("ERR You can't use both OPTIN and OPTOUT", "CLIENT", "TRACKING", "ON", "OPTIN", "OPTOUT")
+	c.expectError("ERR OPTIN and OPTOUT are not compatible with BCAST", "CLIENT", "TRACKING", "ON", "BCAST", "OPTIN")
+	c.expectError("ERR The client ID you want redirect to does not exist", "CLIENT", "TRACKING", "ON", "REDIRECT", "999999")
+	c.expectError("ERR CLIENT CACHING can be called only when the client is in tracking mode", "CLIENT", "CACHING", "YES")
+	c.expect(replyOK, "CLIENT", "TRACKING", "ON", "OPTIN")
+	c.expectError("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.", "CLIENT", "CACHING", "NO")
+	c.expect(replyOK, "CLIENT", "CACHING", "YES")
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+WAIT and WAITAOF block the client until its writes reached enough copies:
+	- WAIT numreplicas timeout waits until numreplicas replicas acknowledged the replication stream up to the
+	  last command of the client, and replies the number of replicas that did
+	- WAITAOF numlocal numreplicas timeout waits until the writes are fsynced to the append only file of this
+	  server (numlocal 1) and of numreplicas replicas, and replies both numbers
+	- the timeout is in milliseconds, 0 waits forever. Once it expired the numbers reached are replied.
+	- REPLCONF GETACK * is sent to the replicas so that they acknowledge right away
+The offset of the last command of a client is kept in Client.woff. The clients wait without holding execMu,
+they are woken when replicas acknowledge and when the file is fsynced. Inside a transaction WAIT does not block
+and replies the numbers reached when it runs.
+min-replicas-to-write is the other side: a master refuses writes unless enough replicas acknowledged the stream
+within min-replicas-max-lag seconds.
+*/
+
+// A client blocked by WAIT or WAITAOF
+type waitingClient struct {
+	//Offset of the stream the client waits for
+	offset int64
+	//Copies waited for, numLocal is 0 or 1
+	numLocal    int
+	numReplicas int
+	//Set for WAITAOF, the replicas must have fsynced their append only file
+	aof bool
+	//Timeout in milliseconds, 0 waits forever
+	timeout int64
+	//Closed once the copies were reached
+	woken chan struct{}
+}
+
+var (
+	//The clients blocked by WAIT and WAITAOF
+	waitingClients = map[*waitingClient]struct{}{}
+
+	errWaitReplica    = errors.New("ERR WAIT cannot be used with replica instances. Please also note that writes to writable replicas are just local and are not propagated.")
+	errWaitAOFReplica = errors.New("ERR WAITAOF cannot be used with replica instances. Please also note that writes to writable replicas are just local and are not propagated.")
+	errWaitAOFLocal   = errors.New("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	errNoReplicas     = errors.New("NOREPLICAS Not enough good replicas to write.")
+)
+
+// Parses WAIT numreplicas timeout or WAITAOF numlocal numreplicas timeout, must be called holding execMu
+func (c *Client) newWaitingClient(cmd *Command) (*waitingClient, error) {
+	if err := cmd.checkArity(); err != nil {
+		return nil, err
+	}
+	w := &waitingClient{offset: c.woff, aof: cmd.name() == COMMAND_WAITAOF, woken: make(chan struct{})}
+	counts := cmd.Args[:len(cmd.Args)-1]
+	if replicaOf != nil {
+		if w.aof {
+			return nil, errWaitAOFReplica
+		}
+		return nil, errWaitReplica
+	}
+	timeout, err := strconv.ParseInt(cmd.Args[len(cmd.Args)-1], 10, 64)
+	if err != nil {
+		return nil, errors.New("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return nil, errors.New("ERR timeout is negative")
+	}
+	w.timeout = timeout
+	if w.aof {
+		if w.numLocal, err = strconv.Atoi(counts[0]); err != nil || w.numLocal < 0 {
+			return nil, errors.New("ERR value is not an integer or out of range")
+		}
+		if w.numLocal > 0 && !config.AppendOnly {
+			return nil, errWaitAOFLocal
+		}
+		counts = counts[1:]
+	}
+	if w.numReplicas, err = strconv.Atoi(counts[0]); err != nil || w.numReplicas < 0 {
+		return nil, errors.New("ERR value is not an integer or out of range")
+	}
+	return w, nil
+}
+
+// Number of copies of the writes reached, must be called holding execMu
+func (w *waitingClient) acknowledged() (local int, acked int) {
+	if appendOnlyFileOffset() >= w.offset {
+		local = 1
+	}
+	for c := range replicas {
+		offset := c.replica.ackOffset
+		if w.aof {
+			offset = c.replica.ackAOFOffset
+		}
+		if offset >= w.offset {
+			acked++
+		}
+	}
+	return local, acked
+}
+
+func (w *waitingClient) reached() bool {
+	local, acked := w.acknowledged()
+	return local >= w.numLocal && acked >= w.numReplicas
+}
+
+func (w *waitingClient) reply() []byte {
+	local, acked := w.acknowledged()
+	if !w.aof {
+		return response.Encode(acked, false)
+	}
+	return response.EncodeArray([][]byte{response.Encode(local, false), response.Encode(acked, false)})
+}
+
+// Wakes the clients whose copies were reached, must be called holding execMu
+func wakeWaitingClients() {
+	for w := range waitingClients {
+		if w.reached() {
+			close(w.woken)
+			delete(waitingClients, w)
+		}
+	}
+}
+
+// Runs WAIT or WAITAOF, blocking the client until the copies are reached or the timeout expires
+func (c *Client) wait(cmd *Command) {
+	if !lockExecMu(c, cmd) {
+		return
+	}
+	w, err := c.newWaitingClient(cmd)
+	if err != nil || w.reached() {
+		execMu.Unlock()
+		//INFO: The errors and the copies already reached are replied right away, like inside a transaction
+		respondAsyncClient(c, cmd)
+		return
+	}
+	waitingClients[w] = struct{}{}
+	if w.numReplicas > 0 && len(replicas) > 0 {
+		feedReplicationStream((&Command{Cmd: "REPLCONF", Args: []string{"GETACK", "*"}}).encode())
+	}
+	execMu.Unlock()
+
+	var expired <-chan time.Time
+	if w.timeout > 0 {
+		timer := time.NewTimer(time.Duration(w.timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-w.woken:
+	case <-expired:
+	}
+
+	execMu.Lock()
+	defer execMu.Unlock()
+	delete(waitingClients, w)
+	start := time.Now()
+	reply := w.reply()
+	recordCall(cmd, time.Since(start), reply)
+	c.write(reply)
+}
+
+/**
+WAIT numreplicas timeout and WAITAOF numlocal numreplicas timeout, when they run they do not block: they are
+only run like this inside a transaction, see Client.wait
+*/
+func (cmd *Command) evalWAIT() ([]byte, error) {
+	if currentClient == nil {
+		return nil, errors.New("ERR WAIT can only be sent by clients")
+	}
+	w, err := currentClient.newWaitingClient(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return w.reply(), nil
+}
+
+// Refuses the writes of a master without enough replicas that acknowledged recently, must be called holding execMu
+func checkMinReplicas(cmd *Command) error {
+	if config.MinReplicasToWrite <= 0 || config.MinReplicasMaxLag <= 0 || replicaOf != nil || applyingMasterStream {
+		return nil
+	}
+	if commandTable[cmd.name()].flags&CMD_FLAG_WRITE == 0 {
+		return nil
+	}
+	if goodReplicas() < config.MinReplicasToWrite {
+		return errNoReplicas
+	}
+	return nil
+}
+
+// Number of replicas that acknowledged the stream within min-replicas-max-lag, must be called holding execMu
+func goodReplicas() int {
+	good := 0
+	for c := range replicas {
+		if time.Since(c.replica.ackTime) <= time.Duration(config.MinReplicasMaxLag)*time.Second {
+			good++
+		}
+	}
+	return good
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+func TestWait(t *testing.T) {
+	setupTestServer(t)
+	c := connect(t)
+	c.expect(int64(0), "WAIT", "0", "0")
+	c.expectError("ERR timeout is negative", "WAIT", "1", "-1")
+	c.expectError("ERR value is not an integer", "WAIT", "x", "0")
+	c.expectError("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled", "WAITAOF", "1", "0", "0")
+
+	replica := connect(t)
+	replica.expect(replyOK, "REPLCONF", "listening-port", "6380")
+	stream := newTestStream(t, replica.conn)
+	replica.fullResync(stream)
+
+	//The client waits until the replica acknowledged its write
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	stream.expectCommand("SIM.ADD", "a", "x")
+	c.send("WAIT", "1", "0")
+	stream.expectCommand("REPLCONF", "GETACK", "*")
+	if !c.silent(50 * time.Millisecond) {
+		t.Error("WAIT replied before the replica acknowledged")
+	}
+	if info := connect(t).do("INFO", "clients").(string); !strings.Contains(info, "blocked_clients:1") {
+		t.Errorf("INFO clients misses blocked_clients:1:\n%s", info)
+	}
+	replica.send("REPLCONF", "ACK", strconv.FormatInt(stream.read, 10))
+	c.expectNext(int64(1))
+
+	//Once the timeout expired the number of replicas reached is replied
+	c.expect(int64(1), "SIM.ADD", "a", "y")
+	stream.expectCommand("SIM.ADD", "a", "y")
+	start := time.Now()
+	c.expect(int64(0), "WAIT", "1", "50")
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("WAIT replied after %v, before its timeout", elapsed)
+	}
+	//Replicas without an append only file do not count for WAITAOF
+	c.expect(array(int64(0), int64(0)), "WAITAOF", "0", "1", "50")
+
+	//Inside a transaction WAIT does not block
+	stream.expectCommand("REPLCONF", "GETACK", "*")
+	stream.expectCommand("REPLCONF", "GETACK", "*")
+	replica.send("REPLCONF", "ACK", strconv.FormatInt(stream.read, 10), "FACK", "-1")
+	c.expect(replyOK, "MULTI")
+	c.expect(response.SimpleString("QUEUED"), "WAIT", "2", "0")
+	deadline := time.Now().Add(testReplyTimeout)
+	for {
+		reply := c.do("EXEC")
+		if replies, ok := reply.([]interface{}); ok && len(replies) == 1 && replies[0] == int64(1) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("EXEC replied %#v", reply)
+		}
+		c.expect(replyOK, "MULTI")
+		c.expect(response.SimpleString("QUEUED"), "WAIT", "2", "0")
+	}
+}
+
+func TestWaitOnReplica(t *testing.T) {
+	setupTestServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	c := connect(t)
+	c.expect(replyOK, "REPLICAOF", host, port)
+	c.expectError("ERR WAIT cannot be used with replica instances", "WAIT", "0", "0")
+	c.expectError("ERR WAITAOF cannot be used with replica instances", "WAITAOF", "0", "0", "0")
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	setupTestServer(t)
+	config.MinReplicasToWrite = 1
+	c := connect(t)
+	c.expectError("NOREPLICAS Not enough good replicas to write.", "SIM.ADD", "a", "x")
+	c.expect("0", "SIM.JACCARD", "a", "a")
+
+	replica := connect(t)
+	stream := newTestStream(t, replica.conn)
+	replica.fullResync(stream)
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+	if info := c.do("INFO", "replication").(string); !strings.Contains(info, "min_slaves_good_slaves:1") {
+		t.Errorf("INFO replication misses min_slaves_good_slaves:1:\n%s", info)
+	}
+
+	//A replica that did not acknowledge within min-replicas-max-lag does not count
+	execMu.Lock()
+	for r := range replicas {
+		r.replica.ackTime = time.Now().Add(-time.Duration(config.MinReplicasMaxLag+1) * time.Second)
+	}
+	execMu.Unlock()
+	c.expectError("NOREPLICAS", "SIM.ADD", "a", "y")
+	c.expectError("NOREPLICAS", "EVAL", "return redis.call('sim.add', KEYS[1], 'y')", "1", "a")
+}
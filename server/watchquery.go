@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+	"github.com/inmemdb/inmem/server/response"
+)
+
+/**
+Reactive queries:
+	- WATCHQUERY command [arg ...] runs a read only command and replies with its id and result,
+	  the command is then run again every time one of the keys it reads is modified and the
+	  new result is pushed to the client whenever it changed
+	- UNWATCHQUERY [id ...] stops the given queries, or all the queries of the client
+The ACL rules of the user are checked for the watched command when it is watched and every time it runs
+again, a query the user is not allowed to run anymore is stopped as if it was unwatched.
+Modifications are debounced: a query is run again watchquery-debounce milliseconds after the first
+modification following its last run, so a burst of writes produces a single update.
+Replies and updates are sent like pub/sub messages, as push frames in RESP3, and in RESP2 a client
+watching queries is in subscriber mode:
+	watchquery <id> <result>
+	query <id> <result>
+	unwatchquery <id> <active queries>
+*/
+
+// A query watched by a client
+type watchedQuery struct {
+	id     int64
+	client *Client
+	cmd    *Command
+	keys   []string
+
+	//The last result sent to the client
+	result []byte
+
+	//Set while a run of the query is scheduled
+	pending bool
+	stopped bool
+}
+
+var (
+	//The queries reading each key, guarded by execMu
+	queryDeps = map[string]map[*watchedQuery]struct{}{}
+
+	errTooManyQueries = errors.New("ERR max number of watched queries per client reached")
+)
+
+func (c *Client) watchQuery(args []string) []byte {
+	cmd := &Command{Cmd: args[0], Args: args[1:]}
+	spec, ok := commandTable[cmd.name()]
+	if !ok || spec.flags&CMD_FLAG_READONLY == 0 {
+		return response.EncodeError(fmt.Errorf("ERR '%s' is not a read only command and can not be watched", cmd.name()))
+	}
+	if err := cmd.checkArity(); err != nil {
+		return response.EncodeError(err)
+	}
+	//The ACL rules of the user apply to the watched command, not only to WATCHQUERY
+	if err := c.checkPermissions(cmd, "toplevel"); err != nil {
+		return response.EncodeError(err)
+	}
+	if len(c.queries) >= config.WatchQueryMaxPerClient {
+		return response.EncodeError(errTooManyQueries)
+	}
+
+	c.lastQueryID++
+	q := &watchedQuery{
+		id:     c.lastQueryID,
+		client: c,
+		cmd:    cmd,
+		keys:   cmd.keys(),
+		result: evalCommand(cmd),
+	}
+	c.queries[q.id] = q
+	for _, key := range q.keys {
+		queries, ok := queryDeps[key]
+		if !ok {
+			queries = make(map[*watchedQuery]struct{})
+			queryDeps[key] = queries
+		}
+		queries[q] = struct{}{}
+	}
+	return c.pubsubFrame(response.Encode("watchquery", false), response.Encode(q.id, false), q.result)
+}
+
+// Stops the given queries, or all of them when no id is given
+func (c *Client) unwatchQuery(args []string) []byte {
+	var ids []int64
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return response.EncodeError(errors.New("ERR value is not an integer or out of range"))
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		for id := range c.queries {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return c.pubsubFrame(response.Encode("unwatchquery", false), response.Encode(nil, false), response.Encode(0, false))
+	}
+
+	var buf bytes.Buffer
+	for _, id := range ids {
+		if q, ok := c.queries[id]; ok {
+			q.stop()
+		}
+		buf.Write(c.pubsubFrame(response.Encode("unwatchquery", false), response.Encode(id, false), response.Encode(len(c.queries), false)))
+	}
+	return buf.Bytes()
+}
+
+// Drops every query of the client without replying
+func (c *Client) unwatchAllQueries() {
+	for _, q := range c.queries {
+		q.stop()
+	}
+}
+
+func (q *watchedQuery) stop() {
+	q.stopped = true
+	delete(q.client.queries, q.id)
+	for _, key := range q.keys {
+		queries := queryDeps[key]
+		delete(queries, q)
+		if len(queries) == 0 {
+			delete(queryDeps, key)
+		}
+	}
+}
+
+// Schedules a run of every query reading the key, must be called holding execMu
+func touchWatchedQueries(key string) {
+	for q := range queryDeps[key] {
+		if q.pending {
+			continue
+		}
+		q.pending = true
+		time.AfterFunc(time.Duration(config.WatchQueryDebounce)*time.Millisecond, q.refresh)
+	}
+}
+
+// Runs the query again and pushes the result if it changed. A query the user is not allowed
+// to run anymore, because its ACL rules changed, is stopped and the client is told.
+func (q *watchedQuery) refresh() {
+	execMu.Lock()
+	defer execMu.Unlock()
+
+	q.pending = false
+	if q.stopped {
+		return
+	}
+	c := q.client
+	if err := c.checkPermissions(q.cmd, "toplevel"); err != nil {
+		q.stop()
+		c.write(c.pubsubFrame(response.Encode("unwatchquery", false), response.Encode(q.id, false), response.Encode(len(c.queries), false)))
+		return
+	}
+	result := evalCommand(q.cmd)
+	if bytes.Equal(result, q.result) {
+		return
+	}
+	q.result = result
+	c.write(c.pubsubFrame(response.Encode("query", false), response.Encode(q.id, false), result))
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/inmemdb/inmem/config"
+)
+
+func TestWatchQuery(t *testing.T) {
+	setupTestServer(t)
+	config.WatchQueryDebounce = 10
+	watcher := connect(t)
+	writer := connect(t)
+
+	watcher.expect(array("watchquery", int64(1), "0"), "WATCHQUERY", "SIM.JACCARD", "a", "b")
+	writer.expect(int64(1), "SIM.ADD", "a", "x")
+	writer.expect(int64(1), "SIM.ADD", "b", "x")
+	//Only changed results are pushed, whether the first write was seen alone or with the second one
+	watcher.expectNext(array("query", int64(1), "1"))
+
+	watcher.expect(array("unwatchquery", int64(1), int64(0)), "UNWATCHQUERY", "1")
+	writer.expect(int64(1), "SIM.ADD", "a", "y")
+	if !watcher.silent(50 * time.Millisecond) {
+		t.Error("an unwatched query was pushed")
+	}
+}
+
+func TestWatchQueryErrors(t *testing.T) {
+	setupTestServer(t)
+	config.WatchQueryMaxPerClient = 1
+	c := connect(t)
+
+	c.expectError("ERR 'sim.add' is not a read only command and can not be watched", "WATCHQUERY", "SIM.ADD", "a", "x")
+	c.expectError("ERR 'nosuchcommand' is not a read only command", "WATCHQUERY", "NOSUCHCOMMAND")
+	c.expectError("ERR wrong number of arguments", "WATCHQUERY", "SIM.JACCARD", "a")
+	c.expect(array("watchquery", int64(1), "0"), "WATCHQUERY", "SIM.JACCARD", "a", "b")
+	c.expectError("ERR max number of watched queries per client reached", "WATCHQUERY", "SIM.JACCARD", "a", "c")
+
+	//The client is in subscriber mode while it watches queries
+	c.expectError("ERR Can't execute 'sim.add'", "SIM.ADD", "a", "x")
+	c.expect(array("unwatchquery", int64(1), int64(0)), "UNWATCHQUERY")
+	c.expect(int64(1), "SIM.ADD", "a", "x")
+}
+
+func TestWatchQueryPermissions(t *testing.T) {
+	setupTestServer(t)
+	config.WatchQueryDebounce = 10
+	admin := connect(t)
+	eve := connect(t)
+
+	admin.expect(replyOK, "ACL", "SETUSER", "eve", "on", ">pw", "+@all", "-sim.index.query", "~public:*")
+	eve.expect(replyOK, "AUTH", "eve", "pw")
+	eve.expectError("NOPERM No permissions to access a key", "WATCHQUERY", "SIM.JACCARD", "public:1", "secret:1")
+	eve.expectError("NOPERM User eve has no permissions to run the 'sim.index.query' command", "WATCHQUERY", "SIM.INDEX.QUERY", "public:idx", "public:1", "0.5")
+	eve.expect(array("watchquery", int64(1), "0"), "WATCHQUERY", "SIM.JACCARD", "public:1", "public:2")
+
+	//Once the user can not read the keys anymore the query is stopped instead of being run again
+	admin.expect(replyOK, "ACL", "SETUSER", "eve", "resetkeys", "~other:*")
+	admin.expect(int64(1), "SIM.ADD", "public:1", "x")
+	eve.expectNext(array("unwatchquery", int64(1), int64(0)))
+	admin.expect(int64(1), "SIM.ADD", "public:2", "x")
+	if !eve.silent(50 * time.Millisecond) {
+		t.Error("a stopped query was pushed")
+	}
+	//The client left subscriber mode with its last query
+	eve.expect(int64(1), "SIM.ADD", "other:1", "x")
+}